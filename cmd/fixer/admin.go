@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"os"
+	"strings"
+
+	"github.com/artificialinc/cm-429-fixer/pkg/admin"
+	"github.com/artificialinc/cm-429-fixer/pkg/audit"
+	"github.com/artificialinc/cm-429-fixer/pkg/cm"
+	"github.com/go-logr/logr"
+)
+
+// adminFlags configure the admin API of the run command
+type adminFlags struct {
+	addr      string
+	tokenFile string
+	stateFile string
+	certFile  string
+	keyFile   string
+}
+
+func (a *adminFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&a.addr, "admin-addr", "", "Address to serve the admin API on, to pause and resume changes, force resets, clear backoff and dump the reset queue, empty to disable")
+	fs.StringVar(&a.tokenFile, "admin-token-file", "", "File with the bearer token every admin API request must carry, required with -admin-addr")
+	fs.StringVar(&a.stateFile, "admin-state-file", "", "File pauses are persisted to, so they survive restarts")
+	fs.StringVar(&a.certFile, "admin-cert-file", "", "TLS certificate file of the admin API, required unless -admin-addr is a loopback address")
+	fs.StringVar(&a.keyFile, "admin-key-file", "", "TLS key file of the admin API")
+}
+
+// server returns the admin server of the watchers, with the persisted pauses
+// loaded, nil if the API is disabled
+func (a *adminFlags) server(log logr.Logger, watchers map[string]*cm.Watcher, pauses *cm.Pauses, auditLog *audit.Log) (*admin.Server, error) {
+	if a.addr == "" {
+		return nil, nil
+	}
+	if a.tokenFile == "" {
+		return nil, errors.New("-admin-token-file is required with -admin-addr")
+	}
+	if err := checkTLS("admin", a.addr, a.certFile, a.keyFile, true); err != nil {
+		return nil, err
+	}
+	b, err := os.ReadFile(a.tokenFile)
+	if err != nil {
+		return nil, err
+	}
+	token := strings.TrimSpace(string(b))
+	if token == "" {
+		return nil, errors.New("admin token file " + a.tokenFile + " is empty")
+	}
+	opts := []admin.Option{admin.WithLogger(log), admin.WithAudit(auditLog)}
+	if a.stateFile != "" {
+		opts = append(opts, admin.WithStateFile(a.stateFile))
+	}
+	s := admin.NewServer(watchers, pauses, token, opts...)
+	if err := s.Load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func serveAdmin(ctx context.Context, log logr.Logger, a *adminFlags, s *admin.Server) {
+	serve(ctx, log, "Admin", s.Handler(), a.addr, a.certFile, a.keyFile)
+}
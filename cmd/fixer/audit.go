@@ -0,0 +1,95 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/user"
+	"strings"
+	"time"
+
+	"github.com/artificialinc/cm-429-fixer/pkg/audit"
+	"github.com/go-logr/logr"
+)
+
+// auditBuffer is how many records wait to be posted to -audit-url before new
+// ones are dropped
+const auditBuffer = 1000
+
+// auditFlags configure the audit log of the commands that change objects
+type auditFlags struct {
+	stdout     bool
+	file       string
+	maxSizeMB  int64
+	maxBackups int
+	url        string
+	headers    headers
+	timeout    time.Duration
+}
+
+// headers is a repeatable Name: value flag
+type headers http.Header
+
+func (h headers) String() string {
+	var s []string
+	for k, vs := range h {
+		for _, v := range vs {
+			s = append(s, k+": "+v)
+		}
+	}
+	return strings.Join(s, ", ")
+}
+
+func (h headers) Set(v string) error {
+	name, value, ok := strings.Cut(v, ":")
+	if !ok {
+		return fmt.Errorf("header %q must be Name: value", v)
+	}
+	http.Header(h).Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	return nil
+}
+
+func (a *auditFlags) register(fs *flag.FlagSet) {
+	a.headers = headers{}
+	fs.BoolVar(&a.stdout, "audit-stdout", false, "Write audit records to stdout")
+	fs.StringVar(&a.file, "audit-file", "", "Append audit records to this file")
+	fs.Int64Var(&a.maxSizeMB, "audit-file-max-size", 100, "Rotate the audit file once it would grow past this many megabytes, 0 to never rotate")
+	fs.IntVar(&a.maxBackups, "audit-file-max-backups", 10, "Rotated audit files to keep, at least 1 unless -audit-file-max-size is 0")
+	fs.StringVar(&a.url, "audit-url", "", "Post every audit record to this URL")
+	fs.Var(a.headers, "audit-header", "Header sent with audit records posted to -audit-url as Name: value, may be repeated")
+	fs.DurationVar(&a.timeout, "audit-timeout", 3*time.Second, "Timeout for posting an audit record. Records are posted in the background, so it doesn't hold up changes.")
+}
+
+// open returns the audit log writing to the configured sinks, nil if there
+// are none. Records that fail to be posted are logged.
+func (a *auditFlags) open(log logr.Logger) (*audit.Log, error) {
+	var sinks []audit.Sink
+	if a.stdout {
+		sinks = append(sinks, audit.NewWriterSink(os.Stdout))
+	}
+	if a.file != "" {
+		s, err := audit.NewFileSink(a.file, a.maxSizeMB<<20, a.maxBackups)
+		if err != nil {
+			return nil, fmt.Errorf("opening audit file: %w", err)
+		}
+		sinks = append(sinks, s)
+	}
+	if a.url != "" {
+		sinks = append(sinks, audit.NewAsyncSink(audit.NewHTTPSink(a.url, http.Header(a.headers), a.timeout), auditBuffer, func(err error) {
+			log.Error(err, "Failed to post audit record")
+		}))
+	}
+	if len(sinks) == 0 {
+		return nil, nil
+	}
+	return audit.New(sinks...), nil
+}
+
+// actor names the user running a command in the audit log
+func actor(command string) string {
+	if u, err := user.Current(); err == nil {
+		return command + ":" + u.Username
+	}
+	return command
+}
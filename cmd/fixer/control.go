@@ -0,0 +1,32 @@
+package main
+
+import (
+	"errors"
+	"flag"
+
+	"github.com/artificialinc/cm-429-fixer/pkg/cm"
+)
+
+// controlFlags name the control ConfigMap of the commands that change objects
+type controlFlags struct {
+	configMap string
+	disabled  bool
+}
+
+func (c *controlFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&c.configMap, "control-configmap", cm.DefaultControl, "Switch off changes according to this ConfigMap in each cluster, as namespace/name or a namespace to use "+cm.DefaultControlName+". A missing ConfigMap switches nothing off.")
+	fs.BoolVar(&c.disabled, "no-control-configmap", false, "Don't read a control ConfigMap, so nothing but the admin API can switch off changes")
+}
+
+// configMapName returns the namespace and name of the control ConfigMap, both
+// empty with -no-control-configmap
+func (c *controlFlags) configMapName() (string, string, error) {
+	if c.disabled {
+		return "", "", nil
+	}
+	namespace, name := cm.SplitControl(c.configMap)
+	if namespace == "" {
+		return "", "", errors.New("-control-configmap needs a namespace, pass -no-control-configmap to read none")
+	}
+	return namespace, name, nil
+}
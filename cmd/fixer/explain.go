@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/artificialinc/cm-429-fixer/pkg/cm"
+)
+
+// explain prints the issuance chain of a certificate and returns the process exit code
+func explain(g *globals, args []string) int {
+	fs := g.flagSet("explain")
+	output := fs.String("output", cm.FormatText, "Output format: text, json or yaml")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: fixer explain [flags] <namespace>/<certificate>")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+
+	namespace, name, ok := strings.Cut(fs.Arg(0), "/")
+	if fs.NArg() != 1 || !ok || namespace == "" || name == "" {
+		fs.Usage()
+		return 2
+	}
+
+	watcher := cm.NewWatcher(
+		cm.WithLogger(g.logger().WithName("watcher")),
+		cm.WithClient(cm.GetLocalClient(g.clientOpts())),
+	)
+
+	chain, err := watcher.Explain(context.Background(), namespace, name)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "explain failed:", err)
+		return 1
+	}
+	if err := chain.Write(os.Stdout, *output); err != nil {
+		fmt.Fprintln(os.Stderr, "writing explanation:", err)
+		return 2
+	}
+	return 0
+}
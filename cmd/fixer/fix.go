@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/artificialinc/cm-429-fixer/pkg/cm"
+)
+
+// fix resets selected rate limited objects and returns the process exit code
+func fix(g *globals, args []string) int {
+	fs := g.flagSet("fix")
+	namespace := fs.String("namespace", "", "Only reset objects in this namespace")
+	certificate := fs.String("certificate", "", "Only reset objects issuing this Certificate")
+	issuer := fs.String("issuer", "", "Only reset objects using this issuer, as name or Kind/name")
+	allRateLimited := fs.Bool("all-rate-limited", false, "Reset every rate limited object matching the other selectors")
+	dryRun := fs.Bool("dry-run", false, "Show what would be reset without changing anything")
+	force := fs.Bool("force", false, "Reset objects that are still backing off")
+	yes := fs.Bool("yes", false, "Don't ask for confirmation")
+	var killSwitch controlFlags
+	killSwitch.register(fs)
+	var auditing auditFlags
+	auditing.register(fs)
+	_ = fs.Parse(args)
+
+	if *certificate == "" && *issuer == "" && !*allRateLimited {
+		fmt.Fprintln(os.Stderr, "select objects with -certificate, -issuer or -all-rate-limited")
+		return 2
+	}
+
+	controlNamespace, controlName, err := killSwitch.configMapName()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	auditLog, err := auditing.open(g.logger().WithName("audit"))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	defer auditLog.Close()
+
+	opts := []cm.Option{
+		cm.WithLogger(g.logger().WithName("watcher")),
+		cm.WithClient(cm.GetLocalClient(g.clientOpts())),
+		cm.WithAudit(auditLog),
+	}
+	if controlNamespace != "" {
+		opts = append(opts, cm.WithControl(cm.GetLocalDynamicClient(g.clientOpts()), controlNamespace, controlName))
+	}
+	watcher := cm.NewWatcher(opts...)
+
+	ctx := context.Background()
+	if err := watcher.LoadControl(ctx); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	targets, err := watcher.Targets(ctx, cm.Selector{
+		Namespace:   *namespace,
+		Certificate: *certificate,
+		Issuer:      *issuer,
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "scan failed:", err)
+		return 2
+	}
+	if len(targets.Findings) == 0 {
+		fmt.Println("Nothing to reset")
+		return 0
+	}
+	if err := targets.Write(os.Stdout, cm.FormatTable); err != nil {
+		fmt.Fprintln(os.Stderr, "writing targets:", err)
+		return 2
+	}
+
+	if !*dryRun && !*yes && !confirm(os.Stdin, fmt.Sprintf("Reset %d objects?", len(targets.Findings))) {
+		fmt.Println("Aborted")
+		return 1
+	}
+
+	return resetAll(ctx, watcher, targets, cm.ResetOptions{DryRun: *dryRun, Force: *force, Actor: actor("fix")})
+}
+
+// resetAll resets every target, returning 1 if any of them failed
+func resetAll(ctx context.Context, w *cm.Watcher, targets *cm.Report, opts cm.ResetOptions) int {
+	code := 0
+	for _, f := range targets.Findings {
+		result, err := w.Reset(ctx, f, opts)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s %s/%s: %v\n", f.Kind, f.Namespace, f.Name, err)
+			code = 1
+			continue
+		}
+		fmt.Printf("%s %s/%s: %s\n", f.Kind, f.Namespace, f.Name, result)
+	}
+	return code
+}
+
+func confirm(in io.Reader, question string) bool {
+	fmt.Printf("%s [y/N]: ", question)
+	answer, _ := bufio.NewReader(in).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
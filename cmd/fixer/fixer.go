@@ -2,14 +2,14 @@
 package main
 
 import (
-	"context"
 	"flag"
+	"fmt"
 	"os"
+	"strings"
 
 	"github.com/artificialinc/cm-429-fixer/pkg/cm"
-	"github.com/go-logr/zapr"
-	"go.uber.org/zap"
-	"go.uber.org/zap/zapcore"
+	"github.com/artificialinc/cm-429-fixer/pkg/logging"
+	"github.com/go-logr/logr"
 
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 )
@@ -24,27 +24,115 @@ func init() {
 	}
 }
 
-func main() {
-	k8sContext := flag.String("k8s-context", "", "Kubernetes context to use")
-	flag.Parse()
+// command is a fixer subcommand
+type command struct {
+	name    string
+	summary string
+	run     func(g *globals, args []string) int
+}
 
-	zapCfg := zap.NewProductionConfig()
-	level, err := zapcore.ParseLevel(logLevel)
-	if err != nil {
-		panic(err)
+var commands = []command{
+	{name: "run", summary: "Watch clusters and reset rate limited Orders and Challenges (default)", run: run},
+	{name: "scan", summary: "Report failed ACME objects", run: scan},
+	{name: "fix", summary: "Reset selected rate limited objects", run: fix},
+	{name: "explain", summary: "Trace the issuance chain of a Certificate", run: explain},
+	{name: "simulate", summary: "Replay recorded status transitions under a retry policy", run: simulate},
+	{name: "version", summary: "Print version information", run: version},
+}
+
+// contexts is a flag that may be repeated or given a comma separated list
+type contexts []string
+
+func (c *contexts) String() string {
+	return strings.Join(*c, ",")
+}
+
+func (c *contexts) Set(v string) error {
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			*c = append(*c, s)
+		}
 	}
-	zapCfg.Level.SetLevel(level)
-	logger, err := zapCfg.Build()
+	return nil
+}
+
+// globals are the flags shared by every subcommand. They may be given before
+// or after the subcommand name.
+type globals struct {
+	kubeconfig string
+	contexts   contexts
+	logLevel   string
+	logLevels  string
+	logFormat  string
+}
+
+func (g *globals) register(fs *flag.FlagSet) {
+	fs.StringVar(&g.kubeconfig, "kubeconfig", g.kubeconfig, "Path to the kubeconfig file, defaults to the standard loading rules")
+	fs.Var(&g.contexts, "context", "Kubernetes context to use, may be repeated or comma separated where several clusters are supported")
+	fs.Var(&g.contexts, "k8s-context", "Alias for -context")
+	fs.StringVar(&g.logLevel, "log-level", g.logLevel, "Log level: debug, info, warn, error or a verbosity such as 2, defaults to the LOG_LEVEL environment variable")
+	fs.StringVar(&g.logLevels, "log-levels", g.logLevels, "Comma separated levels of named loggers, overriding -log-level for them, e.g. watcher=debug,merge=2,klog=warn")
+	fs.StringVar(&g.logFormat, "log-format", g.logFormat, "Log format: json, console or logfmt")
+}
+
+// flagSet returns a flag set for the subcommand with the global flags registered
+func (g *globals) flagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	g.register(fs)
+	return fs
+}
+
+// clientOpts returns the client options for commands working on a single cluster
+func (g *globals) clientOpts() *cm.ClientOpts {
+	opts := &cm.ClientOpts{Kubeconfig: g.kubeconfig}
+	if len(g.contexts) > 0 {
+		opts.Context = g.contexts[0]
+	}
+	return opts
+}
+
+// logger returns the logger configured by the flags, which klog output is
+// also routed through
+func (g *globals) logger() logr.Logger {
+	logger, err := logging.New(logging.Options{Format: g.logFormat, Level: g.logLevel, Levels: g.logLevels})
 	if err != nil {
-		zap.S().Fatalf("Failed to get logger: %v", err)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	logging.RouteKlog(logger.WithName("klog"))
+	return logger
+}
+
+func main() {
+	g := &globals{logLevel: logLevel, logFormat: "json"}
+	flag.CommandLine.Usage = usage
+	g.register(flag.CommandLine)
+	flag.Parse()
+
+	args := flag.Args()
+	name := "run"
+	if len(args) > 0 {
+		name, args = args[0], args[1:]
 	}
 
-	watcher := cm.NewWatcher(
-		cm.WithLogger(zapr.NewLogger(logger).WithName("watcher")),
-		cm.WithClient(cm.GetLocalClient(&cm.ClientOpts{Context: *k8sContext})),
-	)
+	for _, c := range commands {
+		if c.name == name {
+			os.Exit(c.run(g, args))
+		}
+	}
 
-	ctx := context.Background()
+	fmt.Fprintf(os.Stderr, "unknown command %q\n\n", name)
+	usage()
+	os.Exit(2)
+}
 
-	watcher.Run(ctx, make(chan bool))
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintln(out, "Usage: fixer [global flags] [command] [flags]")
+	fmt.Fprintln(out, "\nCommands:")
+	for _, c := range commands {
+		fmt.Fprintf(out, "  %-10s %s\n", c.name, c.summary)
+	}
+	fmt.Fprintln(out, "\nGlobal flags:")
+	flag.PrintDefaults()
 }
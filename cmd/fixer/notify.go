@@ -0,0 +1,71 @@
+package main
+
+import (
+	"flag"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/artificialinc/cm-429-fixer/pkg/notify"
+	"github.com/go-logr/logr"
+)
+
+// notifyFlags configure the incident notifications of the run command
+type notifyFlags struct {
+	urls         contexts
+	template     string
+	headers      headers
+	scopes       string
+	resolveAfter time.Duration
+	attempts     int
+	timeout      time.Duration
+}
+
+func (n *notifyFlags) register(fs *flag.FlagSet) {
+	n.headers = headers{}
+	fs.Var(&n.urls, "notify-url", "Post rate limit incident notifications to this URL, may be repeated or comma separated")
+	fs.StringVar(&n.template, "notify-template", "", "File with a text/template rendering the body of notifications, they are posted as JSON by default")
+	fs.Var(n.headers, "notify-header", "Header sent with notifications as Name: value, may be repeated")
+	fs.StringVar(&n.scopes, "notify-scope", string(notify.ScopeAccount), "Comma separated scopes incidents are aggregated by: account and/or domain")
+	fs.DurationVar(&n.resolveAfter, "notify-resolve-after", notify.DefaultResolveAfter, "Resolve incidents of Orders that haven't been seen rate limited for this long")
+	fs.IntVar(&n.attempts, "notify-attempts", notify.DefaultAttempts, "Times a notification is sent before it is dropped")
+	fs.DurationVar(&n.timeout, "notify-timeout", 10*time.Second, "Timeout for sending a notification")
+}
+
+// notifier returns the notifier posting to the configured URLs, nil if there are none
+func (n *notifyFlags) notifier(log logr.Logger) (*notify.Notifier, error) {
+	if len(n.urls) == 0 {
+		return nil, nil
+	}
+	var tmpl string
+	if n.template != "" {
+		b, err := os.ReadFile(n.template)
+		if err != nil {
+			return nil, err
+		}
+		tmpl = string(b)
+	}
+	opts := []notify.Option{
+		notify.WithLogger(log),
+		notify.WithResolveAfter(n.resolveAfter),
+		notify.WithRetry(n.attempts, notify.DefaultBackoff),
+	}
+	var scopes []notify.Scope
+	for _, s := range strings.Split(n.scopes, ",") {
+		scope, err := notify.ParseScope(strings.TrimSpace(s))
+		if err != nil {
+			return nil, err
+		}
+		scopes = append(scopes, scope)
+	}
+	opts = append(opts, notify.WithScopes(scopes...))
+	for _, url := range n.urls {
+		e, err := notify.NewEndpoint(url, http.Header(n.headers), tmpl, n.timeout)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, notify.WithEndpoint(e))
+	}
+	return notify.New(opts...), nil
+}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/artificialinc/cm-429-fixer/pkg/cm"
+	"github.com/artificialinc/cm-429-fixer/pkg/merge"
+	"github.com/artificialinc/cm-429-fixer/pkg/readiness"
+	"github.com/artificialinc/cm-429-fixer/pkg/webhook"
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/time/rate"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// cluster is a single cluster the fixer runs a watcher against
+type cluster struct {
+	name string
+	opts *cm.ClientOpts
+}
+
+// shutdownTimeout is how long the servers and the tracer provider are given
+// to finish on shutdown
+const shutdownTimeout = 10 * time.Second
+
+// run runs a watcher for every cluster until the process is stopped
+func run(g *globals, args []string) int {
+	fs := g.flagSet("run")
+	kubeconfigDir := fs.String("kubeconfig-dir", "", "Directory of kubeconfig files, a watcher is run for the current context of each")
+	resetsPerHour := fs.Float64("account-resets-per-hour", 60, "Resets allowed per hour for each ACME account, shared across clusters")
+	resetBurst := fs.Int("account-reset-burst", 10, "Resets allowed in a burst for each ACME account")
+	namespace := fs.String("namespace", "", "Only watch Orders and Challenges in this namespace, all namespaces if empty")
+	labelSelector := fs.String("label-selector", "", "Only watch Orders and Challenges matching this label selector")
+	serverSideFilter := fs.Bool("server-side-filter", false, "Ask the API server for Errored objects only, needs .status.state to be a selectable field of the cert-manager CRDs")
+	incidents := fs.Bool("incidents", false, "Record rate limit episodes as RateLimitIncident resources, the CRD must be installed")
+	retryPolicies := fs.Bool("retry-policies", false, "Apply RetryPolicy and ClusterRetryPolicy resources, the CRDs must be installed")
+	holdAfter := fs.Duration("hold-after", 0, "Hold the Certificate instead of resetting when the ACME server asks to wait longer than this, 0 to never hold")
+	var killSwitch controlFlags
+	killSwitch.register(fs)
+	var auditing auditFlags
+	auditing.register(fs)
+	var notifying notifyFlags
+	notifying.register(fs)
+	var tracingOpts tracingFlags
+	tracingOpts.register(fs)
+	var status uiFlags
+	status.register(fs)
+	var control adminFlags
+	control.register(fs)
+	record := fs.String("record", "", "Append the status transitions of Orders and Challenges to this file as JSON lines, for fixer simulate")
+	metricsAddr := fs.String("metrics-addr", ":9402", "Address to serve metrics and the /healthz and /readyz endpoints on, empty to disable")
+	webhookAddr := fs.String("webhook-addr", "", "Address to serve the admission webhooks on over TLS, empty to disable")
+	webhookCert := fs.String("webhook-cert-file", "", "TLS certificate file of the webhook server")
+	webhookKey := fs.String("webhook-key-file", "", "TLS key file of the webhook server")
+	webhookMode := fs.String("webhook-mode", string(webhook.ModeAnnotate), "What the webhook does with new Orders under an active rate limit: annotate or deny")
+	webhookCluster := fs.String("webhook-cluster", "", "Cluster whose issuers the webhook resolves accounts with, defaults to the first cluster")
+	_ = fs.Parse(args)
+
+	log := g.logger()
+
+	clusters, err := discoverClusters(g.kubeconfig, g.contexts, *kubeconfigDir)
+	if err != nil {
+		log.Error(err, "Failed to discover clusters")
+		return 1
+	}
+
+	controlNamespace, controlName, err := killSwitch.configMapName()
+	if err != nil {
+		log.Error(err, "Invalid flags")
+		return 1
+	}
+
+	mode := webhook.Mode(*webhookMode)
+	if mode != webhook.ModeAnnotate && mode != webhook.ModeDeny {
+		log.Error(errors.New("unknown webhook mode "+*webhookMode), "Invalid flags")
+		return 1
+	}
+	if *webhookAddr != "" && (*webhookCert == "" || *webhookKey == "") {
+		log.Error(errors.New("-webhook-addr needs -webhook-cert-file and -webhook-key-file"), "Invalid flags")
+		return 1
+	}
+	// The API server filters out the transitions to Valid, which would leave
+	// a recording that never recovers
+	if *record != "" && *serverSideFilter {
+		log.Error(errors.New("-record can't be combined with -server-side-filter"), "Invalid flags")
+		return 1
+	}
+
+	budget := cm.NewBudget(rate.Limit(*resetsPerHour/time.Hour.Seconds()), *resetBurst)
+	tracker := cm.NewTracker()
+	auditLog, err := auditing.open(log.WithName("audit"))
+	if err != nil {
+		log.Error(err, "Failed to open audit log")
+		return 1
+	}
+	defer auditLog.Close()
+	notifier, err := notifying.notifier(log.WithName("notifier"))
+	if err != nil {
+		log.Error(err, "Failed to configure notifications")
+		return 1
+	}
+	var recorder *cm.Recorder
+	if *record != "" {
+		f, err := os.OpenFile(*record, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+		if err != nil {
+			log.Error(err, "Failed to open recording")
+			return 1
+		}
+		defer f.Close()
+		recorder = cm.NewRecorder(f)
+	}
+
+	// Stopping cancels the watchers, servers and notifier and waits for them,
+	// so the deferred closes flush the audit log and the traces
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	var wg sync.WaitGroup
+	// Run in a goroutine that run waits for before returning
+	goWait := func(f func()) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			f()
+		}()
+	}
+
+	if notifier != nil {
+		goWait(func() { notifier.Run(ctx) })
+	}
+	tp, err := tracingOpts.provider(ctx)
+	if err != nil {
+		log.Error(err, "Failed to configure tracing")
+		return 1
+	}
+	if tp != nil {
+		defer func() {
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+			defer cancel()
+			if err := tp.Shutdown(shutdownCtx); err != nil {
+				log.Error(err, "Failed to flush traces")
+			}
+		}()
+	}
+
+	var (
+		ready    []merge.Input[bool]
+		watchers = map[string]*cm.Watcher{}
+		pauses   = cm.NewPauses()
+	)
+	// Created before the watchers run so persisted pauses apply from the start
+	adminServer, err := control.server(log.WithName("admin"), watchers, pauses, auditLog)
+	if err != nil {
+		log.Error(err, "Failed to configure the admin API")
+		return 1
+	}
+	for _, c := range clusters {
+		if tp != nil {
+			c.opts.TracerProvider = tp
+		}
+		opts := []cm.Option{
+			cm.WithLogger(log.WithName("watcher")),
+			cm.WithCluster(c.name),
+			cm.WithBudget(budget),
+			cm.WithTracker(tracker),
+			cm.WithPauses(pauses),
+			cm.WithNamespace(*namespace),
+			cm.WithTweakListOptions(func(options *metav1.ListOptions) {
+				options.LabelSelector = *labelSelector
+			}),
+			cm.WithClient(cm.GetLocalClient(c.opts)),
+		}
+		if *serverSideFilter {
+			opts = append(opts, cm.WithServerSideFilter())
+		}
+		if *holdAfter > 0 {
+			opts = append(opts, cm.WithHoldAfter(*holdAfter))
+		}
+		if recorder != nil {
+			opts = append(opts, cm.WithRecorder(recorder))
+		}
+		if auditLog != nil {
+			opts = append(opts, cm.WithAudit(auditLog))
+		}
+		if notifier != nil {
+			opts = append(opts, cm.WithNotifier(notifier))
+		}
+		if tp != nil {
+			opts = append(opts, cm.WithTracerProvider(tp))
+		}
+		if *incidents || *retryPolicies || controlNamespace != "" {
+			dyn := cm.GetLocalDynamicClient(c.opts)
+			if *incidents {
+				opts = append(opts, cm.WithIncidents(dyn))
+			}
+			if *retryPolicies {
+				opts = append(opts, cm.WithRetryPolicies(dyn))
+			}
+			if controlNamespace != "" {
+				opts = append(opts, cm.WithControl(dyn, controlNamespace, controlName))
+			}
+		}
+		watcher := cm.NewWatcher(opts...)
+		watchers[c.name] = watcher
+		r, unsubscribe := watcher.Readiness().Subscribe()
+		defer unsubscribe()
+		ready = append(ready, merge.Input[bool]{Name: c.name, C: r})
+
+		goWait(func() { watcher.Run(ctx) })
+	}
+
+	gate := readiness.NewGate()
+	go func() {
+		merged := merge.All(ctx, log.WithName("merge"), merge.Identity, ready...)
+		for s := range merged.C() {
+			log.Info("Readiness changed", "ready", s, "unready", merged.NotOK())
+			gate.Set(s)
+		}
+	}()
+
+	if *metricsAddr != "" {
+		goWait(func() { serveHTTP(ctx, log, *metricsAddr, gate, watchers, pauses) })
+	}
+
+	if *webhookAddr != "" {
+		name := *webhookCluster
+		if name == "" {
+			name = clusters[0].name
+		}
+		watcher, ok := watchers[name]
+		if !ok {
+			log.Error(errors.New("unknown cluster "+name), "Invalid flags")
+			return 1
+		}
+		s := webhook.NewServer(watcher, mode, log.WithName("webhook"), webhook.WithAudit(auditLog))
+		goWait(func() { serveWebhook(ctx, log, *webhookAddr, *webhookCert, *webhookKey, s) })
+	}
+
+	statusUI, err := status.server(log.WithName("ui"), watchers, budget, tracker)
+	if err != nil {
+		log.Error(err, "Failed to configure the UI")
+		return 1
+	}
+	if statusUI != nil {
+		goWait(func() { serveUI(ctx, log, &status, statusUI) })
+	}
+	if adminServer != nil {
+		goWait(func() { serveAdmin(ctx, log, &control, adminServer) })
+	}
+
+	<-ctx.Done()
+	log.Info("Shutting down")
+	wg.Wait()
+	return 0
+}
+
+// discoverClusters returns the clusters to watch. Kubeconfig files are watched
+// with their current context. Without any contexts or a kubeconfig directory
+// the current context of the kubeconfig is used.
+func discoverClusters(kubeconfig string, k8sContexts []string, kubeconfigDir string) ([]cluster, error) {
+	var clusters []cluster
+	for _, c := range k8sContexts {
+		clusters = append(clusters, cluster{name: c, opts: &cm.ClientOpts{Context: c, Kubeconfig: kubeconfig}})
+	}
+
+	if kubeconfigDir != "" {
+		entries, err := os.ReadDir(kubeconfigDir)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			if e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+				continue
+			}
+			// Name the cluster after the file, contexts are often named alike across files
+			name := strings.TrimSuffix(e.Name(), filepath.Ext(e.Name()))
+			clusters = append(clusters, cluster{name: name, opts: &cm.ClientOpts{Kubeconfig: filepath.Join(kubeconfigDir, e.Name())}})
+		}
+		if len(clusters) == 0 {
+			return nil, errors.New("no kubeconfig files found in " + kubeconfigDir)
+		}
+	}
+
+	if len(clusters) == 0 {
+		opts := &cm.ClientOpts{Kubeconfig: kubeconfig}
+		clusters = append(clusters, cluster{name: cm.ClusterName(opts), opts: opts})
+	}
+
+	return clusters, nil
+}
+
+func serveHTTP(ctx context.Context, log logr.Logger, addr string, gate *readiness.Gate, watchers map[string]*cm.Watcher, pauses *cm.Pauses) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	})
+	mux.Handle("/readyz", readyzHandler(gate, watchers, pauses))
+	serve(ctx, log, "HTTP", mux, addr, "", "")
+}
+
+func serveWebhook(ctx context.Context, log logr.Logger, addr, certFile, keyFile string, s *webhook.Server) {
+	serve(ctx, log, "Webhook", s.Handler(), addr, certFile, keyFile)
+}
+
+// serve serves the handler on the address, over TLS if a certificate is
+// given, until the context is done. It then waits for the requests in flight.
+func serve(ctx context.Context, log logr.Logger, name string, handler http.Handler, addr, certFile, keyFile string) {
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	shutdown := make(chan struct{})
+	go func() {
+		defer close(shutdown)
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), shutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			log.Error(err, name+" server didn't shut down cleanly")
+		}
+	}()
+
+	var err error
+	if certFile != "" {
+		err = srv.ListenAndServeTLS(certFile, keyFile)
+	} else {
+		err = srv.ListenAndServe()
+	}
+	if !errors.Is(err, http.ErrServerClosed) {
+		log.Error(err, name+" server stopped")
+		return
+	}
+	<-shutdown
+}
+
+// checkTLS checks the TLS flags of a server. A server taking a bearer token
+// must use TLS unless it only listens on a loopback address, so the token
+// isn't sent over the network in plain text.
+func checkTLS(prefix, addr, certFile, keyFile string, token bool) error {
+	if (certFile == "") != (keyFile == "") {
+		return fmt.Errorf("-%s-cert-file and -%s-key-file must be given together", prefix, prefix)
+	}
+	if certFile != "" || !token || loopback(addr) {
+		return nil
+	}
+	return fmt.Errorf("-%s-addr %s would take its bearer token over plain HTTP, pass -%s-cert-file and -%s-key-file or listen on a loopback address", prefix, addr, prefix, prefix)
+}
+
+// loopback returns whether the address only listens on a loopback interface
+func loopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// clusterReadiness is the readiness of a single cluster reported by /readyz
+type clusterReadiness struct {
+	Ready     bool                `json:"ready"`
+	Informers []cm.InformerHealth `json:"informers"`
+	// Control is what the cluster's control ConfigMap switches off
+	Control *cm.Control `json:"control,omitempty"`
+}
+
+// readyzHandler reports whether every watcher is ready, along with the health
+// of each watcher's informers and what stops the fixer from making changes.
+// A fixer that is paused or switched off is still ready.
+func readyzHandler(gate *readiness.Gate, watchers map[string]*cm.Watcher, pauses *cm.Pauses) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		status := struct {
+			Ready    bool                        `json:"ready"`
+			Clusters map[string]clusterReadiness `json:"clusters"`
+			Pauses   []cm.Pause                  `json:"pauses,omitempty"`
+		}{
+			Ready:    gate.Ready(),
+			Clusters: map[string]clusterReadiness{},
+			Pauses:   pauses.List(),
+		}
+		for name, watcher := range watchers {
+			status.Clusters[name] = clusterReadiness{
+				Ready:     watcher.Readiness().Ready(),
+				Informers: watcher.Health(),
+				Control:   watcher.Control(),
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if !status.Ready {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		_ = json.NewEncoder(w).Encode(status)
+	})
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/artificialinc/cm-429-fixer/pkg/cm"
+)
+
+// scan reports failed ACME objects and returns the process exit code: 0 if
+// nothing is stuck, 1 if a rate limited object waits for a reset or was
+// given up on and 2 on errors
+func scan(g *globals, args []string) int {
+	fs := g.flagSet("scan")
+	namespace := fs.String("namespace", "", "Namespace to scan, all namespaces if empty")
+	output := fs.String("output", cm.FormatTable, "Output format: table, json or yaml")
+	_ = fs.Parse(args)
+
+	watcher := cm.NewWatcher(
+		cm.WithLogger(g.logger().WithName("watcher")),
+		cm.WithClient(cm.GetLocalClient(g.clientOpts())),
+	)
+
+	report, err := watcher.Scan(context.Background(), *namespace)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "scan failed:", err)
+		return 2
+	}
+	if err := report.Write(os.Stdout, *output); err != nil {
+		fmt.Fprintln(os.Stderr, "writing report:", err)
+		return 2
+	}
+	if report.Stuck() {
+		return 1
+	}
+	return 0
+}
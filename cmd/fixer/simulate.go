@@ -0,0 +1,102 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/artificialinc/cm-429-fixer/pkg/cm"
+	"sigs.k8s.io/yaml"
+)
+
+// simulate replays recorded transitions under a retry policy and returns the
+// process exit code
+func simulate(g *globals, args []string) int {
+	fs := g.flagSet("simulate")
+	policy := fs.String("policy", "", "RetryPolicy or ClusterRetryPolicy YAML file whose spec is simulated, the flags below override it")
+	delay := fs.Duration("delay", cm.DefaultDelay, "Wait before the first reset")
+	maxDelay := fs.Duration("max-delay", cm.DefaultMaxDelay, "Limit for the backoff between resets")
+	backoff := fs.Float64("backoff", 2, "Factor the delay grows by after every reset")
+	maxAttempts := fs.Int("max-attempts", 0, "Stop resetting an object after this many resets, 0 for no limit")
+	kinds := fs.String("kinds", "Order,Challenge", "Comma separated kinds that are reset")
+	holdAfter := fs.Duration("hold-after", 0, "Hold the Certificate instead of resetting when the ACME server asks to wait longer than this, 0 to never hold")
+	output := fs.String("output", cm.FormatTable, "Output format: table, json or yaml")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: fixer simulate [flags] [recording...]")
+		fmt.Fprintln(fs.Output(), "Replays transitions recorded by fixer run -record, read from stdin if no files are given")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+
+	var spec cm.RetryPolicySpec
+	if *policy != "" {
+		b, err := os.ReadFile(*policy)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "reading policy:", err)
+			return 2
+		}
+		var p struct {
+			Spec cm.RetryPolicySpec `json:"spec"`
+		}
+		if err := yaml.UnmarshalStrict(b, &p); err != nil {
+			fmt.Fprintln(os.Stderr, "reading policy:", err)
+			return 2
+		}
+		spec = p.Spec
+	}
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "delay":
+			spec.Delay = delay.String()
+		case "max-delay":
+			spec.MaxDelay = maxDelay.String()
+		case "backoff":
+			spec.Backoff = *backoff
+		case "max-attempts":
+			spec.MaxAttempts = *maxAttempts
+		case "kinds":
+			spec.Kinds = strings.Split(*kinds, ",")
+		}
+	})
+
+	var transitions []cm.Transition
+	readers := []io.Reader{os.Stdin}
+	if fs.NArg() > 0 {
+		readers = nil
+		for _, name := range fs.Args() {
+			f, err := os.Open(name)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "reading recording:", err)
+				return 2
+			}
+			defer f.Close()
+			readers = append(readers, f)
+		}
+	}
+	for _, r := range readers {
+		ts, err := cm.ReadTransitions(r)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "reading recording:", err)
+			return 2
+		}
+		transitions = append(transitions, ts...)
+	}
+
+	s, err := cm.Simulate(transitions, spec,
+		cm.WithLogger(g.logger().WithName("simulation")),
+		cm.WithUpdateDelay(*delay),
+		cm.WithMaxDelay(*maxDelay),
+		cm.WithHoldAfter(*holdAfter),
+	)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "simulation failed:", err)
+		return 2
+	}
+	if err := s.Write(os.Stdout, *output); err != nil {
+		fmt.Fprintln(os.Stderr, "writing simulation:", err)
+		return 2
+	}
+	return 0
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"net/http"
+	"time"
+
+	"github.com/artificialinc/cm-429-fixer/pkg/tracing"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// tracingFlags configure the export of traces of the run command
+type tracingFlags struct {
+	url     string
+	headers headers
+	timeout time.Duration
+}
+
+func (t *tracingFlags) register(fs *flag.FlagSet) {
+	t.headers = headers{}
+	fs.StringVar(&t.url, "trace-url", "", "Export traces of detected rate limits and their resets to this OTLP/HTTP traces endpoint, e.g. http://collector:4318/v1/traces")
+	fs.Var(t.headers, "trace-header", "Header sent with traces as Name: value, may be repeated")
+	fs.DurationVar(&t.timeout, "trace-timeout", 10*time.Second, "Timeout for exporting a batch of spans")
+}
+
+// provider returns the tracer provider exporting to the configured URL, nil
+// if there is none
+func (t *tracingFlags) provider(ctx context.Context) (*sdktrace.TracerProvider, error) {
+	if t.url == "" {
+		return nil, nil
+	}
+	exporter, err := tracing.NewExporter(ctx, t.url, http.Header(t.headers), t.timeout)
+	if err != nil {
+		return nil, err
+	}
+	return tracing.NewTracerProvider(exporter), nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+	"strings"
+
+	"github.com/artificialinc/cm-429-fixer/pkg/cm"
+	"github.com/artificialinc/cm-429-fixer/pkg/ui"
+	"github.com/go-logr/logr"
+)
+
+// uiFlags configure the status UI of the run command
+type uiFlags struct {
+	addr      string
+	tokenFile string
+	certFile  string
+	keyFile   string
+}
+
+func (u *uiFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&u.addr, "ui-addr", "", "Address to serve the status UI and its JSON API on, empty to disable")
+	fs.StringVar(&u.tokenFile, "ui-token-file", "", "File with the token needed to force resets and clear holds from the UI, the UI is read only without one")
+	fs.StringVar(&u.certFile, "ui-cert-file", "", "TLS certificate file of the status UI, required with -ui-token-file unless -ui-addr is a loopback address")
+	fs.StringVar(&u.keyFile, "ui-key-file", "", "TLS key file of the status UI")
+}
+
+// server returns the UI server of the watchers, nil if the UI is disabled
+func (u *uiFlags) server(log logr.Logger, watchers map[string]*cm.Watcher, budget *cm.Budget, tracker *cm.Tracker) (*ui.Server, error) {
+	if u.addr == "" {
+		return nil, nil
+	}
+	if err := checkTLS("ui", u.addr, u.certFile, u.keyFile, u.tokenFile != ""); err != nil {
+		return nil, err
+	}
+	opts := []ui.Option{
+		ui.WithLogger(log),
+		ui.WithBudget(budget),
+		ui.WithTracker(tracker),
+	}
+	if u.tokenFile != "" {
+		b, err := os.ReadFile(u.tokenFile)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, ui.WithToken(strings.TrimSpace(string(b))))
+	}
+	return ui.NewServer(watchers, opts...), nil
+}
+
+func serveUI(ctx context.Context, log logr.Logger, u *uiFlags, s *ui.Server) {
+	serve(ctx, log, "UI", s.Handler(), u.addr, u.certFile, u.keyFile)
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+
+	cmapi "github.com/cert-manager/cert-manager/pkg/apis/certmanager/v1"
+)
+
+// Set at build time with -ldflags "-X main.buildVersion=... -X main.buildCommit=..."
+var (
+	buildVersion = "dev"
+	buildCommit  = ""
+)
+
+const certManagerModule = "github.com/cert-manager/cert-manager"
+
+// version prints the build version, commit and the cert-manager API the fixer was compiled against
+func version(g *globals, args []string) int {
+	fs := g.flagSet("version")
+	_ = fs.Parse(args)
+
+	commit := buildCommit
+	certManager := "unknown"
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range info.Settings {
+			if s.Key == "vcs.revision" && commit == "" {
+				commit = s.Value
+			}
+		}
+		for _, dep := range info.Deps {
+			if dep.Path == certManagerModule {
+				certManager = dep.Version
+				if dep.Replace != nil {
+					certManager = dep.Replace.Version
+				}
+			}
+		}
+	}
+	if commit == "" {
+		commit = "unknown"
+	}
+
+	fmt.Printf("version:      %s\n", buildVersion)
+	fmt.Printf("commit:       %s\n", commit)
+	fmt.Printf("cert-manager: %s (%s)\n", certManager, cmapi.SchemeGroupVersion)
+	fmt.Printf("go:           %s %s/%s\n", runtime.Version(), runtime.GOOS, runtime.GOARCH)
+	return 0
+}
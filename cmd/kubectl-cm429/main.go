@@ -0,0 +1,343 @@
+// Package main provides the kubectl-cm429 kubectl plugin, exposing the fixer's
+// inspection and reset commands to kubectl users
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/artificialinc/cm-429-fixer/pkg/audit"
+	"github.com/artificialinc/cm-429-fixer/pkg/cm"
+	"github.com/cert-manager/cert-manager/pkg/client/clientset/versioned"
+	"github.com/spf13/pflag"
+	"k8s.io/cli-runtime/pkg/genericclioptions"
+	"k8s.io/cli-runtime/pkg/genericiooptions"
+	"k8s.io/client-go/dynamic"
+
+	_ "k8s.io/client-go/plugin/pkg/client/auth"
+)
+
+// command is a plugin subcommand
+type command struct {
+	name    string
+	summary string
+	run     func(p *plugin, args []string) int
+}
+
+var commands = []command{
+	{name: "status", summary: "Show rate limited objects and the resets the fixer has made", run: status},
+	{name: "scan", summary: "Report failed ACME objects", run: scan},
+	{name: "explain", summary: "Trace the issuance chain of a Certificate", run: explain},
+	{name: "reset", summary: "Reset selected rate limited objects", run: reset},
+}
+
+// plugin holds the flags shared by every subcommand
+type plugin struct {
+	configFlags   *genericclioptions.ConfigFlags
+	allNamespaces bool
+	output        string
+	streams       genericiooptions.IOStreams
+}
+
+func (p *plugin) register(fs *pflag.FlagSet) {
+	p.configFlags.AddFlags(fs)
+	fs.BoolVarP(&p.allNamespaces, "all-namespaces", "A", p.allNamespaces, "Look in all namespaces")
+	fs.StringVarP(&p.output, "output", "o", p.output, "Output format: table, json or yaml")
+}
+
+// flagSet returns a flag set for the subcommand with the shared flags registered
+func (p *plugin) flagSet(name string) *pflag.FlagSet {
+	fs := pflag.NewFlagSet("kubectl cm429 "+name, pflag.ExitOnError)
+	p.register(fs)
+	return fs
+}
+
+func (p *plugin) watcher(opts ...cm.Option) (*cm.Watcher, error) {
+	cfg, err := p.configFlags.ToRESTConfig()
+	if err != nil {
+		return nil, err
+	}
+	c, err := versioned.NewForConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return cm.NewWatcher(append([]cm.Option{cm.WithClient(c)}, opts...)...), nil
+}
+
+func (p *plugin) dynamicClient() (dynamic.Interface, error) {
+	cfg, err := p.configFlags.ToRESTConfig()
+	if err != nil {
+		return nil, err
+	}
+	return dynamic.NewForConfig(cfg)
+}
+
+// namespace returns the namespace to work in, empty for all namespaces
+func (p *plugin) namespace() (string, error) {
+	if p.allNamespaces {
+		return "", nil
+	}
+	ns, _, err := p.configFlags.ToRawKubeConfigLoader().Namespace()
+	return ns, err
+}
+
+func (p *plugin) fail(format string, a ...interface{}) int {
+	fmt.Fprintf(p.streams.ErrOut, "error: "+format+"\n", a...)
+	return 2
+}
+
+func main() {
+	p := &plugin{
+		configFlags: genericclioptions.NewConfigFlags(true),
+		output:      cm.FormatTable,
+		streams:     genericiooptions.IOStreams{In: os.Stdin, Out: os.Stdout, ErrOut: os.Stderr},
+	}
+
+	fs := pflag.NewFlagSet("kubectl cm429", pflag.ExitOnError)
+	fs.Usage = func() { usage(fs) }
+	fs.SetInterspersed(false)
+	p.register(fs)
+	_ = fs.Parse(os.Args[1:])
+
+	if fs.NArg() == 0 {
+		usage(fs)
+		os.Exit(2)
+	}
+	for _, c := range commands {
+		if c.name == fs.Arg(0) {
+			os.Exit(c.run(p, fs.Args()[1:]))
+		}
+	}
+	fmt.Fprintf(os.Stderr, "unknown command %q\n\n", fs.Arg(0))
+	usage(fs)
+	os.Exit(2)
+}
+
+func usage(fs *pflag.FlagSet) {
+	fmt.Fprintln(os.Stderr, "Usage: kubectl cm429 <command> [flags]")
+	fmt.Fprintln(os.Stderr, "\nCommands:")
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", c.name, c.summary)
+	}
+	fmt.Fprintln(os.Stderr, "\nFlags:")
+	fmt.Fprint(os.Stderr, fs.FlagUsages())
+}
+
+// status lists rate limited objects along with the reset history the fixer stored on them
+func status(p *plugin, args []string) int {
+	fs := p.flagSet("status")
+	_ = fs.Parse(args)
+
+	w, err := p.watcher()
+	if err != nil {
+		return p.fail("%v", err)
+	}
+	ns, err := p.namespace()
+	if err != nil {
+		return p.fail("%v", err)
+	}
+	targets, err := w.Targets(context.Background(), cm.Selector{Namespace: ns})
+	if err != nil {
+		return p.fail("%v", err)
+	}
+
+	if p.output != cm.FormatTable {
+		if err := targets.Write(p.streams.Out, p.output); err != nil {
+			return p.fail("%v", err)
+		}
+		return 0
+	}
+	if len(targets.Findings) == 0 {
+		fmt.Fprintln(p.streams.Out, "No rate limited objects found")
+		return 0
+	}
+
+	tw := tabwriter.NewWriter(p.streams.Out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAMESPACE\tKIND\tNAME\tCERTIFICATE\tRESETS\tLAST RESET\tACTION")
+	for _, f := range targets.Findings {
+		resets, last := "0", "-"
+		if f.RetryState != nil {
+			resets = fmt.Sprint(f.RetryState.Attempts)
+			last = f.RetryState.LastReset.Format(time.RFC3339)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", f.Namespace, f.Kind, f.Name, f.Certificate, resets, last, f.Action)
+	}
+	if err := tw.Flush(); err != nil {
+		return p.fail("%v", err)
+	}
+	return 0
+}
+
+// scan reports failed ACME objects, exiting with 1 if anything is stuck
+func scan(p *plugin, args []string) int {
+	fs := p.flagSet("scan")
+	_ = fs.Parse(args)
+
+	w, err := p.watcher()
+	if err != nil {
+		return p.fail("%v", err)
+	}
+	ns, err := p.namespace()
+	if err != nil {
+		return p.fail("%v", err)
+	}
+	report, err := w.Scan(context.Background(), ns)
+	if err != nil {
+		return p.fail("%v", err)
+	}
+	if err := report.Write(p.streams.Out, p.output); err != nil {
+		return p.fail("%v", err)
+	}
+	if report.Stuck() {
+		return 1
+	}
+	return 0
+}
+
+// explain prints the issuance chain of a certificate
+func explain(p *plugin, args []string) int {
+	fs := p.flagSet("explain")
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		return p.fail("usage: kubectl cm429 explain [-n namespace] <certificate>")
+	}
+
+	ns, err := p.namespace()
+	if err != nil {
+		return p.fail("%v", err)
+	}
+	name := fs.Arg(0)
+	if before, after, ok := strings.Cut(name, "/"); ok {
+		ns, name = before, after
+	}
+	if ns == "" {
+		return p.fail("a namespace is required, use -n or <namespace>/<certificate>")
+	}
+
+	w, err := p.watcher()
+	if err != nil {
+		return p.fail("%v", err)
+	}
+	chain, err := w.Explain(context.Background(), ns, name)
+	if err != nil {
+		return p.fail("%v", err)
+	}
+
+	format := p.output
+	if format == cm.FormatTable {
+		format = cm.FormatText
+	}
+	if err := chain.Write(p.streams.Out, format); err != nil {
+		return p.fail("%v", err)
+	}
+	return 0
+}
+
+// reset resets selected rate limited objects after confirmation
+func reset(p *plugin, args []string) int {
+	fs := p.flagSet("reset")
+	certificate := fs.String("certificate", "", "Only reset objects issuing this Certificate")
+	issuer := fs.String("issuer", "", "Only reset objects using this issuer, as name or Kind/name")
+	allRateLimited := fs.Bool("all-rate-limited", false, "Reset every rate limited object matching the other selectors")
+	dryRun := fs.Bool("dry-run", false, "Show what would be reset without changing anything")
+	force := fs.Bool("force", false, "Reset objects that are still backing off")
+	yes := fs.BoolP("yes", "y", false, "Don't ask for confirmation")
+	auditFile := fs.String("audit-file", "", "Append audit records of the resets to this file")
+	auditURL := fs.String("audit-url", "", "Post audit records of the resets to this URL")
+	controlConfigMap := fs.String("control-configmap", cm.DefaultControl, "Don't reset objects the fixer's control ConfigMap switches off, as namespace/name or a namespace to use "+cm.DefaultControlName+". A missing ConfigMap switches nothing off.")
+	noControl := fs.Bool("no-control-configmap", false, "Don't read the fixer's control ConfigMap")
+	_ = fs.Parse(args)
+
+	if *certificate == "" && *issuer == "" && !*allRateLimited {
+		return p.fail("select objects with --certificate, --issuer or --all-rate-limited")
+	}
+
+	var sinks []audit.Sink
+	if *auditFile != "" {
+		s, err := audit.NewFileSink(*auditFile, 0, 0)
+		if err != nil {
+			return p.fail("%v", err)
+		}
+		sinks = append(sinks, s)
+	}
+	if *auditURL != "" {
+		sinks = append(sinks, audit.NewHTTPSink(*auditURL, nil, 10*time.Second))
+	}
+	auditLog := audit.New(sinks...)
+	defer auditLog.Close()
+
+	opts := []cm.Option{cm.WithAudit(auditLog)}
+	if !*noControl {
+		controlNamespace, controlName := cm.SplitControl(*controlConfigMap)
+		if controlNamespace == "" {
+			return p.fail("--control-configmap needs a namespace, pass --no-control-configmap to read none")
+		}
+		dyn, err := p.dynamicClient()
+		if err != nil {
+			return p.fail("%v", err)
+		}
+		opts = append(opts, cm.WithControl(dyn, controlNamespace, controlName))
+	}
+	w, err := p.watcher(opts...)
+	if err != nil {
+		return p.fail("%v", err)
+	}
+	ns, err := p.namespace()
+	if err != nil {
+		return p.fail("%v", err)
+	}
+
+	ctx := context.Background()
+	if err := w.LoadControl(ctx); err != nil {
+		return p.fail("%v", err)
+	}
+	targets, err := w.Targets(ctx, cm.Selector{Namespace: ns, Certificate: *certificate, Issuer: *issuer})
+	if err != nil {
+		return p.fail("%v", err)
+	}
+	if len(targets.Findings) == 0 {
+		fmt.Fprintln(p.streams.Out, "Nothing to reset")
+		return 0
+	}
+	if err := targets.Write(p.streams.Out, cm.FormatTable); err != nil {
+		return p.fail("%v", err)
+	}
+	if !*dryRun && !*yes && !confirm(p.streams.In, p.streams.Out, fmt.Sprintf("Reset %d objects?", len(targets.Findings))) {
+		fmt.Fprintln(p.streams.Out, "Aborted")
+		return 1
+	}
+
+	code := 0
+	for _, f := range targets.Findings {
+		result, err := w.Reset(ctx, f, cm.ResetOptions{DryRun: *dryRun, Force: *force, Actor: actor()})
+		if err != nil {
+			fmt.Fprintf(p.streams.ErrOut, "%s %s/%s: %v\n", f.Kind, f.Namespace, f.Name, err)
+			code = 1
+			continue
+		}
+		fmt.Fprintf(p.streams.Out, "%s %s/%s: %s\n", f.Kind, f.Namespace, f.Name, result)
+	}
+	return code
+}
+
+// actor names the user running the plugin in the audit log
+func actor() string {
+	if u, err := user.Current(); err == nil {
+		return "kubectl-cm429:" + u.Username
+	}
+	return "kubectl-cm429"
+}
+
+func confirm(in io.Reader, out io.Writer, question string) bool {
+	fmt.Fprintf(out, "%s [y/N]: ", question)
+	answer, _ := bufio.NewReader(in).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
@@ -0,0 +1,218 @@
+package acmetest
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	acmeutil "github.com/cert-manager/cert-manager/pkg/acme/util"
+	acmev1 "github.com/cert-manager/cert-manager/pkg/apis/acme/v1"
+	"github.com/cert-manager/cert-manager/pkg/client/clientset/versioned"
+	"golang.org/x/crypto/acme"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// Harness plays cert-manager's part against a Server. It syncs the pending
+// Orders and Challenges of a clientset with the server through the same ACME
+// client cert-manager uses, and records failures in their status the way
+// cert-manager's controllers do.
+type Harness struct {
+	Server *Server
+
+	client versioned.Interface
+	acme   *acme.Client
+	key    crypto.Signer
+}
+
+// NewHarness starts a server and registers an ACME account with it
+func NewHarness(t testing.TB, client versioned.Interface) *Harness {
+	s := NewServer(t)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &Harness{
+		Server: s,
+		client: client,
+		acme: &acme.Client{
+			Key:          key,
+			DirectoryURL: s.DirectoryURL(),
+			RetryBackoff: acmeutil.RetryBackoff,
+		},
+		key: key,
+	}
+	if _, err := h.acme.Register(context.Background(), &acme.Account{}, acme.AcceptTOS); err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+// Run syncs pending Orders and Challenges every interval until the context is
+// done. Orders are synced before Challenges, each by namespace and name, so
+// scripted responses go to the same objects on every run. Sync errors are
+// retried on the next round, like a controller would.
+func (h *Harness) Run(ctx context.Context, interval time.Duration) {
+	wait.UntilWithContext(ctx, func(ctx context.Context) {
+		orders, err := h.client.AcmeV1().Orders(metav1.NamespaceAll).List(ctx, metav1.ListOptions{})
+		if err == nil {
+			metas := make([]metav1.ObjectMeta, 0, len(orders.Items))
+			for _, o := range orders.Items {
+				metas = append(metas, o.ObjectMeta)
+			}
+			for _, m := range sorted(metas) {
+				_ = h.SyncOrder(ctx, m.Namespace, m.Name)
+			}
+		}
+		challenges, err := h.client.AcmeV1().Challenges(metav1.NamespaceAll).List(ctx, metav1.ListOptions{})
+		if err == nil {
+			metas := make([]metav1.ObjectMeta, 0, len(challenges.Items))
+			for _, c := range challenges.Items {
+				metas = append(metas, c.ObjectMeta)
+			}
+			for _, m := range sorted(metas) {
+				_ = h.SyncChallenge(ctx, m.Namespace, m.Name)
+			}
+		}
+	}, interval)
+}
+
+// sorted sorts objects by namespace and name
+func sorted(metas []metav1.ObjectMeta) []metav1.ObjectMeta {
+	sort.Slice(metas, func(i, j int) bool {
+		if metas[i].Namespace != metas[j].Namespace {
+			return metas[i].Namespace < metas[j].Namespace
+		}
+		return metas[i].Name < metas[j].Name
+	})
+	return metas
+}
+
+// pending returns true for the states cert-manager acts on
+func pending(s acmev1.State) bool {
+	return s == "" || s == acmev1.Pending || s == acmev1.Ready
+}
+
+// SyncOrder creates a pending Order with the server if it hasn't been yet,
+// and finalizes it once it's ready
+func (h *Harness) SyncOrder(ctx context.Context, namespace, name string) error {
+	o, err := h.client.AcmeV1().Orders(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil || !pending(o.Status.State) {
+		return err
+	}
+	o = o.DeepCopy()
+
+	var order *acme.Order
+	if o.Status.URL == "" {
+		order, err = h.acme.AuthorizeOrder(ctx, acme.DomainIDs(o.Spec.DNSNames...))
+		if failed(err) {
+			return h.orderFailed(ctx, o, fmt.Sprintf("Failed to create Order: %v", err))
+		}
+	} else {
+		order, err = h.acme.GetOrder(ctx, o.Status.URL)
+	}
+	if err != nil {
+		return err
+	}
+	o.Status.URL = order.URI
+	o.Status.FinalizeURL = order.FinalizeURL
+	o.Status.State = acmev1.State(order.Status)
+
+	if order.Status == acme.StatusReady {
+		csr, err := h.csr(o.Spec.DNSNames)
+		if err != nil {
+			return err
+		}
+		_, _, err = h.acme.CreateOrderCert(ctx, order.FinalizeURL, csr, false)
+		if failed(err) {
+			return h.orderFailed(ctx, o, fmt.Sprintf("Failed to finalize Order: %v", err))
+		}
+		if err != nil {
+			return err
+		}
+		o.Status.State = acmev1.Valid
+	}
+	return h.patchOrder(ctx, o)
+}
+
+func (h *Harness) orderFailed(ctx context.Context, o *acmev1.Order, reason string) error {
+	o.Status.State = acmev1.Errored
+	o.Status.Reason = reason
+	return h.patchOrder(ctx, o)
+}
+
+// patchOrder writes the status fields the harness manages. It patches rather
+// than updates, as the fake clientset doesn't detect conflicting updates and
+// would drop the fixer's retry state.
+func (h *Harness) patchOrder(ctx context.Context, o *acmev1.Order) error {
+	patch, err := json.Marshal(map[string]interface{}{"status": map[string]interface{}{
+		"state":       o.Status.State,
+		"reason":      o.Status.Reason,
+		"url":         o.Status.URL,
+		"finalizeURL": o.Status.FinalizeURL,
+	}})
+	if err != nil {
+		return err
+	}
+	_, err = h.client.AcmeV1().Orders(o.Namespace).Patch(ctx, o.Name, types.MergePatchType, patch, metav1.PatchOptions{}, "status")
+	return err
+}
+
+// SyncChallenge accepts a pending Challenge with the server
+func (h *Harness) SyncChallenge(ctx context.Context, namespace, name string) error {
+	c, err := h.client.AcmeV1().Challenges(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil || !pending(c.Status.State) {
+		return err
+	}
+	c = c.DeepCopy()
+
+	chal, err := h.acme.Accept(ctx, &acme.Challenge{Type: string(c.Spec.Type), URI: c.Spec.URL, Token: c.Spec.Token})
+	var acmeErr *acme.Error
+	switch {
+	case errors.As(err, &acmeErr) && acmeErr.ProblemType == ProblemMalformed:
+		c.Status.State = acmev1.Expired
+	case failed(err):
+		// cert-manager reports every 4xx on accept with this message
+		c.Status.State = acmev1.Errored
+		c.Status.Reason = fmt.Sprintf("Failed to retrieve Order resource: %v", err)
+	case err != nil:
+		return err
+	default:
+		c.Status.State = acmev1.State(chal.Status)
+		c.Status.Reason = ""
+	}
+	patch, err := json.Marshal(map[string]interface{}{"status": map[string]interface{}{
+		"state":  c.Status.State,
+		"reason": c.Status.Reason,
+	}})
+	if err != nil {
+		return err
+	}
+	_, err = h.client.AcmeV1().Challenges(namespace).Patch(ctx, name, types.MergePatchType, patch, metav1.PatchOptions{}, "status")
+	return err
+}
+
+// failed returns true for the errors cert-manager marks objects Errored for
+func failed(err error) bool {
+	var acmeErr *acme.Error
+	return errors.As(err, &acmeErr) && acmeErr.StatusCode >= 400 && acmeErr.StatusCode < 500
+}
+
+func (h *Harness) csr(domains []string) ([]byte, error) {
+	tmpl := &x509.CertificateRequest{DNSNames: domains}
+	if len(domains) > 0 {
+		tmpl.Subject = pkix.Name{CommonName: domains[0]}
+	}
+	return x509.CreateCertificateRequest(rand.Reader, tmpl, h.key)
+}
@@ -0,0 +1,387 @@
+// Package acmetest provides an in-process ACME server that can be scripted to
+// answer with rate limit problems, and a harness that plays cert-manager's
+// part against it. It is meant for tests only.
+package acmetest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Endpoint is a kind of ACME resource the server answers requests for
+type Endpoint string
+
+// Endpoints requests can be scripted for
+const (
+	NewAccount    Endpoint = "new-account"
+	NewOrder      Endpoint = "new-order"
+	Order         Endpoint = "order"
+	Authorization Endpoint = "authz"
+	Challenge     Endpoint = "chall"
+	Finalize      Endpoint = "finalize"
+	Certificate   Endpoint = "cert"
+)
+
+const (
+	// ProblemRateLimited is the ACME problem type of rate limit errors
+	ProblemRateLimited = "urn:ietf:params:acme:error:rateLimited"
+	// ProblemMalformed is the ACME problem type of malformed requests
+	ProblemMalformed = "urn:ietf:params:acme:error:malformed"
+)
+
+// Response is a scripted problem response
+type Response struct {
+	Status  int
+	Problem string
+	Detail  string
+	// RetryAfter is sent in the Retry-After header unless zero
+	RetryAfter time.Time
+}
+
+// RateLimited returns a rate limit problem like the ones Let's Encrypt sends.
+// The retry after time is in both the Retry-After header and the detail,
+// unless zero.
+func RateLimited(retryAfter time.Time) Response {
+	detail := "too many certificates already issued for this exact set of domains in the last 168 hours"
+	if !retryAfter.IsZero() {
+		detail += ", retry after " + retryAfter.UTC().Format("2006-01-02 15:04:05 UTC")
+	}
+	return Response{
+		Status:     http.StatusTooManyRequests,
+		Problem:    ProblemRateLimited,
+		Detail:     detail + ": see https://letsencrypt.org/docs/rate-limits/",
+		RetryAfter: retryAfter,
+	}
+}
+
+// Problem returns any other problem response
+func Problem(status int, problem, detail string) Response {
+	return Response{Status: status, Problem: problem, Detail: detail}
+}
+
+// Server is an ACME server implementing the subset of RFC 8555 cert-manager
+// uses to issue a certificate. Requests are answered successfully unless a
+// response has been scripted for the endpoint or object. Signatures aren't
+// checked.
+type Server struct {
+	srv *httptest.Server
+	key *ecdsa.PrivateKey
+
+	mu          sync.Mutex
+	nonce       int
+	ids         int
+	scripts     map[Endpoint][]Response
+	requests    map[Endpoint][]time.Time
+	scriptsFor  map[objectKey][]Response
+	requestsFor map[objectKey][]time.Time
+	orders      map[string]*order
+}
+
+// objectKey identifies the requests to an endpoint about one object
+type objectKey struct {
+	endpoint Endpoint
+	object   string
+}
+
+type order struct {
+	Status         string   `json:"status"`
+	Identifiers    []ident  `json:"identifiers"`
+	Authorizations []string `json:"authorizations"`
+	Finalize       string   `json:"finalize"`
+	Certificate    string   `json:"certificate,omitempty"`
+
+	cert []byte
+}
+
+type ident struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+// NewServer starts a server, which is closed when the test ends
+func NewServer(t testing.TB) *Server {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{
+		key:      key,
+		scripts:  map[Endpoint][]Response{},
+		requests: map[Endpoint][]time.Time{},
+		orders:   map[string]*order{},
+
+		scriptsFor:  map[objectKey][]Response{},
+		requestsFor: map[objectKey][]time.Time{},
+	}
+	s.srv = httptest.NewServer(http.HandlerFunc(s.serve))
+	t.Cleanup(s.srv.Close)
+	return s
+}
+
+// URL returns the base URL of the server
+func (s *Server) URL() string {
+	return s.srv.URL
+}
+
+// DirectoryURL returns the URL of the ACME directory
+func (s *Server) DirectoryURL() string {
+	return s.srv.URL + "/directory"
+}
+
+// ChallengeURL returns the URL of a challenge, any name is accepted
+func (s *Server) ChallengeURL(name string) string {
+	return s.url(Challenge, name)
+}
+
+// Script queues responses for the next requests to the endpoint. Once they
+// have been sent the endpoint answers successfully again.
+func (s *Server) Script(e Endpoint, responses ...Response) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.scripts[e] = append(s.scripts[e], responses...)
+}
+
+// ScriptFor queues responses for the next requests to the endpoint about one
+// object, so they don't depend on the order objects are synced in. Orders,
+// their finalization and certificate are named by their first domain, and
+// authorizations and challenges by the name in their URL. Responses scripted
+// for the whole endpoint are sent first.
+func (s *Server) ScriptFor(e Endpoint, object string, responses ...Response) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k := objectKey{endpoint: e, object: object}
+	s.scriptsFor[k] = append(s.scriptsFor[k], responses...)
+}
+
+// Requests returns the times requests were made to the endpoint
+func (s *Server) Requests(e Endpoint) []time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]time.Time(nil), s.requests[e]...)
+}
+
+// RequestsFor returns the times requests were made to the endpoint about the
+// object, named like in ScriptFor
+func (s *Server) RequestsFor(e Endpoint, object string) []time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]time.Time(nil), s.requestsFor[objectKey{endpoint: e, object: object}]...)
+}
+
+func (s *Server) url(e Endpoint, id string) string {
+	if id == "" {
+		return s.srv.URL + "/" + string(e)
+	}
+	return s.srv.URL + "/" + string(e) + "/" + id
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nonce++
+	w.Header().Set("Replay-Nonce", strconv.Itoa(s.nonce))
+	w.Header().Set("Cache-Control", "no-store")
+
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	e, id, _ := strings.Cut(path, "/")
+	switch path {
+	case "directory":
+		s.json(w, http.StatusOK, map[string]string{
+			"newNonce":   s.url("new-nonce", ""),
+			"newAccount": s.url(NewAccount, ""),
+			"newOrder":   s.url(NewOrder, ""),
+			"revokeCert": s.url("revoke-cert", ""),
+			"keyChange":  s.url("key-change", ""),
+		})
+		return
+	case "new-nonce":
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if r.Method != http.MethodPost {
+		s.problem(w, Problem(http.StatusMethodNotAllowed, ProblemMalformed, "only POST is supported"))
+		return
+	}
+
+	endpoint := Endpoint(e)
+	now := time.Now()
+	s.requests[endpoint] = append(s.requests[endpoint], now)
+	if script := s.scripts[endpoint]; len(script) > 0 {
+		s.scripts[endpoint] = script[1:]
+		s.problem(w, script[0])
+		return
+	}
+
+	payload, err := jwsPayload(r)
+	if err != nil {
+		s.problem(w, Problem(http.StatusBadRequest, ProblemMalformed, err.Error()))
+		return
+	}
+	if object := s.objectOf(endpoint, id, payload); object != "" {
+		k := objectKey{endpoint: endpoint, object: object}
+		s.requestsFor[k] = append(s.requestsFor[k], now)
+		if script := s.scriptsFor[k]; len(script) > 0 {
+			s.scriptsFor[k] = script[1:]
+			s.problem(w, script[0])
+			return
+		}
+	}
+	switch endpoint {
+	case NewAccount:
+		w.Header().Set("Location", s.url("account", "1"))
+		s.json(w, http.StatusCreated, map[string]string{"status": "valid"})
+	case NewOrder:
+		s.newOrder(w, payload)
+	case Order:
+		if o, ok := s.orders[id]; ok {
+			w.Header().Set("Location", s.url(Order, id))
+			s.json(w, http.StatusOK, o)
+			return
+		}
+		s.problem(w, Problem(http.StatusNotFound, ProblemMalformed, "no such order"))
+	case Authorization:
+		s.json(w, http.StatusOK, map[string]interface{}{
+			"status":     "valid",
+			"identifier": ident{Type: "dns", Value: id},
+			"challenges": []map[string]string{{"type": "http-01", "url": s.url(Challenge, id), "token": id, "status": "valid"}},
+		})
+	case Challenge:
+		s.json(w, http.StatusOK, map[string]string{"type": "http-01", "url": s.url(Challenge, id), "token": id, "status": "valid"})
+	case Finalize:
+		s.finalize(w, id, payload)
+	case Certificate:
+		if o, ok := s.orders[id]; ok && o.cert != nil {
+			w.Header().Set("Content-Type", "application/pem-certificate-chain")
+			_ = pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: o.cert})
+			return
+		}
+		s.problem(w, Problem(http.StatusNotFound, ProblemMalformed, "no such certificate"))
+	default:
+		s.problem(w, Problem(http.StatusNotFound, ProblemMalformed, "unknown endpoint "+e))
+	}
+}
+
+// objectOf returns the name of the object a request is about, see ScriptFor
+func (s *Server) objectOf(e Endpoint, id string, payload []byte) string {
+	switch e {
+	case NewOrder:
+		var req struct {
+			Identifiers []ident `json:"identifiers"`
+		}
+		if err := json.Unmarshal(payload, &req); err == nil && len(req.Identifiers) > 0 {
+			return req.Identifiers[0].Value
+		}
+	case Order, Finalize, Certificate:
+		if o, ok := s.orders[id]; ok && len(o.Identifiers) > 0 {
+			return o.Identifiers[0].Value
+		}
+	case Authorization, Challenge:
+		return id
+	}
+	return ""
+}
+
+// newOrder creates an order whose authorizations are all valid already
+func (s *Server) newOrder(w http.ResponseWriter, payload []byte) {
+	var req struct {
+		Identifiers []ident `json:"identifiers"`
+	}
+	if err := json.Unmarshal(payload, &req); err != nil || len(req.Identifiers) == 0 {
+		s.problem(w, Problem(http.StatusBadRequest, ProblemMalformed, "no identifiers"))
+		return
+	}
+	s.ids++
+	id := strconv.Itoa(s.ids)
+	o := &order{Status: "ready", Identifiers: req.Identifiers, Finalize: s.url(Finalize, id)}
+	for _, i := range req.Identifiers {
+		o.Authorizations = append(o.Authorizations, s.url(Authorization, i.Value))
+	}
+	s.orders[id] = o
+	w.Header().Set("Location", s.url(Order, id))
+	s.json(w, http.StatusCreated, o)
+}
+
+// finalize issues the certificate of a ready order
+func (s *Server) finalize(w http.ResponseWriter, id string, payload []byte) {
+	o, ok := s.orders[id]
+	if !ok || o.Status != "ready" {
+		s.problem(w, Problem(http.StatusForbidden, "urn:ietf:params:acme:error:orderNotReady", "order is not ready"))
+		return
+	}
+	var req struct {
+		CSR string `json:"csr"`
+	}
+	if err := json.Unmarshal(payload, &req); err != nil {
+		s.problem(w, Problem(http.StatusBadRequest, ProblemMalformed, err.Error()))
+		return
+	}
+	der, err := base64.RawURLEncoding.DecodeString(req.CSR)
+	if err != nil {
+		s.problem(w, Problem(http.StatusBadRequest, "urn:ietf:params:acme:error:badCSR", err.Error()))
+		return
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		s.problem(w, Problem(http.StatusBadRequest, "urn:ietf:params:acme:error:badCSR", err.Error()))
+		return
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(int64(s.ids)),
+		Subject:      pkix.Name{CommonName: csr.Subject.CommonName},
+		DNSNames:     csr.DNSNames,
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+	}
+	o.cert, err = x509.CreateCertificate(rand.Reader, tmpl, tmpl, csr.PublicKey, s.key)
+	if err != nil {
+		s.problem(w, Problem(http.StatusInternalServerError, "urn:ietf:params:acme:error:serverInternal", err.Error()))
+		return
+	}
+	o.Status = "valid"
+	o.Certificate = s.url(Certificate, id)
+	w.Header().Set("Location", s.url(Order, id))
+	s.json(w, http.StatusOK, o)
+}
+
+func (s *Server) json(w http.ResponseWriter, status int, v interface{}) {
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func (s *Server) problem(w http.ResponseWriter, r Response) {
+	if !r.RetryAfter.IsZero() {
+		w.Header().Set("Retry-After", r.RetryAfter.UTC().Format(http.TimeFormat))
+	}
+	w.Header().Set("Content-Type", "application/problem+json")
+	s.json(w, r.Status, map[string]interface{}{"type": r.Problem, "detail": r.Detail, "status": r.Status})
+}
+
+// jwsPayload returns the payload of a flattened JWS request body
+func jwsPayload(r *http.Request) ([]byte, error) {
+	var jws struct {
+		Payload string `json:"payload"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&jws); err != nil {
+		return nil, fmt.Errorf("invalid JWS: %w", err)
+	}
+	return base64.RawURLEncoding.DecodeString(jws.Payload)
+}
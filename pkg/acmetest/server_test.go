@@ -0,0 +1,120 @@
+package acmetest_test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/artificialinc/cm-429-fixer/pkg/acmetest"
+	"github.com/artificialinc/cm-429-fixer/pkg/cm"
+	acmev1 "github.com/cert-manager/cert-manager/pkg/apis/acme/v1"
+	"github.com/cert-manager/cert-manager/pkg/client/clientset/versioned/fake"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestHarness(t *testing.T) {
+	ctx := context.Background()
+	client := fake.NewSimpleClientset(
+		&acmev1.Order{
+			ObjectMeta: metav1.ObjectMeta{Name: "order1", Namespace: "default"},
+			Spec:       acmev1.OrderSpec{DNSNames: []string{"example.com"}},
+		},
+		&acmev1.Challenge{ObjectMeta: metav1.ObjectMeta{Name: "challenge1", Namespace: "default"}},
+	)
+	h := acmetest.NewHarness(t, client)
+	c, err := client.AcmeV1().Challenges("default").Get(ctx, "challenge1", metav1.GetOptions{})
+	assert.NoError(t, err)
+	c.Spec.URL = h.Server.ChallengeURL("challenge1")
+	c.Spec.Type = acmev1.ACMEChallengeTypeHTTP01
+	_, err = client.AcmeV1().Challenges("default").Update(ctx, c, metav1.UpdateOptions{})
+	assert.NoError(t, err)
+
+	retryAfter := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	h.Server.Script(acmetest.NewOrder, acmetest.RateLimited(retryAfter))
+	h.Server.Script(acmetest.Challenge, acmetest.Problem(http.StatusForbidden, "urn:ietf:params:acme:error:unauthorized", "no"))
+
+	// Scripted problems end up in the status like cert-manager records them
+	assert.NoError(t, h.SyncOrder(ctx, "default", "order1"))
+	o, err := client.AcmeV1().Orders("default").Get(ctx, "order1", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, acmev1.Errored, o.Status.State)
+	assert.Contains(t, o.Status.Reason, "Failed to create Order: 429 urn:ietf:params:acme:error:rateLimited: too many certificates")
+	v := cm.Classify(o.Status.State, o.Status.Reason)
+	assert.True(t, v.RateLimited())
+	assert.True(t, retryAfter.Equal(v.RetryAfter), "expected %v, got %v", retryAfter, v.RetryAfter)
+
+	assert.NoError(t, h.SyncChallenge(ctx, "default", "challenge1"))
+	c, err = client.AcmeV1().Challenges("default").Get(ctx, "challenge1", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, acmev1.Errored, c.Status.State)
+	assert.Equal(t, cm.CategoryOther, cm.Classify(c.Status.State, c.Status.Reason).Category)
+
+	// Errored objects are left alone until they are reset
+	assert.NoError(t, h.SyncOrder(ctx, "default", "order1"))
+	assert.Len(t, h.Server.Requests(acmetest.NewOrder), 1)
+
+	// Once the script has run out the server issues
+	o.Status = acmev1.OrderStatus{State: acmev1.Pending}
+	_, err = client.AcmeV1().Orders("default").UpdateStatus(ctx, o, metav1.UpdateOptions{})
+	assert.NoError(t, err)
+	assert.NoError(t, h.SyncOrder(ctx, "default", "order1"))
+	o, err = client.AcmeV1().Orders("default").Get(ctx, "order1", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, acmev1.Valid, o.Status.State)
+	assert.NotEmpty(t, o.Status.URL)
+	assert.Len(t, h.Server.Requests(acmetest.NewOrder), 2)
+	assert.Len(t, h.Server.Requests(acmetest.Finalize), 1)
+	assert.Len(t, h.Server.Requests(acmetest.Certificate), 1)
+}
+
+func TestServerRetryAfter(t *testing.T) {
+	s := acmetest.NewServer(t)
+	retryAfter := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	s.Script(acmetest.NewAccount, acmetest.RateLimited(retryAfter))
+
+	req, err := http.NewRequest(http.MethodPost, s.URL()+"/new-account", nil)
+	assert.NoError(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal(t, "application/problem+json", resp.Header.Get("Content-Type"))
+	header, err := http.ParseTime(resp.Header.Get("Retry-After"))
+	assert.NoError(t, err)
+	assert.True(t, retryAfter.Equal(header))
+	assert.NotEmpty(t, resp.Header.Get("Replay-Nonce"))
+}
+
+func TestServerScriptFor(t *testing.T) {
+	ctx := context.Background()
+	client := fake.NewSimpleClientset(
+		&acmev1.Order{
+			ObjectMeta: metav1.ObjectMeta{Name: "order1", Namespace: "default"},
+			Spec:       acmev1.OrderSpec{DNSNames: []string{"a.example.com"}},
+		},
+		&acmev1.Order{
+			ObjectMeta: metav1.ObjectMeta{Name: "order2", Namespace: "default"},
+			Spec:       acmev1.OrderSpec{DNSNames: []string{"b.example.com"}},
+		},
+	)
+	h := acmetest.NewHarness(t, client)
+	h.Server.ScriptFor(acmetest.Finalize, "b.example.com", acmetest.RateLimited(time.Time{}))
+
+	// Only the order the response was scripted for fails, whichever goes first
+	assert.NoError(t, h.SyncOrder(ctx, "default", "order1"))
+	assert.NoError(t, h.SyncOrder(ctx, "default", "order2"))
+	o, err := client.AcmeV1().Orders("default").Get(ctx, "order1", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, acmev1.Valid, o.Status.State)
+	o, err = client.AcmeV1().Orders("default").Get(ctx, "order2", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, acmev1.Errored, o.Status.State)
+	assert.True(t, cm.Classify(o.Status.State, o.Status.Reason).RateLimited())
+
+	assert.Len(t, h.Server.Requests(acmetest.Finalize), 2)
+	assert.Len(t, h.Server.RequestsFor(acmetest.Finalize, "a.example.com"), 1)
+	assert.Len(t, h.Server.RequestsFor(acmetest.Finalize, "b.example.com"), 1)
+	assert.Len(t, h.Server.RequestsFor(acmetest.NewOrder, "b.example.com"), 1)
+}
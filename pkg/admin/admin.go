@@ -0,0 +1,310 @@
+// Package admin serves an authenticated HTTP API to control a running fixer:
+// pausing and resuming its changes, forcing resets, clearing backoff and
+// dumping the scheduled resets. Every change is audited and pauses may be
+// persisted to survive restarts.
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/artificialinc/cm-429-fixer/pkg/audit"
+	"github.com/artificialinc/cm-429-fixer/pkg/cm"
+	"github.com/artificialinc/cm-429-fixer/pkg/httpapi"
+	"github.com/go-logr/logr"
+	"k8s.io/utils/clock"
+)
+
+// ActorAdmin is the actor of changes made through the API in the audit log.
+// Callers may name themselves with the X-Actor header, which is appended as
+// admin:name.
+const ActorAdmin = "admin"
+
+// KindPause is the object kind of pause records in the audit log
+const KindPause = "Pause"
+
+// ObjectRequest names an Order or Challenge to act on
+type ObjectRequest struct {
+	Cluster   string `json:"cluster"`
+	Kind      string `json:"kind"`
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+}
+
+// PauseRequest pauses or resumes changes in a namespace, of an issuer or
+// everywhere if both are empty
+type PauseRequest struct {
+	Namespace string `json:"namespace,omitempty"`
+	Issuer    string `json:"issuer,omitempty"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+// State is what the server persists
+type State struct {
+	Pauses []cm.Pause `json:"pauses"`
+}
+
+// Server serves the admin API
+type Server struct {
+	watchers  map[string]*cm.Watcher
+	pauses    *cm.Pauses
+	token     string
+	stateFile string
+	auditLog  *audit.Log
+	log       logr.Logger
+	clock     clock.PassiveClock
+}
+
+// Option is a function that sets some option on the server
+type Option func(*Server)
+
+// WithAudit records pauses and resumes in the audit log. Resets and cleared
+// backoffs are audited by the watchers.
+func WithAudit(l *audit.Log) Option {
+	return func(s *Server) {
+		s.auditLog = l
+	}
+}
+
+// WithStateFile persists the pauses to the file on every change, Load reads
+// them back
+func WithStateFile(path string) Option {
+	return func(s *Server) {
+		s.stateFile = path
+	}
+}
+
+// WithLogger sets the logger
+func WithLogger(l logr.Logger) Option {
+	return func(s *Server) {
+		s.log = l
+	}
+}
+
+// WithClock sets the clock pauses are timed with
+func WithClock(c clock.PassiveClock) Option {
+	return func(s *Server) {
+		s.clock = c
+	}
+}
+
+// NewServer creates a server controlling the watchers, keyed by cluster name,
+// and the pauses they share. Requests must carry the token as a bearer token.
+func NewServer(watchers map[string]*cm.Watcher, pauses *cm.Pauses, token string, opts ...Option) *Server {
+	s := &Server{
+		watchers: watchers,
+		pauses:   pauses,
+		token:    token,
+		log:      logr.Discard(),
+		clock:    clock.RealClock{},
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// Load reads the pauses persisted to the state file, if there is one
+func (s *Server) Load() error {
+	if s.stateFile == "" {
+		return nil
+	}
+	b, err := os.ReadFile(s.stateFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var state State
+	if err := json.Unmarshal(b, &state); err != nil {
+		return fmt.Errorf("reading %s: %w", s.stateFile, err)
+	}
+	s.pauses.Set(state.Pauses)
+	return nil
+}
+
+// save writes the pauses to the state file, replacing it whole
+func (s *Server) save() error {
+	if s.stateFile == "" {
+		return nil
+	}
+	b, err := json.MarshalIndent(State{Pauses: s.pauses.List()}, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.stateFile), filepath.Base(s.stateFile)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.stateFile)
+}
+
+// Handler returns the handler of the API
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /pauses", s.handlePauses)
+	mux.HandleFunc("POST /pause", s.handlePause)
+	mux.HandleFunc("POST /resume", s.handleResume)
+	mux.HandleFunc("POST /reset", s.handleReset)
+	mux.HandleFunc("POST /clear-backoff", s.handleClearBackoff)
+	mux.HandleFunc("GET /queue", s.handleQueue)
+	return s.authorized(mux)
+}
+
+func (s *Server) handlePauses(w http.ResponseWriter, _ *http.Request) {
+	pauses := s.pauses.List()
+	if pauses == nil {
+		pauses = []cm.Pause{}
+	}
+	httpapi.WriteJSON(w, http.StatusOK, pauses)
+}
+
+func (s *Server) handlePause(w http.ResponseWriter, r *http.Request) {
+	var req PauseRequest
+	if !httpapi.Decode(w, r, &req) {
+		return
+	}
+	p := cm.Pause{Namespace: req.Namespace, Issuer: req.Issuer, Reason: req.Reason, Actor: actor(r), Since: s.clock.Now()}
+	s.pauses.Pause(p)
+	s.changed(w, audit.ActionPause, p)
+}
+
+func (s *Server) handleResume(w http.ResponseWriter, r *http.Request) {
+	var req PauseRequest
+	if !httpapi.Decode(w, r, &req) {
+		return
+	}
+	if !s.pauses.Resume(req.Namespace, req.Issuer) {
+		httpapi.WriteError(w, http.StatusNotFound, errors.New("not paused"))
+		return
+	}
+	s.changed(w, audit.ActionResume, cm.Pause{Namespace: req.Namespace, Issuer: req.Issuer, Reason: req.Reason, Actor: actor(r)})
+}
+
+// changed audits and persists a pause or resume and responds with the pauses
+// now in force
+func (s *Server) changed(w http.ResponseWriter, action audit.Action, p cm.Pause) {
+	s.log.Info("Pauses changed", "action", action, "namespace", p.Namespace, "issuer", p.Issuer, "actor", p.Actor, "reason", p.Reason)
+	err := s.save()
+	if err != nil {
+		s.log.Error(err, "Error saving pauses", "file", s.stateFile)
+	}
+	s.audit(action, p, err)
+	if err != nil {
+		httpapi.WriteError(w, http.StatusInternalServerError, fmt.Errorf("%s applied but not saved: %w", action, err))
+		return
+	}
+	s.handlePauses(w, nil)
+}
+
+func (s *Server) audit(action audit.Action, p cm.Pause, err error) {
+	if s.auditLog == nil {
+		return
+	}
+	r := audit.Record{
+		Time:   s.clock.Now(),
+		Actor:  p.Actor,
+		Action: action,
+		Object: audit.Object{Kind: KindPause, Namespace: p.Namespace, Name: p.Issuer},
+		Reason: p.Reason,
+	}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	if err := s.auditLog.Record(r); err != nil {
+		s.log.Error(err, "Error writing audit record", "action", action)
+	}
+}
+
+func (s *Server) handleReset(w http.ResponseWriter, r *http.Request) {
+	var req ObjectRequest
+	watcher, ok := s.object(w, r, &req)
+	if !ok {
+		return
+	}
+	log := s.log.WithValues("cluster", req.Cluster, "kind", req.Kind, "namespace", req.Namespace, "name", req.Name)
+	result, err := watcher.Reset(r.Context(), cm.Finding{Kind: req.Kind, Namespace: req.Namespace, Name: req.Name}, cm.ResetOptions{Force: true, Actor: actor(r)})
+	if err != nil {
+		log.Error(err, "Error forcing reset")
+		httpapi.WriteError(w, httpapi.StatusOf(err), err)
+		return
+	}
+	log.Info("Forced reset", "result", result)
+	httpapi.WriteJSON(w, http.StatusOK, map[string]cm.ResetResult{"result": result})
+}
+
+func (s *Server) handleClearBackoff(w http.ResponseWriter, r *http.Request) {
+	var req ObjectRequest
+	watcher, ok := s.object(w, r, &req)
+	if !ok {
+		return
+	}
+	log := s.log.WithValues("cluster", req.Cluster, "kind", req.Kind, "namespace", req.Namespace, "name", req.Name)
+	if err := watcher.ClearBackoff(r.Context(), req.Kind, req.Namespace, req.Name, actor(r)); err != nil {
+		log.Error(err, "Error clearing backoff")
+		httpapi.WriteError(w, httpapi.StatusOf(err), err)
+		return
+	}
+	log.Info("Cleared backoff")
+	httpapi.WriteJSON(w, http.StatusOK, map[string]string{"result": "cleared"})
+}
+
+func (s *Server) handleQueue(w http.ResponseWriter, _ *http.Request) {
+	queue := []cm.QueuedReset{}
+	names := make([]string, 0, len(s.watchers))
+	for name := range s.watchers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		queue = append(queue, s.watchers[name].Queue()...)
+	}
+	httpapi.WriteJSON(w, http.StatusOK, queue)
+}
+
+// object reads a request naming an object and returns the watcher of its cluster
+func (s *Server) object(w http.ResponseWriter, r *http.Request, req *ObjectRequest) (*cm.Watcher, bool) {
+	if !httpapi.Decode(w, r, req) {
+		return nil, false
+	}
+	watcher, ok := s.watchers[req.Cluster]
+	if !ok {
+		httpapi.WriteError(w, http.StatusNotFound, fmt.Errorf("unknown cluster %q", req.Cluster))
+		return nil, false
+	}
+	return watcher, true
+}
+
+// authorized only lets requests with the server's token through
+func (s *Server) authorized(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !httpapi.ValidToken(r, s.token) {
+			httpapi.WriteError(w, http.StatusUnauthorized, errors.New("invalid token"))
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// actor is who made a request, named by its X-Actor header
+func actor(r *http.Request) string {
+	if name := strings.TrimSpace(r.Header.Get("X-Actor")); name != "" {
+		return ActorAdmin + ":" + name
+	}
+	return ActorAdmin
+}
@@ -0,0 +1,111 @@
+package admin_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/artificialinc/cm-429-fixer/pkg/admin"
+	"github.com/artificialinc/cm-429-fixer/pkg/audit"
+	"github.com/artificialinc/cm-429-fixer/pkg/cm"
+	acmev1 "github.com/cert-manager/cert-manager/pkg/apis/acme/v1"
+	"github.com/cert-manager/cert-manager/pkg/client/clientset/versioned/fake"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clocktesting "k8s.io/utils/clock/testing"
+)
+
+// do sends a request as alice and decodes the response into v, if given
+func do(t *testing.T, method, url, token string, body, v interface{}) int {
+	t.Helper()
+	var r bytes.Buffer
+	if body != nil {
+		assert.NoError(t, json.NewEncoder(&r).Encode(body))
+	}
+	req, err := http.NewRequest(method, url, &r)
+	assert.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("X-Actor", "alice")
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	if v != nil {
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(v))
+	}
+	return resp.StatusCode
+}
+
+func TestServer(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	order := &acmev1.Order{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "order1",
+			Namespace:   "default",
+			Annotations: map[string]string{cm.AnnotationAttempts: "5", cm.AnnotationLastReset: now.Format(time.RFC3339)},
+		},
+		Status: acmev1.OrderStatus{State: acmev1.Errored, Reason: "429 rateLimited"},
+	}
+	client := fake.NewSimpleClientset(order)
+	var log bytes.Buffer
+	auditLog := audit.New(audit.NewWriterSink(&log))
+	pauses := cm.NewPauses()
+	w := cm.NewWatcher(cm.WithClient(client), cm.WithCluster("c1"), cm.WithPauses(pauses), cm.WithAudit(auditLog))
+	state := filepath.Join(t.TempDir(), "state.json")
+	opts := []admin.Option{admin.WithStateFile(state), admin.WithAudit(auditLog), admin.WithClock(clocktesting.NewFakePassiveClock(now))}
+	srv := httptest.NewServer(admin.NewServer(map[string]*cm.Watcher{"c1": w}, pauses, "secret", opts...).Handler())
+	defer srv.Close()
+
+	// Every endpoint needs the token
+	assert.Equal(t, http.StatusUnauthorized, do(t, http.MethodGet, srv.URL+"/pauses", "wrong", nil, nil))
+	assert.Equal(t, http.StatusUnauthorized, do(t, http.MethodPost, srv.URL+"/pause", "", admin.PauseRequest{}, nil))
+
+	var listed []cm.Pause
+	assert.Equal(t, http.StatusOK, do(t, http.MethodPost, srv.URL+"/pause", "secret", admin.PauseRequest{Namespace: "default", Reason: "incident"}, &listed))
+	paused := cm.Pause{Namespace: "default", Reason: "incident", Actor: "admin:alice", Since: now}
+	assert.Equal(t, []cm.Pause{paused}, listed)
+	result, err := w.ResetOrder(ctx, "default", "order1", cm.ResetOptions{DryRun: true})
+	assert.NoError(t, err)
+	assert.Equal(t, cm.ResetPaused, result)
+
+	// Pauses survive a restart
+	restored := cm.NewPauses()
+	assert.NoError(t, admin.NewServer(nil, restored, "secret", opts...).Load())
+	assert.Equal(t, []cm.Pause{paused}, restored.List())
+
+	var queue []cm.QueuedReset
+	assert.Equal(t, http.StatusOK, do(t, http.MethodGet, srv.URL+"/queue", "secret", nil, &queue))
+	assert.Empty(t, queue)
+
+	// Objects can still be acted on while paused
+	object := admin.ObjectRequest{Cluster: "c1", Kind: "Order", Namespace: "default", Name: "order1"}
+	assert.Equal(t, http.StatusOK, do(t, http.MethodPost, srv.URL+"/clear-backoff", "secret", object, nil))
+	o, err := client.AcmeV1().Orders("default").Get(ctx, "order1", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, cm.RetryState{}, cm.RetryStateOf(o.ObjectMeta))
+	var reset map[string]cm.ResetResult
+	assert.Equal(t, http.StatusOK, do(t, http.MethodPost, srv.URL+"/reset", "secret", object, &reset))
+	assert.Equal(t, cm.ResetDone, reset["result"])
+	assert.Equal(t, http.StatusNotFound, do(t, http.MethodPost, srv.URL+"/reset", "secret", admin.ObjectRequest{Cluster: "c2"}, nil))
+
+	assert.Equal(t, http.StatusOK, do(t, http.MethodPost, srv.URL+"/resume", "secret", admin.PauseRequest{Namespace: "default"}, &listed))
+	assert.Empty(t, listed)
+	assert.Equal(t, http.StatusNotFound, do(t, http.MethodPost, srv.URL+"/resume", "secret", admin.PauseRequest{Namespace: "default"}, nil))
+	assert.NoError(t, admin.NewServer(nil, restored, "secret", opts...).Load())
+	assert.Empty(t, restored.List())
+
+	var actions []audit.Action
+	dec := json.NewDecoder(&log)
+	for dec.More() {
+		var r audit.Record
+		assert.NoError(t, dec.Decode(&r))
+		assert.Equal(t, "admin:alice", r.Actor)
+		actions = append(actions, r.Action)
+	}
+	assert.Equal(t, []audit.Action{audit.ActionPause, audit.ActionAnnotate, audit.ActionReset, audit.ActionResume}, actions)
+}
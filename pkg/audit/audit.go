@@ -0,0 +1,122 @@
+// Package audit keeps an append-only record of the changes the fixer makes to
+// other people's resources, separate from its application log
+package audit
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Action is the kind of change a record is about
+type Action string
+
+const (
+	// ActionReset is an Order or Challenge set back to pending
+	ActionReset Action = "reset"
+	// ActionDryRun is a reset that was decided on but not made
+	ActionDryRun Action = "dry-run"
+	// ActionAnnotate is a change to an object's annotations, such as a hold
+	// on a Certificate or the webhook's rate limit note
+	ActionAnnotate Action = "annotate"
+	// ActionDelete is an object deleted by the fixer
+	ActionDelete Action = "delete"
+	// ActionDeny is a new object rejected by the webhook
+	ActionDeny Action = "deny"
+	// ActionPause is a pause of the fixer's changes, globally or of a
+	// namespace or issuer
+	ActionPause Action = "pause"
+	// ActionResume is a pause lifted
+	ActionResume Action = "resume"
+)
+
+// Object identifies the object a record is about
+type Object struct {
+	Kind      string `json:"kind"`
+	Namespace string `json:"namespace,omitempty"`
+	Name      string `json:"name"`
+	UID       string `json:"uid,omitempty"`
+}
+
+// Record is a single change, or decision not to change, made by the fixer
+type Record struct {
+	Time    time.Time `json:"time"`
+	Cluster string    `json:"cluster,omitempty"`
+	// Actor is who made the change, the watcher or the user of a command
+	Actor  string `json:"actor"`
+	Action Action `json:"action"`
+	Object Object `json:"object"`
+	// ResourceVersionBefore and ResourceVersionAfter are the object's
+	// resourceVersion before and after the change, if known
+	ResourceVersionBefore string `json:"resourceVersionBefore,omitempty"`
+	ResourceVersionAfter  string `json:"resourceVersionAfter,omitempty"`
+	// Rule is the retry policy or setting that led to the change
+	Rule string `json:"rule,omitempty"`
+	// Reason is why the change was made, usually the object's failure reason
+	Reason string `json:"reason,omitempty"`
+	// Error is set if the change failed, the object may have been changed
+	// in part
+	Error string `json:"error,omitempty"`
+}
+
+// Sink stores records, each written as a single line of JSON
+type Sink interface {
+	Write(line []byte) error
+	Close() error
+}
+
+// Log writes records to every sink. A nil Log discards them.
+type Log struct {
+	mu    sync.Mutex
+	sinks []Sink
+	now   func() time.Time
+}
+
+// New creates a log writing to the sinks
+func New(sinks ...Sink) *Log {
+	return &Log{sinks: sinks, now: time.Now}
+}
+
+// Record writes the record to every sink, setting its time if unset. Records
+// are written one at a time, so sinks see them in order.
+func (l *Log) Record(r Record) error {
+	if l == nil {
+		return nil
+	}
+	if r.Time.IsZero() {
+		r.Time = l.now()
+	}
+	r.Time = r.Time.UTC()
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var errs []error
+	for _, s := range l.sinks {
+		if err := s.Write(line); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Close closes every sink
+func (l *Log) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var errs []error
+	for _, s := range l.sinks {
+		if err := s.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
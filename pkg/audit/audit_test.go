@@ -0,0 +1,208 @@
+package audit_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/artificialinc/cm-429-fixer/pkg/audit"
+	"github.com/stretchr/testify/assert"
+)
+
+func record(name string) audit.Record {
+	return audit.Record{
+		Time:   time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		Actor:  "watcher",
+		Action: audit.ActionReset,
+		Object: audit.Object{Kind: "Order", Namespace: "default", Name: name},
+	}
+}
+
+func TestLog(t *testing.T) {
+	var stdout bytes.Buffer
+	var (
+		mu       sync.Mutex
+		received []audit.Record
+		fail     bool
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer token", r.Header.Get("Authorization"))
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		var rec audit.Record
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&rec))
+		mu.Lock()
+		defer mu.Unlock()
+		if fail {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		received = append(received, rec)
+	}))
+	defer srv.Close()
+
+	l := audit.New(
+		audit.NewWriterSink(&stdout),
+		audit.NewHTTPSink(srv.URL, http.Header{"Authorization": {"Bearer token"}}, time.Second),
+	)
+	assert.NoError(t, l.Record(record("order1")))
+
+	// A failing sink doesn't keep the record from the others
+	mu.Lock()
+	fail = true
+	mu.Unlock()
+	assert.Error(t, l.Record(record("order2")))
+	assert.NoError(t, l.Close())
+
+	lines := strings.Split(strings.TrimSpace(stdout.String()), "\n")
+	assert.Len(t, lines, 2)
+	var first audit.Record
+	assert.NoError(t, json.Unmarshal([]byte(lines[0]), &first))
+	assert.Equal(t, record("order1"), first)
+	assert.Equal(t, []audit.Record{record("order1")}, received)
+
+	// A nil log discards records
+	var discard *audit.Log
+	assert.NoError(t, discard.Record(record("order1")))
+}
+
+func TestFileSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	line := []byte(strings.Repeat("x", 9) + "\n")
+
+	// Room for two records per file, keeping two backups
+	s, err := audit.NewFileSink(path, 20, 2)
+	assert.NoError(t, err)
+	for i := 0; i < 7; i++ {
+		assert.NoError(t, s.Write(line))
+	}
+	assert.NoError(t, s.Close())
+
+	size := func(name string) int {
+		b, err := os.ReadFile(name)
+		if err != nil {
+			return -1
+		}
+		return len(b)
+	}
+	assert.Equal(t, 10, size(path))
+	assert.Equal(t, 20, size(path+".1"))
+	assert.Equal(t, 20, size(path+".2"))
+	assert.Equal(t, -1, size(path+".3"))
+
+	// Reopening appends to the current file
+	s, err = audit.NewFileSink(path, 20, 2)
+	assert.NoError(t, err)
+	assert.NoError(t, s.Write(line))
+	assert.NoError(t, s.Close())
+	assert.Equal(t, 20, size(path))
+	b, err := os.ReadFile(path + ".1")
+	assert.NoError(t, err)
+	assert.Equal(t, append(line, line...), b)
+}
+
+func TestFileSinkRotateErrors(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "audit.log")
+	line := []byte(strings.Repeat("x", 9) + "\n")
+
+	// Rotating without a backup would delete the records
+	_, err := audit.NewFileSink(path, 20, 0)
+	assert.Error(t, err)
+
+	// A backup that can't be replaced fails the rotation, but records are
+	// still appended to the current file
+	assert.NoError(t, os.MkdirAll(filepath.Join(path+".1", "blocked"), 0o700))
+	s, err := audit.NewFileSink(path, 20, 1)
+	assert.NoError(t, err)
+	assert.NoError(t, s.Write(line))
+	assert.NoError(t, s.Write(line))
+	assert.Error(t, s.Write(line))
+	b, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Len(t, b, 30)
+
+	// Once the backup is out of the way rotating works again
+	assert.NoError(t, os.RemoveAll(path+".1"))
+	assert.NoError(t, s.Write(line))
+	assert.NoError(t, s.Close())
+	b, err = os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, line, b)
+	b, err = os.ReadFile(path + ".1")
+	assert.NoError(t, err)
+	assert.Len(t, b, 30)
+}
+
+// blockingSink waits for every write to be released
+type blockingSink struct {
+	release chan error
+	mu      sync.Mutex
+	lines   []string
+	closed  bool
+}
+
+func (s *blockingSink) Write(line []byte) error {
+	err := <-s.release
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err == nil {
+		s.lines = append(s.lines, string(line))
+	}
+	return err
+}
+
+func (s *blockingSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	return nil
+}
+
+func TestAsyncSink(t *testing.T) {
+	slow := &blockingSink{release: make(chan error)}
+	var (
+		mu   sync.Mutex
+		errs []error
+	)
+	s := audit.NewAsyncSink(slow, 1, func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		errs = append(errs, err)
+	})
+	l := audit.New(s)
+
+	// Recording doesn't wait for the sink, until the buffer is full
+	assert.NoError(t, l.Record(record("order1")))
+	assert.Eventually(t, func() bool { return l.Record(record("order2")) == nil }, time.Second, time.Millisecond)
+	assert.EqualError(t, l.Record(record("order3")), "audit buffer full, record dropped")
+	slow.release <- nil
+
+	// Closing gives up on the buffered records once one fails
+	assert.Eventually(t, func() bool { return l.Record(record("order4")) == nil }, time.Second, time.Millisecond)
+	closed := make(chan error)
+	go func() { closed <- l.Close() }()
+	assert.Eventually(t, func() bool {
+		err := s.Write([]byte("{}\n"))
+		return err != nil && err.Error() == "audit sink closed"
+	}, time.Second, time.Millisecond)
+	slow.release <- errors.New("unavailable")
+	assert.NoError(t, <-closed)
+
+	assert.Len(t, slow.lines, 1)
+	assert.Contains(t, slow.lines[0], "order1")
+	assert.True(t, slow.closed)
+	mu.Lock()
+	defer mu.Unlock()
+	if assert.Len(t, errs, 2) {
+		assert.EqualError(t, errs[0], "unavailable")
+		assert.EqualError(t, errs[1], "dropped 1 audit records")
+	}
+}
@@ -0,0 +1,238 @@
+package audit
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// writerSink writes records to a writer such as stdout
+type writerSink struct {
+	w io.Writer
+}
+
+// NewWriterSink returns a sink writing records to w, which isn't closed
+func NewWriterSink(w io.Writer) Sink {
+	return &writerSink{w: w}
+}
+
+func (s *writerSink) Write(line []byte) error {
+	_, err := s.w.Write(line)
+	return err
+}
+
+func (s *writerSink) Close() error {
+	return nil
+}
+
+// FileSink appends records to a file. When the file would grow past its max
+// size it is rotated: path is renamed to path.1, path.1 to path.2 and so on,
+// keeping max backups.
+type FileSink struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	// f is nil once rotating closed it, until the next write reopens it
+	f    *os.File
+	size int64
+}
+
+// NewFileSink opens the file for appending. A max size of 0 never rotates,
+// otherwise at least one backup must be kept.
+func NewFileSink(path string, maxSize int64, maxBackups int) (*FileSink, error) {
+	if maxSize > 0 && maxBackups < 1 {
+		return nil, errors.New("rotating the audit file needs at least one backup")
+	}
+	s := &FileSink{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *FileSink) open() error {
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	s.f, s.size = f, info.Size()
+	return nil
+}
+
+// Write appends the line, rotating the file first if needed. A failed
+// rotation is returned, but the line is still appended to the current file.
+func (s *FileSink) Write(line []byte) error {
+	var rotateErr error
+	if s.f != nil && s.maxSize > 0 && s.size > 0 && s.size+int64(len(line)) > s.maxSize {
+		if err := s.rotate(); err != nil {
+			rotateErr = fmt.Errorf("rotating audit log: %w", err)
+		}
+	}
+	if s.f == nil {
+		if err := s.open(); err != nil {
+			return errors.Join(rotateErr, err)
+		}
+	}
+	n, err := s.f.Write(line)
+	s.size += int64(n)
+	return errors.Join(rotateErr, err)
+}
+
+// rotate closes the file and shifts the backups. The file is reopened by the
+// caller, even if shifting failed.
+func (s *FileSink) rotate() error {
+	err := s.f.Close()
+	s.f = nil
+	if err != nil {
+		return err
+	}
+	backup := func(i int) string {
+		return s.path + "." + strconv.Itoa(i)
+	}
+	_ = os.Remove(backup(s.maxBackups))
+	for i := s.maxBackups - 1; i > 0; i-- {
+		if err := os.Rename(backup(i), backup(i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Rename(s.path, backup(1))
+}
+
+// Close closes the file
+func (s *FileSink) Close() error {
+	if s.f == nil {
+		return nil
+	}
+	return s.f.Close()
+}
+
+// asyncSink writes records to another sink in the background
+type asyncSink struct {
+	sink    Sink
+	onError func(error)
+	lines   chan []byte
+	done    chan struct{}
+
+	mu      sync.Mutex
+	closed  bool
+	closing chan struct{}
+}
+
+// NewAsyncSink returns a sink buffering up to size records for s, which are
+// written in the background so a slow sink such as an HTTP endpoint doesn't
+// hold up the changes being recorded. Records that don't fit in the buffer
+// are dropped with an error. Errors of s are passed to onError.
+func NewAsyncSink(s Sink, size int, onError func(error)) Sink {
+	a := &asyncSink{
+		sink:    s,
+		onError: onError,
+		lines:   make(chan []byte, size),
+		done:    make(chan struct{}),
+		closing: make(chan struct{}),
+	}
+	go a.run()
+	return a
+}
+
+func (a *asyncSink) run() {
+	defer close(a.done)
+	for line := range a.lines {
+		err := a.sink.Write(line)
+		if err == nil {
+			continue
+		}
+		a.onError(err)
+		// Once closing, the records left are dropped rather than waiting for
+		// each of them to fail too
+		select {
+		case <-a.closing:
+			if n := len(a.lines); n > 0 {
+				for range a.lines {
+				}
+				a.onError(fmt.Errorf("dropped %d audit records", n))
+			}
+		default:
+		}
+	}
+}
+
+func (a *asyncSink) Write(line []byte) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		return errors.New("audit sink closed")
+	}
+	select {
+	case a.lines <- line:
+		return nil
+	default:
+		return errors.New("audit buffer full, record dropped")
+	}
+}
+
+// Close writes the buffered records, giving up at the first that fails, and
+// closes the sink
+func (a *asyncSink) Close() error {
+	a.mu.Lock()
+	if !a.closed {
+		a.closed = true
+		close(a.closing)
+		close(a.lines)
+	}
+	a.mu.Unlock()
+	<-a.done
+	return a.sink.Close()
+}
+
+// httpSink posts every record to an HTTP endpoint
+type httpSink struct {
+	url    string
+	header http.Header
+	client *http.Client
+}
+
+// NewHTTPSink returns a sink posting each record as a JSON body to the URL
+// with the given headers, e.g. for authorization. Responses other than 2xx
+// are errors.
+func NewHTTPSink(url string, header http.Header, timeout time.Duration) Sink {
+	return &httpSink{url: url, header: header, client: &http.Client{Timeout: timeout}}
+}
+
+func (s *httpSink) Write(line []byte) error {
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, s.url, bytes.NewReader(line))
+	if err != nil {
+		return err
+	}
+	for k, v := range s.header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("audit endpoint %s returned %s", s.url, resp.Status)
+	}
+	return nil
+}
+
+func (s *httpSink) Close() error {
+	s.client.CloseIdleConnections()
+	return nil
+}
@@ -0,0 +1,50 @@
+package cm
+
+import (
+	"context"
+	"fmt"
+
+	cmapi "github.com/cert-manager/cert-manager/pkg/apis/certmanager/v1"
+	cmmeta "github.com/cert-manager/cert-manager/pkg/apis/meta/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// account returns the ACME account an object referencing the given issuer is
+// registered with. The account URI is read from the issuer status so that
+// watchers of different clusters sharing an account agree on the key. When
+// the issuer can't be read the key falls back to the cluster and issuer name.
+func (w *Watcher) account(ctx context.Context, namespace string, ref cmmeta.ObjectReference) string {
+	fallback := fmt.Sprintf("%s/%s/%s/%s", w.cluster, ref.Kind, namespace, ref.Name)
+	if ref.Group != "" && ref.Group != cmapi.SchemeGroupVersion.Group {
+		// External issuers don't expose an ACME account
+		return fallback
+	}
+
+	_, status, err := w.issuer(ctx, namespace, ref)
+	if err != nil {
+		w.log.V(1).Info("Unable to get issuer", "issuer", issuerName(ref), "namespace", namespace, "error", err.Error())
+		return fallback
+	}
+
+	if status.ACME == nil || status.ACME.URI == "" {
+		return fallback
+	}
+	return status.ACME.URI
+}
+
+// issuer returns the metadata and status of the Issuer or ClusterIssuer the
+// reference points to
+func (w *Watcher) issuer(ctx context.Context, namespace string, ref cmmeta.ObjectReference) (metav1.ObjectMeta, cmapi.IssuerStatus, error) {
+	if ref.Kind == cmapi.ClusterIssuerKind {
+		iss, err := w.c.CertmanagerV1().ClusterIssuers().Get(ctx, ref.Name, metav1.GetOptions{})
+		if err != nil {
+			return metav1.ObjectMeta{}, cmapi.IssuerStatus{}, err
+		}
+		return iss.ObjectMeta, iss.Status, nil
+	}
+	iss, err := w.c.CertmanagerV1().Issuers(namespace).Get(ctx, ref.Name, metav1.GetOptions{})
+	if err != nil {
+		return metav1.ObjectMeta{}, cmapi.IssuerStatus{}, err
+	}
+	return iss.ObjectMeta, iss.Status, nil
+}
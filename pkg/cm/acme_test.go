@@ -0,0 +1,102 @@
+package cm_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/artificialinc/cm-429-fixer/pkg/acmetest"
+	"github.com/artificialinc/cm-429-fixer/pkg/cm"
+	acmev1 "github.com/cert-manager/cert-manager/pkg/apis/acme/v1"
+	"github.com/cert-manager/cert-manager/pkg/client/clientset/versioned/fake"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// dueOf returns when the queued reset of an object is due
+func dueOf(w *cm.Watcher, name string) (time.Time, bool) {
+	for _, q := range w.Queue() {
+		if q.Name == name {
+			return q.Due, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// TestWatcherACME runs the watcher against scripted ACME rate limits, with
+// the harness standing in for cert-manager
+func TestWatcherACME(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	client := fake.NewSimpleClientset(
+		&acmev1.Order{
+			ObjectMeta: metav1.ObjectMeta{Name: "created", Namespace: "default"},
+			Spec:       acmev1.OrderSpec{DNSNames: []string{"a.example.com"}},
+		},
+		&acmev1.Order{
+			ObjectMeta: metav1.ObjectMeta{Name: "finalized", Namespace: "other"},
+			Spec:       acmev1.OrderSpec{DNSNames: []string{"b.example.com"}},
+		},
+	)
+	h := acmetest.NewHarness(t, client)
+	_, err := client.AcmeV1().Challenges("default").Create(ctx, &acmev1.Challenge{
+		ObjectMeta: metav1.ObjectMeta{Name: "challenge1", Namespace: "default"},
+		Spec:       acmev1.ChallengeSpec{URL: h.Server.ChallengeURL("challenge1"), Type: acmev1.ACMEChallengeTypeHTTP01},
+	}, metav1.CreateOptions{})
+	assert.NoError(t, err)
+
+	// Creating the first order is limited until the retry after time, the
+	// second fails finalizing twice without one, and so does the challenge
+	clk := newTestClock()
+	retryAfter := clk.Now().Add(time.Hour)
+	h.Server.ScriptFor(acmetest.NewOrder, "a.example.com", acmetest.RateLimited(retryAfter))
+	h.Server.ScriptFor(acmetest.Finalize, "b.example.com", acmetest.RateLimited(time.Time{}), acmetest.RateLimited(time.Time{}))
+	h.Server.ScriptFor(acmetest.Challenge, "challenge1", acmetest.RateLimited(time.Time{}), acmetest.RateLimited(time.Time{}))
+
+	w := cm.NewWatcher(cm.WithClient(client), cm.WithClock(clk), cm.WithUpdateDelay(time.Minute))
+	clk.run(t, ctx, w)
+	go h.Run(ctx, 20*time.Millisecond)
+
+	// Limits without a retry after time are retried after the watcher's
+	// delay, and then its backoff
+	for attempt := 1; attempt <= 2; attempt++ {
+		waitFor(t, func() bool { return len(w.Queue()) == 3 })
+		due, ok := dueOf(w, "finalized")
+		assert.True(t, ok)
+		clk.step(due.Sub(clk.Now()))
+		waitFor(t, func() bool {
+			o, err := client.AcmeV1().Orders("other").Get(ctx, "finalized", metav1.GetOptions{})
+			if err != nil || cm.RetryStateOf(o.ObjectMeta).Attempts != attempt || o.Status.State == acmev1.Pending {
+				return false
+			}
+			c, err := client.AcmeV1().Challenges("default").Get(ctx, "challenge1", metav1.GetOptions{})
+			return err == nil && cm.RetryStateOf(c.ObjectMeta).Attempts == attempt && c.Status.State != acmev1.Pending
+		})
+	}
+	waitFor(t, orderState(ctx, client, "other", "finalized", acmev1.Valid))
+	waitFor(t, func() bool {
+		c, err := client.AcmeV1().Challenges("default").Get(ctx, "challenge1", metav1.GetOptions{})
+		return err == nil && c.Status.State == acmev1.Valid
+	})
+	assert.Len(t, h.Server.RequestsFor(acmetest.Finalize, "b.example.com"), 3)
+	assert.Len(t, h.Server.RequestsFor(acmetest.Challenge, "challenge1"), 3)
+
+	// The first order isn't retried before the server's retry after time
+	assert.True(t, orderState(ctx, client, "default", "created", acmev1.Errored)())
+	assert.Len(t, h.Server.RequestsFor(acmetest.NewOrder, "a.example.com"), 1)
+	due, ok := dueOf(w, "created")
+	if assert.True(t, ok) {
+		assert.False(t, due.Before(retryAfter), "due at %v, before %v", due, retryAfter)
+	}
+	clk.step(due.Sub(clk.Now()) - time.Second)
+	clk.settle()
+	assert.True(t, orderState(ctx, client, "default", "created", acmev1.Errored)())
+	clk.step(time.Second)
+	waitFor(t, orderState(ctx, client, "default", "created", acmev1.Valid))
+	assert.Len(t, h.Server.RequestsFor(acmetest.NewOrder, "a.example.com"), 2)
+	created, err := client.AcmeV1().Orders("default").Get(ctx, "created", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, cm.RetryStateOf(created.ObjectMeta).Attempts)
+}
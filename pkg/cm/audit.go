@@ -0,0 +1,34 @@
+package cm
+
+import (
+	"github.com/artificialinc/cm-429-fixer/pkg/audit"
+)
+
+// ActorWatcher is the actor of the changes the watcher makes on its own
+const ActorWatcher = "watcher"
+
+// WithAudit records every reset, dry-run decision, annotation and deletion the
+// watcher makes in the audit log
+func WithAudit(l *audit.Log) Option {
+	return func(w *Watcher) {
+		w.auditLog = l
+	}
+}
+
+// audit records a change in the audit log, logging errors
+func (w *Watcher) audit(r audit.Record, err error) {
+	if w.auditLog == nil {
+		return
+	}
+	r.Time = w.clock.Now()
+	r.Cluster = w.cluster
+	if r.Actor == "" {
+		r.Actor = ActorWatcher
+	}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	if err := w.auditLog.Record(r); err != nil {
+		w.log.Error(err, "Error writing audit record", "action", r.Action, "kind", r.Object.Kind, "name", r.Object.Name, "namespace", r.Object.Namespace)
+	}
+}
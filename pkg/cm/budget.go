@@ -0,0 +1,81 @@
+package cm
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Budget limits how many resets may be issued per ACME account. A single
+// Budget can be shared by several watchers so that clusters registered with
+// the same account draw from the same allowance.
+type Budget struct {
+	limit rate.Limit
+	burst int
+
+	mu       sync.Mutex
+	limiters map[string]*rate.Limiter
+}
+
+// NewBudget creates a budget that allows limit resets per second per account,
+// with bursts of up to burst resets
+func NewBudget(limit rate.Limit, burst int) *Budget {
+	return &Budget{
+		limit:    limit,
+		burst:    burst,
+		limiters: map[string]*rate.Limiter{},
+	}
+}
+
+// Reserve takes one reset from the account's budget and returns how long the
+// caller has to wait before performing it. A nil budget never waits.
+func (b *Budget) Reserve(account string) time.Duration {
+	if b == nil {
+		return 0
+	}
+	return b.limiter(account).Reserve().Delay()
+}
+
+func (b *Budget) limiter(account string) *rate.Limiter {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	l, ok := b.limiters[account]
+	if !ok {
+		l = rate.NewLimiter(b.limit, b.burst)
+		b.limiters[account] = l
+	}
+	return l
+}
+
+// BudgetUsage is how much of an account's reset budget is left
+type BudgetUsage struct {
+	Account string `json:"account"`
+	// Available is the number of resets that may be issued right away
+	Available float64 `json:"available"`
+	Burst     int     `json:"burst"`
+	PerHour   float64 `json:"perHour"`
+}
+
+// Usage returns the budget left for every account that has drawn from it,
+// sorted by account. A nil budget has no usage.
+func (b *Budget) Usage(now time.Time) []BudgetUsage {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	usage := make([]BudgetUsage, 0, len(b.limiters))
+	for account, l := range b.limiters {
+		usage = append(usage, BudgetUsage{
+			Account:   account,
+			Available: l.TokensAt(now),
+			Burst:     b.burst,
+			PerHour:   float64(b.limit) * time.Hour.Seconds(),
+		})
+	}
+	sort.Slice(usage, func(i, j int) bool { return usage[i].Account < usage[j].Account })
+	return usage
+}
@@ -0,0 +1,38 @@
+package cm_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/artificialinc/cm-429-fixer/pkg/cm"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/time/rate"
+)
+
+func TestBudget(t *testing.T) {
+	b := cm.NewBudget(rate.Every(time.Hour), 2)
+
+	// Burst is available immediately
+	assert.Equal(t, time.Duration(0), b.Reserve("acct1"))
+	assert.Equal(t, time.Duration(0), b.Reserve("acct1"))
+	// Exhausted budget delays further resets
+	assert.Greater(t, b.Reserve("acct1"), 50*time.Minute)
+	// Other accounts are unaffected
+	assert.Equal(t, time.Duration(0), b.Reserve("acct2"))
+
+	// Usage shows the reset queued on the first account
+	usage := b.Usage(time.Now())
+	if assert.Len(t, usage, 2) {
+		assert.Equal(t, "acct1", usage[0].Account)
+		assert.InDelta(t, -1, usage[0].Available, 0.01)
+		assert.Equal(t, "acct2", usage[1].Account)
+		assert.InDelta(t, 1, usage[1].Available, 0.01)
+		assert.Equal(t, 2, usage[1].Burst)
+		assert.InDelta(t, 1, usage[1].PerHour, 0.001)
+	}
+
+	// A nil budget never waits
+	var nilBudget *cm.Budget
+	assert.Equal(t, time.Duration(0), nilBudget.Reserve("acct1"))
+	assert.Empty(t, nilBudget.Usage(time.Now()))
+}
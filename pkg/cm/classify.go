@@ -0,0 +1,75 @@
+package cm
+
+import (
+	"regexp"
+	"strings"
+	"time"
+
+	acmev1 "github.com/cert-manager/cert-manager/pkg/apis/acme/v1"
+)
+
+// Category is the kind of failure described by an object's reason
+type Category string
+
+const (
+	// CategoryNone is used for objects that have not failed
+	CategoryNone Category = ""
+	// CategoryRateLimited is used for failures caused by ACME rate limits
+	CategoryRateLimited Category = "RateLimited"
+	// CategoryOther is used for any other failure
+	CategoryOther Category = "Other"
+)
+
+// Verdict is the result of classifying an object
+type Verdict struct {
+	Category Category
+	// RetryAfter is the time the ACME server asked us to wait until, zero if
+	// the reason didn't include one
+	RetryAfter time.Time
+}
+
+// RateLimited returns true if the verdict is a rate limit
+func (v Verdict) RateLimited() bool {
+	return v.Category == CategoryRateLimited
+}
+
+var retryAfterRe = regexp.MustCompile(`(?i)retry after (\d{4}-\d{2}-\d{2}[ T]\d{2}:\d{2}:\d{2}(?:Z| UTC|[+-]\d{2}:\d{2})?)`)
+
+var retryAfterLayouts = []string{
+	"2006-01-02 15:04:05 MST",
+	"2006-01-02 15:04:05",
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+}
+
+// Classify classifies the state and reason of an ACME Order or Challenge
+func Classify(state acmev1.State, reason string) Verdict {
+	if state != acmev1.Errored {
+		return Verdict{Category: CategoryNone}
+	}
+	return ClassifyReason(reason)
+}
+
+// ClassifyReason classifies a failure reason or condition message
+func ClassifyReason(reason string) Verdict {
+	if !strings.Contains(reason, "429") && !strings.Contains(reason, "rateLimited") {
+		return Verdict{Category: CategoryOther}
+	}
+	return Verdict{
+		Category:   CategoryRateLimited,
+		RetryAfter: parseRetryAfter(reason),
+	}
+}
+
+func parseRetryAfter(reason string) time.Time {
+	m := retryAfterRe.FindStringSubmatch(reason)
+	if m == nil {
+		return time.Time{}
+	}
+	for _, layout := range retryAfterLayouts {
+		if t, err := time.Parse(layout, m[1]); err == nil {
+			return t.UTC()
+		}
+	}
+	return time.Time{}
+}
@@ -0,0 +1,63 @@
+package cm_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/artificialinc/cm-429-fixer/pkg/cm"
+	acmev1 "github.com/cert-manager/cert-manager/pkg/apis/acme/v1"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClassify(t *testing.T) {
+	type test struct {
+		name       string
+		state      acmev1.State
+		reason     string
+		category   cm.Category
+		retryAfter time.Time
+	}
+
+	tests := []test{
+		{
+			name:     "not errored",
+			state:    acmev1.Pending,
+			reason:   "some 429 error",
+			category: cm.CategoryNone,
+		},
+		{
+			name:     "other error",
+			state:    acmev1.Errored,
+			reason:   "some other error",
+			category: cm.CategoryOther,
+		},
+		{
+			name:     "status code",
+			state:    acmev1.Errored,
+			reason:   "some 429 error",
+			category: cm.CategoryRateLimited,
+		},
+		{
+			name:       "problem type with retry after",
+			state:      acmev1.Errored,
+			reason:     "Failed to create Order: 429 urn:ietf:params:acme:error:rateLimited: Error creating new order :: too many certificates (5) already issued for this exact set of domains in the last 168h0m0s, retry after 2024-08-20 12:30:00 UTC: see https://letsencrypt.org/docs/duplicate-certificate-limit/",
+			category:   cm.CategoryRateLimited,
+			retryAfter: time.Date(2024, 8, 20, 12, 30, 0, 0, time.UTC),
+		},
+		{
+			name:       "rfc3339 retry after",
+			state:      acmev1.Errored,
+			reason:     "urn:ietf:params:acme:error:rateLimited: too many new orders recently, retry after 2024-08-20T12:30:00Z",
+			category:   cm.CategoryRateLimited,
+			retryAfter: time.Date(2024, 8, 20, 12, 30, 0, 0, time.UTC),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := cm.Classify(tt.state, tt.reason)
+			assert.Equal(t, tt.category, v.Category)
+			assert.True(t, tt.retryAfter.Equal(v.RetryAfter), "expected %v, got %v", tt.retryAfter, v.RetryAfter)
+		})
+	}
+}
@@ -0,0 +1,32 @@
+package cm
+
+import (
+	"context"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/utils/clock"
+)
+
+// WithClock sets the clock used for reset delays, backoff, retry after
+// times, holds, readiness and the periodic sweeps. Tests use a fake clock to
+// step through them without waiting.
+func WithClock(c clock.WithTickerAndDelayedExecution) Option {
+	return func(w *Watcher) {
+		w.clock = c
+	}
+}
+
+// every calls f every period, on the watcher's clock, until the context is done
+func (w *Watcher) every(ctx context.Context, period time.Duration, f func(context.Context)) {
+	wait.BackoffUntil(func() {
+		f(ctx)
+	}, wait.NewJitteredBackoffManager(period, 0, w.clock), true, ctx.Done())
+}
+
+// sleep waits for the duration on the watcher's clock
+func (w *Watcher) sleep(d time.Duration) {
+	if d > 0 {
+		<-w.clock.After(d)
+	}
+}
@@ -0,0 +1,173 @@
+package cm_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/artificialinc/cm-429-fixer/pkg/cm"
+	acmev1 "github.com/cert-manager/cert-manager/pkg/apis/acme/v1"
+	"github.com/cert-manager/cert-manager/pkg/client/clientset/versioned/fake"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/clock"
+	clocktesting "k8s.io/utils/clock/testing"
+)
+
+// testClock is a fake clock that knows when the watcher last started waiting
+// on it, so tests only step it once the watcher has scheduled its work
+type testClock struct {
+	*clocktesting.FakeClock
+
+	mu         sync.Mutex
+	lastWaiter time.Time
+}
+
+// newTestClock returns a fake clock set to a whole second, so times recorded
+// in annotations with second precision are exact
+func newTestClock() *testClock {
+	return &testClock{FakeClock: clocktesting.NewFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))}
+}
+
+func (c *testClock) After(d time.Duration) <-chan time.Time {
+	ch := c.FakeClock.After(d)
+	c.waited()
+	return ch
+}
+
+func (c *testClock) NewTimer(d time.Duration) clock.Timer {
+	timer := c.FakeClock.NewTimer(d)
+	c.waited()
+	return timer
+}
+
+func (c *testClock) AfterFunc(d time.Duration, f func()) clock.Timer {
+	timer := c.FakeClock.AfterFunc(d, f)
+	c.waited()
+	return timer
+}
+
+func (c *testClock) waited() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lastWaiter = time.Now()
+}
+
+// settle waits until the watcher has stopped scheduling work on the clock,
+// giving it time to react to what happened before the call
+func (c *testClock) settle() {
+	const quiet = 100 * time.Millisecond
+	start := time.Now()
+	for {
+		c.mu.Lock()
+		last := c.lastWaiter
+		c.mu.Unlock()
+		if last.Before(start) {
+			last = start
+		}
+		since := time.Since(last)
+		if since >= quiet {
+			return
+		}
+		time.Sleep(quiet - since)
+	}
+}
+
+// step advances the clock once the watcher has settled
+func (c *testClock) step(d time.Duration) {
+	c.settle()
+	c.Step(d)
+}
+
+// run runs the watcher on the clock until the context is done, and returns
+// once it's ready. The clock is stepped so the readiness ticker fires.
+func (c *testClock) run(t *testing.T, ctx context.Context, w *cm.Watcher) {
+	t.Helper()
+	go w.Run(ctx)
+	ready := make(chan error)
+	go func() {
+		ready <- w.Readiness().Wait(ctx)
+	}()
+	for {
+		select {
+		case err := <-ready:
+			assert.NoError(t, err)
+			return
+		case <-time.After(10 * time.Millisecond):
+			c.Step(time.Second)
+		}
+	}
+}
+
+// waitFor waits for the watcher's updates to satisfy the condition
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	assert.Eventually(t, cond, 10*time.Second, 10*time.Millisecond)
+}
+
+// never checks the condition doesn't become true while the watcher settles
+func (c *testClock) never(t *testing.T, cond func() bool) {
+	t.Helper()
+	c.settle()
+	assert.False(t, cond())
+}
+
+// orderState returns a condition on an order's state
+func orderState(ctx context.Context, client *fake.Clientset, namespace, name string, state acmev1.State) func() bool {
+	return func() bool {
+		o, err := client.AcmeV1().Orders(namespace).Get(ctx, name, metav1.GetOptions{})
+		return err == nil && o.Status.State == state
+	}
+}
+
+func TestWatcherClock(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	clk := newTestClock()
+	retryAfter := clk.Now().Add(10 * time.Minute)
+	client := fake.NewSimpleClientset()
+	w := cm.NewWatcher(cm.WithClient(client), cm.WithClock(clk))
+	clk.run(t, ctx, w)
+
+	// Created once the watcher runs, so the clock stands still from the time
+	// the watcher sees them
+	for _, o := range []*acmev1.Order{
+		buildOrder("backoff", "default", &acmev1.OrderStatus{State: acmev1.Errored, Reason: "429 rateLimited"}),
+		buildOrder("retry-after", "default", &acmev1.OrderStatus{
+			State:  acmev1.Errored,
+			Reason: "429 rateLimited: retry after " + retryAfter.Format("2006-01-02 15:04:05 UTC"),
+		}),
+	} {
+		_, err := client.AcmeV1().Orders("default").Create(ctx, o, metav1.CreateOptions{})
+		assert.NoError(t, err)
+	}
+
+	// The first reset waits for the delay
+	clk.step(cm.DefaultDelay - time.Millisecond)
+	clk.never(t, orderState(ctx, client, "default", "backoff", acmev1.Pending))
+	clk.step(time.Millisecond)
+	waitFor(t, orderState(ctx, client, "default", "backoff", acmev1.Pending))
+	o, err := client.AcmeV1().Orders("default").Get(ctx, "backoff", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, cm.RetryState{Attempts: 1, LastReset: clk.Now()}, cm.RetryStateOf(o.ObjectMeta))
+
+	// The next one backs off to twice the delay since the last reset
+	rateLimitAgain(t, ctx, client, "default", "backoff", acmev1.OrderStatus{State: acmev1.Errored, Reason: "429 rateLimited"})
+	clk.step(2*cm.DefaultDelay - time.Millisecond)
+	clk.never(t, orderState(ctx, client, "default", "backoff", acmev1.Pending))
+	clk.step(time.Millisecond)
+	waitFor(t, orderState(ctx, client, "default", "backoff", acmev1.Pending))
+	o, err = client.AcmeV1().Orders("default").Get(ctx, "backoff", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, cm.RetryStateOf(o.ObjectMeta).Attempts)
+
+	// The other order waits for the server's retry after time
+	assert.True(t, orderState(ctx, client, "default", "retry-after", acmev1.Errored)())
+	clk.step(retryAfter.Add(-time.Millisecond).Sub(clk.Now()))
+	clk.never(t, orderState(ctx, client, "default", "retry-after", acmev1.Pending))
+	clk.step(time.Millisecond)
+	waitFor(t, orderState(ctx, client, "default", "retry-after", acmev1.Pending))
+}
@@ -5,28 +5,40 @@ import (
 	"context"
 	"errors"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/artificialinc/cm-429-fixer/pkg/audit"
 	"github.com/artificialinc/cm-429-fixer/pkg/merge"
+	"github.com/artificialinc/cm-429-fixer/pkg/notify"
+	"github.com/artificialinc/cm-429-fixer/pkg/readiness"
 	acmev1 "github.com/cert-manager/cert-manager/pkg/apis/acme/v1"
+	cmmeta "github.com/cert-manager/cert-manager/pkg/apis/meta/v1"
 	"github.com/cert-manager/cert-manager/pkg/client/clientset/versioned"
+	"github.com/cert-manager/cert-manager/pkg/client/informers/externalversions"
 	"github.com/go-logr/logr"
+	"go.opentelemetry.io/otel/trace"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
 	"k8s.io/apimachinery/pkg/runtime"
 	apiwatch "k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/utils/clock"
 )
 
 // ClientOpts is a set of options for the client
 type ClientOpts struct {
-	Context string
+	Context    string
+	Kubeconfig string
+	// TracerProvider traces the requests made on behalf of traced operations
+	TracerProvider trace.TracerProvider
 }
 
-// GetLocalClient returns a client for the local cluster
-func GetLocalClient(opts *ClientOpts) versioned.Interface {
+func clientConfig(opts *ClientOpts) clientcmd.ClientConfig {
 	// Get kubeconfig
 	loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
 	// if you want to change the loading rules (which files in which order), you can do so here
@@ -36,10 +48,41 @@ func GetLocalClient(opts *ClientOpts) versioned.Interface {
 	if opts != nil && opts.Context != "" {
 		configOverrides.CurrentContext = opts.Context
 	}
+	if opts != nil && opts.Kubeconfig != "" {
+		loadingRules.ExplicitPath = opts.Kubeconfig
+	}
+
+	return clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, configOverrides)
+}
+
+// restConfig returns the client config the options resolve to
+func restConfig(opts *ClientOpts) (*rest.Config, error) {
+	config, err := clientConfig(opts).ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+	if opts != nil && opts.TracerProvider != nil {
+		traceTransport(config, opts.TracerProvider)
+	}
+	return config, nil
+}
 
-	config := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, configOverrides)
+// ClusterName returns the name of the context the client options resolve to,
+// or "in-cluster" when no kubeconfig is available
+func ClusterName(opts *ClientOpts) string {
+	if opts != nil && opts.Context != "" {
+		return opts.Context
+	}
+	raw, err := clientConfig(opts).RawConfig()
+	if err != nil || raw.CurrentContext == "" {
+		return "in-cluster"
+	}
+	return raw.CurrentContext
+}
 
-	clientConfig, err := config.ClientConfig()
+// GetLocalClient returns a client for the local cluster
+func GetLocalClient(opts *ClientOpts) versioned.Interface {
+	clientConfig, err := restConfig(opts)
 	if err != nil {
 		panic(err)
 	}
@@ -57,12 +100,61 @@ func GetLocalClient(opts *ClientOpts) versioned.Interface {
 	return cmClient
 }
 
+// GetLocalDynamicClient returns a dynamic client for the local cluster
+func GetLocalDynamicClient(opts *ClientOpts) dynamic.Interface {
+	clientConfig, err := restConfig(opts)
+	if err != nil {
+		panic(err)
+	}
+
+	c, err := dynamic.NewForConfig(clientConfig)
+	if err != nil {
+		panic(err)
+	}
+
+	return c
+}
+
 // Watcher watches for orders and challenges and fixes them
 type Watcher struct {
 	c            versioned.Interface
+	dyn          dynamic.Interface
+	policies     *policyStore
+	tracker      *Tracker
+	clock        clock.WithTickerAndDelayedExecution
 	log          logr.Logger
+	cluster      string
+	budget       *Budget
+	ready        *readiness.Gate
 	updateDelay  time.Duration
+	maxDelay     time.Duration
 	resyncPeriod time.Duration
+	namespace    string
+	tweak        func(*metav1.ListOptions)
+
+	serverSideFilter bool
+	holdAfter        time.Duration
+	recorder         *Recorder
+	auditLog         *audit.Log
+	notifier         *notify.Notifier
+	tracer           trace.Tracer
+	pauses           *Pauses
+	control          *controlStore
+
+	// queueMu guards the objects with a reset or hold in the works and the
+	// scheduled hold releases
+	queueMu  sync.Mutex
+	pending  map[objectKey]*pendingObject
+	releases map[string]*release
+
+	// observedMu guards the versions of objects whose limits were last
+	// observed, so resyncs don't write incidents again
+	observedMu sync.Mutex
+	observed   map[objectKey]observedLimit
+
+	watchFailureThreshold time.Duration
+	healthMu              sync.Mutex
+	health                map[string]*informerHealth
 }
 
 // Option is a function that sets some option on the watcher
@@ -82,9 +174,28 @@ func WithLogger(l logr.Logger) Option {
 	}
 }
 
+// WithCluster sets the cluster name used to label logs and metrics
+func WithCluster(name string) Option {
+	return func(w *Watcher) {
+		w.cluster = name
+	}
+}
+
+// WithBudget sets the per account reset budget, which may be shared between watchers
+func WithBudget(b *Budget) Option {
+	return func(w *Watcher) {
+		w.budget = b
+	}
+}
+
 const (
 	// DefaultDelay is the default delay time
 	DefaultDelay = 15 * time.Second
+	// DefaultMaxDelay is the default limit for the backoff between resets
+	DefaultMaxDelay = time.Hour
+	// DefaultWatchFailureThreshold is the default time list and watch calls may
+	// fail before the watcher reports not ready
+	DefaultWatchFailureThreshold = 2 * time.Minute
 )
 
 // WithUpdateDelay sets the update jitter time
@@ -94,6 +205,21 @@ func WithUpdateDelay(t time.Duration) Option {
 	}
 }
 
+// WithMaxDelay sets the limit for the backoff between resets of an object
+func WithMaxDelay(t time.Duration) Option {
+	return func(w *Watcher) {
+		w.maxDelay = t
+	}
+}
+
+// WithWatchFailureThreshold sets how long list and watch calls may fail before
+// the watcher reports not ready
+func WithWatchFailureThreshold(t time.Duration) Option {
+	return func(w *Watcher) {
+		w.watchFailureThreshold = t
+	}
+}
+
 // WithResyncPeriod sets the resync period
 func WithResyncPeriod(t time.Duration) Option {
 	return func(w *Watcher) {
@@ -101,12 +227,38 @@ func WithResyncPeriod(t time.Duration) Option {
 	}
 }
 
+// WithNamespace limits the watcher to Orders and Challenges in the namespace
+func WithNamespace(ns string) Option {
+	return func(w *Watcher) {
+		w.namespace = ns
+	}
+}
+
+// WithTweakListOptions sets a function to adjust the options of every list and
+// watch call, e.g. to add a label selector
+func WithTweakListOptions(tweak func(*metav1.ListOptions)) Option {
+	return func(w *Watcher) {
+		w.tweak = tweak
+	}
+}
+
 // NewWatcher creates a new watcher
 func NewWatcher(opts ...Option) *Watcher {
 	w := &Watcher{
 		log:          logr.Discard(),
+		ready:        readiness.NewGate(),
+		tracker:      NewTracker(),
 		updateDelay:  DefaultDelay,
+		maxDelay:     DefaultMaxDelay,
 		resyncPeriod: 15 * time.Minute,
+		clock:        clock.RealClock{},
+		tracer:       defaultTracer(),
+
+		watchFailureThreshold: DefaultWatchFailureThreshold,
+		health:                map[string]*informerHealth{},
+		pending:               map[objectKey]*pendingObject{},
+		releases:              map[string]*release{},
+		observed:              map[objectKey]observedLimit{},
 	}
 	for _, opt := range opts {
 		opt(w)
@@ -117,73 +269,251 @@ func NewWatcher(opts ...Option) *Watcher {
 		w.c = c
 	}
 
+	if w.cluster != "" {
+		w.log = w.log.WithValues("cluster", w.cluster)
+	}
+
 	return w
 }
 
-// Run starts the watcher
-func (w *Watcher) Run(ctx context.Context, ready chan bool) {
-	challengeReady := make(chan bool)
-	w.runInformer(ctx, w.challengeListWatcher(ctx), &acmev1.Challenge{}, challengeReady)
-	orderReady := make(chan bool)
-	w.runInformer(ctx, w.orderListWatcher(ctx), &acmev1.Order{}, orderReady)
+// Readiness returns the gate reporting whether the watcher's informers have synced
+func (w *Watcher) Readiness() *readiness.Gate {
+	return w.ready
+}
 
-	go func() {
-		merged := merge.Bools(w.log, challengeReady, orderReady)
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			case s := <-merged:
-				ready <- s
-			}
-		}
-	}()
+// Run starts the watcher and blocks until the context is done
+func (w *Watcher) Run(ctx context.Context) {
+	// The informers are built by the watcher, whose list watchers apply the
+	// namespace and list options, the factory only adds the transform
+	factory := externalversions.NewSharedInformerFactoryWithOptions(w.c, w.resyncPeriod,
+		externalversions.WithTransform(Transform),
+	)
+	defer factory.Shutdown()
 
+	challenges := factory.InformerFor(&acmev1.Challenge{}, w.newInformer("challenges", w.challengeListWatcher(ctx), &acmev1.Challenge{}))
+	challengeReady := w.watchInformer(ctx, "challenges", challenges)
+	orders := factory.InformerFor(&acmev1.Order{}, w.newInformer("orders", w.orderListWatcher(ctx), &acmev1.Order{}))
+	orderReady := w.watchInformer(ctx, "orders", orders)
+
+	merged := merge.All(ctx, w.log, merge.Identity,
+		merge.Input[bool]{Name: "challenges", C: challengeReady},
+		merge.Input[bool]{Name: "orders", C: orderReady},
+	)
+	go w.ready.Follow(ctx, merged.C())
+
+	if w.dyn != nil {
+		go w.every(ctx, w.resyncPeriod, w.collectIncidents)
+	}
+	if w.holdAfter > 0 {
+		go w.every(ctx, w.resyncPeriod, w.releaseHolds)
+	}
+	if w.policies != nil {
+		w.runPolicies(ctx)
+	}
+	if w.control != nil {
+		w.runControl(ctx)
+	}
+	if w.pauses != nil || w.control != nil {
+		go w.revisitOnResume(ctx, orders, challenges)
+	}
+
+	factory.Start(ctx.Done())
 	<-ctx.Done()
+	w.ready.Set(false)
 }
 
 func (w *Watcher) updateOrder(o *acmev1.Order) {
-	if o.Status.State == acmev1.Errored && strings.Contains(o.Status.Reason, "429") {
-		// Copy object, informers are prohibited from modifying objects
-		o = o.DeepCopy()
-		// Rate limited, set status to pending to force retry
-		o.Status.State = acmev1.Pending
-		o.Status.Reason = ""
-		// Update after delay to give time to settle
-		go func() {
-			w.log.Info("Rate limited, setting to pending", "order", o.Name, "namespace", o.Namespace, "delay", w.updateDelay)
-			defer w.log.Info("Updated order", "order", o.Name, "namespace", o.Namespace)
-			time.Sleep(w.updateDelay)
-			_, err := w.c.AcmeV1().Orders(o.Namespace).UpdateStatus(context.Background(), o, metav1.UpdateOptions{})
-			if err != nil {
-				w.log.Error(err, "Error updating order", "order", o.Name)
+	p := w.policy(o.Namespace)
+	if v := p.Classify(o.Status.State, o.Status.Reason); v.RateLimited() {
+		detectedTotal.WithLabelValues(w.cluster, "Order").Inc()
+		delay := w.resetDelay(p, o.ObjectMeta, v, w.clock.Now())
+		span := w.startDetect("Order", o.ObjectMeta, p, o.Status.Reason, delay)
+		if !w.observedBefore("Order", o.ObjectMeta, p.exhausted(o.ObjectMeta)) {
+			go w.observeLimit("Order", o.ObjectMeta, o.Spec.IssuerRef, o.Spec.DNSNames, o.Status.Reason, w.clock.Now().Add(delay), p.exhausted(o.ObjectMeta))
+		}
+		if !w.resettable(p, "Order", o.ObjectMeta) {
+			w.endDetect(span, detectOutcome(p, o.ObjectMeta))
+			return
+		}
+		revisit := func() { w.updateOrder(o) }
+		if w.shouldHold(v, w.clock.Now()) {
+			// Rate limited for long, hold the certificate instead of retrying
+			if !w.pend("Order", o.ObjectMeta, nil, revisit) {
+				w.endDetect(span, outcomePending)
+				return
 			}
-		}()
+			w.endDetect(span, outcomeHeld)
+			go w.holdFor("Order", o.ObjectMeta, o.Spec.IssuerRef, v.RetryAfter, o.Status.Reason, delay, span.SpanContext())
+			return
+		}
+		// Rate limited, set status to pending after delay to force retry
+		queued := &QueuedReset{Kind: "Order", Namespace: o.Namespace, Name: o.Name, Stage: StageDelay, Due: w.clock.Now().Add(delay)}
+		if !w.pend("Order", o.ObjectMeta, queued, revisit) {
+			w.endDetect(span, outcomePending)
+			return
+		}
+		w.endDetect(span, outcomeScheduled)
+		go w.scheduleReset("Order", o.ObjectMeta, o.Spec.IssuerRef, queued, span.SpanContext())
 	}
 }
 
 func (w *Watcher) updateChallenge(c *acmev1.Challenge) {
-	if c.Status.State == acmev1.Errored && strings.Contains(c.Status.Reason, "429") {
-		// Copy object, informers are prohibited from modifying objects
-		c = c.DeepCopy()
-		w.log.Info("Rate limited, setting to pending", "challenge", c.Name, "namespace", c.Namespace)
-		// Rate limited, set status to pending to force retry
-		c.Status.State = acmev1.Pending
-		c.Status.Reason = ""
-		// Update after delay to give time to settle
-		go func() {
-			w.log.Info("Rate limited, setting to pending", "challenge", c.Name, "namespace", c.Namespace, "delay", w.updateDelay)
-			defer w.log.Info("Updated challenge", "challenge", c.Name, "namespace", c.Namespace)
-			time.Sleep(w.updateDelay)
-			_, err := w.c.AcmeV1().Challenges(c.Namespace).UpdateStatus(context.Background(), c, metav1.UpdateOptions{})
-			if err != nil {
-				w.log.Error(err, "Error updating challenge", "challenge", c.Name)
+	p := w.policy(c.Namespace)
+	if v := p.Classify(c.Status.State, c.Status.Reason); v.RateLimited() {
+		detectedTotal.WithLabelValues(w.cluster, "Challenge").Inc()
+		delay := w.resetDelay(p, c.ObjectMeta, v, w.clock.Now())
+		span := w.startDetect("Challenge", c.ObjectMeta, p, c.Status.Reason, delay)
+		if !w.observedBefore("Challenge", c.ObjectMeta, p.exhausted(c.ObjectMeta)) {
+			go w.observeLimit("Challenge", c.ObjectMeta, c.Spec.IssuerRef, []string{c.Spec.DNSName}, c.Status.Reason, w.clock.Now().Add(delay), p.exhausted(c.ObjectMeta))
+		}
+		if !w.resettable(p, "Challenge", c.ObjectMeta) {
+			w.endDetect(span, detectOutcome(p, c.ObjectMeta))
+			return
+		}
+		revisit := func() { w.updateChallenge(c) }
+		if w.shouldHold(v, w.clock.Now()) {
+			// Rate limited for long, hold the certificate instead of retrying
+			if !w.pend("Challenge", c.ObjectMeta, nil, revisit) {
+				w.endDetect(span, outcomePending)
+				return
 			}
-		}()
+			w.endDetect(span, outcomeHeld)
+			go w.holdFor("Challenge", c.ObjectMeta, c.Spec.IssuerRef, v.RetryAfter, c.Status.Reason, delay, span.SpanContext())
+			return
+		}
+		// Rate limited, set status to pending after delay to force retry
+		queued := &QueuedReset{Kind: "Challenge", Namespace: c.Namespace, Name: c.Name, Stage: StageDelay, Due: w.clock.Now().Add(delay)}
+		if !w.pend("Challenge", c.ObjectMeta, queued, revisit) {
+			w.endDetect(span, outcomePending)
+			return
+		}
+		w.endDetect(span, outcomeScheduled)
+		go w.scheduleReset("Challenge", c.ObjectMeta, c.Spec.IssuerRef, queued, span.SpanContext())
+	}
+}
+
+// observeLimit records the limit a rate limited object ran into with the
+// tracker, in its Order's incident and with the notifier. The limit is held
+// until the fixer next retries the object.
+func (w *Watcher) observeLimit(kind string, meta metav1.ObjectMeta, issuer cmmeta.ObjectReference, domains []string, reason string, until time.Time, gaveUp bool) {
+	account := w.account(context.Background(), meta.Namespace, issuer)
+	order, _, ok := incidentOrder(kind, meta)
+	if !ok {
+		order = meta.Name
+	}
+	w.tracker.observe(Limit{
+		Account: account,
+		Domains: domains,
+		Until:   until,
+		Reason:  reason,
+		Order:   w.trackerKey(meta.Namespace, order),
+	})
+	w.recordIncident(kind, meta, issuer, account, domains, reason, until)
+	w.notifyLimit(w.trackerKey(meta.Namespace, order), account, domains, reason, until, gaveUp)
+}
+
+// limitRefresh is how often the limit of an object that doesn't change is
+// observed again, refreshing the last seen time of its incident
+const limitRefresh = time.Hour
+
+// observedLimit is the version of an object whose limit was last observed
+type observedLimit struct {
+	resourceVersion string
+	gaveUp          bool
+	at              time.Time
+}
+
+// observedBefore returns true if the limit of this version of the object has
+// been observed within limitRefresh, as it is by every informer resync.
+// Otherwise the version is remembered as observed now.
+func (w *Watcher) observedBefore(kind string, meta metav1.ObjectMeta, gaveUp bool) bool {
+	if meta.ResourceVersion == "" {
+		return false
+	}
+	key := objectKey{kind: kind, namespace: meta.Namespace, name: meta.Name}
+	now := w.clock.Now()
+	w.observedMu.Lock()
+	defer w.observedMu.Unlock()
+	if o, ok := w.observed[key]; ok && o.resourceVersion == meta.ResourceVersion && o.gaveUp == gaveUp && now.Sub(o.at) < limitRefresh {
+		return true
+	}
+	w.observed[key] = observedLimit{resourceVersion: meta.ResourceVersion, gaveUp: gaveUp, at: now}
+	return false
+}
+
+// forgetObserved drops the observed version of an object that left the informer
+func (w *Watcher) forgetObserved(kind string, meta metav1.ObjectMeta) {
+	w.observedMu.Lock()
+	defer w.observedMu.Unlock()
+	delete(w.observed, objectKey{kind: kind, namespace: meta.Namespace, name: meta.Name})
+}
+
+// resettable returns false, and logs why, if the policy doesn't allow the
+// object to be reset
+func (w *Watcher) resettable(p Policy, kind string, meta metav1.ObjectMeta) bool {
+	log := w.log.WithValues(strings.ToLower(kind), meta.Name, "namespace", meta.Namespace, "policy", p.Source)
+	if !p.Enabled(kind) {
+		log.V(1).Info("Rate limited, resets of the kind are disabled by policy")
+		return false
+	}
+	if p.exhausted(meta) {
+		log.Info("Rate limited, giving up after the policy's max attempts", "attempts", RetryStateOf(meta).Attempts)
+		return false
+	}
+	return true
+}
+
+// scheduleReset waits until the queued reset is due, then resets the object
+// through the same path used by manual resets. Each object has at most one
+// reset queued, and the account budget is only drawn from once the object is
+// known to still need a reset. The reset is traced as linked to the detection
+// that scheduled it.
+func (w *Watcher) scheduleReset(kind string, meta metav1.ObjectMeta, issuer cmmeta.ObjectReference, queued *QueuedReset, detected trace.SpanContext) {
+	defer w.done(kind, meta.Namespace, meta.Name)
+	delay := queued.Due.Sub(w.clock.Now())
+	log := w.log.WithValues(strings.ToLower(kind), meta.Name, "namespace", meta.Namespace)
+	log.Info("Rate limited, setting to pending", "delay", delay)
+	ctx, span := w.startReset(kind, meta, detected, delay)
+	w.sleepSpan(ctx, "delay", delay)
+
+	result, err := w.reset(ctx, kind, meta.Namespace, meta.Name, ResetOptions{DryRun: true, check: true})
+	if err == nil && result == ResetDryRun {
+		wait := w.reserve(meta.Namespace, issuer)
+		span.SetAttributes(attrWait.String(wait.String()))
+		w.requeue(queued, StageBudget, w.clock.Now().Add(wait))
+		w.sleepSpan(ctx, "budget", wait)
+		result, err = w.reset(ctx, kind, meta.Namespace, meta.Name, ResetOptions{})
+	}
+	w.endReset(span, result, err)
+	if err != nil {
+		resetsTotal.WithLabelValues(w.cluster, kind, "error").Inc()
+		log.Error(err, "Error resetting "+strings.ToLower(kind))
+		return
+	}
+	resetsTotal.WithLabelValues(w.cluster, kind, string(result)).Inc()
+	log.Info("Reset "+strings.ToLower(kind), "result", result)
+	if result == ResetDone {
+		w.incidentReset(kind, meta)
 	}
 }
 
+// reserve takes a reset from the budget of the account behind the issuer and
+// returns the extra delay needed to stay within it
+func (w *Watcher) reserve(namespace string, ref cmmeta.ObjectReference) time.Duration {
+	if w.budget == nil {
+		return 0
+	}
+	account := w.account(context.Background(), namespace, ref)
+	wait := w.budget.Reserve(account)
+	budgetWaitSeconds.WithLabelValues(w.cluster).Observe(wait.Seconds())
+	if wait > 0 {
+		w.log.Info("Account reset budget exhausted, delaying reset", "account", account, "wait", wait)
+	}
+	return wait
+}
+
 func (w *Watcher) handleAdd(obj interface{}) {
+	w.record(obj, false)
 	switch o := obj.(type) {
 	case *acmev1.Order:
 		w.updateOrder(o)
@@ -195,6 +525,7 @@ func (w *Watcher) handleAdd(obj interface{}) {
 }
 
 func (w *Watcher) handleUpdate(_, obj interface{}) {
+	w.record(obj, false)
 	switch o := obj.(type) {
 	case *acmev1.Order:
 		w.updateOrder(o)
@@ -205,17 +536,66 @@ func (w *Watcher) handleUpdate(_, obj interface{}) {
 	}
 }
 
+// handleDelete resolves the limit, incident and notifications of Orders that
+// have recovered. The informer only holds objects that need the fixer's
+// attention, so recovered Orders are seen as deletes.
+func (w *Watcher) handleDelete(obj interface{}) {
+	w.record(obj, true)
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	if c, ok := obj.(*acmev1.Challenge); ok {
+		w.forgetObserved("Challenge", c.ObjectMeta)
+		return
+	}
+	o, ok := obj.(*acmev1.Order)
+	if !ok {
+		return
+	}
+	w.forgetObserved("Order", o.ObjectMeta)
+	if o.Status.State == acmev1.Valid {
+		w.recovered(o.Namespace, o.Name)
+		return
+	}
+	// With the server side filter, or a tombstone, the object is the last one
+	// seen, and the Order may have recovered since
+	go w.checkRecovered(o.Namespace, o.Name)
+}
+
+// checkRecovered looks up an Order that left the informer, and resolves its
+// limit if it is Valid or gone
+func (w *Watcher) checkRecovered(namespace, name string) {
+	o, err := w.c.AcmeV1().Orders(namespace).Get(context.Background(), name, metav1.GetOptions{})
+	switch {
+	case apierrors.IsNotFound(err) || (err == nil && o.Status.State == acmev1.Valid):
+		w.recovered(namespace, name)
+	case err != nil:
+		w.log.Error(err, "Error looking up deleted Order", "namespace", namespace, "name", name)
+	}
+}
+
+// recovered resolves the limit, incident and notifications of an Order
+func (w *Watcher) recovered(namespace, name string) {
+	w.tracker.resolve(w.trackerKey(namespace, name))
+	if w.notifier != nil {
+		w.notifier.Recovered(w.trackerKey(namespace, name))
+	}
+	w.resolveIncident(namespace, name)
+}
+
 func (w *Watcher) challengeListWatcher(ctx context.Context) *cache.ListWatch {
 	return &cache.ListWatch{
 		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
-			o, err := w.c.AcmeV1().Challenges("").List(ctx, options)
+			w.tweakListOptions(&options)
+			o, err := w.c.AcmeV1().Challenges(w.namespace).List(ctx, options)
 			if err != nil {
 				return nil, err
 			}
 			return o, nil
 		},
 		WatchFunc: func(options metav1.ListOptions) (apiwatch.Interface, error) {
-			o, err := w.c.AcmeV1().Challenges("").Watch(ctx, options)
+			w.tweakListOptions(&options)
+			o, err := w.c.AcmeV1().Challenges(w.namespace).Watch(ctx, options)
 			if err != nil {
 				return nil, err
 			}
@@ -228,14 +608,16 @@ func (w *Watcher) challengeListWatcher(ctx context.Context) *cache.ListWatch {
 func (w *Watcher) orderListWatcher(ctx context.Context) *cache.ListWatch {
 	return &cache.ListWatch{
 		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
-			o, err := w.c.AcmeV1().Orders("").List(ctx, options)
+			w.tweakListOptions(&options)
+			o, err := w.c.AcmeV1().Orders(w.namespace).List(ctx, options)
 			if err != nil {
 				return nil, err
 			}
 			return o, nil
 		},
 		WatchFunc: func(options metav1.ListOptions) (apiwatch.Interface, error) {
-			o, err := w.c.AcmeV1().Orders("").Watch(ctx, options)
+			w.tweakListOptions(&options)
+			o, err := w.c.AcmeV1().Orders(w.namespace).Watch(ctx, options)
 			if err != nil {
 				return nil, err
 			}
@@ -244,45 +626,79 @@ func (w *Watcher) orderListWatcher(ctx context.Context) *cache.ListWatch {
 	}
 }
 
-func (w *Watcher) runInformer(ctx context.Context, listerWatcher cache.ListerWatcher, objType runtime.Object, ready chan bool) {
-	stopCh := make(chan struct{})
-	_, informer := cache.NewInformerWithOptions(
-		cache.InformerOptions{
-			ListerWatcher: listerWatcher,
-			ObjectType:    objType,
-			ResyncPeriod:  w.resyncPeriod,
-			Handler: cache.ResourceEventHandlerFuncs{
-				AddFunc:    w.handleAdd,
-				UpdateFunc: w.handleUpdate,
-			},
-		},
-	)
+func (w *Watcher) tweakListOptions(options *metav1.ListOptions) {
+	if w.serverSideFilter {
+		options.FieldSelector = ErroredFieldSelector
+	}
+	if w.tweak != nil {
+		w.tweak(options)
+	}
+}
 
+// newInformer returns the factory constructor for an informer listing and
+// watching through the list watcher, with the outcome of its calls recorded
+// in the watcher's health. Only objects needing attention are passed on to the informer.
+func (w *Watcher) newInformer(name string, listerWatcher cache.ListerWatcher, objType runtime.Object) func(versioned.Interface, time.Duration) cache.SharedIndexInformer {
+	return func(_ versioned.Interface, resyncPeriod time.Duration) cache.SharedIndexInformer {
+		health := &informerHealth{name: name, clock: w.clock}
+		w.healthMu.Lock()
+		w.health[name] = health
+		w.healthMu.Unlock()
+
+		return cache.NewSharedIndexInformer(&healthListWatcher{lw: &wantedListWatcher{lw: listerWatcher}, health: health}, objType, resyncPeriod,
+			cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	}
+}
+
+// watchInformer registers the watcher's handlers on the informer and returns
+// a channel reporting its readiness
+func (w *Watcher) watchInformer(ctx context.Context, name string, informer cache.SharedIndexInformer) <-chan bool {
+	w.healthMu.Lock()
+	health := w.health[name]
+	w.healthMu.Unlock()
+
+	_, _ = informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    w.handleAdd,
+		UpdateFunc: w.handleUpdate,
+		DeleteFunc: w.handleDelete,
+	})
+	_ = informer.SetWatchErrorHandler(func(_ *cache.Reflector, err error) {
+		health.failure(err)
+		w.log.Info("Watch failed", "informer", name, "error", err.Error())
+	})
+
+	// Report ready once synced, and not ready while list and watch calls have
+	// been failing for longer than the threshold
+	ready := make(chan bool)
 	go func() {
-		ticker := time.NewTicker(1 * time.Second)
+		ticker := w.clock.NewTicker(1 * time.Second)
+		defer ticker.Stop()
+		healthy := false
 		for {
 			select {
 			case <-ctx.Done():
 				return
-			case <-ticker.C:
+			case <-ticker.C():
 				if informer.HasSynced() {
-					ready <- true
+					health.setSynced()
+				}
+				s := health.status(w.clock.Now(), w.watchFailureThreshold)
+				if s.Healthy == healthy {
+					continue
+				}
+				healthy = s.Healthy
+				if healthy {
+					w.log.Info("Informer ready", "informer", name)
+				} else {
+					w.log.Error(errors.New(s.LastError), "Watch failing, reporting not ready", "informer", name, "failingSince", s.FailingSince)
+				}
+				select {
+				case <-ctx.Done():
 					return
+				case ready <- healthy:
 				}
 			}
 		}
 	}()
-
-	// Merge stopCh with ctx.Done
-	go func() {
-		select {
-		case <-ctx.Done():
-		case <-stopCh:
-			close(stopCh)
-		}
-	}()
-
-	go func() {
-		informer.Run(stopCh)
-	}()
+	return ready
 }
@@ -3,13 +3,16 @@ package cm_test
 
 import (
 	"context"
+	"strconv"
 	"testing"
+	"time"
 
 	"github.com/artificialinc/cm-429-fixer/pkg/cm"
 	acmev1 "github.com/cert-manager/cert-manager/pkg/apis/acme/v1"
 	"github.com/cert-manager/cert-manager/pkg/client/clientset/versioned"
 
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/time/rate"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 
@@ -132,27 +135,25 @@ func TestWatcherOrder(t *testing.T) {
 			}
 
 			client := fake.NewSimpleClientset(existing...)
+			clk := newTestClock()
 
 			w := cm.NewWatcher(
 				cm.WithClient(client),
+				cm.WithClock(clk),
 			)
 
-			ready := make(chan bool)
-
-			go func() {
-				w.Run(ctx, ready)
-			}()
-
 			// Wait for the controller to sync
-			doneWaiting := false
-			for !doneWaiting {
-				doneWaiting = <-ready
-			}
+			clk.run(t, ctx, w)
 
 			for _, a := range tt.actions {
 				a(t, ctx, client)
 			}
 
+			// Rate limited orders are reset once the delay has passed
+			clk.step(cm.DefaultDelay)
+			waitFor(t, orderState(ctx, client, "default", "order1", acmev1.Pending))
+			tt.expected(t, ctx, client)
+
 			cancel()
 
 		})
@@ -255,29 +256,67 @@ func TestWatcherChallenge(t *testing.T) {
 			}
 
 			client := fake.NewSimpleClientset(existing...)
+			clk := newTestClock()
 
 			w := cm.NewWatcher(
 				cm.WithClient(client),
+				cm.WithClock(clk),
 			)
 
-			ready := make(chan bool)
-
-			go func() {
-				w.Run(ctx, ready)
-			}()
-
 			// Wait for the controller to sync
-			doneWaiting := false
-			for !doneWaiting {
-				doneWaiting = <-ready
-			}
+			clk.run(t, ctx, w)
 
 			for _, a := range tt.actions {
 				a(t, ctx, client)
 			}
 
+			// Rate limited challenges are reset once the delay has passed
+			clk.step(cm.DefaultDelay)
+			waitFor(t, func() bool {
+				c, err := client.AcmeV1().Challenges("default").Get(ctx, "order1", metav1.GetOptions{})
+				return err == nil && c.Status.State == acmev1.Pending
+			})
+			tt.expected(t, ctx, client)
+
 			cancel()
 
 		})
 	}
 }
+
+func TestWatcherDuplicateEvents(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	clk := newTestClock()
+	client := fake.NewSimpleClientset()
+	budget := cm.NewBudget(rate.Every(time.Hour), 5)
+	w := cm.NewWatcher(cm.WithClient(client), cm.WithClock(clk), cm.WithBudget(budget))
+	clk.run(t, ctx, w)
+
+	// Several updates of one rate limited order queue a single reset
+	o, err := client.AcmeV1().Orders("default").Create(ctx, buildOrder("order1", "default", &acmev1.OrderStatus{
+		State:  acmev1.Errored,
+		Reason: "429 rateLimited",
+	}), metav1.CreateOptions{})
+	assert.NoError(t, err)
+	for i := range 3 {
+		o.Labels = map[string]string{"update": strconv.Itoa(i)}
+		o.ResourceVersion = strconv.Itoa(i + 1)
+		o, err = client.AcmeV1().Orders("default").Update(ctx, o, metav1.UpdateOptions{})
+		assert.NoError(t, err)
+	}
+	waitFor(t, func() bool { return len(w.Queue()) == 1 })
+	clk.step(cm.DefaultDelay)
+	waitFor(t, orderState(ctx, client, "default", "order1", acmev1.Pending))
+
+	// The order is looked at again as it changed, but as it's no longer rate
+	// limited the budget is only drawn from once
+	clk.step(time.Hour)
+	waitFor(t, func() bool { return len(w.Queue()) == 0 })
+	usage := budget.Usage(time.Now())
+	if assert.Len(t, usage, 1) {
+		assert.InDelta(t, 4, usage[0].Available, 0.01)
+	}
+}
@@ -0,0 +1,322 @@
+package cm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	cmmeta "github.com/cert-manager/cert-manager/pkg/apis/meta/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/utils/clock"
+)
+
+// DefaultControlName is the usual name of the control ConfigMap
+const DefaultControlName = "cm-429-fixer-control"
+
+// DefaultControlNamespace is the usual namespace of the control ConfigMap
+const DefaultControlNamespace = "cm-429-fixer"
+
+// DefaultControl is the control ConfigMap read unless told otherwise, as
+// namespace/name
+const DefaultControl = DefaultControlNamespace + "/" + DefaultControlName
+
+// Keys of the control ConfigMap
+const (
+	// ControlKeyPaused switches off every change when true
+	ControlKeyPaused = "paused"
+	// ControlKeyNamespaces lists namespaces, comma or whitespace separated,
+	// whose objects aren't changed
+	ControlKeyNamespaces = "namespaces"
+	// ControlKeyIssuers lists issuers, by name or Kind/name, whose objects
+	// aren't changed
+	ControlKeyIssuers = "issuers"
+	// ControlKeyMaintenanceUntil switches off every change until the RFC 3339 time
+	ControlKeyMaintenanceUntil = "maintenance-until"
+)
+
+// ErrSwitchedOff is returned for changes the control ConfigMap switches off
+var ErrSwitchedOff = errors.New("changes are switched off by the control ConfigMap")
+
+var configMapGVR = schema.GroupVersionResource{Version: "v1", Resource: "configmaps"}
+
+// Control is what the control ConfigMap switches off
+type Control struct {
+	// ConfigMap is the namespace/name of the ConfigMap
+	ConfigMap string `json:"configMap"`
+	// SwitchedOff is true while every change is switched off
+	SwitchedOff      bool       `json:"switchedOff"`
+	Paused           bool       `json:"paused"`
+	Namespaces       []string   `json:"namespaces,omitempty"`
+	Issuers          []string   `json:"issuers,omitempty"`
+	MaintenanceUntil *time.Time `json:"maintenanceUntil,omitempty"`
+	// Errors are the values that couldn't be read, which switch off every
+	// change until they are fixed
+	Errors []string `json:"errors,omitempty"`
+}
+
+// parseControl reads the keys of the ConfigMap's data
+func parseControl(data map[string]string) Control {
+	var c Control
+	if v, ok := data[ControlKeyPaused]; ok && strings.TrimSpace(v) != "" {
+		paused, err := strconv.ParseBool(strings.TrimSpace(v))
+		if err != nil {
+			c.Errors = append(c.Errors, fmt.Sprintf("%s: %q isn't a boolean", ControlKeyPaused, v))
+		}
+		c.Paused = paused
+	}
+	c.Namespaces = controlList(data[ControlKeyNamespaces])
+	c.Issuers = controlList(data[ControlKeyIssuers])
+	if v := strings.TrimSpace(data[ControlKeyMaintenanceUntil]); v != "" {
+		until, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			c.Errors = append(c.Errors, fmt.Sprintf("%s: %q isn't an RFC 3339 time", ControlKeyMaintenanceUntil, v))
+		} else {
+			c.MaintenanceUntil = &until
+		}
+	}
+	return c
+}
+
+func controlList(v string) []string {
+	return strings.FieldsFunc(v, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\n' || r == '\t'
+	})
+}
+
+// all returns why every change is switched off at the time, if it is
+func (c Control) all(now time.Time) (string, bool) {
+	switch {
+	case len(c.Errors) > 0:
+		return "invalid " + strings.Join(c.Errors, "; "), true
+	case c.Paused:
+		return "paused", true
+	case c.MaintenanceUntil != nil && now.Before(*c.MaintenanceUntil):
+		return "maintenance until " + c.MaintenanceUntil.UTC().Format(time.RFC3339), true
+	}
+	return "", false
+}
+
+// switchedOff returns why changes to objects in the namespace issued by the
+// issuer are switched off at the time, if they are
+func (c Control) switchedOff(now time.Time, namespace string, issuer cmmeta.ObjectReference) (string, bool) {
+	if reason, ok := c.all(now); ok {
+		return reason, true
+	}
+	for _, ns := range c.Namespaces {
+		if ns == namespace {
+			return "namespace " + ns + " paused", true
+		}
+	}
+	for _, i := range c.Issuers {
+		if i == issuer.Name || i == issuerName(issuer) {
+			return "issuer " + i + " paused", true
+		}
+	}
+	return "", false
+}
+
+// SplitControl returns the namespace and name of a control ConfigMap given as
+// namespace/name, or as a namespace to use DefaultControlName. The namespace
+// is empty if v is.
+func SplitControl(v string) (string, string) {
+	namespace, name, _ := strings.Cut(v, "/")
+	if name == "" {
+		name = DefaultControlName
+	}
+	return namespace, name
+}
+
+// controlStore holds the state of the control ConfigMap
+type controlStore struct {
+	c         dynamic.Interface
+	namespace string
+	name      string
+
+	mu      sync.Mutex
+	control Control
+	// maintenance fires when the maintenance window ends
+	maintenance clock.Timer
+	// revisit is signalled when changes may have been switched back on
+	revisit chan struct{}
+}
+
+// WithControl switches off changes to objects according to the ConfigMap of
+// the name in the namespace, read using the dynamic client. Every reset,
+// hold, hold release and cleared backoff is switched off, forced and
+// explicit ones included, as are the webhook's annotations.
+func WithControl(c dynamic.Interface, namespace, name string) Option {
+	return func(w *Watcher) {
+		w.control = &controlStore{
+			c:         c,
+			namespace: namespace,
+			name:      name,
+			control:   Control{ConfigMap: namespace + "/" + name},
+			revisit:   make(chan struct{}, 1),
+		}
+	}
+}
+
+// Control returns what the control ConfigMap switches off, nil if the watcher
+// has none
+func (w *Watcher) Control() *Control {
+	if w.control == nil {
+		return nil
+	}
+	w.control.mu.Lock()
+	defer w.control.mu.Unlock()
+	c := w.control.control
+	_, c.SwitchedOff = c.all(w.clock.Now())
+	return &c
+}
+
+// SwitchedOff returns why the control ConfigMap switches off changes to
+// objects in the namespace issued by the issuer, if it does
+func (w *Watcher) SwitchedOff(namespace string, issuer cmmeta.ObjectReference) (string, bool) {
+	if w.control == nil {
+		return "", false
+	}
+	w.control.mu.Lock()
+	defer w.control.mu.Unlock()
+	return w.control.control.switchedOff(w.clock.Now(), namespace, issuer)
+}
+
+// checkSwitchedOff returns an error wrapping ErrSwitchedOff if changes to
+// the object are switched off
+func (w *Watcher) checkSwitchedOff(kind, namespace, name string, issuer cmmeta.ObjectReference) error {
+	if reason, ok := w.SwitchedOff(namespace, issuer); ok {
+		return fmt.Errorf("%w: %s %s/%s, %s", ErrSwitchedOff, kind, namespace, name, reason)
+	}
+	return nil
+}
+
+// runControl starts the informer of the control ConfigMap and blocks until it
+// has synced, so nothing is changed before the switch is known
+func (w *Watcher) runControl(ctx context.Context) {
+	informer := dynamicinformer.NewFilteredDynamicInformer(w.control.c, configMapGVR, w.control.namespace, w.resyncPeriod, cache.Indexers{}, func(options *metav1.ListOptions) {
+		options.FieldSelector = fields.OneTermEqualSelector("metadata.name", w.control.name).String()
+	}).Informer()
+	_, _ = informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    w.updateControl,
+		UpdateFunc: func(_, obj interface{}) { w.updateControl(obj) },
+		DeleteFunc: func(interface{}) { w.setControl(Control{}) },
+	})
+	go informer.Run(ctx.Done())
+	w.updateControlMetrics()
+	w.log.Info("Waiting for the control ConfigMap to sync", "configMap", w.control.namespace+"/"+w.control.name)
+	cache.WaitForCacheSync(ctx.Done(), informer.HasSynced)
+}
+
+// LoadControl reads the control ConfigMap once, for commands that make
+// changes without running the watcher. A missing ConfigMap switches nothing
+// off, any other error must keep the command from making changes.
+func (w *Watcher) LoadControl(ctx context.Context) error {
+	if w.control == nil {
+		return nil
+	}
+	u, err := w.control.c.Resource(configMapGVR).Namespace(w.control.namespace).Get(ctx, w.control.name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		w.setControl(Control{})
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("reading the control ConfigMap %s/%s: %w", w.control.namespace, w.control.name, err)
+	}
+	w.updateControl(u)
+	return nil
+}
+
+func (w *Watcher) updateControl(obj interface{}) {
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok || u.GetName() != w.control.name {
+		return
+	}
+	data, _, err := unstructured.NestedStringMap(u.Object, "data")
+	if err != nil {
+		w.setControl(Control{Errors: []string{err.Error()}})
+		return
+	}
+	w.setControl(parseControl(data))
+}
+
+// setControl stores what the ConfigMap switches off, and has the watcher look
+// at its objects again in case changes have been switched back on
+func (w *Watcher) setControl(c Control) {
+	c.ConfigMap = w.control.namespace + "/" + w.control.name
+
+	w.control.mu.Lock()
+	prev := w.control.control
+	if reflect.DeepEqual(prev, c) {
+		w.control.mu.Unlock()
+		return
+	}
+	w.control.control = c
+	if w.control.maintenance != nil {
+		w.control.maintenance.Stop()
+		w.control.maintenance = nil
+	}
+	if c.MaintenanceUntil != nil && c.MaintenanceUntil.After(w.clock.Now()) {
+		// The revisit updates the metrics once the window has ended
+		w.control.maintenance = w.clock.AfterFunc(c.MaintenanceUntil.Sub(w.clock.Now()), w.control.signal)
+	}
+	w.control.mu.Unlock()
+
+	reason, off := c.all(w.clock.Now())
+	w.log.Info("Control ConfigMap changed", "switchedOff", off, "reason", reason, "namespaces", c.Namespaces, "issuers", c.Issuers)
+	w.updateControlMetrics()
+	if !prev.empty() {
+		w.control.signal()
+	}
+}
+
+// empty returns true if nothing is switched off
+func (c Control) empty() bool {
+	return !c.Paused && len(c.Namespaces) == 0 && len(c.Issuers) == 0 && c.MaintenanceUntil == nil && len(c.Errors) == 0
+}
+
+// signal asks the watcher to look at its objects again
+func (s *controlStore) signal() {
+	select {
+	case s.revisit <- struct{}{}:
+	default:
+	}
+}
+
+// revisits returns the channel signalled when changes may have been switched
+// back on, nil without a control ConfigMap
+func (s *controlStore) revisits() <-chan struct{} {
+	if s == nil {
+		return nil
+	}
+	return s.revisit
+}
+
+func (w *Watcher) updateControlMetrics() {
+	c := w.Control()
+	controlSwitchedOff.WithLabelValues(w.cluster).Set(boolGauge(c.SwitchedOff))
+	controlScopes.WithLabelValues(w.cluster, "namespace").Set(float64(len(c.Namespaces)))
+	controlScopes.WithLabelValues(w.cluster, "issuer").Set(float64(len(c.Issuers)))
+	var until float64
+	if c.MaintenanceUntil != nil {
+		until = float64(c.MaintenanceUntil.Unix())
+	}
+	controlMaintenanceUntil.WithLabelValues(w.cluster).Set(until)
+}
+
+func boolGauge(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,198 @@
+package cm_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/artificialinc/cm-429-fixer/pkg/cm"
+	acmev1 "github.com/cert-manager/cert-manager/pkg/apis/acme/v1"
+	cmapi "github.com/cert-manager/cert-manager/pkg/apis/certmanager/v1"
+	cmmeta "github.com/cert-manager/cert-manager/pkg/apis/meta/v1"
+	"github.com/cert-manager/cert-manager/pkg/client/clientset/versioned/fake"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+var configMapGVR = schema.GroupVersionResource{Version: "v1", Resource: "configmaps"}
+
+func buildControl(data map[string]interface{}) *unstructured.Unstructured {
+	u := &unstructured.Unstructured{Object: map[string]interface{}{"data": data}}
+	u.SetAPIVersion("v1")
+	u.SetKind("ConfigMap")
+	u.SetNamespace("cm-429-fixer")
+	u.SetName(cm.DefaultControlName)
+	return u
+}
+
+func newControlClient(objects ...runtime.Object) dynamic.Interface {
+	return dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		configMapGVR: "ConfigMapList",
+	}, objects...)
+}
+
+// setControl replaces the data of the control ConfigMap
+func setControl(ctx context.Context, t *testing.T, dyn dynamic.Interface, data map[string]interface{}) {
+	t.Helper()
+	_, err := dyn.Resource(configMapGVR).Namespace("cm-429-fixer").Update(ctx, buildControl(data), metav1.UpdateOptions{})
+	assert.NoError(t, err)
+}
+
+func TestControl(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	notAfter := metav1.NewTime(time.Now().Add(30 * 24 * time.Hour))
+	le := cmmeta.ObjectReference{Kind: "ClusterIssuer", Name: "letsencrypt"}
+	client := fake.NewSimpleClientset(
+		&cmapi.Certificate{
+			ObjectMeta: metav1.ObjectMeta{Name: "cert1", Namespace: "team-a"},
+			Spec:       cmapi.CertificateSpec{IssuerRef: le},
+			Status:     cmapi.CertificateStatus{NotAfter: &notAfter},
+		},
+		buildOrder("order1", "default", &acmev1.OrderStatus{State: acmev1.Errored, Reason: "429 rateLimited"}),
+	)
+	// An invalid value switches off every change
+	dyn := newControlClient(buildControl(map[string]interface{}{cm.ControlKeyPaused: "maybe"}))
+	w := cm.NewWatcher(cm.WithClient(client), cm.WithControl(dyn, "cm-429-fixer", cm.DefaultControlName), cm.WithUpdateDelay(time.Hour))
+	go w.Run(ctx)
+	assert.NoError(t, w.Readiness().Wait(ctx))
+
+	c := w.Control()
+	if assert.NotNil(t, c) {
+		assert.Equal(t, "cm-429-fixer/"+cm.DefaultControlName, c.ConfigMap)
+		assert.True(t, c.SwitchedOff)
+		assert.Equal(t, []string{`paused: "maybe" isn't a boolean`}, c.Errors)
+	}
+	reason, off := w.SwitchedOff("default", cmmeta.ObjectReference{Name: "other"})
+	assert.True(t, off)
+	assert.Equal(t, `invalid paused: "maybe" isn't a boolean`, reason)
+
+	// Namespaces and issuers switch off changes to their objects only
+	setControl(ctx, t, dyn, map[string]interface{}{
+		cm.ControlKeyNamespaces: "team-a, team-b",
+		cm.ControlKeyIssuers:    "ClusterIssuer/letsencrypt\nstaging",
+	})
+	waitFor(t, func() bool { return !w.Control().SwitchedOff })
+	c = w.Control()
+	assert.Equal(t, []string{"team-a", "team-b"}, c.Namespaces)
+	assert.Equal(t, []string{"ClusterIssuer/letsencrypt", "staging"}, c.Issuers)
+	_, off = w.SwitchedOff("team-b", cmmeta.ObjectReference{Name: "other"})
+	assert.True(t, off)
+	reason, off = w.SwitchedOff("default", le)
+	assert.True(t, off)
+	assert.Equal(t, "issuer ClusterIssuer/letsencrypt paused", reason)
+	_, off = w.SwitchedOff("default", cmmeta.ObjectReference{Name: "other"})
+	assert.False(t, off)
+
+	// Explicit changes are switched off too
+	err := w.Hold(ctx, "team-a", "cert1", time.Now().Add(time.Hour), "rate limited")
+	assert.True(t, errors.Is(err, cm.ErrSwitchedOff), err)
+	err = w.ReleaseHold(ctx, "team-a", "cert1", "admin")
+	assert.True(t, errors.Is(err, cm.ErrSwitchedOff), err)
+
+	setControl(ctx, t, dyn, map[string]interface{}{cm.ControlKeyPaused: "true"})
+	waitFor(t, func() bool { return w.Control().Paused })
+	err = w.ClearBackoff(ctx, "Order", "default", "order1", "admin")
+	assert.True(t, errors.Is(err, cm.ErrSwitchedOff), err)
+	result, err := w.ResetOrder(ctx, "default", "order1", cm.ResetOptions{Force: true})
+	assert.NoError(t, err)
+	assert.Equal(t, cm.ResetPaused, result)
+
+	report, err := w.Scan(ctx, "")
+	assert.NoError(t, err)
+	if assert.Len(t, report.Findings, 1) {
+		assert.Equal(t, "none, switched off by the control ConfigMap: paused", report.Findings[0].Action)
+	}
+
+	// Deleting the ConfigMap switches changes back on
+	assert.NoError(t, dyn.Resource(configMapGVR).Namespace("cm-429-fixer").Delete(ctx, cm.DefaultControlName, metav1.DeleteOptions{}))
+	waitFor(t, func() bool { return !w.Control().Paused })
+	assert.NoError(t, w.ClearBackoff(ctx, "Order", "default", "order1", "admin"))
+}
+
+func TestWatcherMaintenance(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	clk := newTestClock()
+	client := fake.NewSimpleClientset()
+	dyn := newControlClient(buildControl(map[string]interface{}{
+		cm.ControlKeyMaintenanceUntil: clk.Now().Add(time.Hour).Format(time.RFC3339),
+	}))
+	w := cm.NewWatcher(cm.WithClient(client), cm.WithClock(clk), cm.WithControl(dyn, "cm-429-fixer", cm.DefaultControlName))
+	clk.run(t, ctx, w)
+	assert.True(t, w.Control().SwitchedOff)
+
+	_, err := client.AcmeV1().Orders("default").Create(ctx, buildOrder("order1", "default", &acmev1.OrderStatus{
+		State:  acmev1.Errored,
+		Reason: "429 rateLimited",
+	}), metav1.CreateOptions{})
+	assert.NoError(t, err)
+
+	// The reset is dropped during the maintenance window
+	waitFor(t, func() bool { return len(w.Queue()) == 1 })
+	clk.step(cm.DefaultDelay)
+	waitFor(t, func() bool { return len(w.Queue()) == 0 })
+	assert.True(t, orderState(ctx, client, "default", "order1", acmev1.Errored)())
+
+	// The end of the window looks at the order again
+	clk.step(time.Hour)
+	waitFor(t, func() bool { return !w.Control().SwitchedOff })
+	waitFor(t, func() bool { return len(w.Queue()) == 1 })
+	clk.step(cm.DefaultDelay)
+	waitFor(t, orderState(ctx, client, "default", "order1", acmev1.Pending))
+}
+
+func TestLoadControl(t *testing.T) {
+	ctx := context.Background()
+	client := fake.NewSimpleClientset(buildOrder("order1", "default", &acmev1.OrderStatus{State: acmev1.Errored, Reason: "429 rateLimited"}))
+
+	// Commands read the ConfigMap once, without running the watcher
+	dyn := newControlClient(buildControl(map[string]interface{}{cm.ControlKeyPaused: "true"}))
+	w := cm.NewWatcher(cm.WithClient(client), cm.WithControl(dyn, "cm-429-fixer", cm.DefaultControlName))
+	assert.NoError(t, w.LoadControl(ctx))
+	assert.True(t, w.Control().Paused)
+	result, err := w.ResetOrder(ctx, "default", "order1", cm.ResetOptions{Force: true})
+	assert.NoError(t, err)
+	assert.Equal(t, cm.ResetPaused, result)
+
+	// A missing ConfigMap switches nothing off
+	w = cm.NewWatcher(cm.WithClient(client), cm.WithControl(newControlClient(), "cm-429-fixer", cm.DefaultControlName))
+	assert.NoError(t, w.LoadControl(ctx))
+	assert.False(t, w.Control().SwitchedOff)
+
+	// but one that can't be read is an error
+	failing := newControlClient()
+	failing.(*dynamicfake.FakeDynamicClient).PrependReactor("get", "configmaps", func(k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New("forbidden")
+	})
+	w = cm.NewWatcher(cm.WithClient(client), cm.WithControl(failing, "cm-429-fixer", cm.DefaultControlName))
+	assert.EqualError(t, w.LoadControl(ctx), "reading the control ConfigMap cm-429-fixer/cm-429-fixer-control: forbidden")
+
+	// Without a control ConfigMap there is nothing to read
+	assert.NoError(t, cm.NewWatcher(cm.WithClient(client)).LoadControl(ctx))
+}
+
+func TestSplitControl(t *testing.T) {
+	ns, name := cm.SplitControl("ops/switch")
+	assert.Equal(t, "ops", ns)
+	assert.Equal(t, "switch", name)
+	ns, name = cm.SplitControl("ops")
+	assert.Equal(t, "ops", ns)
+	assert.Equal(t, cm.DefaultControlName, name)
+	ns, _ = cm.SplitControl("")
+	assert.Empty(t, ns)
+	ns, name = cm.SplitControl(cm.DefaultControl)
+	assert.Equal(t, cm.DefaultControlNamespace, ns)
+	assert.Equal(t, cm.DefaultControlName, name)
+}
@@ -0,0 +1,225 @@
+package cm
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	cmapi "github.com/cert-manager/cert-manager/pkg/apis/certmanager/v1"
+	cmmeta "github.com/cert-manager/cert-manager/pkg/apis/meta/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// FormatText is the human readable output format for explanations
+const FormatText = "text"
+
+// Link is an object in a Certificate's issuance chain
+type Link struct {
+	Kind       string      `json:"kind"`
+	Namespace  string      `json:"namespace,omitempty"`
+	Name       string      `json:"name"`
+	Created    time.Time   `json:"created,omitempty"`
+	State      string      `json:"state,omitempty"`
+	Reason     string      `json:"reason,omitempty"`
+	Category   Category    `json:"category,omitempty"`
+	RetryAfter *time.Time  `json:"retryAfter,omitempty"`
+	RetryState *RetryState `json:"retryState,omitempty"`
+	Action     string      `json:"action,omitempty"`
+	Children   []*Link     `json:"children,omitempty"`
+}
+
+// Explain walks the issuance chain of a Certificate: its Issuer, and the
+// CertificateRequests, Orders and Challenges it owns
+func (w *Watcher) Explain(ctx context.Context, namespace, name string) (*Link, error) {
+	cert, err := w.c.CertmanagerV1().Certificates(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	crs, err := w.c.CertmanagerV1().CertificateRequests(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("listing certificate requests: %w", err)
+	}
+	orders, err := w.c.AcmeV1().Orders(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("listing orders: %w", err)
+	}
+	challenges, err := w.c.AcmeV1().Challenges(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("listing challenges: %w", err)
+	}
+
+	now := w.clock.Now()
+	root := &Link{Kind: "Certificate", Namespace: cert.Namespace, Name: cert.Name, Created: cert.CreationTimestamp.Time}
+	if cond := certCondition(cert, cmapi.CertificateConditionReady); cond != nil {
+		root.State = string(cond.Status)
+		if cond.Status != cmmeta.ConditionTrue {
+			root.Reason = cond.Message
+		}
+	}
+	if cond := certCondition(cert, cmapi.CertificateConditionIssuing); cond != nil && cond.Status == cmmeta.ConditionFalse && cert.Status.LastFailureTime != nil {
+		root.Reason = cond.Message
+		w.verdict(root, "Certificate", cert.ObjectMeta, cert.Spec.IssuerRef, ClassifyReason(cond.Message), now)
+	}
+	root.Children = append(root.Children, w.issuerLink(ctx, namespace, cert.Spec.IssuerRef))
+
+	for i := range crs.Items {
+		cr := &crs.Items[i]
+		if !ownedBy(cr.OwnerReferences, cert.UID) {
+			continue
+		}
+		crLink := &Link{Kind: "CertificateRequest", Namespace: cr.Namespace, Name: cr.Name, Created: cr.CreationTimestamp.Time}
+		if cond := crCondition(cr, cmapi.CertificateRequestConditionReady); cond != nil {
+			crLink.State = cond.Reason
+			crLink.Reason = cond.Message
+			if cond.Reason == cmapi.CertificateRequestReasonFailed {
+				w.verdict(crLink, "CertificateRequest", cr.ObjectMeta, cr.Spec.IssuerRef, ClassifyReason(cond.Message), now)
+			}
+		}
+		root.Children = append(root.Children, crLink)
+
+		for j := range orders.Items {
+			o := &orders.Items[j]
+			if !ownedBy(o.OwnerReferences, cr.UID) {
+				continue
+			}
+			oLink := &Link{Kind: "Order", Namespace: o.Namespace, Name: o.Name, Created: o.CreationTimestamp.Time, State: string(o.Status.State), Reason: o.Status.Reason}
+			w.verdict(oLink, "Order", o.ObjectMeta, o.Spec.IssuerRef, w.policy(o.Namespace).Classify(o.Status.State, o.Status.Reason), now)
+			crLink.Children = append(crLink.Children, oLink)
+
+			for k := range challenges.Items {
+				c := &challenges.Items[k]
+				if !ownedBy(c.OwnerReferences, o.UID) {
+					continue
+				}
+				cLink := &Link{Kind: "Challenge", Namespace: c.Namespace, Name: c.Name, Created: c.CreationTimestamp.Time, State: string(c.Status.State), Reason: c.Status.Reason}
+				w.verdict(cLink, "Challenge", c.ObjectMeta, c.Spec.IssuerRef, w.policy(c.Namespace).Classify(c.Status.State, c.Status.Reason), now)
+				oLink.Children = append(oLink.Children, cLink)
+			}
+		}
+	}
+
+	sortLinks(root)
+	return root, nil
+}
+
+// verdict records the classifier's verdict, the stored retry state and what
+// the watcher would do on the link
+func (w *Watcher) verdict(l *Link, kind string, meta metav1.ObjectMeta, issuer cmmeta.ObjectReference, v Verdict, now time.Time) {
+	l.Category = v.Category
+	if v.Category == CategoryNone {
+		return
+	}
+	if !v.RetryAfter.IsZero() {
+		t := v.RetryAfter
+		l.RetryAfter = &t
+	}
+	if s := RetryStateOf(meta); s.Attempts > 0 {
+		l.RetryState = &s
+	}
+	l.Action = w.action(kind, meta, issuer, v, now)
+}
+
+func (w *Watcher) issuerLink(ctx context.Context, namespace string, ref cmmeta.ObjectReference) *Link {
+	l := &Link{Kind: ref.Kind, Name: ref.Name}
+	if l.Kind == "" {
+		l.Kind = cmapi.IssuerKind
+	}
+	if ref.Group != "" && ref.Group != cmapi.SchemeGroupVersion.Group {
+		l.Kind = ref.Kind + "." + ref.Group
+		return l
+	}
+
+	if l.Kind != cmapi.ClusterIssuerKind {
+		l.Namespace = namespace
+	}
+	meta, status, err := w.issuer(ctx, namespace, ref)
+	if err != nil {
+		l.State = "Unknown"
+		l.Reason = err.Error()
+		return l
+	}
+
+	l.Created = meta.CreationTimestamp.Time
+	for _, cond := range status.Conditions {
+		if cond.Type == cmapi.IssuerConditionReady {
+			l.State = string(cond.Status)
+			l.Reason = cond.Message
+		}
+	}
+	return l
+}
+
+func ownedBy(refs []metav1.OwnerReference, uid types.UID) bool {
+	for _, ref := range refs {
+		if ref.UID == uid {
+			return true
+		}
+	}
+	return false
+}
+
+func sortLinks(l *Link) {
+	// Keep the issuer first, order everything else oldest first
+	sort.SliceStable(l.Children, func(i, j int) bool {
+		a, b := l.Children[i], l.Children[j]
+		if (a.Kind == "CertificateRequest") != (b.Kind == "CertificateRequest") {
+			return b.Kind == "CertificateRequest"
+		}
+		return a.Created.Before(b.Created)
+	})
+	for _, c := range l.Children {
+		sortLinks(c)
+	}
+}
+
+// Write writes the chain to out in the given format
+func (l *Link) Write(out io.Writer, format string) error {
+	switch format {
+	case FormatJSON:
+		return writeJSON(out, l)
+	case FormatYAML:
+		return writeYAML(out, l)
+	case FormatText, "":
+		l.writeText(out, 0, time.Now())
+		return nil
+	default:
+		return fmt.Errorf("unknown output format %q", format)
+	}
+}
+
+func (l *Link) writeText(out io.Writer, depth int, now time.Time) {
+	indent := strings.Repeat("  ", depth)
+	name := l.Name
+	if l.Namespace != "" {
+		name = l.Namespace + "/" + name
+	}
+	age := ""
+	if !l.Created.IsZero() {
+		age = fmt.Sprintf(" (age %s)", now.Sub(l.Created).Round(time.Second))
+	}
+	fmt.Fprintf(out, "%s%s %s%s\n", indent, l.Kind, name, age)
+
+	detail := func(key, value string) {
+		if value != "" {
+			fmt.Fprintf(out, "%s  %-12s %s\n", indent, key+":", value)
+		}
+	}
+	detail("state", l.State)
+	detail("reason", l.Reason)
+	detail("verdict", string(l.Category))
+	if l.RetryAfter != nil {
+		detail("retry after", l.RetryAfter.Format(time.RFC3339))
+	}
+	if l.RetryState != nil {
+		detail("resets", fmt.Sprintf("%d, last at %s", l.RetryState.Attempts, l.RetryState.LastReset.Format(time.RFC3339)))
+	}
+	detail("action", l.Action)
+
+	for _, c := range l.Children {
+		c.writeText(out, depth+1, now)
+	}
+}
@@ -0,0 +1,80 @@
+package cm_test
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/artificialinc/cm-429-fixer/pkg/cm"
+	acmev1 "github.com/cert-manager/cert-manager/pkg/apis/acme/v1"
+	cmapi "github.com/cert-manager/cert-manager/pkg/apis/certmanager/v1"
+	cmmeta "github.com/cert-manager/cert-manager/pkg/apis/meta/v1"
+	"github.com/cert-manager/cert-manager/pkg/client/clientset/versioned/fake"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestExplain(t *testing.T) {
+	cert := &cmapi.Certificate{
+		ObjectMeta: metav1.ObjectMeta{Name: "cert1", Namespace: "default", UID: "cert-uid"},
+		Spec:       cmapi.CertificateSpec{IssuerRef: cmmeta.ObjectReference{Name: "letsencrypt", Kind: cmapi.ClusterIssuerKind}},
+	}
+	issuer := &cmapi.ClusterIssuer{
+		ObjectMeta: metav1.ObjectMeta{Name: "letsencrypt"},
+		Status: cmapi.IssuerStatus{Conditions: []cmapi.IssuerCondition{{
+			Type:   cmapi.IssuerConditionReady,
+			Status: cmmeta.ConditionTrue,
+		}}},
+	}
+	cr := &cmapi.CertificateRequest{ObjectMeta: metav1.ObjectMeta{
+		Name:            "cert1-1",
+		Namespace:       "default",
+		UID:             "cr-uid",
+		OwnerReferences: []metav1.OwnerReference{{Kind: "Certificate", Name: "cert1", UID: "cert-uid"}},
+	}}
+	order := buildOrder("order1", "default", &acmev1.OrderStatus{
+		State:  acmev1.Errored,
+		Reason: "some 429 error",
+	})
+	order.UID = "order-uid"
+	order.OwnerReferences = []metav1.OwnerReference{{Kind: "CertificateRequest", Name: "cert1-1", UID: "cr-uid"}}
+	order.Annotations = map[string]string{
+		cm.AnnotationAttempts:  "2",
+		cm.AnnotationLastReset: "2024-08-20T12:00:00Z",
+	}
+	challenge := buildChallenge("challenge1", "default", &acmev1.ChallengeStatus{State: acmev1.Pending})
+	challenge.OwnerReferences = []metav1.OwnerReference{{Kind: "Order", Name: "order1", UID: "order-uid"}}
+
+	client := fake.NewSimpleClientset(cert, issuer, cr, order, challenge)
+	w := cm.NewWatcher(cm.WithClient(client))
+
+	chain, err := w.Explain(context.Background(), "default", "cert1")
+	assert.NoError(t, err)
+	assert.Equal(t, "Certificate", chain.Kind)
+	assert.Len(t, chain.Children, 2)
+
+	iss := chain.Children[0]
+	assert.Equal(t, cmapi.ClusterIssuerKind, iss.Kind)
+	assert.Equal(t, "True", iss.State)
+
+	req := chain.Children[1]
+	assert.Equal(t, "CertificateRequest", req.Kind)
+	assert.Len(t, req.Children, 1)
+
+	o := req.Children[0]
+	assert.Equal(t, "order1", o.Name)
+	assert.Equal(t, cm.CategoryRateLimited, o.Category)
+	assert.Equal(t, 2, o.RetryState.Attempts)
+	assert.Contains(t, o.Action, "reset to pending")
+	assert.Len(t, o.Children, 1)
+	assert.Equal(t, "challenge1", o.Children[0].Name)
+
+	for _, format := range []string{cm.FormatText, cm.FormatJSON, cm.FormatYAML} {
+		var out bytes.Buffer
+		assert.NoError(t, chain.Write(&out, format))
+		assert.Contains(t, out.String(), "order1")
+	}
+
+	_, err = w.Explain(context.Background(), "default", "missing")
+	assert.Error(t, err)
+}
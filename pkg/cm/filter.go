@@ -0,0 +1,97 @@
+package cm
+
+import (
+	acmev1 "github.com/cert-manager/cert-manager/pkg/apis/acme/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	apiwatch "k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+)
+
+// ErroredFieldSelector selects Errored Orders and Challenges. The API server
+// only accepts it once the cert-manager CRDs declare .status.state as a
+// selectable field, which needs Kubernetes 1.31 or later.
+const ErroredFieldSelector = "status.state=" + string(acmev1.Errored)
+
+// WithServerSideFilter asks the API server to only send Errored Orders and
+// Challenges using ErroredFieldSelector. List and watch calls fail, and the
+// watcher reports not ready, if the CRDs don't support it.
+func WithServerSideFilter() Option {
+	return func(w *Watcher) {
+		w.serverSideFilter = true
+	}
+}
+
+// wanted returns false for Orders and Challenges that need no attention: those
+// that haven't errored, unless the fixer has reset them and they aren't Valid
+// yet. It only reads the state and annotations, so it is cheap enough to run
+// on every event.
+func wanted(obj runtime.Object) bool {
+	switch o := obj.(type) {
+	case *acmev1.Order:
+		return wantedState(o.Status.State, o.Annotations)
+	case *acmev1.Challenge:
+		return wantedState(o.Status.State, o.Annotations)
+	}
+	return true
+}
+
+func wantedState(state acmev1.State, annotations map[string]string) bool {
+	if state == acmev1.Errored {
+		return true
+	}
+	_, reset := annotations[AnnotationAttempts]
+	return reset && state != acmev1.Valid
+}
+
+// wantedListWatcher drops objects that aren't wanted before they reach the
+// informer, much like the server side filter. Listed objects are left out
+// and watch events for them become deletes, so the informer forgets objects
+// that have recovered and never queues the rest.
+type wantedListWatcher struct {
+	lw cache.ListerWatcher
+}
+
+func (l *wantedListWatcher) List(options metav1.ListOptions) (runtime.Object, error) {
+	o, err := l.lw.List(options)
+	if err != nil {
+		return nil, err
+	}
+	switch list := o.(type) {
+	case *acmev1.OrderList:
+		// Copy rather than filter in place so the dropped items can be freed
+		items := []acmev1.Order{}
+		for i := range list.Items {
+			if wanted(&list.Items[i]) {
+				items = append(items, list.Items[i])
+			}
+		}
+		list.Items = items
+	case *acmev1.ChallengeList:
+		items := []acmev1.Challenge{}
+		for i := range list.Items {
+			if wanted(&list.Items[i]) {
+				items = append(items, list.Items[i])
+			}
+		}
+		list.Items = items
+	}
+	return o, nil
+}
+
+func (l *wantedListWatcher) Watch(options metav1.ListOptions) (apiwatch.Interface, error) {
+	w, err := l.lw.Watch(options)
+	if err != nil {
+		return nil, err
+	}
+	return apiwatch.Filter(w, wantedEvent), nil
+}
+
+// wantedEvent turns events for objects that aren't wanted into deletes.
+// The informer ignores deletes of objects it doesn't know about.
+func wantedEvent(e apiwatch.Event) (apiwatch.Event, bool) {
+	if (e.Type == apiwatch.Added || e.Type == apiwatch.Modified) && !wanted(e.Object) {
+		e.Type = apiwatch.Deleted
+	}
+	return e, true
+}
@@ -0,0 +1,122 @@
+package cm_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/artificialinc/cm-429-fixer/pkg/cm"
+	acmev1 "github.com/cert-manager/cert-manager/pkg/apis/acme/v1"
+	cmmeta "github.com/cert-manager/cert-manager/pkg/apis/meta/v1"
+	"github.com/cert-manager/cert-manager/pkg/client/clientset/versioned/fake"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestWatcherServerSideFilter(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	client := fake.NewSimpleClientset()
+	selectors := make(chan string, 10)
+	client.PrependReactor("list", "*", func(a k8stesting.Action) (bool, runtime.Object, error) {
+		selectors <- a.(k8stesting.ListAction).GetListRestrictions().Fields.String()
+		return false, nil, nil
+	})
+
+	w := cm.NewWatcher(cm.WithClient(client), cm.WithServerSideFilter())
+	go w.Run(ctx)
+	assert.NoError(t, w.Readiness().Wait(ctx))
+
+	assert.Equal(t, cm.ErroredFieldSelector, <-selectors)
+	assert.Equal(t, cm.ErroredFieldSelector, <-selectors)
+}
+
+func TestWatcherServerSideFilterRecovered(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	order := buildOrder("order1", "default", &acmev1.OrderStatus{
+		State:  acmev1.Errored,
+		Reason: "429 urn:ietf:params:acme:error:rateLimited: too many certificates",
+	})
+	order.UID = "order1-uid"
+	order.Spec.IssuerRef = cmmeta.ObjectReference{Name: "letsencrypt", Kind: "ClusterIssuer"}
+	order.Spec.DNSNames = []string{"example.com"}
+	client := fake.NewSimpleClientset(order)
+	orders := watch.NewFake()
+	client.PrependWatchReactor("orders", func(k8stesting.Action) (bool, watch.Interface, error) {
+		return true, orders, nil
+	})
+	dyn := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		cm.IncidentGVR: cm.IncidentKind + "List",
+	})
+
+	tracker := cm.NewTracker()
+	w := cm.NewWatcher(cm.WithClient(client), cm.WithServerSideFilter(), cm.WithTracker(tracker), cm.WithIncidents(dyn), cm.WithUpdateDelay(time.Hour))
+	go w.Run(ctx)
+	assert.NoError(t, w.Readiness().Wait(ctx))
+	assert.Eventually(t, func() bool {
+		incidents, err := w.Incidents(ctx, "default")
+		return err == nil && len(incidents) == 1 && len(tracker.Limits(time.Now())) == 1
+	}, 10*time.Second, 50*time.Millisecond)
+
+	// The API server sends the last Errored object once the Order no longer
+	// matches the selector, the watcher looks up that it is Valid
+	valid := order.DeepCopy()
+	valid.Status = acmev1.OrderStatus{State: acmev1.Valid}
+	_, err := client.AcmeV1().Orders("default").UpdateStatus(ctx, valid, metav1.UpdateOptions{})
+	assert.NoError(t, err)
+	orders.Delete(order)
+	assert.Eventually(t, func() bool {
+		incidents, err := w.Incidents(ctx, "default")
+		return err == nil && len(incidents) == 0 && len(tracker.Limits(time.Now())) == 0
+	}, 10*time.Second, 50*time.Millisecond)
+}
+
+// BenchmarkWatcherEvents measures how fast the watcher consumes order updates.
+// Valid orders are dropped before reaching the informer's queue, errored ones
+// are cached and classified.
+func BenchmarkWatcherEvents(b *testing.B) {
+	for _, bc := range []struct {
+		name   string
+		status acmev1.OrderStatus
+	}{
+		{name: "valid", status: acmev1.OrderStatus{State: acmev1.Valid}},
+		{name: "errored", status: acmev1.OrderStatus{State: acmev1.Errored, Reason: "connection refused"}},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			client := fake.NewSimpleClientset()
+			orders := watch.NewFake()
+			client.PrependWatchReactor("orders", func(k8stesting.Action) (bool, watch.Interface, error) {
+				return true, orders, nil
+			})
+
+			w := cm.NewWatcher(cm.WithClient(client))
+			go w.Run(ctx)
+			waitCtx, waitCancel := context.WithTimeout(ctx, 10*time.Second)
+			defer waitCancel()
+			if err := w.Readiness().Wait(waitCtx); err != nil {
+				b.Fatal(err)
+			}
+
+			order := buildOrder("order1", "default", &bc.status)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				orders.Modify(order)
+			}
+			b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "events/s")
+		})
+	}
+}
@@ -0,0 +1,116 @@
+package cm
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	apiwatch "k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/utils/clock"
+)
+
+// InformerHealth is the list/watch health of one of the watcher's informers
+type InformerHealth struct {
+	Name         string    `json:"name"`
+	Synced       bool      `json:"synced"`
+	Healthy      bool      `json:"healthy"`
+	LastSuccess  time.Time `json:"lastSuccess,omitempty"`
+	FailingSince time.Time `json:"failingSince,omitempty"`
+	LastError    string    `json:"lastError,omitempty"`
+}
+
+// informerHealth tracks the outcome of an informer's list and watch calls
+type informerHealth struct {
+	name  string
+	clock clock.PassiveClock
+
+	mu           sync.Mutex
+	synced       bool
+	lastSuccess  time.Time
+	failingSince time.Time
+	lastError    error
+}
+
+func (h *informerHealth) success() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastSuccess = h.clock.Now()
+	h.failingSince = time.Time{}
+	h.lastError = nil
+}
+
+func (h *informerHealth) failure(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.failingSince.IsZero() {
+		h.failingSince = h.clock.Now()
+	}
+	h.lastError = err
+}
+
+func (h *informerHealth) setSynced() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.synced = true
+}
+
+// status reports the informer as healthy if it has synced and its list and
+// watch calls haven't been failing for longer than the threshold
+func (h *informerHealth) status(now time.Time, threshold time.Duration) InformerHealth {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := InformerHealth{
+		Name:         h.name,
+		Synced:       h.synced,
+		LastSuccess:  h.lastSuccess,
+		FailingSince: h.failingSince,
+	}
+	if h.lastError != nil {
+		s.LastError = h.lastError.Error()
+	}
+	s.Healthy = h.synced && (h.failingSince.IsZero() || now.Sub(h.failingSince) < threshold)
+	return s
+}
+
+// healthListWatcher records the outcome of list and watch calls
+type healthListWatcher struct {
+	lw     cache.ListerWatcher
+	health *informerHealth
+}
+
+func (l *healthListWatcher) List(options metav1.ListOptions) (runtime.Object, error) {
+	o, err := l.lw.List(options)
+	if err != nil {
+		l.health.failure(err)
+		return nil, err
+	}
+	l.health.success()
+	return o, nil
+}
+
+func (l *healthListWatcher) Watch(options metav1.ListOptions) (apiwatch.Interface, error) {
+	o, err := l.lw.Watch(options)
+	if err != nil {
+		l.health.failure(err)
+		return nil, err
+	}
+	l.health.success()
+	return o, nil
+}
+
+// Health returns the list/watch health of the watcher's informers
+func (w *Watcher) Health() []InformerHealth {
+	w.healthMu.Lock()
+	defer w.healthMu.Unlock()
+
+	now := w.clock.Now()
+	var out []InformerHealth
+	for _, h := range w.health {
+		out = append(out, h.status(now, w.watchFailureThreshold))
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
@@ -0,0 +1,68 @@
+package cm_test
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/artificialinc/cm-429-fixer/pkg/cm"
+	"github.com/cert-manager/cert-manager/pkg/client/clientset/versioned/fake"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestWatcherWatchFailure(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	client := fake.NewSimpleClientset()
+
+	var failing atomic.Bool
+	orderWatches := make(chan *watch.FakeWatcher, 10)
+	client.PrependReactor("list", "orders", func(k8stesting.Action) (bool, runtime.Object, error) {
+		if failing.Load() {
+			return true, nil, errors.New("orders is forbidden")
+		}
+		return false, nil, nil
+	})
+	client.PrependWatchReactor("orders", func(k8stesting.Action) (bool, watch.Interface, error) {
+		if failing.Load() {
+			return true, nil, errors.New("orders is forbidden")
+		}
+		fw := watch.NewFake()
+		orderWatches <- fw
+		return true, fw, nil
+	})
+
+	w := cm.NewWatcher(
+		cm.WithClient(client),
+		cm.WithWatchFailureThreshold(time.Millisecond),
+	)
+	go w.Run(ctx)
+
+	assert.NoError(t, w.Readiness().Wait(ctx))
+
+	// Break the watch, the informer relists and keeps failing
+	failing.Store(true)
+	(<-orderWatches).Stop()
+
+	assert.Eventually(t, func() bool { return !w.Readiness().Ready() }, 10*time.Second, 50*time.Millisecond)
+	for _, h := range w.Health() {
+		if h.Name == "orders" {
+			assert.False(t, h.Healthy)
+			assert.Contains(t, h.LastError, "forbidden")
+			assert.False(t, h.FailingSince.IsZero())
+		} else {
+			assert.True(t, h.Healthy)
+		}
+	}
+
+	// Recovers once the calls succeed again
+	failing.Store(false)
+	assert.Eventually(t, func() bool { return w.Readiness().Ready() }, 10*time.Second, 50*time.Millisecond)
+}
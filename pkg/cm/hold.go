@@ -0,0 +1,371 @@
+package cm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/artificialinc/cm-429-fixer/pkg/audit"
+	cmapi "github.com/cert-manager/cert-manager/pkg/apis/certmanager/v1"
+	cmmeta "github.com/cert-manager/cert-manager/pkg/apis/meta/v1"
+	"go.opentelemetry.io/otel/trace"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/retry"
+)
+
+const (
+	// AnnotationHoldUntil is set on held Certificates to the time the hold ends
+	AnnotationHoldUntil = "cm-429-fixer.artificial.com/hold-until"
+	// AnnotationHoldRecord records the changes a hold made to a Certificate
+	// as a JSON HoldRecord, so they can be undone
+	AnnotationHoldRecord = "cm-429-fixer.artificial.com/hold-record"
+)
+
+// HoldRecord is what a hold changed on a Certificate
+type HoldRecord struct {
+	Until  time.Time `json:"until"`
+	Reason string    `json:"reason"`
+	// OriginalRenewBefore is the renewBefore before the hold, nil if unset
+	OriginalRenewBefore *metav1.Duration `json:"originalRenewBefore,omitempty"`
+	// RenewBefore is the renewBefore the hold set, nil if it wasn't changed
+	RenewBefore *metav1.Duration `json:"renewBefore,omitempty"`
+}
+
+// HoldRecordOf reads the hold record of a Certificate, nil if it isn't held
+func HoldRecordOf(meta metav1.ObjectMeta) (*HoldRecord, error) {
+	raw, ok := meta.Annotations[AnnotationHoldRecord]
+	if !ok {
+		return nil, nil
+	}
+	var r HoldRecord
+	if err := json.Unmarshal([]byte(raw), &r); err != nil {
+		return nil, fmt.Errorf("reading hold record of %s/%s: %w", meta.Namespace, meta.Name, err)
+	}
+	return &r, nil
+}
+
+// WithHoldAfter holds the Certificate of a rate limited object instead of
+// resetting it when the ACME server asks to wait longer than d. Zero, the
+// default, never holds.
+func WithHoldAfter(d time.Duration) Option {
+	return func(w *Watcher) {
+		w.holdAfter = d
+	}
+}
+
+// shouldHold returns true if the verdict asks to wait long enough to hold
+func (w *Watcher) shouldHold(v Verdict, now time.Time) bool {
+	return w.holdAfter > 0 && v.RetryAfter.Sub(now) > w.holdAfter
+}
+
+// holdFor holds the Certificate a rate limited object was issued for, unless
+// changes to it are paused. When the Certificate can't be held, the object is
+// reset after the delay as if it wasn't limited for long.
+func (w *Watcher) holdFor(kind string, meta metav1.ObjectMeta, issuer cmmeta.ObjectReference, until time.Time, reason string, delay time.Duration, detected trace.SpanContext) {
+	if w.gated(kind, meta.Namespace, meta.Name, issuer, false) {
+		w.done(kind, meta.Namespace, meta.Name)
+		return
+	}
+	ctx := context.Background()
+	log := w.log.WithValues(strings.ToLower(kind), meta.Name, "namespace", meta.Namespace)
+
+	cert, err := w.certificateOf(ctx, meta)
+	if err == nil {
+		err = w.Hold(ctx, meta.Namespace, cert, until, reason)
+	}
+	switch {
+	case err == nil:
+		log.Info("Rate limited for long, holding certificate instead of resetting", "certificate", cert, "until", until)
+		w.scheduleRelease(meta.Namespace, cert, until)
+	case cert == "" || errors.Is(err, ErrNotHeld):
+		log.Info("Rate limited for long, but the certificate can't be held, resetting instead", "certificate", cert, "reason", err.Error())
+		queued := &QueuedReset{Kind: kind, Namespace: meta.Namespace, Name: meta.Name, Stage: StageDelay, Due: w.clock.Now().Add(delay)}
+		w.queueReset(queued)
+		w.scheduleReset(kind, meta, issuer, queued, detected)
+		return
+	default:
+		log.Error(err, "Error holding certificate", "certificate", cert)
+	}
+	w.done(kind, meta.Namespace, meta.Name)
+}
+
+// certificateOf follows an object's owners up to its Certificate
+func (w *Watcher) certificateOf(ctx context.Context, meta metav1.ObjectMeta) (string, error) {
+	refs := meta.OwnerReferences
+	for len(refs) > 0 {
+		ref := refs[0]
+		switch ref.Kind {
+		case cmapi.CertificateKind:
+			return ref.Name, nil
+		case cmapi.CertificateRequestKind:
+			cr, err := w.c.CertmanagerV1().CertificateRequests(meta.Namespace).Get(ctx, ref.Name, metav1.GetOptions{})
+			if err != nil {
+				return "", err
+			}
+			refs = cr.OwnerReferences
+		case "Order":
+			o, err := w.c.AcmeV1().Orders(meta.Namespace).Get(ctx, ref.Name, metav1.GetOptions{})
+			if err != nil {
+				return "", err
+			}
+			refs = o.OwnerReferences
+		default:
+			return "", fmt.Errorf("unexpected owner %s %s", ref.Kind, ref.Name)
+		}
+	}
+	return "", fmt.Errorf("%s/%s isn't owned by a Certificate", meta.Namespace, meta.Name)
+}
+
+// ErrNotHeld is returned when holding a Certificate wouldn't stop cert-manager
+// from retrying it
+var ErrNotHeld = errors.New("certificate can't be held")
+
+// Hold stops cert-manager from retrying the Certificate until the given time.
+// The Certificate is annotated with the hold and its renewBefore is lowered
+// so renewal isn't due until the hold ends, but no earlier than cert-manager
+// allows. What was changed is recorded on the Certificate for ReleaseHold.
+// Holding a held Certificate extends the hold. Certificates that have never
+// been issued, that expire before the hold ends or whose renewBefore can't be
+// changed, e.g. as they set renewBeforePercentage, can't be held and
+// ErrNotHeld is returned.
+func (w *Watcher) Hold(ctx context.Context, namespace, name string, until time.Time, reason string) error {
+	changed := false
+	var audited *audit.Record
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		cert, err := w.c.CertmanagerV1().Certificates(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if err := w.checkSwitchedOff(cmapi.CertificateKind, namespace, name, cert.Spec.IssuerRef); err != nil {
+			return err
+		}
+		record, err := HoldRecordOf(cert.ObjectMeta)
+		if err != nil {
+			return err
+		}
+		if record == nil {
+			record = &HoldRecord{OriginalRenewBefore: cert.Spec.RenewBefore}
+		} else if !until.After(record.Until) {
+			return nil
+		}
+		record.Until = until.UTC().Truncate(time.Second)
+		record.Reason = reason
+
+		switch {
+		case cert.Status.NotAfter == nil:
+			return fmt.Errorf("%w: %s/%s has never been issued", ErrNotHeld, namespace, name)
+		case !cert.Status.NotAfter.After(record.Until):
+			return fmt.Errorf("%w: %s/%s expires before the hold ends", ErrNotHeld, namespace, name)
+		}
+		renewBefore := cert.Status.NotAfter.Sub(record.Until).Truncate(time.Second)
+		if renewBefore < cmapi.MinimumRenewBefore {
+			w.log.V(1).Info("Certificate expires soon after the hold ends, holding for less", "certificate", name, "namespace", namespace, "renewBefore", cmapi.MinimumRenewBefore)
+			renewBefore = cmapi.MinimumRenewBefore
+		}
+		record.RenewBefore = &metav1.Duration{Duration: renewBefore}
+		raw, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		patch, err := json.Marshal(map[string]interface{}{
+			"metadata": map[string]interface{}{
+				"resourceVersion": cert.ResourceVersion,
+				"annotations": map[string]string{
+					AnnotationHoldUntil:  record.Until.Format(time.RFC3339),
+					AnnotationHoldRecord: string(raw),
+				},
+			},
+			"spec": map[string]interface{}{"renewBefore": record.RenewBefore},
+		})
+		if err != nil {
+			return err
+		}
+		audited = holdRecord(cert.ObjectMeta, fmt.Sprintf("hold-after %s", w.holdAfter), reason)
+		updated, err := w.c.CertmanagerV1().Certificates(namespace).Patch(ctx, name, types.MergePatchType, patch, metav1.PatchOptions{})
+		if apierrors.IsInvalid(err) || apierrors.IsForbidden(err) {
+			return fmt.Errorf("%w: renewBefore of %s/%s can't be changed: %w", ErrNotHeld, namespace, name, err)
+		}
+		if err == nil {
+			changed = true
+			audited.ResourceVersionAfter = updated.ResourceVersion
+		}
+		return err
+	})
+	if changed {
+		holdsTotal.WithLabelValues(w.cluster, "hold").Inc()
+	}
+	if changed || (audited != nil && err != nil) {
+		w.audit(*audited, err)
+	}
+	return err
+}
+
+// holdRecord is the audit record of a change to a Certificate's hold
+func holdRecord(meta metav1.ObjectMeta, rule, reason string) *audit.Record {
+	return &audit.Record{
+		Action:                audit.ActionAnnotate,
+		Object:                audit.Object{Kind: cmapi.CertificateKind, Namespace: meta.Namespace, Name: meta.Name, UID: string(meta.UID)},
+		ResourceVersionBefore: meta.ResourceVersion,
+		Rule:                  rule,
+		Reason:                reason,
+	}
+}
+
+// ReleaseHold undoes a hold. The original renewBefore is only restored if
+// the hold's value is still in place, so later changes by others are kept.
+// The actor names who released it in the audit log, the watcher if empty.
+func (w *Watcher) ReleaseHold(ctx context.Context, namespace, name, actor string) error {
+	changed := false
+	var audited *audit.Record
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		cert, err := w.c.CertmanagerV1().Certificates(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if err := w.checkSwitchedOff(cmapi.CertificateKind, namespace, name, cert.Spec.IssuerRef); err != nil {
+			return err
+		}
+		record, err := HoldRecordOf(cert.ObjectMeta)
+		if err != nil || record == nil {
+			return err
+		}
+
+		patch := map[string]interface{}{
+			"metadata": map[string]interface{}{
+				"resourceVersion": cert.ResourceVersion,
+				"annotations":     map[string]interface{}{AnnotationHoldUntil: nil, AnnotationHoldRecord: nil},
+			},
+		}
+		if record.RenewBefore != nil && cert.Spec.RenewBefore != nil && *cert.Spec.RenewBefore == *record.RenewBefore {
+			patch["spec"] = map[string]interface{}{"renewBefore": record.OriginalRenewBefore}
+		}
+		raw, err := json.Marshal(patch)
+		if err != nil {
+			return err
+		}
+		audited = holdRecord(cert.ObjectMeta, "hold ended", "released hold until "+record.Until.Format(time.RFC3339))
+		audited.Actor = actor
+		updated, err := w.c.CertmanagerV1().Certificates(namespace).Patch(ctx, name, types.MergePatchType, raw, metav1.PatchOptions{})
+		if err == nil {
+			changed = true
+			audited.ResourceVersionAfter = updated.ResourceVersion
+		}
+		return err
+	})
+	if changed {
+		holdsTotal.WithLabelValues(w.cluster, "release").Inc()
+	}
+	if changed || (audited != nil && err != nil) {
+		w.audit(*audited, err)
+	}
+	return err
+}
+
+// scheduleRelease releases the hold once it ends, unless it has been extended.
+// Each Certificate has at most one release scheduled, for its latest hold.
+func (w *Watcher) scheduleRelease(namespace, name string, until time.Time) {
+	key := namespace + "/" + name
+	w.queueMu.Lock()
+	defer w.queueMu.Unlock()
+	if r, ok := w.releases[key]; ok {
+		if !until.After(r.until) {
+			return
+		}
+		r.timer.Stop()
+	}
+	r := &release{until: until}
+	w.releases[key] = r
+	r.timer = w.clock.AfterFunc(until.Sub(w.clock.Now()), func() {
+		w.queueMu.Lock()
+		if w.releases[key] == r {
+			delete(w.releases, key)
+		}
+		w.queueMu.Unlock()
+		w.releaseDue(context.Background(), namespace, name)
+	})
+}
+
+// releaseDue releases the Certificate's hold if it has ended
+func (w *Watcher) releaseDue(ctx context.Context, namespace, name string) {
+	cert, err := w.c.CertmanagerV1().Certificates(namespace).Get(ctx, name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return
+	}
+	if err != nil {
+		w.log.Error(err, "Error getting held certificate", "certificate", name, "namespace", namespace)
+		return
+	}
+	record, err := HoldRecordOf(cert.ObjectMeta)
+	if err != nil {
+		w.log.Error(err, "Unable to release hold")
+		return
+	}
+	if record == nil || w.clock.Now().Before(record.Until) {
+		return
+	}
+	// Paused holds are released by releaseHolds once resumed
+	if w.gated(cmapi.CertificateKind, namespace, name, cert.Spec.IssuerRef, false) {
+		return
+	}
+	if err := w.ReleaseHold(ctx, namespace, name, ""); err != nil {
+		w.log.Error(err, "Error releasing hold", "certificate", name, "namespace", namespace)
+		return
+	}
+	w.log.Info("Hold ended, certificate released", "certificate", name, "namespace", namespace)
+}
+
+// releaseHolds releases the holds that have ended. Holds are normally released
+// on time by the watcher that made them, this catches the ones missed while
+// the watcher wasn't running.
+func (w *Watcher) releaseHolds(ctx context.Context) {
+	certs, err := w.c.CertmanagerV1().Certificates(w.namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		w.log.Error(err, "Error listing certificates")
+		return
+	}
+	for _, cert := range certs.Items {
+		if _, ok := cert.Annotations[AnnotationHoldRecord]; ok {
+			w.releaseDue(ctx, cert.Namespace, cert.Name)
+		}
+	}
+}
+
+// Held is a Certificate held by the fixer
+type Held struct {
+	Namespace string    `json:"namespace"`
+	Name      string    `json:"name"`
+	Domains   []string  `json:"domains"`
+	Until     time.Time `json:"until"`
+	Reason    string    `json:"reason"`
+}
+
+// Holds lists the Certificates the fixer holds
+func (w *Watcher) Holds(ctx context.Context) ([]Held, error) {
+	certs, err := w.c.CertmanagerV1().Certificates(w.namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("listing certificates: %w", err)
+	}
+	held := []Held{}
+	for _, cert := range certs.Items {
+		record, err := HoldRecordOf(cert.ObjectMeta)
+		if err != nil {
+			return nil, err
+		}
+		if record == nil {
+			continue
+		}
+		held = append(held, Held{
+			Namespace: cert.Namespace,
+			Name:      cert.Name,
+			Domains:   cert.Spec.DNSNames,
+			Until:     record.Until,
+			Reason:    record.Reason,
+		})
+	}
+	return held, nil
+}
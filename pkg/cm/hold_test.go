@@ -0,0 +1,187 @@
+package cm_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/artificialinc/cm-429-fixer/pkg/cm"
+	acmev1 "github.com/cert-manager/cert-manager/pkg/apis/acme/v1"
+	cmapi "github.com/cert-manager/cert-manager/pkg/apis/certmanager/v1"
+	"github.com/cert-manager/cert-manager/pkg/client/clientset/versioned/fake"
+	"github.com/stretchr/testify/assert"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clienttesting "k8s.io/client-go/testing"
+)
+
+func TestWatcherHold(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	notAfter := metav1.NewTime(time.Now().Add(30 * 24 * time.Hour))
+	cert := &cmapi.Certificate{
+		ObjectMeta: metav1.ObjectMeta{Name: "cert1", Namespace: "default", UID: "cert-uid"},
+		Status:     cmapi.CertificateStatus{NotAfter: &notAfter},
+	}
+	cr := &cmapi.CertificateRequest{ObjectMeta: metav1.ObjectMeta{
+		Name:            "cert1-1",
+		Namespace:       "default",
+		UID:             "cr-uid",
+		OwnerReferences: []metav1.OwnerReference{{Kind: "Certificate", Name: "cert1", UID: "cert-uid"}},
+	}}
+	retryAfter := time.Now().Add(3 * time.Second).UTC().Truncate(time.Second)
+	order := buildOrder("order1", "default", &acmev1.OrderStatus{
+		State:  acmev1.Errored,
+		Reason: "429 rateLimited: too many certificates, retry after " + retryAfter.Format("2006-01-02 15:04:05 UTC"),
+	})
+	order.OwnerReferences = []metav1.OwnerReference{{Kind: "CertificateRequest", Name: "cert1-1", UID: "cr-uid"}}
+	client := fake.NewSimpleClientset(cert, cr, order)
+
+	w := cm.NewWatcher(cm.WithClient(client), cm.WithHoldAfter(time.Second))
+	go w.Run(ctx)
+	assert.NoError(t, w.Readiness().Wait(ctx))
+
+	// The certificate is held until the retry-after time, its renewal pushed
+	// back to then
+	var record *cm.HoldRecord
+	assert.Eventually(t, func() bool {
+		c, err := client.CertmanagerV1().Certificates("default").Get(ctx, "cert1", metav1.GetOptions{})
+		if err != nil {
+			return false
+		}
+		record, err = cm.HoldRecordOf(c.ObjectMeta)
+		return err == nil && record != nil && c.Spec.RenewBefore != nil
+	}, 10*time.Second, 50*time.Millisecond)
+	assert.True(t, record.Until.Equal(retryAfter), "expected %v, got %v", retryAfter, record.Until)
+	assert.Nil(t, record.OriginalRenewBefore)
+	assert.InDelta(t, notAfter.Sub(retryAfter).Seconds(), record.RenewBefore.Seconds(), 1)
+
+	// The order is left alone while the certificate is held
+	o, err := client.AcmeV1().Orders("default").Get(ctx, "order1", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, acmev1.Errored, o.Status.State)
+
+	// Once the hold ends the original settings are restored
+	assert.Eventually(t, func() bool {
+		c, err := client.CertmanagerV1().Certificates("default").Get(ctx, "cert1", metav1.GetOptions{})
+		if err != nil {
+			return false
+		}
+		_, held := c.Annotations[cm.AnnotationHoldUntil]
+		return !held && c.Spec.RenewBefore == nil
+	}, 10*time.Second, 50*time.Millisecond)
+}
+
+func TestReleaseHoldKeepsChanges(t *testing.T) {
+	ctx := context.Background()
+	notAfter := metav1.NewTime(time.Now().Add(30 * 24 * time.Hour))
+	original := &metav1.Duration{Duration: 24 * time.Hour}
+	client := fake.NewSimpleClientset(&cmapi.Certificate{
+		ObjectMeta: metav1.ObjectMeta{Name: "cert1", Namespace: "default"},
+		Spec:       cmapi.CertificateSpec{RenewBefore: original},
+		Status:     cmapi.CertificateStatus{NotAfter: &notAfter},
+	})
+	w := cm.NewWatcher(cm.WithClient(client))
+
+	assert.NoError(t, w.Hold(ctx, "default", "cert1", time.Now().Add(time.Hour), "rate limited"))
+	c, err := client.CertmanagerV1().Certificates("default").Get(ctx, "cert1", metav1.GetOptions{})
+	assert.NoError(t, err)
+	record, err := cm.HoldRecordOf(c.ObjectMeta)
+	assert.NoError(t, err)
+	assert.Equal(t, original, record.OriginalRenewBefore)
+
+	// Holding again for less doesn't shorten the hold
+	assert.NoError(t, w.Hold(ctx, "default", "cert1", time.Now(), "rate limited"))
+	c, err = client.CertmanagerV1().Certificates("default").Get(ctx, "cert1", metav1.GetOptions{})
+	assert.NoError(t, err)
+	again, err := cm.HoldRecordOf(c.ObjectMeta)
+	assert.NoError(t, err)
+	assert.Equal(t, record.Until, again.Until)
+
+	// Someone changes renewBefore during the hold, the release keeps it
+	changed := &metav1.Duration{Duration: 48 * time.Hour}
+	c.Spec.RenewBefore = changed
+	_, err = client.CertmanagerV1().Certificates("default").Update(ctx, c, metav1.UpdateOptions{})
+	assert.NoError(t, err)
+
+	held, err := w.Holds(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []cm.Held{{Namespace: "default", Name: "cert1", Until: record.Until, Reason: "rate limited"}}, held)
+
+	assert.NoError(t, w.ReleaseHold(ctx, "default", "cert1", ""))
+	held, err = w.Holds(ctx)
+	assert.NoError(t, err)
+	assert.Empty(t, held)
+	c, err = client.CertmanagerV1().Certificates("default").Get(ctx, "cert1", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, changed, c.Spec.RenewBefore)
+	assert.NotContains(t, c.Annotations, cm.AnnotationHoldRecord)
+	assert.NotContains(t, c.Annotations, cm.AnnotationHoldUntil)
+}
+
+func TestHoldNotHeld(t *testing.T) {
+	ctx := context.Background()
+	until := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	soon := metav1.NewTime(until.Add(time.Minute))
+	client := fake.NewSimpleClientset(
+		&cmapi.Certificate{ObjectMeta: metav1.ObjectMeta{Name: "new", Namespace: "default"}},
+		&cmapi.Certificate{ObjectMeta: metav1.ObjectMeta{Name: "expiring", Namespace: "default"}, Status: cmapi.CertificateStatus{NotAfter: &soon}},
+	)
+	w := cm.NewWatcher(cm.WithClient(client))
+
+	// cert-manager retries a Certificate that has never been issued whatever
+	// its renewBefore
+	err := w.Hold(ctx, "default", "new", until, "rate limited")
+	assert.ErrorIs(t, err, cm.ErrNotHeld)
+	c, err := client.CertmanagerV1().Certificates("default").Get(ctx, "new", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Empty(t, c.Annotations)
+
+	// renewBefore isn't lowered below cert-manager's minimum
+	assert.NoError(t, w.Hold(ctx, "default", "expiring", until, "rate limited"))
+	c, err = client.CertmanagerV1().Certificates("default").Get(ctx, "expiring", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, &metav1.Duration{Duration: cmapi.MinimumRenewBefore}, c.Spec.RenewBefore)
+	// A hold can't outlast the certificate
+	assert.ErrorIs(t, w.Hold(ctx, "default", "expiring", soon.Add(time.Minute), "rate limited"), cm.ErrNotHeld)
+
+	// A renewBefore cert-manager rejects, e.g. next to renewBeforePercentage,
+	// can't hold the Certificate either
+	client.PrependReactor("patch", "certificates", func(clienttesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewInvalid(cmapi.SchemeGroupVersion.WithKind(cmapi.CertificateKind).GroupKind(), "expiring", nil)
+	})
+	assert.ErrorIs(t, w.Hold(ctx, "default", "expiring", soon.Add(-time.Second), "rate limited"), cm.ErrNotHeld)
+}
+
+func TestWatcherHoldNotHeld(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	clk := newTestClock()
+	retryAfter := clk.Now().Add(2 * time.Hour)
+	cert := &cmapi.Certificate{ObjectMeta: metav1.ObjectMeta{Name: "cert1", Namespace: "default", UID: "cert-uid"}}
+	order := buildOrder("order1", "default", &acmev1.OrderStatus{
+		State:  acmev1.Errored,
+		Reason: "429 rateLimited: too many certificates, retry after " + retryAfter.Format("2006-01-02 15:04:05 UTC"),
+	})
+	order.OwnerReferences = []metav1.OwnerReference{{Kind: "Certificate", Name: "cert1", UID: "cert-uid"}}
+	client := fake.NewSimpleClientset(cert, order)
+	w := cm.NewWatcher(cm.WithClient(client), cm.WithClock(clk), cm.WithHoldAfter(time.Hour))
+	clk.run(t, ctx, w)
+
+	// The certificate has never been issued, so the order is reset once the
+	// limit has passed instead
+	waitFor(t, func() bool {
+		q := w.Queue()
+		return len(q) == 1 && q[0].Due.Equal(retryAfter)
+	})
+	clk.step(retryAfter.Sub(clk.Now()))
+	waitFor(t, orderState(ctx, client, "default", "order1", acmev1.Pending))
+	c, err := client.CertmanagerV1().Certificates("default").Get(ctx, "cert1", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.NotContains(t, c.Annotations, cm.AnnotationHoldRecord)
+}
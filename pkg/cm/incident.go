@@ -0,0 +1,244 @@
+package cm
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/artificialinc/cm-429-fixer/pkg/audit"
+	"github.com/artificialinc/cm-429-fixer/pkg/notify"
+	acmev1 "github.com/cert-manager/cert-manager/pkg/apis/acme/v1"
+	cmmeta "github.com/cert-manager/cert-manager/pkg/apis/meta/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/util/retry"
+)
+
+// IncidentGVR is the resource of the RateLimitIncident CRD, see
+// deploy/crds/ratelimitincidents.yaml
+var IncidentGVR = schema.GroupVersionResource{
+	Group:    "cm-429-fixer.artificial.com",
+	Version:  "v1alpha1",
+	Resource: "ratelimitincidents",
+}
+
+// IncidentKind is the kind of the RateLimitIncident CRD
+const IncidentKind = "RateLimitIncident"
+
+// Incident records a rate limit episode of an Order. It is named after the
+// Order, owned by it, and deleted once the Order is Valid.
+type Incident struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   IncidentSpec   `json:"spec"`
+	Status IncidentStatus `json:"status,omitempty"`
+}
+
+// IncidentSpec identifies the Order and ACME account that are rate limited
+type IncidentSpec struct {
+	// Order is the name of the Order in the incident's namespace
+	Order     string                 `json:"order"`
+	IssuerRef cmmeta.ObjectReference `json:"issuerRef"`
+	Account   string                 `json:"account"`
+	Domains   []string               `json:"domains,omitempty"`
+}
+
+// IncidentStatus tracks the progress of the episode
+type IncidentStatus struct {
+	FirstSeen     metav1.Time  `json:"firstSeen"`
+	LastSeen      metav1.Time  `json:"lastSeen"`
+	Reason        string       `json:"reason,omitempty"`
+	ResetAttempts int          `json:"resetAttempts"`
+	LastReset     *metav1.Time `json:"lastReset,omitempty"`
+	HoldUntil     *metav1.Time `json:"holdUntil,omitempty"`
+}
+
+// WithIncidents records rate limit episodes as RateLimitIncidents using the
+// dynamic client. The CRD must be installed.
+func WithIncidents(c dynamic.Interface) Option {
+	return func(w *Watcher) {
+		w.dyn = c
+	}
+}
+
+// Incidents lists the RateLimitIncidents in the namespace, all namespaces if empty
+func (w *Watcher) Incidents(ctx context.Context, namespace string) ([]Incident, error) {
+	if w.dyn == nil {
+		return nil, errors.New("incidents are not enabled")
+	}
+	list, err := w.dyn.Resource(IncidentGVR).Namespace(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	incidents := make([]Incident, len(list.Items))
+	for i := range list.Items {
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(list.Items[i].Object, &incidents[i]); err != nil {
+			return nil, err
+		}
+	}
+	return incidents, nil
+}
+
+// incidentOrder returns the name and UID of the Order a rate limited object
+// belongs to, which is the object itself for Orders and the owner for Challenges
+func incidentOrder(kind string, meta metav1.ObjectMeta) (string, metav1.OwnerReference, bool) {
+	if kind == "Order" {
+		return meta.Name, metav1.OwnerReference{
+			APIVersion: acmev1.SchemeGroupVersion.String(),
+			Kind:       "Order",
+			Name:       meta.Name,
+			UID:        meta.UID,
+		}, true
+	}
+	for _, ref := range meta.OwnerReferences {
+		if ref.Kind == "Order" {
+			return ref.Name, metav1.OwnerReference{
+				APIVersion: ref.APIVersion,
+				Kind:       ref.Kind,
+				Name:       ref.Name,
+				UID:        ref.UID,
+			}, true
+		}
+	}
+	return "", metav1.OwnerReference{}, false
+}
+
+// recordIncident creates or updates the incident of the Order a rate limited
+// object belongs to
+func (w *Watcher) recordIncident(kind string, meta metav1.ObjectMeta, issuer cmmeta.ObjectReference, account string, domains []string, reason string, holdUntil time.Time) {
+	if w.dyn == nil {
+		return
+	}
+	order, owner, ok := incidentOrder(kind, meta)
+	if !ok {
+		return
+	}
+
+	ctx := context.Background()
+	now := metav1.NewTime(w.clock.Now())
+	err := w.updateIncident(ctx, meta.Namespace, order, true, func(in *Incident) {
+		if in.Status.FirstSeen.IsZero() {
+			in.OwnerReferences = []metav1.OwnerReference{owner}
+			in.Spec = IncidentSpec{
+				Order:     order,
+				IssuerRef: issuer,
+				Account:   account,
+			}
+			in.Status.FirstSeen = now
+		}
+		in.Spec.Domains = notify.MergeDomains(in.Spec.Domains, domains)
+		in.Status.LastSeen = now
+		in.Status.Reason = reason
+		in.Status.HoldUntil = nil
+		if holdUntil.After(now.Time) {
+			t := metav1.NewTime(holdUntil)
+			in.Status.HoldUntil = &t
+		}
+	})
+	if err != nil {
+		w.log.Error(err, "Error recording incident", "order", order, "namespace", meta.Namespace)
+	}
+}
+
+// incidentReset counts a reset of an object towards its Order's incident
+func (w *Watcher) incidentReset(kind string, meta metav1.ObjectMeta) {
+	if w.dyn == nil {
+		return
+	}
+	order, _, ok := incidentOrder(kind, meta)
+	if !ok {
+		return
+	}
+
+	now := metav1.NewTime(w.clock.Now())
+	err := w.updateIncident(context.Background(), meta.Namespace, order, false, func(in *Incident) {
+		in.Status.ResetAttempts++
+		in.Status.LastReset = &now
+	})
+	if err != nil && !apierrors.IsNotFound(err) {
+		w.log.Error(err, "Error recording incident reset", "order", order, "namespace", meta.Namespace)
+	}
+}
+
+// updateIncident applies the update to the Order's incident. A missing
+// incident is created if create is set, its update sees a zero FirstSeen.
+func (w *Watcher) updateIncident(ctx context.Context, namespace, order string, create bool, update func(*Incident)) error {
+	client := w.dyn.Resource(IncidentGVR).Namespace(namespace)
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		var in Incident
+		u, err := client.Get(ctx, order, metav1.GetOptions{})
+		create := create && apierrors.IsNotFound(err)
+		switch {
+		case create:
+			in = Incident{
+				TypeMeta: metav1.TypeMeta{APIVersion: IncidentGVR.GroupVersion().String(), Kind: IncidentKind},
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      order,
+					Namespace: namespace,
+					Labels:    map[string]string{"app.kubernetes.io/managed-by": "cm-429-fixer"},
+				},
+			}
+		case err != nil:
+			return err
+		default:
+			if err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.Object, &in); err != nil {
+				return err
+			}
+		}
+
+		update(&in)
+		obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&in)
+		if err != nil {
+			return err
+		}
+		if create {
+			_, err = client.Create(ctx, &unstructured.Unstructured{Object: obj}, metav1.CreateOptions{})
+			return err
+		}
+		_, err = client.Update(ctx, &unstructured.Unstructured{Object: obj}, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+// resolveIncident deletes the incident of an Order that is no longer rate limited
+func (w *Watcher) resolveIncident(namespace, order string) {
+	if w.dyn == nil {
+		return
+	}
+	err := w.dyn.Resource(IncidentGVR).Namespace(namespace).Delete(context.Background(), order, metav1.DeleteOptions{})
+	if apierrors.IsNotFound(err) {
+		return
+	}
+	w.audit(audit.Record{
+		Action: audit.ActionDelete,
+		Object: audit.Object{Kind: "RateLimitIncident", Namespace: namespace, Name: order},
+		Reason: "Order is no longer rate limited",
+	}, err)
+	if err != nil {
+		w.log.Error(err, "Error deleting incident", "order", order, "namespace", namespace)
+		return
+	}
+	w.log.Info("Rate limit incident resolved", "order", order, "namespace", namespace)
+}
+
+// collectIncidents deletes the incidents of Orders that are Valid or gone.
+// Recovered Orders are normally seen by the informer, this catches the ones
+// missed while the watcher wasn't running.
+func (w *Watcher) collectIncidents(ctx context.Context) {
+	incidents, err := w.Incidents(ctx, w.namespace)
+	if err != nil {
+		w.log.Error(err, "Error listing incidents")
+		return
+	}
+	for _, in := range incidents {
+		o, err := w.c.AcmeV1().Orders(in.Namespace).Get(ctx, in.Spec.Order, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) || (err == nil && o.Status.State == acmev1.Valid) {
+			w.resolveIncident(in.Namespace, in.Name)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package cm_test
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/artificialinc/cm-429-fixer/pkg/cm"
+	acmev1 "github.com/cert-manager/cert-manager/pkg/apis/acme/v1"
+	cmmeta "github.com/cert-manager/cert-manager/pkg/apis/meta/v1"
+	"github.com/cert-manager/cert-manager/pkg/client/clientset/versioned/fake"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestWatcherIncident(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	client := fake.NewSimpleClientset()
+	dyn := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		cm.IncidentGVR: cm.IncidentKind + "List",
+	})
+
+	w := cm.NewWatcher(
+		cm.WithClient(client),
+		cm.WithIncidents(dyn),
+		cm.WithUpdateDelay(10*time.Millisecond),
+	)
+	go w.Run(ctx)
+	assert.NoError(t, w.Readiness().Wait(ctx))
+
+	order := buildOrder("order1", "default", &acmev1.OrderStatus{
+		State:  acmev1.Errored,
+		Reason: "429 urn:ietf:params:acme:error:rateLimited: too many certificates",
+	})
+	order.UID = "order1-uid"
+	order.Spec.IssuerRef = cmmeta.ObjectReference{Name: "letsencrypt", Kind: "ClusterIssuer"}
+	order.Spec.DNSNames = []string{"example.com", "www.example.com"}
+	_, err := client.AcmeV1().Orders("default").Create(ctx, order, metav1.CreateOptions{})
+	assert.NoError(t, err)
+
+	// Recorded on detection and counts the reset
+	var incident cm.Incident
+	assert.Eventually(t, func() bool {
+		incidents, err := w.Incidents(ctx, "default")
+		if err != nil || len(incidents) != 1 {
+			return false
+		}
+		incident = incidents[0]
+		return incident.Status.ResetAttempts == 1
+	}, 10*time.Second, 50*time.Millisecond)
+	assert.Equal(t, "order1", incident.Name)
+	assert.Equal(t, "order1", incident.Spec.Order)
+	assert.Equal(t, []string{"example.com", "www.example.com"}, incident.Spec.Domains)
+	assert.Equal(t, "/ClusterIssuer/default/letsencrypt", incident.Spec.Account)
+	assert.Contains(t, incident.Status.Reason, "rateLimited")
+	assert.False(t, incident.Status.FirstSeen.IsZero())
+	assert.NotNil(t, incident.Status.LastReset)
+	if assert.Len(t, incident.OwnerReferences, 1) {
+		assert.Equal(t, order.UID, incident.OwnerReferences[0].UID)
+	}
+
+	// Collected once the order is valid
+	order, err = client.AcmeV1().Orders("default").Get(ctx, "order1", metav1.GetOptions{})
+	assert.NoError(t, err)
+	order.Status = acmev1.OrderStatus{State: acmev1.Valid}
+	_, err = client.AcmeV1().Orders("default").UpdateStatus(ctx, order, metav1.UpdateOptions{})
+	assert.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		incidents, err := w.Incidents(ctx, "default")
+		return err == nil && len(incidents) == 0
+	}, 10*time.Second, 50*time.Millisecond)
+}
+
+func TestWatcherIncidentResync(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	order := buildOrder("order1", "default", &acmev1.OrderStatus{
+		State:  acmev1.Errored,
+		Reason: "429 urn:ietf:params:acme:error:rateLimited: too many certificates",
+	})
+	order.ResourceVersion = "1"
+	order.Spec.IssuerRef = cmmeta.ObjectReference{Name: "letsencrypt", Kind: "ClusterIssuer"}
+	order.Spec.DNSNames = []string{"example.com"}
+	client := fake.NewSimpleClientset(order)
+	dyn := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		cm.IncidentGVR: cm.IncidentKind + "List",
+	})
+	var writes atomic.Int32
+	dyn.PrependReactor("*", "ratelimitincidents", func(a k8stesting.Action) (bool, runtime.Object, error) {
+		if a.GetVerb() == "create" || a.GetVerb() == "update" {
+			writes.Add(1)
+		}
+		return false, nil, nil
+	})
+
+	w := cm.NewWatcher(cm.WithClient(client), cm.WithIncidents(dyn), cm.WithUpdateDelay(time.Hour), cm.WithResyncPeriod(20*time.Millisecond))
+	go w.Run(ctx)
+	assert.NoError(t, w.Readiness().Wait(ctx))
+	assert.Eventually(t, func() bool { return writes.Load() == 1 }, 10*time.Second, 10*time.Millisecond)
+
+	// Resyncs of the same version don't write the incident again
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal(t, int32(1), writes.Load())
+
+	// A new version does
+	order.ResourceVersion = "2"
+	order.Status.Reason += ", retry after 2030-01-01 00:00:00 UTC"
+	_, err := client.AcmeV1().Orders("default").UpdateStatus(ctx, order, metav1.UpdateOptions{})
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool { return writes.Load() == 2 }, 10*time.Second, 10*time.Millisecond)
+	incidents, err := w.Incidents(ctx, "default")
+	assert.NoError(t, err)
+	if assert.Len(t, incidents, 1) {
+		assert.Contains(t, incidents[0].Status.Reason, "retry after")
+	}
+}
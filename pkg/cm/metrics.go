@@ -0,0 +1,48 @@
+package cm
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	detectedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cm429_fixer_detected_total",
+		Help: "Number of rate limited objects detected",
+	}, []string{"cluster", "kind"})
+
+	resetsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cm429_fixer_resets_total",
+		Help: "Number of resets issued, by result",
+	}, []string{"cluster", "kind", "result"})
+
+	budgetWaitSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "cm429_fixer_budget_wait_seconds",
+		Help:    "Time resets were held back by the per account budget",
+		Buckets: prometheus.ExponentialBuckets(1, 4, 8),
+	}, []string{"cluster"})
+
+	holdsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cm429_fixer_holds_total",
+		Help: "Number of certificate holds placed and released",
+	}, []string{"cluster", "action"})
+
+	controlSwitchedOff = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "cm429_fixer_control_switched_off",
+		Help: "Whether the control ConfigMap switches off every change, by being paused, in maintenance or invalid",
+	}, []string{"cluster"})
+
+	controlScopes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "cm429_fixer_control_paused_scopes",
+		Help: "Number of namespaces and issuers the control ConfigMap pauses",
+	}, []string{"cluster", "scope"})
+
+	controlMaintenanceUntil = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "cm429_fixer_control_maintenance_until_seconds",
+		Help: "End of the control ConfigMap's maintenance window as a Unix time, 0 if there is none",
+	}, []string{"cluster"})
+)
+
+func init() {
+	prometheus.MustRegister(detectedTotal, resetsTotal, budgetWaitSeconds, holdsTotal,
+		controlSwitchedOff, controlScopes, controlMaintenanceUntil)
+}
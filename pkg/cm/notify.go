@@ -0,0 +1,29 @@
+package cm
+
+import (
+	"time"
+
+	"github.com/artificialinc/cm-429-fixer/pkg/notify"
+)
+
+// WithNotifier reports rate limited Orders to the notifier, which may be
+// shared between watchers. Challenges count towards their Order. The notifier
+// must be run separately.
+func WithNotifier(n *notify.Notifier) Option {
+	return func(w *Watcher) {
+		w.notifier = n
+	}
+}
+
+// notifyLimit reports a rate limited Order, or one the fixer gave up on
+func (w *Watcher) notifyLimit(order, account string, domains []string, reason string, until time.Time, gaveUp bool) {
+	if w.notifier == nil {
+		return
+	}
+	o := notify.Observation{Order: order, Account: account, Domains: domains, Reason: reason, Until: until}
+	if gaveUp {
+		w.notifier.GaveUp(o)
+		return
+	}
+	w.notifier.Limited(o)
+}
@@ -0,0 +1,191 @@
+package cm
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	acmev1 "github.com/cert-manager/cert-manager/pkg/apis/acme/v1"
+	cmmeta "github.com/cert-manager/cert-manager/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// Pause stops the watcher from changing objects, in a namespace, of an issuer
+// or everywhere if both are empty
+type Pause struct {
+	Namespace string `json:"namespace,omitempty"`
+	// Issuer is the issuer name or Kind/name
+	Issuer string    `json:"issuer,omitempty"`
+	Reason string    `json:"reason,omitempty"`
+	Actor  string    `json:"actor,omitempty"`
+	Since  time.Time `json:"since"`
+}
+
+// Global returns true if the pause applies everywhere
+func (p Pause) Global() bool {
+	return p.Namespace == "" && p.Issuer == ""
+}
+
+// matches returns true if the pause applies to objects in the namespace
+// issued by the issuer
+func (p Pause) matches(namespace string, issuer cmmeta.ObjectReference) bool {
+	if p.Namespace != "" && p.Namespace != namespace {
+		return false
+	}
+	return p.Issuer == "" || p.Issuer == issuer.Name || p.Issuer == issuerName(issuer)
+}
+
+type pauseKey struct {
+	namespace string
+	issuer    string
+}
+
+// Pauses are the pauses in force, which may be shared between watchers. A nil
+// Pauses never pauses anything.
+type Pauses struct {
+	mu     sync.Mutex
+	pauses map[pauseKey]Pause
+	// resume is closed and replaced whenever a pause is lifted
+	resume chan struct{}
+}
+
+// NewPauses returns pauses with nothing paused
+func NewPauses() *Pauses {
+	return &Pauses{pauses: map[pauseKey]Pause{}, resume: make(chan struct{})}
+}
+
+// WithPauses stops the watcher from resetting objects, holding Certificates
+// and releasing holds while they are paused. Forced resets and explicit
+// releases still go through. Objects are looked at again when a pause is
+// lifted.
+func WithPauses(p *Pauses) Option {
+	return func(w *Watcher) {
+		w.pauses = p
+	}
+}
+
+// Pause adds the pause, replacing any pause of the same scope
+func (ps *Pauses) Pause(p Pause) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.pauses[pauseKey{p.Namespace, p.Issuer}] = p
+}
+
+// Resume lifts the pause of the scope and returns false if there was none
+func (ps *Pauses) Resume(namespace, issuer string) bool {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	key := pauseKey{namespace, issuer}
+	if _, ok := ps.pauses[key]; !ok {
+		return false
+	}
+	delete(ps.pauses, key)
+	close(ps.resume)
+	ps.resume = make(chan struct{})
+	return true
+}
+
+// Set replaces every pause, e.g. with pauses persisted by a previous run
+func (ps *Pauses) Set(pauses []Pause) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.pauses = map[pauseKey]Pause{}
+	for _, p := range pauses {
+		ps.pauses[pauseKey{p.Namespace, p.Issuer}] = p
+	}
+	close(ps.resume)
+	ps.resume = make(chan struct{})
+}
+
+// List returns the pauses in force, the global one first
+func (ps *Pauses) List() []Pause {
+	if ps == nil {
+		return nil
+	}
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	pauses := make([]Pause, 0, len(ps.pauses))
+	for _, p := range ps.pauses {
+		pauses = append(pauses, p)
+	}
+	sort.Slice(pauses, func(i, j int) bool {
+		if pauses[i].Namespace != pauses[j].Namespace {
+			return pauses[i].Namespace < pauses[j].Namespace
+		}
+		return pauses[i].Issuer < pauses[j].Issuer
+	})
+	return pauses
+}
+
+// Paused returns the pause in force for objects in the namespace issued by
+// the issuer, if any
+func (ps *Pauses) Paused(namespace string, issuer cmmeta.ObjectReference) (Pause, bool) {
+	if ps == nil {
+		return Pause{}, false
+	}
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	for _, p := range ps.pauses {
+		if p.matches(namespace, issuer) {
+			return p, true
+		}
+	}
+	return Pause{}, false
+}
+
+// resumed returns a channel closed when a pause is next lifted, nil if there
+// are no pauses
+func (ps *Pauses) resumed() <-chan struct{} {
+	if ps == nil {
+		return nil
+	}
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return ps.resume
+}
+
+// gated returns true, and logs why, if changes to the object are paused or
+// switched off by the control ConfigMap. Forced changes are only stopped by
+// the control ConfigMap.
+func (w *Watcher) gated(kind, namespace, name string, issuer cmmeta.ObjectReference, force bool) bool {
+	log := w.log.WithValues(strings.ToLower(kind), name, "namespace", namespace)
+	if reason, ok := w.SwitchedOff(namespace, issuer); ok {
+		log.V(1).Info("Switched off by the control ConfigMap, leaving "+strings.ToLower(kind)+" alone", "reason", reason)
+		return true
+	}
+	if force {
+		return false
+	}
+	if p, ok := w.pauses.Paused(namespace, issuer); ok {
+		log.V(1).Info("Paused, leaving "+strings.ToLower(kind)+" alone", "pausedBy", p.Actor, "reason", p.Reason)
+		return true
+	}
+	return false
+}
+
+// revisitOnResume looks at every Order and Challenge in the informers again
+// when a pause is lifted or the control ConfigMap changes, so their resets
+// don't wait for the next resync
+func (w *Watcher) revisitOnResume(ctx context.Context, informers ...cache.SharedIndexInformer) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-w.pauses.resumed():
+		case <-w.control.revisits():
+			w.updateControlMetrics()
+		}
+		for _, informer := range informers {
+			for _, obj := range informer.GetStore().List() {
+				switch o := obj.(type) {
+				case *acmev1.Order:
+					w.updateOrder(o)
+				case *acmev1.Challenge:
+					w.updateChallenge(o)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package cm_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/artificialinc/cm-429-fixer/pkg/cm"
+	acmev1 "github.com/cert-manager/cert-manager/pkg/apis/acme/v1"
+	cmmeta "github.com/cert-manager/cert-manager/pkg/apis/meta/v1"
+	"github.com/cert-manager/cert-manager/pkg/client/clientset/versioned/fake"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestPauses(t *testing.T) {
+	le := cmmeta.ObjectReference{Kind: "ClusterIssuer", Name: "letsencrypt"}
+	other := cmmeta.ObjectReference{Name: "other"}
+
+	var nilPauses *cm.Pauses
+	_, paused := nilPauses.Paused("default", le)
+	assert.False(t, paused)
+
+	ps := cm.NewPauses()
+	_, paused = ps.Paused("default", le)
+	assert.False(t, paused)
+
+	ps.Pause(cm.Pause{Namespace: "team-a", Reason: "incident"})
+	ps.Pause(cm.Pause{Issuer: "ClusterIssuer/letsencrypt"})
+	p, paused := ps.Paused("team-a", other)
+	assert.True(t, paused)
+	assert.Equal(t, "incident", p.Reason)
+	_, paused = ps.Paused("default", le)
+	assert.True(t, paused)
+	_, paused = ps.Paused("default", other)
+	assert.False(t, paused)
+	assert.Equal(t, []cm.Pause{{Issuer: "ClusterIssuer/letsencrypt"}, {Namespace: "team-a", Reason: "incident"}}, ps.List())
+
+	assert.False(t, ps.Resume("default", ""))
+	assert.True(t, ps.Resume("", "ClusterIssuer/letsencrypt"))
+	_, paused = ps.Paused("default", le)
+	assert.False(t, paused)
+
+	// A global pause matches everything
+	ps.Pause(cm.Pause{})
+	assert.True(t, ps.List()[0].Global())
+	_, paused = ps.Paused("default", other)
+	assert.True(t, paused)
+
+	ps.Set(nil)
+	assert.Empty(t, ps.List())
+}
+
+func TestWatcherPause(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	clk := newTestClock()
+	client := fake.NewSimpleClientset()
+	pauses := cm.NewPauses()
+	pauses.Pause(cm.Pause{Namespace: "default"})
+	w := cm.NewWatcher(cm.WithClient(client), cm.WithClock(clk), cm.WithCluster("c1"), cm.WithPauses(pauses))
+	clk.run(t, ctx, w)
+
+	_, err := client.AcmeV1().Orders("default").Create(ctx, buildOrder("order1", "default", &acmev1.OrderStatus{
+		State:  acmev1.Errored,
+		Reason: "429 rateLimited",
+	}), metav1.CreateOptions{})
+	assert.NoError(t, err)
+
+	// The reset is queued, then dropped while paused
+	waitFor(t, func() bool { return len(w.Queue()) == 1 })
+	q := w.Queue()[0]
+	assert.Equal(t, cm.QueuedReset{Cluster: "c1", Kind: "Order", Namespace: "default", Name: "order1", Stage: cm.StageDelay, Due: clk.Now().Add(cm.DefaultDelay)}, q)
+	clk.step(cm.DefaultDelay)
+	waitFor(t, func() bool { return len(w.Queue()) == 0 })
+	assert.True(t, orderState(ctx, client, "default", "order1", acmev1.Errored)())
+
+	// Forced resets still go through
+	result, err := w.ResetOrder(ctx, "default", "order1", cm.ResetOptions{DryRun: true})
+	assert.NoError(t, err)
+	assert.Equal(t, cm.ResetPaused, result)
+	result, err = w.ResetOrder(ctx, "default", "order1", cm.ResetOptions{DryRun: true, Force: true})
+	assert.NoError(t, err)
+	assert.Equal(t, cm.ResetDryRun, result)
+
+	// Resuming looks at the order again
+	assert.True(t, pauses.Resume("default", ""))
+	waitFor(t, func() bool { return len(w.Queue()) == 1 })
+	clk.step(cm.DefaultDelay)
+	waitFor(t, orderState(ctx, client, "default", "order1", acmev1.Pending))
+}
+
+func TestScanPaused(t *testing.T) {
+	ctx := context.Background()
+	client := fake.NewSimpleClientset(buildOrder("order1", "default", &acmev1.OrderStatus{State: acmev1.Errored, Reason: "429 rateLimited"}))
+	pauses := cm.NewPauses()
+	pauses.Pause(cm.Pause{Actor: "admin:alice"})
+	w := cm.NewWatcher(cm.WithClient(client), cm.WithPauses(pauses))
+
+	report, err := w.Scan(ctx, "")
+	assert.NoError(t, err)
+	if assert.Len(t, report.Findings, 1) {
+		assert.Equal(t, "none, paused by admin:alice", report.Findings[0].Action)
+		assert.Nil(t, report.Findings[0].NextReset)
+	}
+}
@@ -0,0 +1,400 @@
+package cm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	acmev1 "github.com/cert-manager/cert-manager/pkg/apis/acme/v1"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+)
+
+var (
+	// RetryPolicyGVR is the resource of the namespaced RetryPolicy CRD, see
+	// deploy/crds/retrypolicies.yaml
+	RetryPolicyGVR = schema.GroupVersionResource{
+		Group:    "cm-429-fixer.artificial.com",
+		Version:  "v1alpha1",
+		Resource: "retrypolicies",
+	}
+	// ClusterRetryPolicyGVR is the resource of the cluster scoped
+	// ClusterRetryPolicy CRD, the default for namespaces without a RetryPolicy
+	ClusterRetryPolicyGVR = schema.GroupVersionResource{
+		Group:    "cm-429-fixer.artificial.com",
+		Version:  "v1alpha1",
+		Resource: "clusterretrypolicies",
+	}
+)
+
+// PolicyConditionValid is the status condition reporting whether a policy's
+// spec is valid. Invalid policies are ignored.
+const PolicyConditionValid = "Valid"
+
+// RetryPolicySpec is the spec shared by RetryPolicies and ClusterRetryPolicies.
+// Unset fields are inherited, from the ClusterRetryPolicy for RetryPolicies
+// and from the watcher's options for ClusterRetryPolicies.
+type RetryPolicySpec struct {
+	// Delay is the wait before the first reset, as a Go duration
+	Delay string `json:"delay,omitempty"`
+	// MaxDelay limits the backoff between resets, as a Go duration
+	MaxDelay string `json:"maxDelay,omitempty"`
+	// Backoff multiplies the delay after every reset
+	Backoff float64 `json:"backoff,omitempty"`
+	// MaxAttempts stops resets of an object after this many, 0 for no limit
+	MaxAttempts int `json:"maxAttempts,omitempty"`
+	// Kinds are the kinds that are reset, Order and Challenge
+	Kinds []string `json:"kinds,omitempty"`
+	// ReasonMatchers are regular expressions matching the reasons of rate
+	// limited objects
+	ReasonMatchers []string `json:"reasonMatchers,omitempty"`
+}
+
+// retryPolicy is the part of a RetryPolicy or ClusterRetryPolicy the watcher reads
+type retryPolicy struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   RetryPolicySpec `json:"spec"`
+	Status struct {
+		ObservedGeneration int64              `json:"observedGeneration,omitempty"`
+		Conditions         []metav1.Condition `json:"conditions,omitempty"`
+	} `json:"status,omitempty"`
+}
+
+// Policy is the retry behavior that applies to an object
+type Policy struct {
+	// Source names the policy, e.g. RetryPolicy staging/fast
+	Source         string
+	Delay          time.Duration
+	MaxDelay       time.Duration
+	Backoff        float64
+	MaxAttempts    int
+	Kinds          []string
+	ReasonMatchers []*regexp.Regexp
+}
+
+// Enabled returns true if objects of the kind are reset
+func (p Policy) Enabled(kind string) bool {
+	for _, k := range p.Kinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// Classify classifies the state and reason of an ACME Order or Challenge
+// using the policy's reason matchers
+func (p Policy) Classify(state acmev1.State, reason string) Verdict {
+	v := Classify(state, reason)
+	if v.Category == CategoryNone || len(p.ReasonMatchers) == 0 {
+		return v
+	}
+	for _, re := range p.ReasonMatchers {
+		if re.MatchString(reason) {
+			return Verdict{Category: CategoryRateLimited, RetryAfter: parseRetryAfter(reason)}
+		}
+	}
+	return Verdict{Category: CategoryOther}
+}
+
+// exhausted returns true if the object has been reset the max attempts
+func (p Policy) exhausted(meta metav1.ObjectMeta) bool {
+	return p.MaxAttempts > 0 && RetryStateOf(meta).Attempts >= p.MaxAttempts
+}
+
+// backoff returns the minimum time between resets after the given number of
+// attempts, growing from the delay by the backoff factor up to the max delay
+func (p Policy) backoff(attempts int) time.Duration {
+	d := p.Delay
+	for i := 0; i < attempts && d < p.MaxDelay; i++ {
+		d = time.Duration(float64(d) * p.Backoff)
+	}
+	if d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	return d
+}
+
+// apply returns the policy with the fields set in the spec overridden. The
+// delay and max delay are checked as resolved, so a spec setting one of them
+// must agree with the other inherited from the policy.
+func (p Policy) apply(source string, spec RetryPolicySpec) (Policy, error) {
+	base := p.Source
+	p.Source = source
+	var errs []error
+	delays := true
+	if spec.Delay != "" {
+		d, err := time.ParseDuration(spec.Delay)
+		if err != nil || d <= 0 {
+			errs = append(errs, fmt.Errorf("delay %q must be a positive duration", spec.Delay))
+			delays = false
+		}
+		p.Delay = d
+	}
+	if spec.MaxDelay != "" {
+		d, err := time.ParseDuration(spec.MaxDelay)
+		if err != nil || d <= 0 {
+			errs = append(errs, fmt.Errorf("maxDelay %q must be a positive duration", spec.MaxDelay))
+			delays = false
+		}
+		p.MaxDelay = d
+	}
+	if delays && p.MaxDelay < p.Delay {
+		switch {
+		case spec.Delay != "" && spec.MaxDelay != "":
+			errs = append(errs, fmt.Errorf("maxDelay %s is less than delay %s", p.MaxDelay, p.Delay))
+		case spec.Delay != "":
+			errs = append(errs, fmt.Errorf("delay %s is more than the maxDelay %s of the %s policy", p.Delay, p.MaxDelay, base))
+		case spec.MaxDelay != "":
+			errs = append(errs, fmt.Errorf("maxDelay %s is less than the delay %s of the %s policy", p.MaxDelay, p.Delay, base))
+		}
+	}
+	if spec.Backoff != 0 {
+		if spec.Backoff < 1 {
+			errs = append(errs, fmt.Errorf("backoff %v must be at least 1", spec.Backoff))
+		}
+		p.Backoff = spec.Backoff
+	}
+	if spec.MaxAttempts < 0 {
+		errs = append(errs, fmt.Errorf("maxAttempts %d must not be negative", spec.MaxAttempts))
+	}
+	if spec.MaxAttempts != 0 {
+		p.MaxAttempts = spec.MaxAttempts
+	}
+	if len(spec.Kinds) > 0 {
+		for _, k := range spec.Kinds {
+			if k != "Order" && k != "Challenge" {
+				errs = append(errs, fmt.Errorf("kind %q must be Order or Challenge", k))
+			}
+		}
+		p.Kinds = spec.Kinds
+	}
+	if len(spec.ReasonMatchers) > 0 {
+		p.ReasonMatchers = nil
+		for _, m := range spec.ReasonMatchers {
+			re, err := regexp.Compile(m)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("reasonMatcher %q: %w", m, err))
+				continue
+			}
+			p.ReasonMatchers = append(p.ReasonMatchers, re)
+		}
+	}
+	return p, errors.Join(errs...)
+}
+
+// WithRetryPolicies resolves the retry behavior of every object from the
+// RetryPolicy in its namespace or the ClusterRetryPolicy, read using the
+// dynamic client. The CRDs must be installed.
+func WithRetryPolicies(c dynamic.Interface) Option {
+	return func(w *Watcher) {
+		w.policies = &policyStore{
+			c:          c,
+			cluster:    map[string]RetryPolicySpec{},
+			namespaced: map[string]map[string]RetryPolicySpec{},
+		}
+	}
+}
+
+// policyStore holds the specs of the valid policies in the cluster
+type policyStore struct {
+	c dynamic.Interface
+
+	mu         sync.RWMutex
+	cluster    map[string]RetryPolicySpec
+	namespaced map[string]map[string]RetryPolicySpec
+	// retryPolicies is the informer store of the RetryPolicies, validated
+	// again as the ClusterRetryPolicy they inherit from changes
+	retryPolicies cache.Store
+}
+
+// defaultPolicy is the policy set by the watcher's options
+func (w *Watcher) defaultPolicy() Policy {
+	return Policy{
+		Source:   "default",
+		Delay:    w.updateDelay,
+		MaxDelay: w.maxDelay,
+		Backoff:  2,
+		Kinds:    []string{"Order", "Challenge"},
+	}
+}
+
+// policy resolves the policy for objects in the namespace. The first valid
+// RetryPolicy by name applies on top of the first valid ClusterRetryPolicy.
+func (w *Watcher) policy(namespace string) Policy {
+	p := w.defaultPolicy()
+	if w.policies == nil {
+		return p
+	}
+
+	w.policies.mu.RLock()
+	defer w.policies.mu.RUnlock()
+	p = firstPolicy(p, "ClusterRetryPolicy ", w.policies.cluster)
+	return firstPolicy(p, "RetryPolicy "+namespace+"/", w.policies.namespaced[namespace])
+}
+
+// basePolicy is the policy a policy of the resource applies on top of, the
+// ClusterRetryPolicy for RetryPolicies and the default for ClusterRetryPolicies
+func (w *Watcher) basePolicy(gvr schema.GroupVersionResource) Policy {
+	p := w.defaultPolicy()
+	if gvr != RetryPolicyGVR {
+		return p
+	}
+	w.policies.mu.RLock()
+	defer w.policies.mu.RUnlock()
+	return firstPolicy(p, "ClusterRetryPolicy ", w.policies.cluster)
+}
+
+func firstPolicy(base Policy, prefix string, specs map[string]RetryPolicySpec) Policy {
+	names := make([]string, 0, len(specs))
+	for name := range specs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if p, err := base.apply(prefix+name, specs[name]); err == nil {
+			return p
+		}
+	}
+	return base
+}
+
+// runPolicies starts informers for the policies and blocks until they have
+// synced, so no object is handled with the wrong policy
+func (w *Watcher) runPolicies(ctx context.Context) {
+	var informers []cache.SharedIndexInformer
+	for gvr, namespace := range map[schema.GroupVersionResource]string{
+		ClusterRetryPolicyGVR: metav1.NamespaceAll,
+		RetryPolicyGVR:        w.namespace,
+	} {
+		gvr := gvr
+		informer := dynamicinformer.NewFilteredDynamicInformer(w.policies.c, gvr, namespace, w.resyncPeriod, cache.Indexers{}, nil).Informer()
+		_, _ = informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+			AddFunc:    func(obj interface{}) { w.updatePolicy(ctx, gvr, obj) },
+			UpdateFunc: func(_, obj interface{}) { w.updatePolicy(ctx, gvr, obj) },
+			DeleteFunc: func(obj interface{}) { w.deletePolicy(ctx, gvr, obj) },
+		})
+		if gvr == RetryPolicyGVR {
+			w.policies.retryPolicies = informer.GetStore()
+		}
+		informers = append(informers, informer)
+	}
+	var synced []cache.InformerSynced
+	for _, informer := range informers {
+		go informer.Run(ctx.Done())
+		synced = append(synced, informer.HasSynced)
+	}
+	w.log.Info("Waiting for retry policies to sync")
+	cache.WaitForCacheSync(ctx.Done(), synced...)
+}
+
+// updatePolicy validates a policy on top of the policy it inherits from,
+// stores it if it is valid and reports the outcome in its Valid condition
+func (w *Watcher) updatePolicy(ctx context.Context, gvr schema.GroupVersionResource, obj interface{}) {
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return
+	}
+	var rp retryPolicy
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.Object, &rp); err != nil {
+		w.log.Error(err, "Error reading retry policy", "policy", u.GetName(), "namespace", u.GetNamespace())
+		return
+	}
+
+	_, err := w.basePolicy(gvr).apply("", rp.Spec)
+
+	w.policies.mu.Lock()
+	specs := w.policies.cluster
+	if gvr == RetryPolicyGVR {
+		specs = w.policies.namespaced[rp.Namespace]
+		if specs == nil {
+			specs = map[string]RetryPolicySpec{}
+			w.policies.namespaced[rp.Namespace] = specs
+		}
+	}
+	if err == nil {
+		specs[rp.Name] = rp.Spec
+	} else {
+		delete(specs, rp.Name)
+	}
+	w.policies.mu.Unlock()
+	if gvr == ClusterRetryPolicyGVR {
+		defer w.revalidatePolicies(ctx)
+	}
+
+	cond := metav1.Condition{
+		Type:               PolicyConditionValid,
+		Status:             metav1.ConditionTrue,
+		ObservedGeneration: rp.Generation,
+		Reason:             "Valid",
+		Message:            "Policy is valid",
+	}
+	if err != nil {
+		w.log.Info("Invalid retry policy", "policy", rp.Name, "namespace", rp.Namespace, "error", err.Error())
+		cond.Status = metav1.ConditionFalse
+		cond.Reason = "InvalidSpec"
+		cond.Message = strings.ReplaceAll(err.Error(), "\n", "; ")
+	}
+	if existing := apimeta.FindStatusCondition(rp.Status.Conditions, cond.Type); existing != nil &&
+		existing.Status == cond.Status && existing.Message == cond.Message && rp.Status.ObservedGeneration == rp.Generation {
+		return
+	}
+	apimeta.SetStatusCondition(&rp.Status.Conditions, cond)
+	rp.Status.ObservedGeneration = rp.Generation
+
+	status, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&rp.Status)
+	if err != nil {
+		w.log.Error(err, "Error converting retry policy status", "policy", rp.Name)
+		return
+	}
+	u = u.DeepCopy()
+	u.Object["status"] = status
+	if _, err := w.policies.c.Resource(gvr).Namespace(rp.Namespace).UpdateStatus(ctx, u, metav1.UpdateOptions{}); err != nil {
+		w.log.Error(err, "Error updating retry policy status", "policy", rp.Name, "namespace", rp.Namespace)
+	}
+}
+
+func (w *Watcher) deletePolicy(ctx context.Context, gvr schema.GroupVersionResource, obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return
+	}
+
+	w.policies.mu.Lock()
+	if gvr == RetryPolicyGVR {
+		delete(w.policies.namespaced[u.GetNamespace()], u.GetName())
+	} else {
+		delete(w.policies.cluster, u.GetName())
+	}
+	w.policies.mu.Unlock()
+	if gvr == ClusterRetryPolicyGVR {
+		w.revalidatePolicies(ctx)
+	}
+}
+
+// revalidatePolicies validates the RetryPolicies again after the
+// ClusterRetryPolicies changed
+func (w *Watcher) revalidatePolicies(ctx context.Context) {
+	if w.policies.retryPolicies == nil {
+		return
+	}
+	for _, obj := range w.policies.retryPolicies.List() {
+		w.updatePolicy(ctx, RetryPolicyGVR, obj)
+	}
+}
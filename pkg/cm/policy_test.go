@@ -0,0 +1,187 @@
+package cm_test
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/artificialinc/cm-429-fixer/pkg/cm"
+	acmev1 "github.com/cert-manager/cert-manager/pkg/apis/acme/v1"
+	"github.com/cert-manager/cert-manager/pkg/client/clientset/versioned/fake"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+)
+
+func buildPolicy(kind, namespace, name string, spec map[string]interface{}) *unstructured.Unstructured {
+	u := &unstructured.Unstructured{Object: map[string]interface{}{"spec": spec}}
+	u.SetAPIVersion(cm.RetryPolicyGVR.GroupVersion().String())
+	u.SetKind(kind)
+	u.SetNamespace(namespace)
+	u.SetName(name)
+	return u
+}
+
+func TestWatcherRetryPolicies(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	rateLimited := acmev1.OrderStatus{State: acmev1.Errored, Reason: "429 urn:ietf:params:acme:error:rateLimited"}
+	client := fake.NewSimpleClientset(
+		buildOrder("order1", "staging", &rateLimited),
+		buildOrder("order2", "prod", &rateLimited),
+		buildChallenge("challenge1", "staging", &acmev1.ChallengeStatus{State: acmev1.Errored, Reason: "429 too many requests"}),
+	)
+	dyn := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		cm.RetryPolicyGVR:        "RetryPolicyList",
+		cm.ClusterRetryPolicyGVR: "ClusterRetryPolicyList",
+	},
+		buildPolicy("ClusterRetryPolicy", "", "default", map[string]interface{}{"maxAttempts": int64(1), "delay": "1h", "maxDelay": "2h"}),
+		buildPolicy("RetryPolicy", "staging", "fast", map[string]interface{}{"delay": "1ms", "kinds": []interface{}{"Order"}}),
+		buildPolicy("RetryPolicy", "prod", "broken", map[string]interface{}{"delay": "soon", "backoff": 0.5}),
+	)
+
+	w := cm.NewWatcher(
+		cm.WithClient(client),
+		cm.WithRetryPolicies(dyn),
+		// Keep the watcher's own resets out of the way
+		cm.WithUpdateDelay(time.Hour),
+		cm.WithMaxDelay(time.Hour),
+	)
+	go w.Run(ctx)
+	assert.NoError(t, w.Readiness().Wait(ctx))
+
+	// Invalid policies report why in their status and are ignored
+	assert.Eventually(t, func() bool {
+		u, err := dyn.Resource(cm.RetryPolicyGVR).Namespace("prod").Get(ctx, "broken", metav1.GetOptions{})
+		if err != nil {
+			return false
+		}
+		conditions, _, _ := unstructured.NestedSlice(u.Object, "status", "conditions")
+		if len(conditions) != 1 {
+			return false
+		}
+		cond := conditions[0].(map[string]interface{})
+		message, _ := cond["message"].(string)
+		return cond["status"] == "False" && cond["reason"] == "InvalidSpec" &&
+			strings.Contains(message, `delay "soon"`) && strings.Contains(message, "backoff 0.5")
+	}, 10*time.Second, 50*time.Millisecond)
+	u, err := dyn.Resource(cm.RetryPolicyGVR).Namespace("staging").Get(ctx, "fast", metav1.GetOptions{})
+	assert.NoError(t, err)
+	conditions, _, _ := unstructured.NestedSlice(u.Object, "status", "conditions")
+	if assert.Len(t, conditions, 1) {
+		assert.Equal(t, "True", conditions[0].(map[string]interface{})["status"])
+	}
+
+	// prod falls back to the cluster default, which allows a single reset
+	result, err := w.ResetOrder(ctx, "prod", "order2", cm.ResetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, cm.ResetDone, result)
+	rateLimitAgain(t, ctx, client, "prod", "order2", rateLimited)
+	result, err = w.ResetOrder(ctx, "prod", "order2", cm.ResetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, cm.ResetExhausted, result)
+
+	// staging resets orders after its own delay, but not challenges
+	assert.Eventually(t, func() bool {
+		o, err := client.AcmeV1().Orders("staging").Get(ctx, "order1", metav1.GetOptions{})
+		return err == nil && o.Status.State == acmev1.Pending
+	}, 10*time.Second, 50*time.Millisecond)
+	result, err = w.ResetChallenge(ctx, "staging", "challenge1", cm.ResetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, cm.ResetDisabled, result)
+
+	report, err := w.Scan(ctx, "staging")
+	assert.NoError(t, err)
+	for _, f := range report.Findings {
+		if f.Kind == "Challenge" {
+			assert.Equal(t, "none, disabled by RetryPolicy staging/fast", f.Action)
+		}
+	}
+	// A challenge with resets disabled isn't stuck, an order the fixer gave up on is
+	assert.False(t, report.Stuck())
+	report, err = w.Scan(ctx, "prod")
+	assert.NoError(t, err)
+	if assert.Len(t, report.Findings, 1) {
+		assert.True(t, report.Findings[0].GaveUp)
+		assert.Nil(t, report.Findings[0].NextReset)
+	}
+	assert.True(t, report.Stuck())
+}
+
+func TestWatcherRetryPolicyInheritedDelay(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dyn := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		cm.RetryPolicyGVR:        "RetryPolicyList",
+		cm.ClusterRetryPolicyGVR: "ClusterRetryPolicyList",
+	},
+		buildPolicy("ClusterRetryPolicy", "", "default", map[string]interface{}{"maxDelay": "10m"}),
+		buildPolicy("ClusterRetryPolicy", "", "tight", map[string]interface{}{"maxDelay": "1s"}),
+		buildPolicy("RetryPolicy", "staging", "slow", map[string]interface{}{"delay": "30m"}),
+	)
+	w := cm.NewWatcher(
+		cm.WithClient(fake.NewSimpleClientset()),
+		cm.WithRetryPolicies(dyn),
+		cm.WithUpdateDelay(time.Minute),
+		cm.WithMaxDelay(time.Hour),
+	)
+	go w.Run(ctx)
+	assert.NoError(t, w.Readiness().Wait(ctx))
+
+	// condition returns the status and message of a policy's Valid condition
+	condition := func(gvr schema.GroupVersionResource, namespace, name string) (string, string) {
+		u, err := dyn.Resource(gvr).Namespace(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return "", ""
+		}
+		conditions, _, _ := unstructured.NestedSlice(u.Object, "status", "conditions")
+		if len(conditions) != 1 {
+			return "", ""
+		}
+		cond := conditions[0].(map[string]interface{})
+		status, _ := cond["status"].(string)
+		message, _ := cond["message"].(string)
+		return status, message
+	}
+	waitForCondition := func(gvr schema.GroupVersionResource, namespace, name, status, message string) {
+		t.Helper()
+		assert.Eventually(t, func() bool {
+			s, m := condition(gvr, namespace, name)
+			return s == status && m == message
+		}, 10*time.Second, 50*time.Millisecond)
+	}
+
+	// The delay and max delay a policy sets are checked against those it inherits
+	waitForCondition(cm.ClusterRetryPolicyGVR, "", "default", "True", "Policy is valid")
+	waitForCondition(cm.ClusterRetryPolicyGVR, "", "tight", "False", "maxDelay 1s is less than the delay 1m0s of the default policy")
+	waitForCondition(cm.RetryPolicyGVR, "staging", "slow", "False", "delay 30m0s is more than the maxDelay 10m0s of the ClusterRetryPolicy default policy")
+
+	// and checked again as the ClusterRetryPolicy changes
+	u, err := dyn.Resource(cm.ClusterRetryPolicyGVR).Get(ctx, "default", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.NoError(t, unstructured.SetNestedField(u.Object, "1h", "spec", "maxDelay"))
+	_, err = dyn.Resource(cm.ClusterRetryPolicyGVR).Update(ctx, u, metav1.UpdateOptions{})
+	assert.NoError(t, err)
+	waitForCondition(cm.RetryPolicyGVR, "staging", "slow", "True", "Policy is valid")
+}
+
+// rateLimitAgain sets the status of a reset order back, keeping its retry state
+func rateLimitAgain(t *testing.T, ctx context.Context, client *fake.Clientset, namespace, name string, status acmev1.OrderStatus) {
+	o, err := client.AcmeV1().Orders(namespace).Get(ctx, name, metav1.GetOptions{})
+	assert.NoError(t, err)
+	o.Status = status
+	// The fake clientset doesn't set resource versions, which the watcher
+	// needs to tell a new rate limit from a duplicate event
+	o.ResourceVersion = strconv.FormatInt(time.Now().UnixNano(), 10)
+	_, err = client.AcmeV1().Orders(namespace).UpdateStatus(ctx, o, metav1.UpdateOptions{})
+	assert.NoError(t, err)
+}
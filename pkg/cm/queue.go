@@ -0,0 +1,140 @@
+package cm
+
+import (
+	"sort"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/clock"
+)
+
+// Stages of a queued reset
+const (
+	// StageDelay is a reset waiting out its delay or backoff
+	StageDelay = "delay"
+	// StageBudget is a reset waiting for its account's reset budget
+	StageBudget = "budget"
+)
+
+// QueuedReset is a reset the watcher has scheduled and not yet made
+type QueuedReset struct {
+	Cluster   string `json:"cluster"`
+	Kind      string `json:"kind"`
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	Stage     string `json:"stage"`
+	// Due is when the reset is next looked at
+	Due time.Time `json:"due"`
+}
+
+type objectKey struct {
+	kind      string
+	namespace string
+	name      string
+}
+
+// pendingObject is the reset or hold the watcher is working on for an object
+type pendingObject struct {
+	// queued is the reset shown by Queue, nil for a hold
+	queued          *QueuedReset
+	resourceVersion string
+	// revisit looks at the object again once the work is done, set when the
+	// object changed in the meantime to revisitVersion
+	revisit        func()
+	revisitVersion string
+}
+
+// release is the scheduled release of a held Certificate
+type release struct {
+	until time.Time
+	timer clock.Timer
+}
+
+// pend marks the object as having a reset or hold in the works, with q shown
+// by Queue for a reset, and returns false if it already has one. Duplicate
+// events are dropped, an object that has changed is looked at again by
+// revisit once the work is done.
+func (w *Watcher) pend(kind string, meta metav1.ObjectMeta, q *QueuedReset, revisit func()) bool {
+	key := objectKey{kind, meta.Namespace, meta.Name}
+	w.queueMu.Lock()
+	defer w.queueMu.Unlock()
+	if p, ok := w.pending[key]; ok {
+		if p.resourceVersion != meta.ResourceVersion {
+			p.revisit = revisit
+			p.revisitVersion = meta.ResourceVersion
+		}
+		return false
+	}
+	if q != nil {
+		q.Cluster = w.cluster
+	}
+	w.pending[key] = &pendingObject{queued: q, resourceVersion: meta.ResourceVersion}
+	return true
+}
+
+// queueReset shows the reset of an object that already has work pending,
+// e.g. one that couldn't be held, in the queue
+func (w *Watcher) queueReset(q *QueuedReset) {
+	q.Cluster = w.cluster
+	w.queueMu.Lock()
+	defer w.queueMu.Unlock()
+	if p, ok := w.pending[objectKey{q.Kind, q.Namespace, q.Name}]; ok {
+		p.queued = q
+	}
+}
+
+// wrote records a change the watcher made to an object, so its event isn't
+// taken for a change by someone else if the object has work pending
+func (w *Watcher) wrote(kind string, meta metav1.ObjectMeta) {
+	w.queueMu.Lock()
+	defer w.queueMu.Unlock()
+	p, ok := w.pending[objectKey{kind, meta.Namespace, meta.Name}]
+	if !ok {
+		return
+	}
+	p.resourceVersion = meta.ResourceVersion
+	if p.revisitVersion == meta.ResourceVersion {
+		p.revisit = nil
+	}
+}
+
+// done ends the object's reset or hold, and looks at the object again if it
+// changed in the meantime
+func (w *Watcher) done(kind, namespace, name string) {
+	key := objectKey{kind, namespace, name}
+	w.queueMu.Lock()
+	p := w.pending[key]
+	delete(w.pending, key)
+	w.queueMu.Unlock()
+	if p != nil && p.revisit != nil {
+		p.revisit()
+	}
+}
+
+// requeue moves a queued reset to another stage
+func (w *Watcher) requeue(q *QueuedReset, stage string, due time.Time) {
+	w.queueMu.Lock()
+	defer w.queueMu.Unlock()
+	q.Stage = stage
+	q.Due = due
+}
+
+// Queue returns the resets the watcher has scheduled, the soonest due first.
+// An object is queued at most once.
+func (w *Watcher) Queue() []QueuedReset {
+	w.queueMu.Lock()
+	defer w.queueMu.Unlock()
+	queue := make([]QueuedReset, 0, len(w.pending))
+	for _, p := range w.pending {
+		if p.queued != nil {
+			queue = append(queue, *p.queued)
+		}
+	}
+	sort.Slice(queue, func(i, j int) bool {
+		if !queue[i].Due.Equal(queue[j].Due) {
+			return queue[i].Due.Before(queue[j].Due)
+		}
+		return queue[i].Namespace+"/"+queue[i].Name < queue[j].Namespace+"/"+queue[j].Name
+	})
+	return queue
+}
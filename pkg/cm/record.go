@@ -0,0 +1,120 @@
+package cm
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	acmev1 "github.com/cert-manager/cert-manager/pkg/apis/acme/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// Transition is a status change of an Order or Challenge seen by the watcher
+type Transition struct {
+	Time      time.Time    `json:"time"`
+	Cluster   string       `json:"cluster,omitempty"`
+	Kind      string       `json:"kind"`
+	Namespace string       `json:"namespace"`
+	Name      string       `json:"name"`
+	State     acmev1.State `json:"state"`
+	Reason    string       `json:"reason,omitempty"`
+}
+
+func (t Transition) key() string {
+	return t.Cluster + "/" + t.Kind + "/" + t.Namespace + "/" + t.Name
+}
+
+// Recorder writes transitions to a stream as JSON lines. It may be shared
+// between watchers.
+type Recorder struct {
+	mu   sync.Mutex
+	out  io.Writer
+	last map[string]Transition
+}
+
+// NewRecorder returns a recorder writing to out
+func NewRecorder(out io.Writer) *Recorder {
+	return &Recorder{out: out, last: map[string]Transition{}}
+}
+
+// Record writes the transition unless the object was last recorded in the
+// same state for the same reason
+func (r *Recorder) Record(t Transition) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key := t.key()
+	if last, ok := r.last[key]; ok && last.State == t.State && last.Reason == t.Reason {
+		return nil
+	}
+	r.last[key] = t
+	b, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	_, err = r.out.Write(append(b, '\n'))
+	return err
+}
+
+// forget drops what the recorder knows about an object that has gone away
+func (r *Recorder) forget(t Transition) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.last, t.key())
+}
+
+// ReadTransitions reads transitions recorded as JSON lines
+func ReadTransitions(in io.Reader) ([]Transition, error) {
+	var transitions []Transition
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var t Transition
+		if err := json.Unmarshal(scanner.Bytes(), &t); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		transitions = append(transitions, t)
+	}
+	return transitions, scanner.Err()
+}
+
+// WithRecorder records the status transitions of the Orders and Challenges
+// the watcher sees, for replay by Simulate. The watcher only sees objects
+// that need its attention, so Orders and Challenges that recover show up in
+// their new state as they leave its cache. With WithServerSideFilter they
+// aren't seen at all.
+func WithRecorder(r *Recorder) Option {
+	return func(w *Watcher) {
+		w.recorder = r
+	}
+}
+
+// record records the state of an object the watcher has seen
+func (w *Watcher) record(obj interface{}, deleted bool) {
+	if w.recorder == nil {
+		return
+	}
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	t := Transition{Time: w.clock.Now().UTC(), Cluster: w.cluster}
+	switch o := obj.(type) {
+	case *acmev1.Order:
+		t.Kind, t.Namespace, t.Name, t.State, t.Reason = "Order", o.Namespace, o.Name, o.Status.State, o.Status.Reason
+	case *acmev1.Challenge:
+		t.Kind, t.Namespace, t.Name, t.State, t.Reason = "Challenge", o.Namespace, o.Name, o.Status.State, o.Status.Reason
+	default:
+		return
+	}
+	if err := w.recorder.Record(t); err != nil {
+		w.log.Error(err, "Error recording transition")
+	}
+	if deleted {
+		w.recorder.forget(t)
+	}
+}
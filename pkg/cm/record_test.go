@@ -0,0 +1,75 @@
+package cm_test
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/artificialinc/cm-429-fixer/pkg/cm"
+	acmev1 "github.com/cert-manager/cert-manager/pkg/apis/acme/v1"
+	"github.com/cert-manager/cert-manager/pkg/client/clientset/versioned/fake"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// syncBuffer is a buffer that may be read while the watcher writes to it
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) transitions(t *testing.T) []cm.Transition {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ts, err := cm.ReadTransitions(bytes.NewReader(b.buf.Bytes()))
+	assert.NoError(t, err)
+	return ts
+}
+
+func TestWatcherRecord(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	clk := newTestClock()
+	client := fake.NewSimpleClientset()
+	var out syncBuffer
+	w := cm.NewWatcher(cm.WithClient(client), cm.WithClock(clk), cm.WithCluster("test"), cm.WithRecorder(cm.NewRecorder(&out)))
+	clk.run(t, ctx, w)
+
+	_, err := client.AcmeV1().Orders("default").Create(ctx, buildOrder("order1", "default", &acmev1.OrderStatus{State: acmev1.Errored, Reason: "429 rateLimited"}), metav1.CreateOptions{})
+	assert.NoError(t, err)
+	waitFor(t, func() bool { return len(out.transitions(t)) == 1 })
+	limitedAt := clk.Now()
+
+	// The reset is recorded once, not for the update of its annotations
+	clk.step(cm.DefaultDelay)
+	waitFor(t, orderState(ctx, client, "default", "order1", acmev1.Pending))
+	resetAt := clk.Now()
+
+	// The recovered order is recorded as it leaves the cache
+	o, err := client.AcmeV1().Orders("default").Get(ctx, "order1", metav1.GetOptions{})
+	assert.NoError(t, err)
+	o.Status.State = acmev1.Valid
+	_, err = client.AcmeV1().Orders("default").UpdateStatus(ctx, o, metav1.UpdateOptions{})
+	assert.NoError(t, err)
+	waitFor(t, func() bool { return len(out.transitions(t)) == 3 })
+	clk.never(t, func() bool { return len(out.transitions(t)) != 3 })
+
+	order := func(at time.Time, state acmev1.State, reason string) cm.Transition {
+		return cm.Transition{Time: at.UTC(), Cluster: "test", Kind: "Order", Namespace: "default", Name: "order1", State: state, Reason: reason}
+	}
+	assert.Equal(t, []cm.Transition{
+		order(limitedAt, acmev1.Errored, "429 rateLimited"),
+		order(resetAt, acmev1.Pending, ""),
+		order(resetAt, acmev1.Valid, ""),
+	}, out.transitions(t))
+}
@@ -0,0 +1,64 @@
+package cm
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+
+	"sigs.k8s.io/yaml"
+)
+
+// Output formats supported when writing reports
+const (
+	FormatTable = "table"
+	FormatJSON  = "json"
+	FormatYAML  = "yaml"
+)
+
+// Write writes the report to out in the given format
+func (r *Report) Write(out io.Writer, format string) error {
+	switch format {
+	case FormatJSON:
+		return writeJSON(out, r)
+	case FormatYAML:
+		return writeYAML(out, r)
+	case FormatTable, "":
+		tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "NAMESPACE\tKIND\tNAME\tCERTIFICATE\tISSUER\tSTATE\tCATEGORY\tRETRY AFTER\tACTION")
+		for _, f := range r.Findings {
+			retryAfter := "-"
+			if f.RetryAfter != nil {
+				retryAfter = f.RetryAfter.Format(time.RFC3339)
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+				f.Namespace, f.Kind, f.Name, orDash(f.Certificate), f.Issuer, f.State, f.Category, retryAfter, f.Action)
+		}
+		return tw.Flush()
+	default:
+		return fmt.Errorf("unknown output format %q", format)
+	}
+}
+
+func writeJSON(out io.Writer, v interface{}) error {
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func writeYAML(out io.Writer, v interface{}) error {
+	b, err := yaml.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = out.Write(b)
+	return err
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
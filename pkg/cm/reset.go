@@ -0,0 +1,371 @@
+package cm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/artificialinc/cm-429-fixer/pkg/audit"
+	acmev1 "github.com/cert-manager/cert-manager/pkg/apis/acme/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/retry"
+)
+
+const (
+	// AnnotationAttempts records how many times the fixer has reset an object
+	AnnotationAttempts = "cm-429-fixer.artificial.com/reset-attempts"
+	// AnnotationLastReset records when the fixer last reset an object
+	AnnotationLastReset = "cm-429-fixer.artificial.com/last-reset"
+)
+
+// RetryState is the reset history the fixer stores on an object
+type RetryState struct {
+	Attempts  int       `json:"attempts"`
+	LastReset time.Time `json:"lastReset,omitempty"`
+}
+
+// RetryStateOf reads the retry state from an object's annotations
+func RetryStateOf(meta metav1.ObjectMeta) RetryState {
+	var s RetryState
+	s.Attempts, _ = strconv.Atoi(meta.Annotations[AnnotationAttempts])
+	s.LastReset, _ = time.Parse(time.RFC3339, meta.Annotations[AnnotationLastReset])
+	return s
+}
+
+func (s RetryState) apply(meta *metav1.ObjectMeta) {
+	if meta.Annotations == nil {
+		meta.Annotations = map[string]string{}
+	}
+	meta.Annotations[AnnotationAttempts] = strconv.Itoa(s.Attempts)
+	meta.Annotations[AnnotationLastReset] = s.LastReset.UTC().Format(time.RFC3339)
+}
+
+// patch returns a merge patch recording the retry state on an object. It
+// only touches the annotations, and fails with a conflict if the object has
+// changed since it was read.
+func (s RetryState) patch(meta metav1.ObjectMeta) ([]byte, error) {
+	patched := metav1.ObjectMeta{ResourceVersion: meta.ResourceVersion}
+	s.apply(&patched)
+	return json.Marshal(map[string]interface{}{"metadata": map[string]interface{}{
+		"resourceVersion": patched.ResourceVersion,
+		"annotations":     patched.Annotations,
+	}})
+}
+
+// ResetResult is the outcome of a reset
+type ResetResult string
+
+const (
+	// ResetDone means the object was set back to pending
+	ResetDone ResetResult = "reset"
+	// ResetDryRun means the object would have been reset
+	ResetDryRun ResetResult = "dry-run"
+	// ResetNotDue means the object is still backing off
+	ResetNotDue ResetResult = "not-due"
+	// ResetSkipped means the object is no longer rate limited
+	ResetSkipped ResetResult = "skipped"
+	// ResetDisabled means the retry policy doesn't reset objects of the kind
+	ResetDisabled ResetResult = "disabled"
+	// ResetExhausted means the object has been reset the policy's max attempts
+	ResetExhausted ResetResult = "exhausted"
+	// ResetPaused means changes to the object are paused or switched off
+	ResetPaused ResetResult = "paused"
+)
+
+// ResetOptions controls how an object is reset
+type ResetOptions struct {
+	// DryRun performs all checks without updating the object
+	DryRun bool
+	// Force resets the object even if it is still backing off or paused, but
+	// not if the control ConfigMap switches it off
+	Force bool
+	// Actor names who asked for the reset in the audit log, the watcher if empty
+	Actor string
+
+	// check is set for the watcher's own dry run before a reset, which isn't
+	// audited
+	check bool
+}
+
+// notBefore returns the earliest time an object may be reset again, taking
+// into account the policy's backoff and the server's retry after time
+func (w *Watcher) notBefore(p Policy, meta metav1.ObjectMeta, v Verdict) time.Time {
+	var t time.Time
+	if s := RetryStateOf(meta); !s.LastReset.IsZero() {
+		t = s.LastReset.Add(p.backoff(s.Attempts))
+	}
+	if v.RetryAfter.After(t) {
+		t = v.RetryAfter
+	}
+	return t
+}
+
+// resetDelay returns how long to wait before resetting an object. The policy's
+// delay gives the object time to settle and resets are never issued before
+// the object's backoff or the server's retry after time have passed.
+func (w *Watcher) resetDelay(p Policy, meta metav1.ObjectMeta, v Verdict, now time.Time) time.Duration {
+	delay := p.Delay
+	if until := w.notBefore(p, meta, v).Sub(now); until > delay {
+		delay = until
+	}
+	return delay
+}
+
+// Reset resets the Order or Challenge a finding refers to
+func (w *Watcher) Reset(ctx context.Context, f Finding, opts ResetOptions) (ResetResult, error) {
+	return w.reset(ctx, f.Kind, f.Namespace, f.Name, opts)
+}
+
+func (w *Watcher) reset(ctx context.Context, kind, namespace, name string, opts ResetOptions) (ResetResult, error) {
+	switch kind {
+	case "Order":
+		return w.ResetOrder(ctx, namespace, name, opts)
+	case "Challenge":
+		return w.ResetChallenge(ctx, namespace, name, opts)
+	default:
+		return ResetSkipped, fmt.Errorf("can't reset %s %s/%s, only Orders and Challenges can be reset", kind, namespace, name)
+	}
+}
+
+// ResetOrder sets a rate limited order back to pending. The order is read
+// fresh so that an order that has moved on since it was observed is left
+// alone, and its retry state is recorded before the status is updated.
+func (w *Watcher) ResetOrder(ctx context.Context, namespace, name string, opts ResetOptions) (ResetResult, error) {
+	o, err := w.c.AcmeV1().Orders(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return "", err
+	}
+	p := w.policy(namespace)
+	result, state := w.checkReset(p, "Order", o.ObjectMeta, p.Classify(o.Status.State, o.Status.Reason), opts)
+	if (result == ResetDone || result == ResetDryRun) && w.gated("Order", namespace, name, o.Spec.IssuerRef, opts.Force) {
+		result = ResetPaused
+	}
+	record := resetRecord("Order", o.ObjectMeta, p, o.Status.Reason, opts)
+	if result == ResetDryRun && !opts.check {
+		record.Action = audit.ActionDryRun
+		w.audit(record, nil)
+	}
+	if result != ResetDone {
+		return result, nil
+	}
+
+	patch, err := state.patch(o.ObjectMeta)
+	if err != nil {
+		return "", err
+	}
+	o, err = w.c.AcmeV1().Orders(namespace).Patch(ctx, name, types.MergePatchType, patch, metav1.PatchOptions{})
+	if err != nil {
+		err = fmt.Errorf("recording retry state: %w", err)
+		w.audit(record, err)
+		return "", err
+	}
+	w.wrote("Order", o.ObjectMeta)
+	record.ResourceVersionAfter = o.ResourceVersion
+	o.Status.State = acmev1.Pending
+	o.Status.Reason = ""
+	updated, err := w.c.AcmeV1().Orders(namespace).UpdateStatus(ctx, o, metav1.UpdateOptions{})
+	if err != nil {
+		w.audit(record, err)
+		return "", err
+	}
+	record.ResourceVersionAfter = updated.ResourceVersion
+	w.audit(record, nil)
+	return ResetDone, nil
+}
+
+// ResetChallenge sets a rate limited challenge back to pending, see ResetOrder
+func (w *Watcher) ResetChallenge(ctx context.Context, namespace, name string, opts ResetOptions) (ResetResult, error) {
+	c, err := w.c.AcmeV1().Challenges(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return "", err
+	}
+	p := w.policy(namespace)
+	result, state := w.checkReset(p, "Challenge", c.ObjectMeta, p.Classify(c.Status.State, c.Status.Reason), opts)
+	if (result == ResetDone || result == ResetDryRun) && w.gated("Challenge", namespace, name, c.Spec.IssuerRef, opts.Force) {
+		result = ResetPaused
+	}
+	record := resetRecord("Challenge", c.ObjectMeta, p, c.Status.Reason, opts)
+	if result == ResetDryRun && !opts.check {
+		record.Action = audit.ActionDryRun
+		w.audit(record, nil)
+	}
+	if result != ResetDone {
+		return result, nil
+	}
+
+	patch, err := state.patch(c.ObjectMeta)
+	if err != nil {
+		return "", err
+	}
+	c, err = w.c.AcmeV1().Challenges(namespace).Patch(ctx, name, types.MergePatchType, patch, metav1.PatchOptions{})
+	if err != nil {
+		err = fmt.Errorf("recording retry state: %w", err)
+		w.audit(record, err)
+		return "", err
+	}
+	w.wrote("Challenge", c.ObjectMeta)
+	record.ResourceVersionAfter = c.ResourceVersion
+	c.Status.State = acmev1.Pending
+	c.Status.Reason = ""
+	updated, err := w.c.AcmeV1().Challenges(namespace).UpdateStatus(ctx, c, metav1.UpdateOptions{})
+	if err != nil {
+		w.audit(record, err)
+		return "", err
+	}
+	record.ResourceVersionAfter = updated.ResourceVersion
+	w.audit(record, nil)
+	return ResetDone, nil
+}
+
+// ClearBackoff removes the retry state of an Order or Challenge, so its next
+// reset neither waits out a backoff nor counts towards the policy's max
+// attempts. The actor names who cleared it in the audit log.
+func (w *Watcher) ClearBackoff(ctx context.Context, kind, namespace, name, actor string) error {
+	var audited *audit.Record
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		audited = nil
+		switch kind {
+		case "Order":
+			o, err := w.c.AcmeV1().Orders(namespace).Get(ctx, name, metav1.GetOptions{})
+			if err != nil {
+				return err
+			}
+			if err := w.checkSwitchedOff(kind, namespace, name, o.Spec.IssuerRef); err != nil || !hasRetryState(o.ObjectMeta) {
+				return err
+			}
+			audited = backoffRecord(kind, o.ObjectMeta, actor)
+			updated, err := w.c.AcmeV1().Orders(namespace).Patch(ctx, name, types.MergePatchType, clearRetryStatePatch(o.ObjectMeta), metav1.PatchOptions{})
+			if err == nil {
+				audited.ResourceVersionAfter = updated.ResourceVersion
+			}
+			return err
+		case "Challenge":
+			c, err := w.c.AcmeV1().Challenges(namespace).Get(ctx, name, metav1.GetOptions{})
+			if err != nil {
+				return err
+			}
+			if err := w.checkSwitchedOff(kind, namespace, name, c.Spec.IssuerRef); err != nil || !hasRetryState(c.ObjectMeta) {
+				return err
+			}
+			audited = backoffRecord(kind, c.ObjectMeta, actor)
+			updated, err := w.c.AcmeV1().Challenges(namespace).Patch(ctx, name, types.MergePatchType, clearRetryStatePatch(c.ObjectMeta), metav1.PatchOptions{})
+			if err == nil {
+				audited.ResourceVersionAfter = updated.ResourceVersion
+			}
+			return err
+		default:
+			return fmt.Errorf("can't clear the backoff of %s %s/%s, only Orders and Challenges back off", kind, namespace, name)
+		}
+	})
+	if audited != nil {
+		w.audit(*audited, err)
+	}
+	return err
+}
+
+// hasRetryState returns true if the object has retry state annotations
+func hasRetryState(meta metav1.ObjectMeta) bool {
+	_, attempts := meta.Annotations[AnnotationAttempts]
+	_, last := meta.Annotations[AnnotationLastReset]
+	return attempts || last
+}
+
+// clearRetryStatePatch returns a merge patch removing the retry state
+// annotations, which fails with a conflict if the object has changed since
+// it was read
+func clearRetryStatePatch(meta metav1.ObjectMeta) []byte {
+	return []byte(fmt.Sprintf(`{"metadata":{"resourceVersion":%q,"annotations":{%q:null,%q:null}}}`,
+		meta.ResourceVersion, AnnotationAttempts, AnnotationLastReset))
+}
+
+// backoffRecord is the audit record of clearing an object's retry state
+func backoffRecord(kind string, meta metav1.ObjectMeta, actor string) *audit.Record {
+	return &audit.Record{
+		Actor:                 actor,
+		Action:                audit.ActionAnnotate,
+		Object:                audit.Object{Kind: kind, Namespace: meta.Namespace, Name: meta.Name, UID: string(meta.UID)},
+		ResourceVersionBefore: meta.ResourceVersion,
+		Rule:                  "clear backoff",
+	}
+}
+
+// resetRecord is the audit record of a reset of the object
+func resetRecord(kind string, meta metav1.ObjectMeta, p Policy, reason string, opts ResetOptions) audit.Record {
+	return audit.Record{
+		Actor:                 opts.Actor,
+		Action:                audit.ActionReset,
+		Object:                audit.Object{Kind: kind, Namespace: meta.Namespace, Name: meta.Name, UID: string(meta.UID)},
+		ResourceVersionBefore: meta.ResourceVersion,
+		Rule:                  p.Source,
+		Reason:                reason,
+	}
+}
+
+// checkReset decides whether an object may be reset under the policy and
+// returns the retry state to record if it is. Forced resets ignore the
+// backoff and max attempts, but not the kinds the policy disables.
+func (w *Watcher) checkReset(p Policy, kind string, meta metav1.ObjectMeta, v Verdict, opts ResetOptions) (ResetResult, RetryState) {
+	if !v.RateLimited() {
+		return ResetSkipped, RetryState{}
+	}
+	if !p.Enabled(kind) {
+		return ResetDisabled, RetryState{}
+	}
+	if !opts.Force && p.exhausted(meta) {
+		return ResetExhausted, RetryState{}
+	}
+	now := w.clock.Now()
+	if !opts.Force && now.Before(w.notBefore(p, meta, v)) {
+		return ResetNotDue, RetryState{}
+	}
+	if opts.DryRun {
+		return ResetDryRun, RetryState{}
+	}
+	s := RetryStateOf(meta)
+	s.Attempts++
+	s.LastReset = now
+	return ResetDone, s
+}
+
+// Selector selects findings to act on, empty fields match everything
+type Selector struct {
+	Namespace   string
+	Certificate string
+	// Issuer matches either the issuer name or Kind/name
+	Issuer string
+}
+
+// Matches returns true if the finding is selected
+func (s Selector) Matches(f Finding) bool {
+	if s.Namespace != "" && f.Namespace != s.Namespace {
+		return false
+	}
+	if s.Certificate != "" && f.Certificate != s.Certificate {
+		return false
+	}
+	if s.Issuer != "" && f.Issuer != s.Issuer && !strings.HasSuffix(f.Issuer, "/"+s.Issuer) {
+		return false
+	}
+	return true
+}
+
+// Targets scans for rate limited Orders and Challenges matching the selector,
+// the objects a reset can act on
+func (w *Watcher) Targets(ctx context.Context, sel Selector) (*Report, error) {
+	report, err := w.Scan(ctx, sel.Namespace)
+	if err != nil {
+		return nil, err
+	}
+	targets := &Report{Findings: []Finding{}}
+	for _, f := range report.Findings {
+		if !f.Resettable() || !sel.Matches(f) {
+			continue
+		}
+		targets.Findings = append(targets.Findings, f)
+	}
+	return targets, nil
+}
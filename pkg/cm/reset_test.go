@@ -0,0 +1,154 @@
+package cm_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/artificialinc/cm-429-fixer/pkg/audit"
+	"github.com/artificialinc/cm-429-fixer/pkg/cm"
+	acmev1 "github.com/cert-manager/cert-manager/pkg/apis/acme/v1"
+	"github.com/cert-manager/cert-manager/pkg/client/clientset/versioned/fake"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestResetOrder(t *testing.T) {
+	ctx := context.Background()
+	client := fake.NewSimpleClientset(
+		buildOrder("order1", "default", &acmev1.OrderStatus{
+			State:  acmev1.Errored,
+			Reason: "some 429 error",
+		}),
+		buildOrder("order2", "default", &acmev1.OrderStatus{
+			State:  acmev1.Errored,
+			Reason: "some other error",
+		}),
+	)
+	w := cm.NewWatcher(cm.WithClient(client))
+
+	errorAgain := func() {
+		o, err := client.AcmeV1().Orders("default").Get(ctx, "order1", metav1.GetOptions{})
+		assert.NoError(t, err)
+		o.Status.State = acmev1.Errored
+		o.Status.Reason = "some 429 error"
+		_, err = client.AcmeV1().Orders("default").UpdateStatus(ctx, o, metav1.UpdateOptions{})
+		assert.NoError(t, err)
+	}
+	assertOrder := func(state acmev1.State, attempts int) {
+		o, err := client.AcmeV1().Orders("default").Get(ctx, "order1", metav1.GetOptions{})
+		assert.NoError(t, err)
+		assert.Equal(t, state, o.Status.State)
+		assert.Equal(t, attempts, cm.RetryStateOf(o.ObjectMeta).Attempts)
+	}
+
+	result, err := w.ResetOrder(ctx, "default", "order1", cm.ResetOptions{DryRun: true})
+	assert.NoError(t, err)
+	assert.Equal(t, cm.ResetDryRun, result)
+	assertOrder(acmev1.Errored, 0)
+
+	result, err = w.ResetOrder(ctx, "default", "order1", cm.ResetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, cm.ResetDone, result)
+	assertOrder(acmev1.Pending, 1)
+
+	// Already pending, nothing to do
+	result, err = w.ResetOrder(ctx, "default", "order1", cm.ResetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, cm.ResetSkipped, result)
+
+	// Rate limited again straight away, still backing off
+	errorAgain()
+	result, err = w.ResetOrder(ctx, "default", "order1", cm.ResetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, cm.ResetNotDue, result)
+	assertOrder(acmev1.Errored, 1)
+
+	result, err = w.ResetOrder(ctx, "default", "order1", cm.ResetOptions{Force: true})
+	assert.NoError(t, err)
+	assert.Equal(t, cm.ResetDone, result)
+	assertOrder(acmev1.Pending, 2)
+
+	result, err = w.ResetOrder(ctx, "default", "order2", cm.ResetOptions{Force: true})
+	assert.NoError(t, err)
+	assert.Equal(t, cm.ResetSkipped, result)
+
+	_, err = w.Reset(ctx, cm.Finding{Kind: "Certificate", Namespace: "default", Name: "cert1"}, cm.ResetOptions{})
+	assert.Error(t, err)
+}
+
+func TestSelector(t *testing.T) {
+	f := cm.Finding{Namespace: "default", Certificate: "cert1", Issuer: "ClusterIssuer/letsencrypt"}
+
+	assert.True(t, cm.Selector{}.Matches(f))
+	assert.True(t, cm.Selector{Namespace: "default", Certificate: "cert1"}.Matches(f))
+	assert.True(t, cm.Selector{Issuer: "letsencrypt"}.Matches(f))
+	assert.True(t, cm.Selector{Issuer: "ClusterIssuer/letsencrypt"}.Matches(f))
+	assert.False(t, cm.Selector{Issuer: "Issuer/letsencrypt"}.Matches(f))
+	assert.False(t, cm.Selector{Namespace: "other"}.Matches(f))
+	assert.False(t, cm.Selector{Certificate: "cert2"}.Matches(f))
+}
+
+func TestResetAudit(t *testing.T) {
+	ctx := context.Background()
+	order := buildOrder("order1", "default", &acmev1.OrderStatus{State: acmev1.Errored, Reason: "some 429 error"})
+	order.ResourceVersion = "1"
+	client := fake.NewSimpleClientset(order)
+	var out bytes.Buffer
+	w := cm.NewWatcher(cm.WithClient(client), cm.WithCluster("test"), cm.WithAudit(audit.New(audit.NewWriterSink(&out))))
+
+	_, err := w.ResetOrder(ctx, "default", "order1", cm.ResetOptions{DryRun: true, Actor: "fix:someone"})
+	assert.NoError(t, err)
+	_, err = w.ResetOrder(ctx, "default", "order1", cm.ResetOptions{})
+	assert.NoError(t, err)
+	o, err := client.AcmeV1().Orders("default").Get(ctx, "order1", metav1.GetOptions{})
+	assert.NoError(t, err)
+	// Checks that change nothing aren't recorded
+	_, err = w.ResetOrder(ctx, "default", "order1", cm.ResetOptions{})
+	assert.NoError(t, err)
+
+	var records []audit.Record
+	dec := json.NewDecoder(&out)
+	for dec.More() {
+		var r audit.Record
+		assert.NoError(t, dec.Decode(&r))
+		assert.False(t, r.Time.IsZero())
+		r.Time = time.Time{}
+		records = append(records, r)
+	}
+	object := audit.Object{Kind: "Order", Namespace: "default", Name: "order1"}
+	assert.Equal(t, []audit.Record{
+		{Cluster: "test", Actor: "fix:someone", Action: audit.ActionDryRun, Object: object, ResourceVersionBefore: "1", Rule: "default", Reason: "some 429 error"},
+		{Cluster: "test", Actor: cm.ActorWatcher, Action: audit.ActionReset, Object: object, ResourceVersionBefore: "1", ResourceVersionAfter: o.ResourceVersion, Rule: "default", Reason: "some 429 error"},
+	}, records)
+}
+
+func TestClearBackoff(t *testing.T) {
+	ctx := context.Background()
+	order := buildOrder("order1", "default", &acmev1.OrderStatus{State: acmev1.Errored, Reason: "some 429 error"})
+	order.Annotations = map[string]string{cm.AnnotationAttempts: "3", cm.AnnotationLastReset: "2024-01-01T00:00:00Z", "other": "kept"}
+	client := fake.NewSimpleClientset(order)
+	var out bytes.Buffer
+	w := cm.NewWatcher(cm.WithClient(client), cm.WithAudit(audit.New(audit.NewWriterSink(&out))))
+
+	assert.NoError(t, w.ClearBackoff(ctx, "Order", "default", "order1", "admin"))
+	o, err := client.AcmeV1().Orders("default").Get(ctx, "order1", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"other": "kept"}, o.Annotations)
+	assert.Equal(t, cm.RetryState{}, cm.RetryStateOf(o.ObjectMeta))
+
+	// Clearing again changes nothing and isn't recorded
+	assert.NoError(t, w.ClearBackoff(ctx, "Order", "default", "order1", "admin"))
+	assert.Error(t, w.ClearBackoff(ctx, "Certificate", "default", "cert1", "admin"))
+
+	var r audit.Record
+	dec := json.NewDecoder(&out)
+	assert.NoError(t, dec.Decode(&r))
+	assert.Equal(t, "admin", r.Actor)
+	assert.Equal(t, audit.ActionAnnotate, r.Action)
+	assert.Equal(t, "clear backoff", r.Rule)
+	assert.Equal(t, o.ResourceVersion, r.ResourceVersionAfter)
+	assert.False(t, dec.More())
+}
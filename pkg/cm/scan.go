@@ -0,0 +1,227 @@
+package cm
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	cmapi "github.com/cert-manager/cert-manager/pkg/apis/certmanager/v1"
+	cmmeta "github.com/cert-manager/cert-manager/pkg/apis/meta/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// Finding is a single failed object found by a scan. The account is only
+// resolved for rate limited Orders and Challenges, and the next reset is set
+// for the ones the watcher will reset. GaveUp is set for the ones reset the
+// max attempts of their policy.
+type Finding struct {
+	Kind        string      `json:"kind"`
+	Namespace   string      `json:"namespace"`
+	Name        string      `json:"name"`
+	Certificate string      `json:"certificate,omitempty"`
+	Issuer      string      `json:"issuer,omitempty"`
+	Account     string      `json:"account,omitempty"`
+	State       string      `json:"state"`
+	Reason      string      `json:"reason,omitempty"`
+	Category    Category    `json:"category"`
+	RetryAfter  *time.Time  `json:"retryAfter,omitempty"`
+	RetryState  *RetryState `json:"retryState,omitempty"`
+	NextReset   *time.Time  `json:"nextReset,omitempty"`
+	GaveUp      bool        `json:"gaveUp,omitempty"`
+	Action      string      `json:"action"`
+}
+
+// Resettable returns true if the finding is a rate limited Order or Challenge
+func (f Finding) Resettable() bool {
+	return f.Category == CategoryRateLimited && (f.Kind == "Order" || f.Kind == "Challenge")
+}
+
+// Report is the result of a scan
+type Report struct {
+	Findings []Finding `json:"findings"`
+}
+
+// Stuck returns true if the report contains rate limited Orders or
+// Challenges the watcher will reset or has given up on. Other failures, and
+// resets that are disabled, paused or switched off, don't count.
+func (r *Report) Stuck() bool {
+	for _, f := range r.Findings {
+		if f.NextReset != nil || f.GaveUp {
+			return true
+		}
+	}
+	return false
+}
+
+// Scan lists Orders, Challenges, CertificateRequests and Certificates in the
+// namespace, or all namespaces if empty, and reports the ones that have failed
+// along with what the watcher would do about them
+func (w *Watcher) Scan(ctx context.Context, namespace string) (*Report, error) {
+	certs, err := w.c.CertmanagerV1().Certificates(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("listing certificates: %w", err)
+	}
+	crs, err := w.c.CertmanagerV1().CertificateRequests(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("listing certificate requests: %w", err)
+	}
+	orders, err := w.c.AcmeV1().Orders(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("listing orders: %w", err)
+	}
+	challenges, err := w.c.AcmeV1().Challenges(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("listing challenges: %w", err)
+	}
+
+	// Index owners by UID so every object can be traced back to its Certificate
+	owner := map[types.UID]string{}
+	for _, c := range certs.Items {
+		owner[c.UID] = c.Name
+	}
+	for _, cr := range crs.Items {
+		owner[cr.UID] = ownerName(cr.OwnerReferences, owner)
+	}
+	for _, o := range orders.Items {
+		owner[o.UID] = ownerName(o.OwnerReferences, owner)
+	}
+
+	now := w.clock.Now()
+	r := &Report{Findings: []Finding{}}
+
+	for _, c := range challenges.Items {
+		v := w.policy(c.Namespace).Classify(c.Status.State, c.Status.Reason)
+		if v.Category == CategoryNone {
+			continue
+		}
+		f := w.finding("Challenge", c.ObjectMeta, ownerName(c.OwnerReferences, owner), c.Spec.IssuerRef, string(c.Status.State), c.Status.Reason, v, now)
+		if f.Resettable() {
+			f.Account = w.account(ctx, c.Namespace, c.Spec.IssuerRef)
+		}
+		r.Findings = append(r.Findings, f)
+	}
+	for _, o := range orders.Items {
+		v := w.policy(o.Namespace).Classify(o.Status.State, o.Status.Reason)
+		if v.Category == CategoryNone {
+			continue
+		}
+		f := w.finding("Order", o.ObjectMeta, owner[o.UID], o.Spec.IssuerRef, string(o.Status.State), o.Status.Reason, v, now)
+		if f.Resettable() {
+			f.Account = w.account(ctx, o.Namespace, o.Spec.IssuerRef)
+		}
+		r.Findings = append(r.Findings, f)
+	}
+	for _, cr := range crs.Items {
+		cond := crCondition(&cr, cmapi.CertificateRequestConditionReady)
+		if cond == nil || cond.Reason != cmapi.CertificateRequestReasonFailed {
+			continue
+		}
+		v := ClassifyReason(cond.Message)
+		r.Findings = append(r.Findings, w.finding("CertificateRequest", cr.ObjectMeta, owner[cr.UID], cr.Spec.IssuerRef, cond.Reason, cond.Message, v, now))
+	}
+	for _, c := range certs.Items {
+		cond := certCondition(&c, cmapi.CertificateConditionIssuing)
+		if cond == nil || cond.Status != cmmeta.ConditionFalse || c.Status.LastFailureTime == nil {
+			continue
+		}
+		v := ClassifyReason(cond.Message)
+		r.Findings = append(r.Findings, w.finding("Certificate", c.ObjectMeta, c.Name, c.Spec.IssuerRef, cond.Reason, cond.Message, v, now))
+	}
+
+	return r, nil
+}
+
+func (w *Watcher) finding(kind string, meta metav1.ObjectMeta, cert string, issuer cmmeta.ObjectReference, state, reason string, v Verdict, now time.Time) Finding {
+	f := Finding{
+		Kind:        kind,
+		Namespace:   meta.Namespace,
+		Name:        meta.Name,
+		Certificate: cert,
+		Issuer:      issuerName(issuer),
+		State:       state,
+		Reason:      reason,
+		Category:    v.Category,
+		Action:      w.action(kind, meta, issuer, v, now),
+	}
+	if !v.RetryAfter.IsZero() {
+		t := v.RetryAfter
+		f.RetryAfter = &t
+	}
+	if s := RetryStateOf(meta); s.Attempts > 0 {
+		f.RetryState = &s
+	}
+	_, paused := w.pauses.Paused(meta.Namespace, issuer)
+	_, off := w.SwitchedOff(meta.Namespace, issuer)
+	if p := w.policy(meta.Namespace); f.Resettable() && p.Enabled(kind) {
+		f.GaveUp = p.exhausted(meta)
+		if !f.GaveUp && !paused && !off {
+			t := now.Add(w.resetDelay(p, meta, v, now))
+			f.NextReset = &t
+		}
+	}
+	return f
+}
+
+// action describes what the watcher would do with an object of the kind
+func (w *Watcher) action(kind string, meta metav1.ObjectMeta, issuer cmmeta.ObjectReference, v Verdict, now time.Time) string {
+	if !v.RateLimited() {
+		return "none"
+	}
+	switch kind {
+	case "Order", "Challenge":
+		p := w.policy(meta.Namespace)
+		if !p.Enabled(kind) {
+			return "none, disabled by " + p.Source
+		}
+		if attempts := RetryStateOf(meta).Attempts; p.MaxAttempts > 0 && attempts >= p.MaxAttempts {
+			return fmt.Sprintf("none, gave up after %d resets", attempts)
+		}
+		if reason, ok := w.SwitchedOff(meta.Namespace, issuer); ok {
+			return "none, switched off by the control ConfigMap: " + reason
+		}
+		if pause, ok := w.pauses.Paused(meta.Namespace, issuer); ok && pause.Actor != "" {
+			return "none, paused by " + pause.Actor
+		} else if ok {
+			return "none, paused"
+		}
+		return fmt.Sprintf("reset to pending in %s", w.resetDelay(p, meta, v, now).Round(time.Second))
+	default:
+		return "none, recovers once its Order is reset"
+	}
+}
+
+func ownerName(refs []metav1.OwnerReference, owner map[types.UID]string) string {
+	for _, ref := range refs {
+		if name, ok := owner[ref.UID]; ok {
+			return name
+		}
+	}
+	return ""
+}
+
+func issuerName(ref cmmeta.ObjectReference) string {
+	kind := ref.Kind
+	if kind == "" {
+		kind = cmapi.IssuerKind
+	}
+	return kind + "/" + ref.Name
+}
+
+func crCondition(cr *cmapi.CertificateRequest, t cmapi.CertificateRequestConditionType) *cmapi.CertificateRequestCondition {
+	for i := range cr.Status.Conditions {
+		if cr.Status.Conditions[i].Type == t {
+			return &cr.Status.Conditions[i]
+		}
+	}
+	return nil
+}
+
+func certCondition(c *cmapi.Certificate, t cmapi.CertificateConditionType) *cmapi.CertificateCondition {
+	for i := range c.Status.Conditions {
+		if c.Status.Conditions[i].Type == t {
+			return &c.Status.Conditions[i]
+		}
+	}
+	return nil
+}
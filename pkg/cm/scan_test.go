@@ -0,0 +1,81 @@
+package cm_test
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/artificialinc/cm-429-fixer/pkg/cm"
+	acmev1 "github.com/cert-manager/cert-manager/pkg/apis/acme/v1"
+	cmapi "github.com/cert-manager/cert-manager/pkg/apis/certmanager/v1"
+	"github.com/cert-manager/cert-manager/pkg/client/clientset/versioned/fake"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestScan(t *testing.T) {
+	cert := &cmapi.Certificate{ObjectMeta: metav1.ObjectMeta{Name: "cert1", Namespace: "default", UID: "cert-uid"}}
+	cr := &cmapi.CertificateRequest{ObjectMeta: metav1.ObjectMeta{
+		Name:            "cert1-1",
+		Namespace:       "default",
+		UID:             "cr-uid",
+		OwnerReferences: []metav1.OwnerReference{{Kind: "Certificate", Name: "cert1", UID: "cert-uid"}},
+	}}
+	limited := buildOrder("order1", "default", &acmev1.OrderStatus{
+		State:  acmev1.Errored,
+		Reason: "some 429 error",
+	})
+	limited.UID = "order-uid"
+	limited.OwnerReferences = []metav1.OwnerReference{{Kind: "CertificateRequest", Name: "cert1-1", UID: "cr-uid"}}
+	limited.Spec.IssuerRef.Name = "letsencrypt"
+
+	client := fake.NewSimpleClientset(
+		cert,
+		cr,
+		limited,
+		buildOrder("order2", "default", &acmev1.OrderStatus{State: acmev1.Valid}),
+		buildChallenge("challenge1", "other", &acmev1.ChallengeStatus{
+			State:  acmev1.Errored,
+			Reason: "some other error",
+		}),
+	)
+
+	w := cm.NewWatcher(cm.WithClient(client))
+
+	report, err := w.Scan(context.Background(), "")
+	assert.NoError(t, err)
+	assert.True(t, report.Stuck())
+	assert.Len(t, report.Findings, 2)
+
+	byName := map[string]cm.Finding{}
+	for _, f := range report.Findings {
+		byName[f.Name] = f
+	}
+	assert.Equal(t, cm.CategoryRateLimited, byName["order1"].Category)
+	assert.Equal(t, "cert1", byName["order1"].Certificate)
+	assert.Equal(t, "Issuer/letsencrypt", byName["order1"].Issuer)
+	assert.Contains(t, byName["order1"].Action, "reset to pending")
+	// The issuer can't be read, so the account falls back to its name
+	assert.Contains(t, byName["order1"].Account, "default/letsencrypt")
+	assert.NotNil(t, byName["order1"].NextReset)
+	assert.Empty(t, byName["challenge1"].Account)
+	assert.Nil(t, byName["challenge1"].NextReset)
+	assert.Equal(t, cm.CategoryOther, byName["challenge1"].Category)
+	assert.Equal(t, "none", byName["challenge1"].Action)
+
+	// Failures the fixer doesn't act on aren't stuck
+	report, err = w.Scan(context.Background(), "other")
+	assert.NoError(t, err)
+	assert.Len(t, report.Findings, 1)
+	assert.False(t, report.Stuck())
+
+	report, err = w.Scan(context.Background(), "empty")
+	assert.NoError(t, err)
+	assert.False(t, report.Stuck())
+
+	for _, format := range []string{cm.FormatTable, cm.FormatJSON, cm.FormatYAML} {
+		var out bytes.Buffer
+		assert.NoError(t, report.Write(&out, format))
+	}
+	assert.Error(t, report.Write(&bytes.Buffer{}, "xml"))
+}
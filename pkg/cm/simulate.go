@@ -0,0 +1,243 @@
+package cm
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	acmev1 "github.com/cert-manager/cert-manager/pkg/apis/acme/v1"
+	"github.com/cert-manager/cert-manager/pkg/client/clientset/versioned"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clocktesting "k8s.io/utils/clock/testing"
+)
+
+// Outcome is how a simulated object ends up
+type Outcome string
+
+const (
+	// OutcomeIssued means a retry after the rate limit ended would have succeeded
+	OutcomeIssued Outcome = "issued"
+	// OutcomeLimited means the object was still rate limited when the recording ended
+	OutcomeLimited Outcome = "limited"
+	// OutcomeExhausted means the policy's max attempts were used up
+	OutcomeExhausted Outcome = "exhausted"
+	// OutcomeDisabled means the policy doesn't reset objects of the kind
+	OutcomeDisabled Outcome = "disabled"
+)
+
+// SimulatedPolicy is the retry behavior a simulation ran with
+type SimulatedPolicy struct {
+	Delay       metav1.Duration `json:"delay"`
+	MaxDelay    metav1.Duration `json:"maxDelay"`
+	Backoff     float64         `json:"backoff"`
+	MaxAttempts int             `json:"maxAttempts"`
+	Kinds       []string        `json:"kinds"`
+	HoldAfter   metav1.Duration `json:"holdAfter"`
+}
+
+// SimulatedObject compares what happened to a rate limited object in the
+// recording with what the simulated policy would have done
+type SimulatedObject struct {
+	Cluster   string `json:"cluster,omitempty"`
+	Kind      string `json:"kind"`
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	// LimitedAt is when the object was first recorded rate limited
+	LimitedAt time.Time `json:"limitedAt"`
+	// RecordedResets counts the recorded Errored to Pending transitions
+	RecordedResets int `json:"recordedResets"`
+	// RecordedDelay is from LimitedAt until the object was recorded Valid,
+	// nil if it never was
+	RecordedDelay *metav1.Duration `json:"recordedDelay,omitempty"`
+	Resets        int              `json:"resets"`
+	Holds         int              `json:"holds"`
+	Outcome       Outcome          `json:"outcome"`
+	// Delay is from LimitedAt until the simulated retry that would have
+	// succeeded, nil unless the outcome is issued
+	Delay *metav1.Duration `json:"delay,omitempty"`
+}
+
+// Simulation is the result of replaying recorded transitions
+type Simulation struct {
+	Policy         SimulatedPolicy   `json:"policy"`
+	Objects        []SimulatedObject `json:"objects"`
+	RecordedResets int               `json:"recordedResets"`
+	Resets         int               `json:"resets"`
+	Holds          int               `json:"holds"`
+}
+
+// Simulate replays recorded transitions through the classifier and a policy
+// on a virtual clock. The policy is the watcher's, set by the options, with
+// the fields set in the spec overridden. Every rate limited object is retried
+// as the watcher would have, from the time it was first recorded rate
+// limited. Retries before the object was last recorded rate limited fail for
+// the reason recorded at the time; a retry after that succeeds if the object
+// was recorded Valid later on.
+func Simulate(transitions []Transition, spec RetryPolicySpec, opts ...Option) (*Simulation, error) {
+	if len(transitions) == 0 {
+		return nil, errors.New("no transitions to simulate")
+	}
+	transitions = append([]Transition(nil), transitions...)
+	sort.SliceStable(transitions, func(i, j int) bool {
+		return transitions[i].Time.Before(transitions[j].Time)
+	})
+
+	clk := clocktesting.NewFakeClock(transitions[0].Time)
+	// The client is never used, it only keeps NewWatcher from loading one
+	opts = append([]Option{WithClient(&versioned.Clientset{})}, opts...)
+	w := NewWatcher(append(opts, WithClock(clk))...)
+	p, err := w.defaultPolicy().apply("simulation", spec)
+	if err != nil {
+		return nil, err
+	}
+	if p.Delay <= 0 {
+		return nil, errors.New("simulating needs a positive delay")
+	}
+
+	s := &Simulation{
+		Policy: SimulatedPolicy{
+			Delay:       metav1.Duration{Duration: p.Delay},
+			MaxDelay:    metav1.Duration{Duration: p.MaxDelay},
+			Backoff:     p.Backoff,
+			MaxAttempts: p.MaxAttempts,
+			Kinds:       p.Kinds,
+			HoldAfter:   metav1.Duration{Duration: w.holdAfter},
+		},
+		Objects: []SimulatedObject{},
+	}
+	end := transitions[len(transitions)-1].Time
+	byObject := map[string][]Transition{}
+	var keys []string
+	for _, t := range transitions {
+		if _, ok := byObject[t.key()]; !ok {
+			keys = append(keys, t.key())
+		}
+		byObject[t.key()] = append(byObject[t.key()], t)
+	}
+	for _, key := range keys {
+		o, ok := w.simulateObject(clk, p, byObject[key], end)
+		if !ok {
+			continue
+		}
+		s.Objects = append(s.Objects, o)
+		s.RecordedResets += o.RecordedResets
+		s.Resets += o.Resets
+		s.Holds += o.Holds
+	}
+	return s, nil
+}
+
+// simulateObject replays the transitions of a single object, returning false
+// if it was never rate limited
+func (w *Watcher) simulateObject(clk *clocktesting.FakeClock, p Policy, ts []Transition, end time.Time) (SimulatedObject, bool) {
+	var limited []Transition
+	for _, t := range ts {
+		if p.Classify(t.State, t.Reason).RateLimited() {
+			limited = append(limited, t)
+		}
+	}
+	if len(limited) == 0 {
+		return SimulatedObject{}, false
+	}
+	first, last := limited[0], limited[len(limited)-1]
+	o := SimulatedObject{
+		Cluster:   first.Cluster,
+		Kind:      first.Kind,
+		Namespace: first.Namespace,
+		Name:      first.Name,
+		LimitedAt: first.Time,
+	}
+	recovered := false
+	for i, t := range ts {
+		if i > 0 && ts[i-1].State == acmev1.Errored && t.State == acmev1.Pending {
+			o.RecordedResets++
+		}
+		if !recovered && t.State == acmev1.Valid && t.Time.After(last.Time) {
+			recovered = true
+			o.RecordedDelay = &metav1.Duration{Duration: t.Time.Sub(first.Time)}
+		}
+	}
+
+	if !p.Enabled(o.Kind) {
+		o.Outcome = OutcomeDisabled
+		return o, true
+	}
+	var meta metav1.ObjectMeta
+	now, current := first.Time, first
+	for {
+		v := p.Classify(current.State, current.Reason)
+		if w.shouldHold(v, now) {
+			// The Certificate is held and reissued once the limit ends
+			o.Holds++
+			now = v.RetryAfter
+		} else {
+			now = now.Add(w.resetDelay(p, meta, v, now))
+			clk.SetTime(now)
+			result, state := w.checkReset(p, o.Kind, meta, v, ResetOptions{})
+			if result == ResetExhausted {
+				o.Outcome = OutcomeExhausted
+				return o, true
+			}
+			if now.After(end) {
+				o.Outcome = OutcomeLimited
+				return o, true
+			}
+			state.apply(&meta)
+			o.Resets++
+		}
+		if now.After(last.Time) {
+			if recovered {
+				o.Outcome = OutcomeIssued
+				o.Delay = &metav1.Duration{Duration: now.Sub(first.Time)}
+				return o, true
+			}
+			if now.After(end) {
+				o.Outcome = OutcomeLimited
+				return o, true
+			}
+		}
+		// The retry fails for the reason the object was last limited for
+		for _, t := range limited {
+			if t.Time.After(now) {
+				break
+			}
+			current = t
+		}
+	}
+}
+
+// Write writes the simulation to out in the given format
+func (s *Simulation) Write(out io.Writer, format string) error {
+	switch format {
+	case FormatJSON:
+		return writeJSON(out, s)
+	case FormatYAML:
+		return writeYAML(out, s)
+	case FormatTable, "":
+		p := s.Policy
+		fmt.Fprintf(out, "Policy: delay %s, max delay %s, backoff %v, max attempts %d, kinds %s, hold after %s\n\n",
+			p.Delay.Duration, p.MaxDelay.Duration, p.Backoff, p.MaxAttempts, strings.Join(p.Kinds, ","), p.HoldAfter.Duration)
+		tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "NAMESPACE\tKIND\tNAME\tLIMITED AT\tRECORDED RESETS\tRESETS\tHOLDS\tRECORDED DELAY\tPROJECTED DELAY\tOUTCOME")
+		for _, o := range s.Objects {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%d\t%d\t%s\t%s\t%s\n",
+				o.Namespace, o.Kind, o.Name, o.LimitedAt.Format(time.RFC3339), o.RecordedResets, o.Resets, o.Holds,
+				durationOrDash(o.RecordedDelay), durationOrDash(o.Delay), o.Outcome)
+		}
+		fmt.Fprintf(tw, "TOTAL\t\t\t\t%d\t%d\t%d\t\t\t\n", s.RecordedResets, s.Resets, s.Holds)
+		return tw.Flush()
+	default:
+		return fmt.Errorf("unknown output format %q", format)
+	}
+}
+
+func durationOrDash(d *metav1.Duration) string {
+	if d == nil {
+		return "-"
+	}
+	return d.Duration.String()
+}
@@ -0,0 +1,131 @@
+package cm_test
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/artificialinc/cm-429-fixer/pkg/cm"
+	acmev1 "github.com/cert-manager/cert-manager/pkg/apis/acme/v1"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestSimulate(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := func(d time.Duration) time.Time { return start.Add(d) }
+	order := func(name string, d time.Duration, state acmev1.State, reason string) cm.Transition {
+		return cm.Transition{Time: at(d), Kind: "Order", Namespace: "default", Name: name, State: state, Reason: reason}
+	}
+	retryAfter := "429 rateLimited: retry after " + at(2*time.Hour).Format("2006-01-02 15:04:05 UTC")
+
+	// The outage lasts two hours, during which the fixer reset "outage" twice
+	// and "held" was given a retry after time
+	transitions := []cm.Transition{
+		order("outage", 0, acmev1.Errored, "429 rateLimited"),
+		order("held", 0, acmev1.Errored, retryAfter),
+		order("never", 0, acmev1.Errored, "429 rateLimited"),
+		order("outage", time.Minute, acmev1.Pending, ""),
+		order("outage", time.Minute, acmev1.Errored, "429 rateLimited"),
+		order("other", time.Minute, acmev1.Errored, "404 not found"),
+		order("outage", time.Hour, acmev1.Pending, ""),
+		order("outage", 2*time.Hour, acmev1.Errored, "429 rateLimited"),
+		order("held", 2*time.Hour+time.Minute, acmev1.Valid, ""),
+		order("outage", 2*time.Hour+30*time.Minute, acmev1.Valid, ""),
+	}
+	duration := func(d time.Duration) *metav1.Duration { return &metav1.Duration{Duration: d} }
+
+	for _, tt := range []struct {
+		name     string
+		spec     cm.RetryPolicySpec
+		opts     []cm.Option
+		expected map[string]cm.SimulatedObject
+		resets   int
+		holds    int
+	}{
+		{
+			// Resets back off from a minute to an hour: 1m, 3m, 7m, 15m, 31m,
+			// 63m and 123m, which is after the outage
+			name: "backoff",
+			spec: cm.RetryPolicySpec{Delay: "1m", MaxDelay: "1h"},
+			expected: map[string]cm.SimulatedObject{
+				"outage": {Resets: 7, Outcome: cm.OutcomeIssued, Delay: duration(123 * time.Minute)},
+				"held":   {Resets: 1, Outcome: cm.OutcomeIssued, Delay: duration(2 * time.Hour)},
+				"never":  {Resets: 7, Outcome: cm.OutcomeLimited},
+			},
+			resets: 15,
+		},
+		{
+			// With a max delay of 10 minutes resets continue at 15m, 25m and so
+			// on up to 125m
+			name: "max delay",
+			spec: cm.RetryPolicySpec{Delay: "1m", MaxDelay: "10m"},
+			expected: map[string]cm.SimulatedObject{
+				"outage": {Resets: 15, Outcome: cm.OutcomeIssued, Delay: duration(125 * time.Minute)},
+				"held":   {Resets: 1, Outcome: cm.OutcomeIssued, Delay: duration(2 * time.Hour)},
+				"never":  {Resets: 17, Outcome: cm.OutcomeLimited},
+			},
+			resets: 33,
+		},
+		{
+			name: "hold",
+			spec: cm.RetryPolicySpec{Delay: "1m", MaxDelay: "1h"},
+			opts: []cm.Option{cm.WithHoldAfter(time.Hour)},
+			expected: map[string]cm.SimulatedObject{
+				"outage": {Resets: 7, Outcome: cm.OutcomeIssued, Delay: duration(123 * time.Minute)},
+				"held":   {Holds: 1, Outcome: cm.OutcomeIssued, Delay: duration(2 * time.Hour)},
+				"never":  {Resets: 7, Outcome: cm.OutcomeLimited},
+			},
+			resets: 14,
+			holds:  1,
+		},
+		{
+			name: "max attempts",
+			spec: cm.RetryPolicySpec{Delay: "1m", MaxDelay: "1h", MaxAttempts: 3},
+			expected: map[string]cm.SimulatedObject{
+				"outage": {Resets: 3, Outcome: cm.OutcomeExhausted},
+				"held":   {Resets: 1, Outcome: cm.OutcomeIssued, Delay: duration(2 * time.Hour)},
+				"never":  {Resets: 3, Outcome: cm.OutcomeExhausted},
+			},
+			resets: 7,
+		},
+		{
+			name: "disabled",
+			spec: cm.RetryPolicySpec{Kinds: []string{"Challenge"}},
+			expected: map[string]cm.SimulatedObject{
+				"outage": {Outcome: cm.OutcomeDisabled},
+				"held":   {Outcome: cm.OutcomeDisabled},
+				"never":  {Outcome: cm.OutcomeDisabled},
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := cm.Simulate(transitions, tt.spec, tt.opts...)
+			assert.NoError(t, err)
+			got := map[string]cm.SimulatedObject{}
+			for _, o := range s.Objects {
+				assert.True(t, o.LimitedAt.Equal(start))
+				got[o.Name] = cm.SimulatedObject{Resets: o.Resets, Holds: o.Holds, Outcome: o.Outcome, Delay: o.Delay}
+			}
+			assert.Equal(t, tt.expected, got)
+			assert.Equal(t, tt.resets, s.Resets)
+			assert.Equal(t, tt.holds, s.Holds)
+			assert.Equal(t, 2, s.RecordedResets)
+
+			var out bytes.Buffer
+			assert.NoError(t, s.Write(&out, cm.FormatTable))
+			assert.Contains(t, out.String(), "outage")
+		})
+	}
+
+	// The recorded delay is until the object was recorded Valid
+	s, err := cm.Simulate(transitions, cm.RetryPolicySpec{})
+	assert.NoError(t, err)
+	assert.Equal(t, "outage", s.Objects[0].Name)
+	assert.Equal(t, 2, s.Objects[0].RecordedResets)
+	assert.Equal(t, duration(150*time.Minute), s.Objects[0].RecordedDelay)
+	assert.Nil(t, s.Objects[2].RecordedDelay)
+
+	_, err = cm.Simulate(transitions, cm.RetryPolicySpec{Backoff: 0.5})
+	assert.Error(t, err)
+}
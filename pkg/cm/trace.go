@@ -0,0 +1,137 @@
+package cm
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/rest"
+)
+
+// tracerName is the instrumentation scope of the watcher's spans
+const tracerName = "github.com/artificialinc/cm-429-fixer/pkg/cm"
+
+// Span attributes
+const (
+	attrCluster   = attribute.Key("cm429.cluster")
+	attrKind      = attribute.Key("cm429.kind")
+	attrNamespace = attribute.Key("cm429.namespace")
+	attrName      = attribute.Key("cm429.name")
+	attrRule      = attribute.Key("cm429.rule")
+	attrReason    = attribute.Key("cm429.reason")
+	attrDelay     = attribute.Key("cm429.delay")
+	attrWait      = attribute.Key("cm429.budget_wait")
+	attrOutcome   = attribute.Key("cm429.outcome")
+)
+
+// Outcomes of detected rate limits
+const (
+	outcomeScheduled = "scheduled"
+	outcomeHeld      = "held"
+	outcomeDisabled  = "disabled"
+	outcomeExhausted = "exhausted"
+	// outcomePending is an object with a reset or hold already in the works
+	outcomePending = "pending"
+)
+
+// WithTracerProvider traces every rate limited object the watcher detects and
+// the reset it schedules for it. The reset is a separate trace linked from the
+// detection, with spans for the delay, the budget wait and the API requests.
+func WithTracerProvider(tp trace.TracerProvider) Option {
+	return func(w *Watcher) {
+		w.tracer = tp.Tracer(tracerName)
+	}
+}
+
+// defaultTracer doesn't record anything
+func defaultTracer() trace.Tracer {
+	return noop.NewTracerProvider().Tracer(tracerName)
+}
+
+// objectAttributes are the attributes of spans about an object
+func (w *Watcher) objectAttributes(kind string, meta metav1.ObjectMeta) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attrCluster.String(w.cluster),
+		attrKind.String(kind),
+		attrNamespace.String(meta.Namespace),
+		attrName.String(meta.Name),
+	}
+}
+
+// startDetect starts the span of a detected rate limit, which is ended with
+// its outcome by endDetect
+func (w *Watcher) startDetect(kind string, meta metav1.ObjectMeta, p Policy, reason string, delay time.Duration) trace.Span {
+	_, span := w.tracer.Start(context.Background(), "detect",
+		trace.WithTimestamp(w.clock.Now()),
+		trace.WithAttributes(w.objectAttributes(kind, meta)...),
+		trace.WithAttributes(
+			attrRule.String(p.Source),
+			attrReason.String(reason),
+			attrDelay.String(delay.String()),
+		),
+	)
+	return span
+}
+
+func (w *Watcher) endDetect(span trace.Span, outcome string) {
+	span.SetAttributes(attrOutcome.String(outcome))
+	span.End(trace.WithTimestamp(w.clock.Now()))
+}
+
+// detectOutcome is the outcome of a rate limit the policy doesn't reset
+func detectOutcome(p Policy, meta metav1.ObjectMeta) string {
+	if p.exhausted(meta) {
+		return outcomeExhausted
+	}
+	return outcomeDisabled
+}
+
+// startReset starts the span of a scheduled reset, linked to the span of the
+// detection that scheduled it
+func (w *Watcher) startReset(kind string, meta metav1.ObjectMeta, detected trace.SpanContext, delay time.Duration) (context.Context, trace.Span) {
+	return w.tracer.Start(context.Background(), "reset",
+		trace.WithNewRoot(),
+		trace.WithTimestamp(w.clock.Now()),
+		trace.WithLinks(trace.Link{SpanContext: detected}),
+		trace.WithAttributes(w.objectAttributes(kind, meta)...),
+		trace.WithAttributes(attrDelay.String(delay.String())),
+	)
+}
+
+// endReset ends the span of a reset with its result
+func (w *Watcher) endReset(span trace.Span, result ResetResult, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		result = "error"
+	}
+	span.SetAttributes(attrOutcome.String(string(result)))
+	span.End(trace.WithTimestamp(w.clock.Now()))
+}
+
+// sleepSpan sleeps for the duration in a span of the name
+func (w *Watcher) sleepSpan(ctx context.Context, name string, d time.Duration) {
+	_, span := w.tracer.Start(ctx, name, trace.WithTimestamp(w.clock.Now()))
+	w.sleep(d)
+	span.End(trace.WithTimestamp(w.clock.Now()))
+}
+
+// traceTransport wraps the transport of a client config in spans for the
+// requests made on behalf of a traced operation. Requests of the informers,
+// which aren't part of any trace, are left alone.
+func traceTransport(config *rest.Config, tp trace.TracerProvider) {
+	config.Wrap(func(rt http.RoundTripper) http.RoundTripper {
+		return otelhttp.NewTransport(rt,
+			otelhttp.WithTracerProvider(tp),
+			otelhttp.WithFilter(func(r *http.Request) bool {
+				return trace.SpanContextFromContext(r.Context()).IsValid()
+			}),
+		)
+	})
+}
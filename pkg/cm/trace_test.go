@@ -0,0 +1,135 @@
+package cm_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/artificialinc/cm-429-fixer/pkg/cm"
+	acmev1 "github.com/cert-manager/cert-manager/pkg/apis/acme/v1"
+	"github.com/cert-manager/cert-manager/pkg/client/clientset/versioned/fake"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// spanNamed returns the first span of the name
+func spanNamed(spans tracetest.SpanStubs, name string) (tracetest.SpanStub, bool) {
+	for _, s := range spans {
+		if s.Name == name {
+			return s, true
+		}
+	}
+	return tracetest.SpanStub{}, false
+}
+
+func attributes(s tracetest.SpanStub) map[attribute.Key]string {
+	m := map[attribute.Key]string{}
+	for _, kv := range s.Attributes {
+		m[kv.Key] = kv.Value.Emit()
+	}
+	return m
+}
+
+func TestWatcherTracing(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	clk := newTestClock()
+	client := fake.NewSimpleClientset()
+	w := cm.NewWatcher(cm.WithClient(client), cm.WithClock(clk), cm.WithCluster("c1"), cm.WithTracerProvider(tp))
+	clk.run(t, ctx, w)
+
+	_, err := client.AcmeV1().Orders("default").Create(ctx, buildOrder("order1", "default", &acmev1.OrderStatus{
+		State:  acmev1.Errored,
+		Reason: "429 rateLimited",
+	}), metav1.CreateOptions{})
+	assert.NoError(t, err)
+	clk.step(cm.DefaultDelay)
+	waitFor(t, orderState(ctx, client, "default", "order1", acmev1.Pending))
+	waitFor(t, func() bool {
+		_, ok := spanNamed(exporter.GetSpans(), "reset")
+		return ok
+	})
+
+	spans := exporter.GetSpans()
+	detect, ok := spanNamed(spans, "detect")
+	assert.True(t, ok)
+	assert.Equal(t, map[attribute.Key]string{
+		"cm429.cluster":   "c1",
+		"cm429.kind":      "Order",
+		"cm429.namespace": "default",
+		"cm429.name":      "order1",
+		"cm429.rule":      "default",
+		"cm429.reason":    "429 rateLimited",
+		"cm429.delay":     "15s",
+		"cm429.outcome":   "scheduled",
+	}, attributes(detect))
+
+	// The reset is its own trace, linked to the detection, and spans the delay
+	reset, _ := spanNamed(spans, "reset")
+	assert.NotEqual(t, detect.SpanContext.TraceID(), reset.SpanContext.TraceID())
+	if assert.Len(t, reset.Links, 1) {
+		assert.Equal(t, detect.SpanContext, reset.Links[0].SpanContext)
+	}
+	assert.Equal(t, "reset", attributes(reset)["cm429.outcome"])
+	assert.Equal(t, "0s", attributes(reset)["cm429.budget_wait"])
+	assert.Equal(t, cm.DefaultDelay, reset.EndTime.Sub(reset.StartTime))
+	delay, ok := spanNamed(spans, "delay")
+	assert.True(t, ok)
+	assert.Equal(t, reset.SpanContext.SpanID(), delay.Parent.SpanID())
+	assert.Equal(t, cm.DefaultDelay, delay.EndTime.Sub(delay.StartTime))
+	budget, ok := spanNamed(spans, "budget")
+	assert.True(t, ok)
+	assert.Equal(t, reset.SpanContext.SpanID(), budget.Parent.SpanID())
+}
+
+func TestClientTracing(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(buildOrder("order1", "default", &acmev1.OrderStatus{}))
+	}))
+	defer srv.Close()
+	kubeconfig := filepath.Join(t.TempDir(), "kubeconfig")
+	assert.NoError(t, os.WriteFile(kubeconfig, []byte(`apiVersion: v1
+kind: Config
+clusters:
+- name: test
+  cluster:
+    server: `+srv.URL+`
+contexts:
+- name: test
+  context:
+    cluster: test
+current-context: test
+`), 0o600))
+
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	client := cm.GetLocalClient(&cm.ClientOpts{Kubeconfig: kubeconfig, TracerProvider: tp})
+
+	// Requests outside of a trace, like the informers', aren't traced
+	ctx := context.Background()
+	_, err := client.AcmeV1().Orders("default").Get(ctx, "order1", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Empty(t, exporter.GetSpans())
+
+	ctx, span := tp.Tracer("test").Start(ctx, "reset")
+	_, err = client.AcmeV1().Orders("default").Get(ctx, "order1", metav1.GetOptions{})
+	assert.NoError(t, err)
+	span.End()
+	spans := exporter.GetSpans()
+	if assert.Len(t, spans, 2) {
+		assert.Equal(t, span.SpanContext().SpanID(), spans[0].Parent.SpanID())
+		assert.Equal(t, "reset", spans[1].Name)
+	}
+}
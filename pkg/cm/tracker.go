@@ -0,0 +1,109 @@
+package cm
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/artificialinc/cm-429-fixer/pkg/notify"
+	cmmeta "github.com/cert-manager/cert-manager/pkg/apis/meta/v1"
+)
+
+// Limit is a rate limit the ACME server is known to be enforcing for an
+// account and a set of domains
+type Limit struct {
+	Account string    `json:"account"`
+	Domains []string  `json:"domains"`
+	Until   time.Time `json:"until"`
+	Reason  string    `json:"reason"`
+	// Order is the Order that ran into the limit, as cluster/namespace/name
+	Order string `json:"order"`
+}
+
+// Tracker keeps the rate limits watchers have seen until they expire or the
+// Order that ran into them recovers. It may be shared between watchers.
+type Tracker struct {
+	mu     sync.Mutex
+	limits map[string]Limit
+}
+
+// NewTracker creates an empty tracker
+func NewTracker() *Tracker {
+	return &Tracker{limits: map[string]Limit{}}
+}
+
+// WithTracker sets the rate limit tracker, which may be shared between watchers
+func WithTracker(t *Tracker) Option {
+	return func(w *Watcher) {
+		w.tracker = t
+	}
+}
+
+// observe records the limit an Order ran into, extending a limit already
+// recorded for it
+func (t *Tracker) observe(l Limit) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if existing, ok := t.limits[l.Order]; ok {
+		l.Domains = notify.MergeDomains(existing.Domains, l.Domains)
+		if existing.Until.After(l.Until) {
+			l.Until = existing.Until
+		}
+	}
+	t.limits[l.Order] = l
+}
+
+// resolve forgets the limit of an Order that has recovered
+func (t *Tracker) resolve(order string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.limits, order)
+}
+
+// Active returns the limit still in force at the given time for the account
+// that covers any of the domains
+func (t *Tracker) Active(account string, domains []string, now time.Time) (Limit, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for key, l := range t.limits {
+		if !l.Until.After(now) {
+			delete(t.limits, key)
+			continue
+		}
+		if l.Account != account {
+			continue
+		}
+		for _, d := range domains {
+			for _, ld := range l.Domains {
+				if d == ld {
+					return l, true
+				}
+			}
+		}
+	}
+	return Limit{}, false
+}
+
+// Limits returns every limit still in force at the given time
+func (t *Tracker) Limits(now time.Time) []Limit {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var limits []Limit
+	for _, l := range t.limits {
+		if l.Until.After(now) {
+			limits = append(limits, l)
+		}
+	}
+	return limits
+}
+
+// ActiveLimit returns the known rate limit that a new Order for the domains,
+// using the issuer, would run into
+func (w *Watcher) ActiveLimit(ctx context.Context, namespace string, issuer cmmeta.ObjectReference, domains []string) (Limit, bool) {
+	return w.tracker.Active(w.account(ctx, namespace, issuer), domains, w.clock.Now())
+}
+
+// trackerKey identifies the Order an object belongs to across clusters
+func (w *Watcher) trackerKey(namespace, order string) string {
+	return w.cluster + "/" + namespace + "/" + order
+}
@@ -0,0 +1,62 @@
+package cm_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/artificialinc/cm-429-fixer/pkg/cm"
+	acmev1 "github.com/cert-manager/cert-manager/pkg/apis/acme/v1"
+	cmmeta "github.com/cert-manager/cert-manager/pkg/apis/meta/v1"
+	"github.com/cert-manager/cert-manager/pkg/client/clientset/versioned/fake"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestWatcherActiveLimit(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	issuer := cmmeta.ObjectReference{Name: "letsencrypt", Kind: "ClusterIssuer"}
+	retryAfter := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	order := buildOrder("order1", "default", &acmev1.OrderStatus{
+		State:  acmev1.Errored,
+		Reason: "429 rateLimited: too many certificates, retry after " + retryAfter.Format("2006-01-02 15:04:05 UTC"),
+	})
+	order.Spec.IssuerRef = issuer
+	order.Spec.DNSNames = []string{"example.com"}
+	client := fake.NewSimpleClientset(order)
+
+	tracker := cm.NewTracker()
+	w := cm.NewWatcher(cm.WithClient(client), cm.WithCluster("c1"), cm.WithTracker(tracker))
+	go w.Run(ctx)
+	assert.NoError(t, w.Readiness().Wait(ctx))
+
+	var limit cm.Limit
+	assert.Eventually(t, func() bool {
+		var ok bool
+		limit, ok = w.ActiveLimit(ctx, "default", issuer, []string{"www.example.com", "example.com"})
+		return ok
+	}, 10*time.Second, 50*time.Millisecond)
+	assert.Equal(t, "c1/default/order1", limit.Order)
+	assert.False(t, limit.Until.Before(retryAfter))
+	assert.Len(t, tracker.Limits(time.Now()), 1)
+
+	// Other domains and accounts aren't limited
+	_, ok := w.ActiveLimit(ctx, "default", issuer, []string{"other.com"})
+	assert.False(t, ok)
+	_, ok = w.ActiveLimit(ctx, "default", cmmeta.ObjectReference{Name: "other", Kind: "ClusterIssuer"}, []string{"example.com"})
+	assert.False(t, ok)
+
+	// Recovered orders lift the limit
+	o, err := client.AcmeV1().Orders("default").Get(ctx, "order1", metav1.GetOptions{})
+	assert.NoError(t, err)
+	o.Status = acmev1.OrderStatus{State: acmev1.Valid}
+	_, err = client.AcmeV1().Orders("default").UpdateStatus(ctx, o, metav1.UpdateOptions{})
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		_, ok := w.ActiveLimit(ctx, "default", issuer, []string{"example.com"})
+		return !ok
+	}, 10*time.Second, 50*time.Millisecond)
+}
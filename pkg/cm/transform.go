@@ -0,0 +1,31 @@
+package cm
+
+import (
+	acmev1 "github.com/cert-manager/cert-manager/pkg/apis/acme/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Transform strips the fields the watcher never reads from Orders and
+// Challenges before they are cached. The CSR, issued certificate, challenge
+// keys and solver configs make up most of an object's size and resets always
+// work on a fresh copy from the API server, so nothing stripped is written back.
+func Transform(obj interface{}) (interface{}, error) {
+	switch o := obj.(type) {
+	case *acmev1.Order:
+		stripMeta(&o.ObjectMeta)
+		o.Spec.Request = nil
+		o.Status.Certificate = nil
+		o.Status.Authorizations = nil
+	case *acmev1.Challenge:
+		stripMeta(&o.ObjectMeta)
+		o.Spec.Key = ""
+		o.Spec.Solver = acmev1.ACMEChallengeSolver{}
+	}
+	return obj, nil
+}
+
+func stripMeta(meta *metav1.ObjectMeta) {
+	meta.ManagedFields = nil
+	delete(meta.Annotations, corev1.LastAppliedConfigAnnotation)
+}
@@ -0,0 +1,160 @@
+package cm_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/artificialinc/cm-429-fixer/pkg/cm"
+	acmev1 "github.com/cert-manager/cert-manager/pkg/apis/acme/v1"
+	cmmeta "github.com/cert-manager/cert-manager/pkg/apis/meta/v1"
+	"github.com/cert-manager/cert-manager/pkg/client/clientset/versioned/fake"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8sruntime "k8s.io/apimachinery/pkg/runtime"
+	apiwatch "k8s.io/apimachinery/pkg/watch"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/cache"
+)
+
+// bulkyOrder builds an order with the fields a real cluster fills in
+func bulkyOrder(i int) *acmev1.Order {
+	return &acmev1.Order{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("order-%d", i),
+			Namespace: "default",
+			Annotations: map[string]string{
+				cm.AnnotationAttempts:              "1",
+				corev1.LastAppliedConfigAnnotation: string(bytes.Repeat([]byte("x"), 512)),
+			},
+			ManagedFields: []metav1.ManagedFieldsEntry{
+				{Manager: "cert-manager-orders", Operation: metav1.ManagedFieldsOperationUpdate, FieldsV1: &metav1.FieldsV1{Raw: bytes.Repeat([]byte("f"), 1024)}},
+				{Manager: "cert-manager-orders", Operation: metav1.ManagedFieldsOperationUpdate, Subresource: "status", FieldsV1: &metav1.FieldsV1{Raw: bytes.Repeat([]byte("s"), 512)}},
+			},
+		},
+		Spec: acmev1.OrderSpec{
+			Request:   bytes.Repeat([]byte("r"), 2048),
+			IssuerRef: cmmeta.ObjectReference{Name: "letsencrypt", Kind: "ClusterIssuer"},
+			DNSNames:  []string{fmt.Sprintf("host-%d.example.com", i)},
+		},
+		Status: acmev1.OrderStatus{
+			State:       acmev1.Valid,
+			Certificate: bytes.Repeat([]byte("c"), 2048),
+			Authorizations: []acmev1.ACMEAuthorization{{
+				URL:        "https://acme.example.com/authz/1",
+				Identifier: fmt.Sprintf("host-%d.example.com", i),
+				Challenges: []acmev1.ACMEChallenge{{URL: "https://acme.example.com/chall/1", Token: "token", Type: "http-01"}},
+			}},
+		},
+	}
+}
+
+func TestTransform(t *testing.T) {
+	t.Parallel()
+
+	obj, err := cm.Transform(bulkyOrder(1))
+	assert.NoError(t, err)
+	o := obj.(*acmev1.Order)
+	assert.Empty(t, o.ManagedFields)
+	assert.Equal(t, map[string]string{cm.AnnotationAttempts: "1"}, o.Annotations)
+	assert.Empty(t, o.Spec.Request)
+	assert.Empty(t, o.Status.Certificate)
+	assert.Empty(t, o.Status.Authorizations)
+	assert.Equal(t, "letsencrypt", o.Spec.IssuerRef.Name)
+	assert.Equal(t, []string{"host-1.example.com"}, o.Spec.DNSNames)
+	assert.Equal(t, acmev1.Valid, o.Status.State)
+
+	obj, err = cm.Transform(&acmev1.Challenge{
+		ObjectMeta: metav1.ObjectMeta{Name: "challenge1", Namespace: "default"},
+		Spec: acmev1.ChallengeSpec{
+			Key:       "secret-key-authorization",
+			Solver:    acmev1.ACMEChallengeSolver{HTTP01: &acmev1.ACMEChallengeSolverHTTP01{}},
+			IssuerRef: cmmeta.ObjectReference{Name: "letsencrypt"},
+		},
+		Status: acmev1.ChallengeStatus{State: acmev1.Errored, Reason: "429"},
+	})
+	assert.NoError(t, err)
+	c := obj.(*acmev1.Challenge)
+	assert.Empty(t, c.Spec.Key)
+	assert.Nil(t, c.Spec.Solver.HTTP01)
+	assert.Equal(t, "letsencrypt", c.Spec.IssuerRef.Name)
+	assert.Equal(t, "429", c.Status.Reason)
+
+	tombstone := cache.DeletedFinalStateUnknown{Key: "default/order1"}
+	obj, err = cm.Transform(tombstone)
+	assert.NoError(t, err)
+	assert.Equal(t, tombstone, obj)
+}
+
+// BenchmarkInformerMemory reports the heap used to cache 10k orders, one in
+// ten of them Errored, by an informer over a plain list watch as the fixer
+// used to build them, and by the watcher's own informers
+func BenchmarkInformerMemory(b *testing.B) {
+	for _, bc := range []struct {
+		name string
+		run  func(ctx context.Context, client *fake.Clientset) error
+	}{
+		{name: "listwatch", run: func(ctx context.Context, client *fake.Clientset) error {
+			informer := cache.NewSharedIndexInformer(&cache.ListWatch{
+				ListFunc: func(options metav1.ListOptions) (k8sruntime.Object, error) {
+					return client.AcmeV1().Orders("").List(ctx, options)
+				},
+				WatchFunc: func(options metav1.ListOptions) (apiwatch.Interface, error) {
+					return client.AcmeV1().Orders("").Watch(ctx, options)
+				},
+			}, &acmev1.Order{}, 0, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+			go informer.Run(ctx.Done())
+			if !cache.WaitForCacheSync(ctx.Done(), informer.HasSynced) {
+				return ctx.Err()
+			}
+			return nil
+		}},
+		{name: "watcher", run: func(ctx context.Context, client *fake.Clientset) error {
+			w := cm.NewWatcher(cm.WithClient(client))
+			go w.Run(ctx)
+			return w.Readiness().Wait(ctx)
+		}},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				// List freshly built orders, as decoding an API response would,
+				// so the cache holds the only reference to them
+				client := fake.NewSimpleClientset()
+				client.PrependReactor("list", "orders", func(k8stesting.Action) (bool, k8sruntime.Object, error) {
+					list := &acmev1.OrderList{Items: make([]acmev1.Order, 10000)}
+					for i := range list.Items {
+						list.Items[i] = *bulkyOrder(i)
+						if i%10 == 0 {
+							list.Items[i].Status.State = acmev1.Errored
+							list.Items[i].Status.Reason = "connection refused"
+						}
+					}
+					return true, list, nil
+				})
+
+				ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+				before := heapAlloc()
+				if err := bc.run(ctx, client); err != nil {
+					b.Fatal(err)
+				}
+				after := heapAlloc()
+
+				b.ReportMetric(float64(after-before)/(1<<20), "MiB/10k-orders")
+				// Let the informers stop so the next iteration starts from an empty heap
+				cancel()
+				time.Sleep(100 * time.Millisecond)
+			}
+		})
+	}
+}
+
+func heapAlloc() int64 {
+	var stats runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&stats)
+	return int64(stats.HeapAlloc)
+}
@@ -0,0 +1,52 @@
+// Package httpapi holds what the fixer's JSON HTTP APIs, the admin API and
+// the status page, share: encoding responses and errors, decoding requests
+// and checking bearer tokens.
+package httpapi
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/artificialinc/cm-429-fixer/pkg/cm"
+)
+
+// WriteJSON responds with v encoded as JSON
+func WriteJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// WriteError responds with the error as {"error": "..."}
+func WriteError(w http.ResponseWriter, status int, err error) {
+	WriteJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// StatusOf returns the status of a response to a failed action
+func StatusOf(err error) int {
+	if errors.Is(err, cm.ErrSwitchedOff) {
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
+// Decode reads the JSON request body into req, responding with an error and
+// returning false if it can't
+func Decode(w http.ResponseWriter, r *http.Request, req interface{}) bool {
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		WriteError(w, http.StatusBadRequest, fmt.Errorf("decoding request: %w", err))
+		return false
+	}
+	return true
+}
+
+// ValidToken returns true if the request carries the token as a bearer token.
+// An empty token is never valid.
+func ValidToken(r *http.Request, token string) bool {
+	bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return token != "" && ok && subtle.ConstantTimeCompare([]byte(bearer), []byte(token)) == 1
+}
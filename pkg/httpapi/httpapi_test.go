@@ -0,0 +1,48 @@
+package httpapi_test
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/artificialinc/cm-429-fixer/pkg/cm"
+	"github.com/artificialinc/cm-429-fixer/pkg/httpapi"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidToken(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPost, "/", nil)
+	assert.False(t, httpapi.ValidToken(r, "secret"))
+	assert.False(t, httpapi.ValidToken(r, ""))
+	r.Header.Set("Authorization", "Bearer wrong")
+	assert.False(t, httpapi.ValidToken(r, "secret"))
+	r.Header.Set("Authorization", "secret")
+	assert.False(t, httpapi.ValidToken(r, "secret"))
+	r.Header.Set("Authorization", "Bearer secret")
+	assert.True(t, httpapi.ValidToken(r, "secret"))
+	r.Header.Set("Authorization", "Bearer ")
+	assert.False(t, httpapi.ValidToken(r, ""))
+}
+
+func TestDecode(t *testing.T) {
+	var req struct {
+		Name string `json:"name"`
+	}
+	w := httptest.NewRecorder()
+	assert.True(t, httpapi.Decode(w, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"name":"order1"}`)), &req))
+	assert.Equal(t, "order1", req.Name)
+
+	w = httptest.NewRecorder()
+	assert.False(t, httpapi.Decode(w, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{`)), &req))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	assert.Contains(t, w.Body.String(), `"error":"decoding request: `)
+}
+
+func TestStatusOf(t *testing.T) {
+	assert.Equal(t, http.StatusConflict, httpapi.StatusOf(fmt.Errorf("resetting: %w", cm.ErrSwitchedOff)))
+	assert.Equal(t, http.StatusInternalServerError, httpapi.StatusOf(errors.New("failed")))
+}
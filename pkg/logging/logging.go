@@ -0,0 +1,192 @@
+// Package logging builds the fixer's logger. Logs are written by zap in one of
+// several formats, at a level that can be overridden per logger name, and
+// klog output from client-go is routed through the same logger.
+package logging
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/go-logr/zapr"
+	zaplogfmt "github.com/jsternberg/zap-logfmt"
+	"go.uber.org/zap"
+	"go.uber.org/zap/buffer"
+	"go.uber.org/zap/zapcore"
+	"k8s.io/klog/v2"
+)
+
+// Formats logs can be written in
+const (
+	FormatJSON    = "json"
+	FormatConsole = "console"
+	FormatLogfmt  = "logfmt"
+)
+
+// Options configure a logger
+type Options struct {
+	// Format is json, console or logfmt, json if empty
+	Format string
+	// Level is the level of every logger without an override, info if empty
+	Level string
+	// Levels overrides the level of named loggers and the loggers named under
+	// them, as comma separated name=level pairs, e.g. watcher=debug,merge=2
+	Levels string
+	// Output is where logs are written, stderr if nil
+	Output zapcore.WriteSyncer
+}
+
+// ParseLevel parses a zap level name, or a logr verbosity which enables
+// logger.V(n) and below
+func ParseLevel(s string) (zapcore.Level, error) {
+	if v, err := strconv.Atoi(s); err == nil {
+		if v < 0 {
+			return 0, fmt.Errorf("verbosity %d must not be negative", v)
+		}
+		return zapcore.Level(-v), nil
+	}
+	return zapcore.ParseLevel(s)
+}
+
+// parseLevels parses name=level overrides
+func parseLevels(s string) (map[string]zapcore.Level, error) {
+	levels := map[string]zapcore.Level{}
+	for _, pair := range strings.Split(s, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("logger level %q must be name=level", pair)
+		}
+		level, err := ParseLevel(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("level of logger %s: %w", name, err)
+		}
+		levels[strings.TrimSpace(name)] = level
+	}
+	return levels, nil
+}
+
+// New builds a logger
+func New(o Options) (logr.Logger, error) {
+	if o.Level == "" {
+		o.Level = "info"
+	}
+	level, err := ParseLevel(o.Level)
+	if err != nil {
+		return logr.Logger{}, err
+	}
+	levels, err := parseLevels(o.Levels)
+	if err != nil {
+		return logr.Logger{}, err
+	}
+	if o.Output == nil {
+		o.Output = zapcore.Lock(os.Stderr)
+	}
+
+	var (
+		enc        zapcore.Encoder
+		stacktrace = zapcore.ErrorLevel
+		sampled    = true
+	)
+	switch o.Format {
+	case FormatJSON, "":
+		enc = zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig())
+	case FormatLogfmt:
+		enc = logfmtEncoder{zaplogfmt.NewEncoder(zap.NewProductionEncoderConfig())}
+	case FormatConsole:
+		enc = zapcore.NewConsoleEncoder(zap.NewDevelopmentEncoderConfig())
+		stacktrace = zapcore.WarnLevel
+		sampled = false
+	default:
+		return logr.Logger{}, fmt.Errorf("unknown log format %q, must be json, console or logfmt", o.Format)
+	}
+
+	// The core writes everything enabled for any logger, the level core
+	// filters by name
+	lowest := level
+	for _, l := range levels {
+		if l < lowest {
+			lowest = l
+		}
+	}
+	var core zapcore.Core = zapcore.NewCore(enc, o.Output, lowest)
+	if sampled {
+		// As zap's production config does
+		core = zapcore.NewSamplerWithOptions(core, time.Second, 100, 100)
+	}
+	core = &levelCore{Core: core, level: level, levels: levels}
+	return zapr.NewLogger(zap.New(core, zap.AddCaller(), zap.AddStacktrace(stacktrace), zap.ErrorOutput(o.Output))), nil
+}
+
+// logfmtEncoder adds the logger name, which the logfmt encoder leaves out
+type logfmtEncoder struct {
+	zapcore.Encoder
+}
+
+func (e logfmtEncoder) Clone() zapcore.Encoder {
+	return logfmtEncoder{e.Encoder.Clone()}
+}
+
+func (e logfmtEncoder) EncodeEntry(ent zapcore.Entry, fields []zapcore.Field) (*buffer.Buffer, error) {
+	if ent.LoggerName != "" {
+		fields = append([]zapcore.Field{zap.String("logger", ent.LoggerName)}, fields...)
+	}
+	return e.Encoder.EncodeEntry(ent, fields)
+}
+
+// levelCore filters entries by the level of their logger's name. Names are
+// matched on whole dot separated components, the longest match wins.
+type levelCore struct {
+	zapcore.Core
+	level  zapcore.Level
+	levels map[string]zapcore.Level
+}
+
+func (c *levelCore) With(fields []zapcore.Field) zapcore.Core {
+	return &levelCore{Core: c.Core.With(fields), level: c.level, levels: c.levels}
+}
+
+func (c *levelCore) Check(e zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if !c.levelOf(e.LoggerName).Enabled(e.Level) {
+		return ce
+	}
+	return c.Core.Check(e, ce)
+}
+
+// levelOf returns the level of the logger name
+func (c *levelCore) levelOf(name string) zapcore.Level {
+	for name != "" {
+		if l, ok := c.levels[name]; ok {
+			return l
+		}
+		i := strings.LastIndex(name, ".")
+		if i < 0 {
+			break
+		}
+		name = name[:i]
+	}
+	return c.level
+}
+
+// maxVerbosity bounds the klog verbosity RouteKlog enables
+const maxVerbosity = 10
+
+// RouteKlog sends klog output, such as client-go's, to the logger. klog's
+// verbosity is set to the highest any logger enables, so the level of the
+// logger's name decides which messages are written.
+func RouteKlog(log logr.Logger) {
+	v := 0
+	for v < maxVerbosity && log.V(v+1).Enabled() {
+		v++
+	}
+	fs := flag.NewFlagSet("klog", flag.ContinueOnError)
+	klog.InitFlags(fs)
+	_ = fs.Set("v", strconv.Itoa(v))
+	klog.SetLogger(log)
+}
@@ -0,0 +1,100 @@
+package logging_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/artificialinc/cm-429-fixer/pkg/logging"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap/zapcore"
+	"k8s.io/klog/v2"
+)
+
+// lines returns the messages logged, one per line
+func lines(buf *bytes.Buffer) []string {
+	var msgs []string
+	for _, l := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if l != "" {
+			msgs = append(msgs, l)
+		}
+	}
+	buf.Reset()
+	return msgs
+}
+
+func TestLevels(t *testing.T) {
+	var buf bytes.Buffer
+	log, err := logging.New(logging.Options{
+		Format: logging.FormatLogfmt,
+		Level:  "warn",
+		Levels: "watcher=debug, merge=2, watcher.quiet=error",
+		Output: zapcore.AddSync(&buf),
+	})
+	assert.NoError(t, err)
+
+	log.Info("root")
+	log.Error(nil, "root error")
+	log.WithName("watcher").V(1).Info("watcher debug")
+	log.WithName("watcher").V(2).Info("watcher verbose")
+	log.WithName("watcher").WithName("child").V(1).Info("child debug")
+	log.WithName("watcher").WithName("quiet").Info("quiet info")
+	log.WithName("merge").V(2).Info("merge verbose", "input", "orders")
+	log.WithName("merger").Info("merger info")
+
+	msgs := lines(&buf)
+	if assert.Len(t, msgs, 4) {
+		assert.Contains(t, msgs[0], `msg="root error"`)
+		assert.Contains(t, msgs[1], `msg="watcher debug" logger=watcher`)
+		assert.Contains(t, msgs[2], `msg="child debug" logger=watcher.child`)
+		assert.Contains(t, msgs[3], `msg="merge verbose" logger=merge`)
+		assert.Contains(t, msgs[3], "input=orders")
+	}
+}
+
+func TestFormats(t *testing.T) {
+	for format, want := range map[string]string{
+		"":                    `"msg":"hello"`,
+		logging.FormatJSON:    `"msg":"hello"`,
+		logging.FormatLogfmt:  `msg=hello`,
+		logging.FormatConsole: "\thello\t",
+	} {
+		var buf bytes.Buffer
+		log, err := logging.New(logging.Options{Format: format, Output: zapcore.AddSync(&buf)})
+		assert.NoError(t, err)
+		log.Info("hello", "key", "value")
+		assert.Contains(t, buf.String(), want, format)
+	}
+
+	for _, o := range []logging.Options{
+		{Format: "xml"},
+		{Level: "loud"},
+		{Level: "-1"},
+		{Levels: "watcher"},
+		{Levels: "watcher=loud"},
+	} {
+		_, err := logging.New(o)
+		assert.Error(t, err, "%+v", o)
+	}
+}
+
+func TestRouteKlog(t *testing.T) {
+	var buf bytes.Buffer
+	log, err := logging.New(logging.Options{Levels: "klog=2", Output: zapcore.AddSync(&buf)})
+	assert.NoError(t, err)
+	logging.RouteKlog(log.WithName("klog"))
+	defer klog.ClearLogger()
+
+	klog.InfoS("client-go info", "resource", "orders")
+	klog.V(2).InfoS("client-go verbose")
+	klog.V(3).InfoS("client-go too verbose")
+	klog.Flush()
+
+	msgs := lines(&buf)
+	if assert.Len(t, msgs, 2) {
+		assert.Contains(t, msgs[0], `"logger":"klog"`)
+		assert.Contains(t, msgs[0], `"msg":"client-go info"`)
+		assert.Contains(t, msgs[0], `"resource":"orders"`)
+		assert.Contains(t, msgs[1], `"msg":"client-go verbose"`)
+	}
+}
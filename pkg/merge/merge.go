@@ -2,36 +2,153 @@
 package merge
 
 import (
+	"context"
 	"reflect"
-	"slices"
+	"strconv"
+	"sync"
 
 	"github.com/go-logr/logr"
 )
 
-// Bools merges multiple bool channels into a single channel
+// Input is a named channel to merge
+type Input[T any] struct {
+	Name string
+	C    <-chan T
+}
+
+// State is the latest known state of an input
+type State[T any] struct {
+	Name string
+	// Value is the last value received, the zero value until Received is set
+	Value    T
+	Received bool
+	Closed   bool
+	// OK is true if the input's last value satisfies the merge predicate
+	OK bool
+}
+
+// Merged is the result of merging several inputs into one boolean channel
+type Merged[T any] struct {
+	out chan bool
+
+	mu     sync.Mutex
+	states []State[T]
+}
+
+// C returns the channel of combined values. A value is sent every time an
+// input changes and the channel is closed once the context is cancelled or
+// every input has been closed.
+func (m *Merged[T]) C() <-chan bool {
+	return m.out
+}
+
+// Snapshot returns a copy of the latest state of every input
+func (m *Merged[T]) Snapshot() []State[T] {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]State[T](nil), m.states...)
+}
+
+// NotOK returns the names of the inputs whose latest value doesn't satisfy the predicate
+func (m *Merged[T]) NotOK() []string {
+	var names []string
+	for _, s := range m.Snapshot() {
+		if !s.OK {
+			names = append(names, s.Name)
+		}
+	}
+	return names
+}
+
+// All merges the inputs into a channel that is true while ok holds for the
+// latest value of every input. Inputs that haven't sent anything yet count
+// as not ok, closed inputs keep their last value.
+func All[T any](ctx context.Context, log logr.Logger, ok func(T) bool, inputs ...Input[T]) *Merged[T] {
+	return merge(ctx, log, ok, func(states []State[T]) bool {
+		for _, s := range states {
+			if !s.OK {
+				return false
+			}
+		}
+		return true
+	}, inputs)
+}
+
+// Any merges the inputs into a channel that is true while ok holds for the
+// latest value of at least one input
+func Any[T any](ctx context.Context, log logr.Logger, ok func(T) bool, inputs ...Input[T]) *Merged[T] {
+	return merge(ctx, log, ok, func(states []State[T]) bool {
+		for _, s := range states {
+			if s.OK {
+				return true
+			}
+		}
+		return false
+	}, inputs)
+}
+
+// Bools merges multiple bool channels into a single channel that is true
+// once every channel's latest value is true. It can't be cancelled, use All
+// where the consumer may stop reading.
 func Bools(log logr.Logger, ready ...<-chan bool) <-chan bool {
+	inputs := make([]Input[bool], len(ready))
+	for i, ch := range ready {
+		inputs[i] = Input[bool]{Name: strconv.Itoa(i), C: ch}
+	}
+	return All(context.Background(), log, Identity, inputs...).C()
+}
+
+// Identity is the predicate for merging bool channels
+func Identity(b bool) bool {
+	return b
+}
+
+func merge[T any](ctx context.Context, log logr.Logger, ok func(T) bool, combine func([]State[T]) bool, inputs []Input[T]) *Merged[T] {
 	log.V(2).Info("Merging channels")
-	out := make(chan bool)
+	m := &Merged[T]{
+		out:    make(chan bool),
+		states: make([]State[T], len(inputs)),
+	}
+
+	// The first case is the context, input i is case i+1
+	cases := make([]reflect.SelectCase, len(inputs)+1)
+	cases[0] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ctx.Done())}
+	for i, in := range inputs {
+		m.states[i].Name = in.Name
+		cases[i+1] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(in.C)}
+	}
+
 	go func() {
-		cases := make([]reflect.SelectCase, len(ready))
-		statuses := make([]bool, len(ready))
-		for i, ch := range ready {
-			cases[i] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ch)}
-		}
-		defer close(out)
-		for {
-			chosen, value, ok := reflect.Select(cases)
-			if !ok {
-				log.V(2).Info("channel is closed", "channel", chosen)
+		defer close(m.out)
+		for open := len(inputs); open > 0; {
+			chosen, value, received := reflect.Select(cases)
+			if chosen == 0 {
+				return
+			}
+
+			m.mu.Lock()
+			s := &m.states[chosen-1]
+			if !received {
+				s.Closed = true
+				m.mu.Unlock()
+				log.V(2).Info("channel is closed", "channel", s.Name)
 				cases[chosen].Chan = reflect.ValueOf(nil)
+				open--
 				continue
 			}
-			b := value.Bool()
-			log.V(2).Info("channel changed state", "channel", chosen, "state", b)
-			statuses[chosen] = b
-			out <- !slices.Contains(statuses, false)
+			v, _ := value.Interface().(T)
+			s.Value, s.Received, s.OK = v, true, ok(v)
+			log.V(2).Info("channel changed state", "channel", s.Name, "state", s.OK)
+			combined := combine(m.states)
+			m.mu.Unlock()
+
+			select {
+			case m.out <- combined:
+			case <-ctx.Done():
+				return
+			}
 		}
 	}()
 
-	return out
+	return m
 }
@@ -2,11 +2,14 @@
 package merge_test
 
 import (
+	"context"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/artificialinc/cm-429-fixer/pkg/merge"
 	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestBools(t *testing.T) {
@@ -116,3 +119,81 @@ func TestBools(t *testing.T) {
 	}
 
 }
+
+func TestAll(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	orders := make(chan int)
+	challenges := make(chan int)
+	m := merge.All(ctx, logr.Discard(), func(i int) bool { return i > 0 },
+		merge.Input[int]{Name: "orders", C: orders},
+		merge.Input[int]{Name: "challenges", C: challenges},
+	)
+
+	assert.ElementsMatch(t, []string{"orders", "challenges"}, m.NotOK())
+
+	orders <- 1
+	assert.False(t, <-m.C())
+	assert.Equal(t, []string{"challenges"}, m.NotOK())
+
+	challenges <- 2
+	assert.True(t, <-m.C())
+	assert.Empty(t, m.NotOK())
+
+	orders <- 0
+	assert.False(t, <-m.C())
+
+	snapshot := m.Snapshot()
+	assert.Equal(t, merge.State[int]{Name: "orders", Value: 0, Received: true}, snapshot[0])
+	assert.Equal(t, merge.State[int]{Name: "challenges", Value: 2, Received: true, OK: true}, snapshot[1])
+
+	close(orders)
+	close(challenges)
+	_, open := <-m.C()
+	assert.False(t, open, "output is closed once every input is closed")
+	assert.True(t, m.Snapshot()[0].Closed)
+}
+
+func TestAny(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a := make(chan bool)
+	b := make(chan bool)
+	m := merge.Any(ctx, logr.Discard(), merge.Identity,
+		merge.Input[bool]{Name: "a", C: a},
+		merge.Input[bool]{Name: "b", C: b},
+	)
+
+	a <- false
+	assert.False(t, <-m.C())
+	b <- true
+	assert.True(t, <-m.C())
+	a <- true
+	assert.True(t, <-m.C())
+	b <- false
+	assert.True(t, <-m.C())
+	a <- false
+	assert.False(t, <-m.C())
+}
+
+func TestAllCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	in := make(chan bool)
+	m := merge.All(ctx, logr.Discard(), merge.Identity, merge.Input[bool]{Name: "in", C: in})
+
+	// Nobody reads the output, cancelling must still release the merge
+	in <- true
+	cancel()
+
+	select {
+	case _, open := <-m.C():
+		for open {
+			_, open = <-m.C()
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("output not closed after cancel")
+	}
+}
@@ -0,0 +1,110 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// DefaultTemplate posts the notification as JSON
+const DefaultTemplate = "{{ json . }}"
+
+// Endpoint is an HTTP endpoint notifications are posted to, such as a Slack
+// incoming webhook or the PagerDuty events API
+type Endpoint struct {
+	url    string
+	header http.Header
+	tmpl   *template.Template
+	client *http.Client
+}
+
+// NewEndpoint returns an endpoint posting notifications to the URL with the
+// given headers. The body is rendered from a text/template with the
+// Notification as data, DefaultTemplate if empty. The template function json
+// encodes a value as JSON, so strings can be embedded safely.
+func NewEndpoint(url string, header http.Header, tmpl string, timeout time.Duration) (*Endpoint, error) {
+	if tmpl == "" {
+		tmpl = DefaultTemplate
+	}
+	t, err := template.New(url).Funcs(template.FuncMap{
+		"json": func(v interface{}) (string, error) {
+			b, err := json.Marshal(v)
+			return string(b), err
+		},
+		"join": strings.Join,
+	}).Parse(tmpl)
+	if err != nil {
+		return nil, fmt.Errorf("parsing template of %s: %w", url, err)
+	}
+	return &Endpoint{url: url, header: header, tmpl: t, client: &http.Client{Timeout: timeout}}, nil
+}
+
+// permanentError is a failure retrying won't fix
+type permanentError struct {
+	error
+}
+
+// post sends the notification once
+func (e *Endpoint) post(ctx context.Context, notification Notification) error {
+	var body bytes.Buffer
+	if err := e.tmpl.Execute(&body, notification); err != nil {
+		return permanentError{fmt.Errorf("rendering template: %w", err)}
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.url, &body)
+	if err != nil {
+		return permanentError{err}
+	}
+	for k, v := range e.header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Idempotency-Key", notification.ID)
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode <= 299:
+		return nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusRequestTimeout || resp.StatusCode >= 500:
+		return fmt.Errorf("%s returned %s", e.url, resp.Status)
+	default:
+		return permanentError{fmt.Errorf("%s returned %s", e.url, resp.Status)}
+	}
+}
+
+// deliver sends the notification to every endpoint, retrying failures with
+// backoff up to the notifier's attempts
+func (n *Notifier) deliver(ctx context.Context, notification Notification) {
+	for _, e := range n.endpoints {
+		backoff := n.backoff
+		for attempt := 1; ; attempt++ {
+			err := e.post(ctx, notification)
+			if err == nil {
+				notificationsTotal.WithLabelValues(string(notification.Event), "sent").Inc()
+				break
+			}
+			var permanent permanentError
+			if errors.As(err, &permanent) || attempt >= n.attempts || ctx.Err() != nil {
+				notificationsTotal.WithLabelValues(string(notification.Event), "failed").Inc()
+				n.log.Error(err, "Dropping notification", "id", notification.ID, "attempts", attempt)
+				break
+			}
+			n.log.V(1).Info("Notification failed, retrying", "id", notification.ID, "error", err.Error(), "backoff", backoff)
+			select {
+			case <-ctx.Done():
+			case <-n.clock.After(backoff):
+			}
+			backoff *= 2
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package notify_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/artificialinc/cm-429-fixer/pkg/notify"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeliverRetry(t *testing.T) {
+	r := newReceiver(t)
+	r.fail = 2
+	n := start(t,
+		notify.WithEndpoint(endpoint(t, r.URL)),
+		notify.WithRetry(3, time.Millisecond),
+	)
+
+	// Retries past failures, with the same ID so the receiver can dedupe
+	n.Limited(notify.Observation{Order: "c/ns/order1", Account: "acct"})
+	r.waitFor(t, "account/acct/ open")
+
+	// Gives up after the attempts and moves on to the next notification
+	r.mu.Lock()
+	r.fail = 3
+	r.mu.Unlock()
+	n.GaveUp(notify.Observation{Order: "c/ns/order1", Account: "acct"})
+	n.Recovered("c/ns/order1")
+	r.waitFor(t, "account/acct/ open", "account/acct/ resolve")
+}
+
+func TestEndpointTemplate(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		bodies []string
+		header http.Header
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		bodies = append(bodies, string(b))
+		header = r.Header
+		// Client errors aren't retried
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer srv.Close()
+
+	e, err := notify.NewEndpoint(srv.URL, http.Header{"Authorization": {"Bearer token"}},
+		`{"text": {{ printf "ACME account %s rate limit %s: %s" .Account .Event .Reason | json }}, "domains": {{ join .Domains ", " | json }}}`, time.Second)
+	assert.NoError(t, err)
+	n := start(t, notify.WithEndpoint(e), notify.WithRetry(3, time.Millisecond))
+
+	n.Limited(notify.Observation{Order: "c/ns/order1", Account: "acct", Domains: []string{"a.example.com", "b.example.com"}, Reason: `"quoted"`})
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(bodies) > 0
+	}, 5*time.Second, 10*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{`{"text": "ACME account acct rate limit open: \"quoted\"", "domains": "a.example.com, b.example.com"}`}, bodies)
+	assert.Equal(t, "Bearer token", header.Get("Authorization"))
+	assert.Equal(t, "application/json", header.Get("Content-Type"))
+
+	_, err = notify.NewEndpoint(srv.URL, nil, "{{ .Missing", time.Second)
+	assert.Error(t, err)
+}
@@ -0,0 +1,435 @@
+// Package notify tells people when an ACME account enters or leaves a rate
+// limit window. Rate limited Orders are aggregated into incidents per account,
+// or per account and domain, and each incident is announced once when it
+// opens, escalates and resolves.
+package notify
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/utils/clock"
+)
+
+// Event is a change in an incident
+type Event string
+
+const (
+	// EventOpen is sent when the first Order of an incident is rate limited
+	EventOpen Event = "open"
+	// EventEscalate is sent when the fixer gives up on an Order of an incident
+	EventEscalate Event = "escalate"
+	// EventResolve is sent when every Order of an incident has recovered
+	EventResolve Event = "resolve"
+)
+
+// Scope is what incidents are aggregated by
+type Scope string
+
+const (
+	// ScopeAccount aggregates incidents by ACME account
+	ScopeAccount Scope = "account"
+	// ScopeDomain aggregates incidents by ACME account and domain
+	ScopeDomain Scope = "domain"
+)
+
+// Observation is a rate limited Order seen by a watcher
+type Observation struct {
+	// Order identifies the Order, as cluster/namespace/name
+	Order   string
+	Account string
+	Domains []string
+	Reason  string
+	// Until is when the fixer next retries the Order
+	Until time.Time
+}
+
+// Notification is sent for every incident event. It is the data of the
+// endpoint templates.
+type Notification struct {
+	// ID identifies the event of the incident, so receivers can drop
+	// notifications delivered twice
+	ID      string   `json:"id"`
+	Event   Event    `json:"event"`
+	Scope   Scope    `json:"scope"`
+	Account string   `json:"account"`
+	Domain  string   `json:"domain,omitempty"`
+	Domains []string `json:"domains"`
+	// Orders are the Orders that have been part of the incident, as
+	// cluster/namespace/name
+	Orders []string  `json:"orders"`
+	Reason string    `json:"reason,omitempty"`
+	Until  time.Time `json:"until"`
+	Opened time.Time `json:"opened"`
+	Time   time.Time `json:"time"`
+}
+
+// incidentKey identifies an incident, the domain is empty for accounts
+type incidentKey struct {
+	scope   Scope
+	account string
+	domain  string
+}
+
+// incident is an open incident. Orders are the ones still rate limited,
+// members every Order that has been part of it.
+type incident struct {
+	incidentKey
+	opened    time.Time
+	reason    string
+	until     time.Time
+	escalated bool
+	orders    map[string]struct{}
+	members   map[string]struct{}
+	domains   map[string]struct{}
+}
+
+// order is what the notifier knows about a rate limited Order
+type order struct {
+	Observation
+	seen time.Time
+}
+
+const (
+	// DefaultResolveAfter is how long an Order that isn't seen rate limited
+	// any more is kept in its incidents
+	DefaultResolveAfter = time.Hour
+	// DefaultAttempts is how many times a notification is sent before it is dropped
+	DefaultAttempts = 5
+	// DefaultBackoff is the wait before the first retry, doubled on every retry
+	DefaultBackoff = time.Second
+	// FlushTimeout is how long the notifications still queued when Run's
+	// context is done are given to be delivered
+	FlushTimeout = 10 * time.Second
+)
+
+var notificationsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "cm429_fixer_notifications_total",
+	Help: "Number of incident notifications, by event and result",
+}, []string{"event", "result"})
+
+func init() {
+	prometheus.MustRegister(notificationsTotal)
+}
+
+// Notifier aggregates rate limited Orders into incidents and sends
+// notifications about them to its endpoints. It may be shared between watchers.
+type Notifier struct {
+	log          logr.Logger
+	clock        clock.WithTicker
+	endpoints    []*Endpoint
+	scopes       []Scope
+	resolveAfter time.Duration
+	attempts     int
+	backoff      time.Duration
+
+	mu        sync.Mutex
+	orders    map[string]*order
+	incidents map[incidentKey]*incident
+	queue     []Notification
+	queued    chan struct{}
+}
+
+// Option is a function that sets some option on the notifier
+type Option func(*Notifier)
+
+// WithLogger sets the logger
+func WithLogger(l logr.Logger) Option {
+	return func(n *Notifier) {
+		n.log = l
+	}
+}
+
+// WithClock sets the clock used for incident times, retries and expiry
+func WithClock(c clock.WithTicker) Option {
+	return func(n *Notifier) {
+		n.clock = c
+	}
+}
+
+// WithEndpoint adds an endpoint notifications are sent to
+func WithEndpoint(e *Endpoint) Option {
+	return func(n *Notifier) {
+		n.endpoints = append(n.endpoints, e)
+	}
+}
+
+// WithScopes sets what incidents are aggregated by, the account by default
+func WithScopes(scopes ...Scope) Option {
+	return func(n *Notifier) {
+		n.scopes = scopes
+	}
+}
+
+// WithResolveAfter sets how long an Order that isn't seen rate limited any
+// more, and hasn't been seen to recover, is kept in its incidents. Orders
+// that are deleted or missed while the watcher was down leave this way.
+func WithResolveAfter(d time.Duration) Option {
+	return func(n *Notifier) {
+		n.resolveAfter = d
+	}
+}
+
+// WithRetry sets how many times a notification is sent before it's dropped,
+// and the wait before the first retry, which doubles on every retry
+func WithRetry(attempts int, backoff time.Duration) Option {
+	return func(n *Notifier) {
+		n.attempts = attempts
+		n.backoff = backoff
+	}
+}
+
+// New creates a notifier
+func New(opts ...Option) *Notifier {
+	n := &Notifier{
+		log:          logr.Discard(),
+		clock:        clock.RealClock{},
+		scopes:       []Scope{ScopeAccount},
+		resolveAfter: DefaultResolveAfter,
+		attempts:     DefaultAttempts,
+		backoff:      DefaultBackoff,
+		orders:       map[string]*order{},
+		incidents:    map[incidentKey]*incident{},
+		queued:       make(chan struct{}, 1),
+	}
+	for _, opt := range opts {
+		opt(n)
+	}
+	return n
+}
+
+// ParseScope parses the name of a scope
+func ParseScope(s string) (Scope, error) {
+	switch Scope(s) {
+	case ScopeAccount, ScopeDomain:
+		return Scope(s), nil
+	default:
+		return "", fmt.Errorf("unknown scope %q, must be account or domain", s)
+	}
+}
+
+// Limited records a rate limited Order, opening its incidents if needed
+func (n *Notifier) Limited(o Observation) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.limited(o, n.clock.Now())
+}
+
+// GaveUp records that the fixer has given up on a rate limited Order,
+// escalating its incidents
+func (n *Notifier) GaveUp(o Observation) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	now := n.clock.Now()
+	for _, in := range n.limited(o, now) {
+		if !in.escalated {
+			in.escalated = true
+			n.send(in, EventEscalate, now)
+		}
+	}
+}
+
+// limited adds the Order to its incidents and returns them
+func (n *Notifier) limited(o Observation, now time.Time) []*incident {
+	if existing, ok := n.orders[o.Order]; ok {
+		if existing.Account != o.Account {
+			n.leave(existing, now)
+		} else {
+			o.Domains = MergeDomains(existing.Domains, o.Domains)
+			if existing.Until.After(o.Until) {
+				o.Until = existing.Until
+			}
+		}
+	}
+	n.orders[o.Order] = &order{Observation: o, seen: now}
+
+	var incidents []*incident
+	for _, key := range n.keys(o) {
+		in, ok := n.incidents[key]
+		if !ok {
+			in = &incident{
+				incidentKey: key,
+				opened:      now,
+				orders:      map[string]struct{}{},
+				members:     map[string]struct{}{},
+				domains:     map[string]struct{}{},
+			}
+			n.incidents[key] = in
+		}
+		in.orders[o.Order] = struct{}{}
+		in.members[o.Order] = struct{}{}
+		for _, d := range o.Domains {
+			if key.domain == "" || key.domain == d {
+				in.domains[d] = struct{}{}
+			}
+		}
+		if o.Reason != "" {
+			in.reason = o.Reason
+		}
+		if o.Until.After(in.until) {
+			in.until = o.Until
+		}
+		if !ok {
+			n.send(in, EventOpen, now)
+		}
+		incidents = append(incidents, in)
+	}
+	return incidents
+}
+
+// Recovered records that an Order is no longer rate limited, resolving the
+// incidents it was the last Order of
+func (n *Notifier) Recovered(orderKey string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if o, ok := n.orders[orderKey]; ok {
+		n.leave(o, n.clock.Now())
+	}
+}
+
+// leave removes an Order from its incidents
+func (n *Notifier) leave(o *order, now time.Time) {
+	delete(n.orders, o.Order)
+	for _, key := range n.keys(o.Observation) {
+		in, ok := n.incidents[key]
+		if !ok {
+			continue
+		}
+		delete(in.orders, o.Order)
+		if len(in.orders) == 0 {
+			delete(n.incidents, key)
+			n.send(in, EventResolve, now)
+		}
+	}
+}
+
+// expire removes the Orders that haven't been seen rate limited for the
+// resolve after period
+func (n *Notifier) expire() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	now := n.clock.Now()
+	for _, o := range n.orders {
+		last := o.seen
+		if o.Until.After(last) {
+			last = o.Until
+		}
+		if now.Sub(last) > n.resolveAfter {
+			n.leave(o, now)
+		}
+	}
+}
+
+// keys returns the keys of the incidents of an Order
+func (n *Notifier) keys(o Observation) []incidentKey {
+	var keys []incidentKey
+	for _, s := range n.scopes {
+		switch s {
+		case ScopeAccount:
+			keys = append(keys, incidentKey{scope: s, account: o.Account})
+		case ScopeDomain:
+			for _, d := range o.Domains {
+				keys = append(keys, incidentKey{scope: s, account: o.Account, domain: d})
+			}
+		}
+	}
+	return keys
+}
+
+// send queues a notification about the incident for delivery
+func (n *Notifier) send(in *incident, event Event, now time.Time) {
+	notification := Notification{
+		ID:      fmt.Sprintf("%s/%s/%s/%d/%s", in.scope, in.account, in.domain, in.opened.UnixNano(), event),
+		Event:   event,
+		Scope:   in.scope,
+		Account: in.account,
+		Domain:  in.domain,
+		Domains: sortedKeys(in.domains),
+		Orders:  sortedKeys(in.members),
+		Reason:  in.reason,
+		Until:   in.until,
+		Opened:  in.opened,
+		Time:    now,
+	}
+	n.log.Info("Rate limit incident "+string(event), "scope", in.scope, "account", in.account, "domain", in.domain)
+	n.queue = append(n.queue, notification)
+	select {
+	case n.queued <- struct{}{}:
+	default:
+	}
+}
+
+func sortedKeys(m map[string]struct{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Run delivers queued notifications and expires Orders that are no longer
+// seen, until the context is done. Notifications are delivered one at a
+// time, in the order the events happened. Once the context is done the
+// notifications still queued are given FlushTimeout to be delivered.
+func (n *Notifier) Run(ctx context.Context) {
+	// Deliveries outlive the context, so a notification being posted as it
+	// is done isn't dropped
+	deliverCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	defer cancel()
+	stop := context.AfterFunc(ctx, func() { time.AfterFunc(FlushTimeout, cancel) })
+	defer stop()
+
+	ticker := n.clock.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			n.drain(deliverCtx)
+			return
+		case <-ticker.C():
+			n.expire()
+		case <-n.queued:
+		}
+		n.drain(deliverCtx)
+	}
+}
+
+// drain delivers the queued notifications until the queue is empty
+func (n *Notifier) drain(ctx context.Context) {
+	for {
+		n.mu.Lock()
+		if len(n.queue) == 0 {
+			n.mu.Unlock()
+			return
+		}
+		notification := n.queue[0]
+		n.queue = n.queue[1:]
+		n.mu.Unlock()
+		n.deliver(ctx, notification)
+	}
+}
+
+// MergeDomains returns the domains with those of add not already among them
+// appended. The domains are copied, so neither list is changed.
+func MergeDomains(domains, add []string) []string {
+	domains = append([]string(nil), domains...)
+	for _, d := range add {
+		found := false
+		for _, existing := range domains {
+			if existing == d {
+				found = true
+				break
+			}
+		}
+		if !found {
+			domains = append(domains, d)
+		}
+	}
+	return domains
+}
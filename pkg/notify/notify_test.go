@@ -0,0 +1,191 @@
+package notify_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/artificialinc/cm-429-fixer/pkg/notify"
+	"github.com/stretchr/testify/assert"
+	clocktesting "k8s.io/utils/clock/testing"
+)
+
+// receiver stands in for Slack or PagerDuty, recording the notifications
+// posted to it
+type receiver struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	received []notify.Notification
+	// fail is the number of requests still to answer with a 503
+	fail int
+}
+
+func newReceiver(t *testing.T) *receiver {
+	r := &receiver{}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var n notify.Notification
+		assert.NoError(t, json.NewDecoder(req.Body).Decode(&n))
+		assert.Equal(t, n.ID, req.Header.Get("Idempotency-Key"))
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if r.fail > 0 {
+			r.fail--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		r.received = append(r.received, n)
+	}))
+	t.Cleanup(r.Close)
+	return r
+}
+
+// events returns the events received, as scope/account/domain event
+func (r *receiver) events() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var events []string
+	for _, n := range r.received {
+		events = append(events, string(n.Scope)+"/"+n.Account+"/"+n.Domain+" "+string(n.Event))
+	}
+	return events
+}
+
+func (r *receiver) waitFor(t *testing.T, events ...string) {
+	t.Helper()
+	assert.Eventually(t, func() bool { return len(r.events()) >= len(events) }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, events, r.events())
+}
+
+func start(t *testing.T, opts ...notify.Option) *notify.Notifier {
+	n := notify.New(opts...)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go n.Run(ctx)
+	return n
+}
+
+func endpoint(t *testing.T, url string) *notify.Endpoint {
+	e, err := notify.NewEndpoint(url, nil, "", time.Second)
+	assert.NoError(t, err)
+	return e
+}
+
+func TestNotifier(t *testing.T) {
+	r := newReceiver(t)
+	until := time.Date(2024, 1, 1, 3, 0, 0, 0, time.UTC)
+	n := start(t,
+		notify.WithEndpoint(endpoint(t, r.URL)),
+		notify.WithScopes(notify.ScopeAccount, notify.ScopeDomain),
+	)
+
+	n.Limited(notify.Observation{Order: "c/ns/order1", Account: "acct", Domains: []string{"a.example.com"}, Reason: "too many certificates", Until: until})
+	r.waitFor(t,
+		"account/acct/ open",
+		"domain/acct/a.example.com open",
+	)
+
+	// A second Order of the account only opens the incident of its domain,
+	// seeing the first one again doesn't notify
+	n.Limited(notify.Observation{Order: "c/ns/order2", Account: "acct", Domains: []string{"b.example.com"}, Until: until})
+	n.Limited(notify.Observation{Order: "c/ns/order1", Account: "acct", Domains: []string{"a.example.com"}, Until: until})
+	r.waitFor(t,
+		"account/acct/ open",
+		"domain/acct/a.example.com open",
+		"domain/acct/b.example.com open",
+	)
+
+	// Giving up escalates the incidents of the Order once
+	n.GaveUp(notify.Observation{Order: "c/ns/order1", Account: "acct", Domains: []string{"a.example.com"}, Until: until})
+	n.GaveUp(notify.Observation{Order: "c/ns/order1", Account: "acct", Domains: []string{"a.example.com"}, Until: until})
+	r.waitFor(t,
+		"account/acct/ open",
+		"domain/acct/a.example.com open",
+		"domain/acct/b.example.com open",
+		"account/acct/ escalate",
+		"domain/acct/a.example.com escalate",
+	)
+
+	// The account incident resolves with its last Order
+	n.Recovered("c/ns/order1")
+	n.Recovered("c/ns/unknown")
+	n.Recovered("c/ns/order2")
+	r.waitFor(t,
+		"account/acct/ open",
+		"domain/acct/a.example.com open",
+		"domain/acct/b.example.com open",
+		"account/acct/ escalate",
+		"domain/acct/a.example.com escalate",
+		"domain/acct/a.example.com resolve",
+		"account/acct/ resolve",
+		"domain/acct/b.example.com resolve",
+	)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	resolved := r.received[6]
+	assert.Equal(t, []string{"c/ns/order1", "c/ns/order2"}, resolved.Orders)
+	assert.Equal(t, []string{"a.example.com", "b.example.com"}, resolved.Domains)
+	assert.Equal(t, until, resolved.Until)
+	assert.Equal(t, "too many certificates", resolved.Reason)
+	assert.Equal(t, r.received[0].Opened, resolved.Opened)
+	assert.NotEqual(t, r.received[0].ID, resolved.ID)
+}
+
+func TestNotifierExpire(t *testing.T) {
+	r := newReceiver(t)
+	clk := clocktesting.NewFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	n := start(t,
+		notify.WithEndpoint(endpoint(t, r.URL)),
+		notify.WithClock(clk),
+		notify.WithResolveAfter(time.Hour),
+	)
+	assert.Eventually(t, clk.HasWaiters, 5*time.Second, 10*time.Millisecond)
+
+	// The Order is kept until an hour past its retry
+	n.Limited(notify.Observation{Order: "c/ns/order1", Account: "acct", Until: clk.Now().Add(30 * time.Minute)})
+	r.waitFor(t, "account/acct/ open")
+	for i := 0; i < 90; i++ {
+		clk.Step(time.Minute)
+	}
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, []string{"account/acct/ open"}, r.events())
+
+	clk.Step(time.Minute)
+	r.waitFor(t, "account/acct/ open", "account/acct/ resolve")
+}
+
+func TestNotifierFlush(t *testing.T) {
+	r := newReceiver(t)
+	n := notify.New(
+		notify.WithEndpoint(endpoint(t, r.URL)),
+		notify.WithScopes(notify.ScopeAccount, notify.ScopeDomain),
+	)
+	n.Limited(notify.Observation{Order: "c/ns/order1", Account: "acct", Domains: []string{"a.example.com"}})
+
+	// Notifications queued when the context is done are still delivered
+	// before Run returns
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	n.Run(ctx)
+	assert.Equal(t, []string{"account/acct/ open", "domain/acct/a.example.com open"}, r.events())
+}
+
+func TestMergeDomains(t *testing.T) {
+	domains := make([]string, 1, 4)
+	domains[0] = "a.example.com"
+	add := []string{"b.example.com", "a.example.com"}
+
+	merged := notify.MergeDomains(domains, add)
+	assert.Equal(t, []string{"a.example.com", "b.example.com"}, merged)
+
+	// Neither list is changed, even with room to append in place
+	merged[0] = "c.example.com"
+	assert.Equal(t, []string{"a.example.com"}, domains)
+	assert.Empty(t, domains[:cap(domains)][1])
+	assert.Equal(t, []string{"b.example.com", "a.example.com"}, add)
+}
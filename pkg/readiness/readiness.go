@@ -0,0 +1,112 @@
+// Package readiness provides a gate holding the latest readiness state
+package readiness
+
+import (
+	"context"
+	"sync"
+)
+
+// Gate stores the latest readiness state. Producers never block on it and any
+// number of consumers can poll, wait for or subscribe to the state.
+type Gate struct {
+	mu      sync.Mutex
+	ready   bool
+	changed chan struct{}
+	subs    map[chan bool]struct{}
+}
+
+// NewGate creates a gate that starts out not ready
+func NewGate() *Gate {
+	return &Gate{
+		changed: make(chan struct{}),
+		subs:    map[chan bool]struct{}{},
+	}
+}
+
+// Set records the readiness state and notifies waiters and subscribers
+func (g *Gate) Set(ready bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if ready == g.ready {
+		return
+	}
+	g.ready = ready
+	close(g.changed)
+	g.changed = make(chan struct{})
+	for sub := range g.subs {
+		offer(sub, ready)
+	}
+}
+
+// Ready returns the latest readiness state
+func (g *Gate) Ready() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.ready
+}
+
+// Wait blocks until the gate is ready or the context is done
+func (g *Gate) Wait(ctx context.Context) error {
+	for {
+		g.mu.Lock()
+		ready, changed := g.ready, g.changed
+		g.mu.Unlock()
+
+		if ready {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+// Subscribe returns a channel receiving the current state followed by every
+// change. Slow subscribers only see the latest state, values they haven't
+// read yet are replaced. The returned function ends the subscription.
+func (g *Gate) Subscribe() (<-chan bool, func()) {
+	sub := make(chan bool, 1)
+
+	g.mu.Lock()
+	g.subs[sub] = struct{}{}
+	offer(sub, g.ready)
+	g.mu.Unlock()
+
+	var once sync.Once
+	return sub, func() {
+		once.Do(func() {
+			g.mu.Lock()
+			delete(g.subs, sub)
+			g.mu.Unlock()
+			close(sub)
+		})
+	}
+}
+
+// Follow sets the gate from the values received on ch until it is closed or
+// the context is done
+func (g *Gate) Follow(ctx context.Context, ch <-chan bool) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ready, ok := <-ch:
+			if !ok {
+				return
+			}
+			g.Set(ready)
+		}
+	}
+}
+
+// offer replaces any unread value in the buffered channel with v
+func offer(ch chan bool, v bool) {
+	select {
+	case <-ch:
+	default:
+	}
+	ch <- v
+}
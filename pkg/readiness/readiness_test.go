@@ -0,0 +1,91 @@
+// Package readiness_test implements tests for readiness.go
+package readiness_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/artificialinc/cm-429-fixer/pkg/readiness"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGate(t *testing.T) {
+	g := readiness.NewGate()
+	assert.False(t, g.Ready())
+
+	// Producers never block, even without consumers
+	for i := 0; i < 10; i++ {
+		g.Set(i%2 == 0)
+	}
+	g.Set(true)
+	assert.True(t, g.Ready())
+
+	g.Set(false)
+	assert.False(t, g.Ready())
+}
+
+func TestGateWait(t *testing.T) {
+	g := readiness.NewGate()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, g.Wait(ctx), context.DeadlineExceeded)
+
+	done := make(chan error)
+	for i := 0; i < 3; i++ {
+		go func() {
+			done <- g.Wait(context.Background())
+		}()
+	}
+	g.Set(true)
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, <-done)
+	}
+
+	// Returns immediately once ready
+	assert.NoError(t, g.Wait(context.Background()))
+}
+
+func TestGateSubscribe(t *testing.T) {
+	g := readiness.NewGate()
+
+	sub, unsubscribe := g.Subscribe()
+	assert.False(t, <-sub, "subscribers get the current state")
+
+	// A slow subscriber only sees the latest state
+	g.Set(true)
+	g.Set(false)
+	g.Set(true)
+	assert.True(t, <-sub)
+	select {
+	case v := <-sub:
+		t.Fatalf("unexpected value %v", v)
+	default:
+	}
+
+	other, unsubscribeOther := g.Subscribe()
+	defer unsubscribeOther()
+	assert.True(t, <-other)
+
+	unsubscribe()
+	_, open := <-sub
+	assert.False(t, open)
+	g.Set(false)
+	assert.False(t, <-other)
+}
+
+func TestGateFollow(t *testing.T) {
+	g := readiness.NewGate()
+	ch := make(chan bool)
+	done := make(chan struct{})
+	go func() {
+		g.Follow(context.Background(), ch)
+		close(done)
+	}()
+
+	ch <- true
+	assert.NoError(t, g.Wait(context.Background()))
+	close(ch)
+	<-done
+}
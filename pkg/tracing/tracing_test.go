@@ -0,0 +1,86 @@
+package tracing_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/artificialinc/cm-429-fixer/pkg/tracing"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestExporter(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		spans []*tracepb.Span
+		names []string
+		fail  bool
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/traces", r.URL.Path)
+		assert.Equal(t, "application/x-protobuf", r.Header.Get("Content-Type"))
+		assert.Equal(t, "Bearer token", r.Header.Get("Authorization"))
+		body, err := io.ReadAll(r.Body)
+		assert.NoError(t, err)
+
+		mu.Lock()
+		defer mu.Unlock()
+		if fail {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		for len(body) > 0 {
+			num, typ, n := protowire.ConsumeTag(body)
+			assert.Equal(t, protowire.Number(1), num)
+			assert.Equal(t, protowire.BytesType, typ)
+			body = body[n:]
+			b, n := protowire.ConsumeBytes(body)
+			assert.Greater(t, n, 0)
+			body = body[n:]
+			var rs tracepb.ResourceSpans
+			assert.NoError(t, proto.Unmarshal(b, &rs))
+			for _, a := range rs.GetResource().GetAttributes() {
+				if a.GetKey() == "service.name" {
+					names = append(names, a.GetValue().GetStringValue())
+				}
+			}
+			for _, ss := range rs.GetScopeSpans() {
+				spans = append(spans, ss.GetSpans()...)
+			}
+		}
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	exporter, err := tracing.NewExporter(ctx, srv.URL+"/v1/traces", http.Header{"Authorization": {"Bearer token"}}, time.Second)
+	assert.NoError(t, err)
+	tp := tracing.NewTracerProvider(exporter)
+	ctx, parent := tp.Tracer("test").Start(ctx, "parent")
+	_, child := tp.Tracer("test").Start(ctx, "child")
+	child.End()
+	parent.End()
+	assert.NoError(t, tp.Shutdown(context.Background()))
+
+	mu.Lock()
+	assert.Equal(t, []string{tracing.ServiceName}, names)
+	if assert.Len(t, spans, 2) {
+		assert.Equal(t, "child", spans[0].GetName())
+		assert.Equal(t, "parent", spans[1].GetName())
+		assert.Equal(t, spans[1].GetSpanId(), spans[0].GetParentSpanId())
+	}
+
+	// Failures are reported
+	fail = true
+	mu.Unlock()
+	exporter, err = tracing.NewExporter(context.Background(), srv.URL+"/v1/traces", http.Header{"Authorization": {"Bearer token"}}, time.Second)
+	assert.NoError(t, err)
+	assert.Error(t, exporter.ExportSpans(context.Background(), tracetest.SpanStubs{{Name: "span"}}.Snapshots()))
+}
@@ -0,0 +1,317 @@
+// Package ui serves a status page showing what the fixer knows during an
+// incident, and the JSON API behind it. Forcing resets and clearing holds
+// from the page needs a token.
+package ui
+
+import (
+	"context"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/artificialinc/cm-429-fixer/pkg/cm"
+	"github.com/artificialinc/cm-429-fixer/pkg/httpapi"
+	"github.com/go-logr/logr"
+	"k8s.io/utils/clock"
+)
+
+//go:embed static
+var static embed.FS
+
+// ActorUI is the actor of changes made from the page in the audit log
+const ActorUI = "ui"
+
+// DefaultStatusTTL is how long the status is served from cache by default
+const DefaultStatusTTL = 15 * time.Second
+
+// Status is everything the page shows
+type Status struct {
+	Time     time.Time       `json:"time"`
+	Clusters []ClusterStatus `json:"clusters"`
+	// Limits are the rate limits in force, across clusters
+	Limits []cm.Limit `json:"limits"`
+	// Budget is the reset budget left per ACME account, across clusters
+	Budget []cm.BudgetUsage `json:"budget"`
+	// Actions is true if resets and releases are enabled
+	Actions bool `json:"actions"`
+}
+
+// ClusterStatus is what a single cluster's watcher knows
+type ClusterStatus struct {
+	Name string `json:"name"`
+	// Objects are the failed Orders and Challenges, with how they were classified
+	Objects []cm.Finding `json:"objects"`
+	Holds   []cm.Held    `json:"holds"`
+	// Control is what the cluster's control ConfigMap switches off, if it has one
+	Control *cm.Control `json:"control,omitempty"`
+	// Error is set if the cluster couldn't be read
+	Error string `json:"error,omitempty"`
+}
+
+// ResetRequest asks for an Order or Challenge to be reset right away
+type ResetRequest struct {
+	Cluster   string `json:"cluster"`
+	Kind      string `json:"kind"`
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+}
+
+// ReleaseRequest asks for the hold of a Certificate to be cleared
+type ReleaseRequest struct {
+	Cluster   string `json:"cluster"`
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+}
+
+// Server serves the status page and its API
+type Server struct {
+	watchers map[string]*cm.Watcher
+	tracker  *cm.Tracker
+	budget   *cm.Budget
+	token    string
+	log      logr.Logger
+	clock    clock.PassiveClock
+	ttl      time.Duration
+
+	// mu is held while the cached status is refreshed, so concurrent
+	// requests wait for the same refresh
+	mu     sync.Mutex
+	cached *Status
+}
+
+// Option is a function that sets some option on the server
+type Option func(*Server)
+
+// WithTracker shows the rate limits of the tracker, which may be shared between watchers
+func WithTracker(t *cm.Tracker) Option {
+	return func(s *Server) {
+		s.tracker = t
+	}
+}
+
+// WithBudget shows the usage of the reset budget, which may be shared between watchers
+func WithBudget(b *cm.Budget) Option {
+	return func(s *Server) {
+		s.budget = b
+	}
+}
+
+// WithToken enables forcing resets and clearing holds for requests carrying
+// the token as a bearer token. Without a token the page is read only.
+func WithToken(token string) Option {
+	return func(s *Server) {
+		s.token = token
+	}
+}
+
+// WithLogger sets the logger
+func WithLogger(l logr.Logger) Option {
+	return func(s *Server) {
+		s.log = l
+	}
+}
+
+// WithStatusTTL sets how long the status served to the page is cached.
+// Collecting it lists the failed objects and holds of every cluster.
+func WithStatusTTL(d time.Duration) Option {
+	return func(s *Server) {
+		s.ttl = d
+	}
+}
+
+// WithClock sets the clock used for the status time and budget usage
+func WithClock(c clock.PassiveClock) Option {
+	return func(s *Server) {
+		s.clock = c
+	}
+}
+
+// NewServer creates a server for the watchers, keyed by cluster name
+func NewServer(watchers map[string]*cm.Watcher, opts ...Option) *Server {
+	s := &Server{watchers: watchers, log: logr.Discard(), clock: clock.RealClock{}, ttl: DefaultStatusTTL}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// Handler returns the handler serving the page at / and the API under /api/
+func (s *Server) Handler() http.Handler {
+	files, err := fs.Sub(static, "static")
+	if err != nil {
+		panic(err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("GET /", http.FileServer(http.FS(files)))
+	mux.HandleFunc("GET /api/status", s.handleStatus)
+	mux.HandleFunc("POST /api/reset", s.authorized(s.handleReset))
+	mux.HandleFunc("POST /api/release", s.authorized(s.handleRelease))
+	return mux
+}
+
+// Status collects the status of every cluster
+func (s *Server) Status(ctx context.Context) Status {
+	now := s.clock.Now()
+	status := Status{
+		Time:     now,
+		Clusters: []ClusterStatus{},
+		Limits:   []cm.Limit{},
+		Budget:   s.budget.Usage(now),
+		Actions:  s.token != "",
+	}
+	if s.tracker != nil {
+		status.Limits = append(status.Limits, s.tracker.Limits(now)...)
+		sort.Slice(status.Limits, func(i, j int) bool { return status.Limits[i].Order < status.Limits[j].Order })
+	}
+	if status.Budget == nil {
+		status.Budget = []cm.BudgetUsage{}
+	}
+	for _, name := range s.clusters() {
+		status.Clusters = append(status.Clusters, s.clusterStatus(ctx, name))
+	}
+	return status
+}
+
+func (s *Server) clusters() []string {
+	names := make([]string, 0, len(s.watchers))
+	for name := range s.watchers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// cachedStatus returns the status, collecting it again once it's older than
+// the TTL
+func (s *Server) cachedStatus(ctx context.Context) Status {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cached != nil && s.clock.Since(s.cached.Time) < s.ttl {
+		return *s.cached
+	}
+	// A client going away mustn't leave its errors in the cache for others
+	status := s.Status(context.WithoutCancel(ctx))
+	s.cached = &status
+	return status
+}
+
+// invalidate makes the next request collect the status again, after an action
+func (s *Server) invalidate() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cached = nil
+}
+
+func (s *Server) clusterStatus(ctx context.Context, name string) ClusterStatus {
+	w := s.watchers[name]
+	cs := ClusterStatus{Name: name, Objects: []cm.Finding{}, Holds: []cm.Held{}, Control: w.Control()}
+	report, err := w.Scan(ctx, "")
+	if err != nil {
+		cs.Error = err.Error()
+		return cs
+	}
+	// The next reset is the one the watcher has scheduled, if any
+	due := map[string]time.Time{}
+	for _, q := range w.Queue() {
+		due[q.Kind+"/"+q.Namespace+"/"+q.Name] = q.Due
+	}
+	for _, f := range report.Findings {
+		if f.Kind != "Order" && f.Kind != "Challenge" {
+			continue
+		}
+		f.NextReset = nil
+		if t, ok := due[f.Kind+"/"+f.Namespace+"/"+f.Name]; ok {
+			f.NextReset = &t
+		}
+		cs.Objects = append(cs.Objects, f)
+	}
+	sort.Slice(cs.Objects, func(i, j int) bool {
+		a, b := cs.Objects[i], cs.Objects[j]
+		if a.Namespace != b.Namespace {
+			return a.Namespace < b.Namespace
+		}
+		if a.Kind != b.Kind {
+			return a.Kind > b.Kind
+		}
+		return a.Name < b.Name
+	})
+	holds, err := w.Holds(ctx)
+	if err != nil {
+		cs.Error = err.Error()
+		return cs
+	}
+	cs.Holds = holds
+	return cs
+}
+
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	httpapi.WriteJSON(w, http.StatusOK, s.cachedStatus(r.Context()))
+}
+
+func (s *Server) handleReset(w http.ResponseWriter, r *http.Request) {
+	var req ResetRequest
+	watcher, ok := s.decode(w, r, &req, func() string { return req.Cluster })
+	if !ok {
+		return
+	}
+	log := s.log.WithValues("cluster", req.Cluster, "kind", req.Kind, "namespace", req.Namespace, "name", req.Name)
+	result, err := watcher.Reset(r.Context(), cm.Finding{Kind: req.Kind, Namespace: req.Namespace, Name: req.Name}, cm.ResetOptions{Force: true, Actor: ActorUI})
+	if err != nil {
+		log.Error(err, "Error forcing reset")
+		httpapi.WriteError(w, httpapi.StatusOf(err), err)
+		return
+	}
+	s.invalidate()
+	log.Info("Forced reset", "result", result)
+	httpapi.WriteJSON(w, http.StatusOK, map[string]cm.ResetResult{"result": result})
+}
+
+func (s *Server) handleRelease(w http.ResponseWriter, r *http.Request) {
+	var req ReleaseRequest
+	watcher, ok := s.decode(w, r, &req, func() string { return req.Cluster })
+	if !ok {
+		return
+	}
+	log := s.log.WithValues("cluster", req.Cluster, "certificate", req.Name, "namespace", req.Namespace)
+	if err := watcher.ReleaseHold(r.Context(), req.Namespace, req.Name, ActorUI); err != nil {
+		log.Error(err, "Error clearing hold")
+		httpapi.WriteError(w, httpapi.StatusOf(err), err)
+		return
+	}
+	s.invalidate()
+	log.Info("Cleared hold")
+	httpapi.WriteJSON(w, http.StatusOK, map[string]string{"result": "released"})
+}
+
+// decode reads a request body and returns the watcher of its cluster
+func (s *Server) decode(w http.ResponseWriter, r *http.Request, req interface{}, cluster func() string) (*cm.Watcher, bool) {
+	if !httpapi.Decode(w, r, req) {
+		return nil, false
+	}
+	watcher, ok := s.watchers[cluster()]
+	if !ok {
+		httpapi.WriteError(w, http.StatusNotFound, fmt.Errorf("unknown cluster %q", cluster()))
+		return nil, false
+	}
+	return watcher, true
+}
+
+// authorized only lets requests with the server's token through
+func (s *Server) authorized(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.token == "" {
+			httpapi.WriteError(w, http.StatusForbidden, errors.New("actions are disabled, the fixer has no UI token"))
+			return
+		}
+		if !httpapi.ValidToken(r, s.token) {
+			httpapi.WriteError(w, http.StatusUnauthorized, errors.New("invalid token"))
+			return
+		}
+		h(w, r)
+	}
+}
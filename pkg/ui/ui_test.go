@@ -0,0 +1,180 @@
+package ui_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/artificialinc/cm-429-fixer/pkg/audit"
+	"github.com/artificialinc/cm-429-fixer/pkg/cm"
+	"github.com/artificialinc/cm-429-fixer/pkg/ui"
+	acmev1 "github.com/cert-manager/cert-manager/pkg/apis/acme/v1"
+	cmapi "github.com/cert-manager/cert-manager/pkg/apis/certmanager/v1"
+	"github.com/cert-manager/cert-manager/pkg/client/clientset/versioned/fake"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/time/rate"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clocktesting "k8s.io/utils/clock/testing"
+)
+
+func post(t *testing.T, url, token string, body interface{}) *http.Response {
+	b, err := json.Marshal(body)
+	assert.NoError(t, err)
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(b))
+	assert.NoError(t, err)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	return resp
+}
+
+func getStatus(t *testing.T, url string) ui.Status {
+	t.Helper()
+	resp, err := http.Get(url + "/api/status")
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	var status ui.Status
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&status))
+	return status
+}
+
+func TestServer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	notAfter := metav1.NewTime(time.Now().Add(30 * 24 * time.Hour))
+	client := fake.NewSimpleClientset(
+		&acmev1.Order{
+			ObjectMeta: metav1.ObjectMeta{Name: "order1", Namespace: "default"},
+			Status:     acmev1.OrderStatus{State: acmev1.Errored, Reason: "429 rateLimited"},
+		},
+		&cmapi.Certificate{
+			ObjectMeta: metav1.ObjectMeta{Name: "cert1", Namespace: "default"},
+			Status:     cmapi.CertificateStatus{NotAfter: &notAfter},
+		},
+	)
+	var log bytes.Buffer
+	budget := cm.NewBudget(rate.Every(time.Hour), 2)
+	budget.Reserve("acct1")
+	w := cm.NewWatcher(cm.WithClient(client), cm.WithCluster("c1"), cm.WithAudit(audit.New(audit.NewWriterSink(&log))))
+	assert.NoError(t, w.Hold(ctx, "default", "cert1", time.Now().Add(time.Hour), "rate limited"))
+	go w.Run(ctx)
+	assert.NoError(t, w.Readiness().Wait(ctx))
+	assert.Eventually(t, func() bool { return len(w.Queue()) == 1 }, 5*time.Second, 10*time.Millisecond)
+
+	srv := httptest.NewServer(ui.NewServer(map[string]*cm.Watcher{"c1": w}, ui.WithBudget(budget), ui.WithToken("secret")).Handler())
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/")
+	assert.NoError(t, err)
+	page, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, string(page), "<title>cm-429-fixer</title>")
+
+	status := getStatus(t, srv.URL)
+	assert.True(t, status.Actions)
+	if assert.Len(t, status.Clusters, 1) {
+		c := status.Clusters[0]
+		assert.Equal(t, "c1", c.Name)
+		if assert.Len(t, c.Objects, 1) {
+			assert.Equal(t, "order1", c.Objects[0].Name)
+			assert.Equal(t, cm.CategoryRateLimited, c.Objects[0].Category)
+			// The next reset is the one the watcher has scheduled
+			if assert.NotNil(t, c.Objects[0].NextReset) {
+				assert.True(t, w.Queue()[0].Due.Equal(*c.Objects[0].NextReset))
+			}
+		}
+		if assert.Len(t, c.Holds, 1) {
+			assert.Equal(t, "cert1", c.Holds[0].Name)
+		}
+	}
+	if assert.Len(t, status.Budget, 1) {
+		assert.Equal(t, "acct1", status.Budget[0].Account)
+	}
+
+	// Actions need the token
+	reset := ui.ResetRequest{Cluster: "c1", Kind: "Order", Namespace: "default", Name: "order1"}
+	assert.Equal(t, http.StatusUnauthorized, post(t, srv.URL+"/api/reset", "", reset).StatusCode)
+	assert.Equal(t, http.StatusUnauthorized, post(t, srv.URL+"/api/reset", "wrong", reset).StatusCode)
+	assert.Equal(t, http.StatusNotFound, post(t, srv.URL+"/api/reset", "secret", ui.ResetRequest{Cluster: "c2"}).StatusCode)
+
+	assert.Equal(t, http.StatusOK, post(t, srv.URL+"/api/reset", "secret", reset).StatusCode)
+	o, err := client.AcmeV1().Orders("default").Get(ctx, "order1", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, acmev1.Pending, o.Status.State)
+
+	release := ui.ReleaseRequest{Cluster: "c1", Namespace: "default", Name: "cert1"}
+	assert.Equal(t, http.StatusOK, post(t, srv.URL+"/api/release", "secret", release).StatusCode)
+	held, err := w.Holds(ctx)
+	assert.NoError(t, err)
+	assert.Empty(t, held)
+
+	// Both actions are audited as the UI's
+	var objects []string
+	for _, line := range strings.Split(strings.TrimSpace(log.String()), "\n") {
+		var r audit.Record
+		assert.NoError(t, json.Unmarshal([]byte(line), &r))
+		if r.Actor == ui.ActorUI {
+			objects = append(objects, r.Object.Name)
+		}
+	}
+	assert.Equal(t, []string{"order1", "cert1"}, objects)
+}
+
+func TestServerReadOnly(t *testing.T) {
+	w := cm.NewWatcher(cm.WithClient(fake.NewSimpleClientset()))
+	srv := httptest.NewServer(ui.NewServer(map[string]*cm.Watcher{"c1": w}).Handler())
+	defer srv.Close()
+
+	assert.False(t, getStatus(t, srv.URL).Actions)
+
+	reset := ui.ResetRequest{Cluster: "c1", Kind: "Order", Namespace: "default", Name: "order1"}
+	assert.Equal(t, http.StatusForbidden, post(t, srv.URL+"/api/reset", "", reset).StatusCode)
+	assert.Equal(t, http.StatusForbidden, post(t, srv.URL+"/api/release", "anything", ui.ReleaseRequest{Cluster: "c1"}).StatusCode)
+}
+
+func TestServerStatusCache(t *testing.T) {
+	ctx := context.Background()
+	clk := clocktesting.NewFakePassiveClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	client := fake.NewSimpleClientset(&acmev1.Order{
+		ObjectMeta: metav1.ObjectMeta{Name: "order1", Namespace: "default"},
+		Status:     acmev1.OrderStatus{State: acmev1.Errored, Reason: "429 rateLimited"},
+	})
+	w := cm.NewWatcher(cm.WithClient(client))
+	srv := httptest.NewServer(ui.NewServer(map[string]*cm.Watcher{"c1": w}, ui.WithClock(clk), ui.WithStatusTTL(time.Minute), ui.WithToken("secret")).Handler())
+	defer srv.Close()
+
+	objects := func() int {
+		s := getStatus(t, srv.URL)
+		if !assert.Len(t, s.Clusters, 1) {
+			return -1
+		}
+		return len(s.Clusters[0].Objects)
+	}
+	assert.Equal(t, 1, objects())
+	_, err := client.AcmeV1().Orders("default").Create(ctx, &acmev1.Order{
+		ObjectMeta: metav1.ObjectMeta{Name: "order2", Namespace: "default"},
+		Status:     acmev1.OrderStatus{State: acmev1.Errored, Reason: "429 rateLimited"},
+	}, metav1.CreateOptions{})
+	assert.NoError(t, err)
+
+	// The status is collected again once the TTL is up
+	assert.Equal(t, 1, objects())
+	clk.SetTime(clk.Now().Add(time.Minute))
+	assert.Equal(t, 2, objects())
+
+	// and after an action
+	reset := ui.ResetRequest{Cluster: "c1", Kind: "Order", Namespace: "default", Name: "order1"}
+	assert.Equal(t, http.StatusOK, post(t, srv.URL+"/api/reset", "secret", reset).StatusCode)
+	assert.Equal(t, 1, objects())
+}
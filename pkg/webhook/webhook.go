@@ -0,0 +1,277 @@
+// Package webhook implements admission webhooks that warn about, or hold
+// back, new Orders for domains under a known ACME rate limit
+package webhook
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/artificialinc/cm-429-fixer/pkg/audit"
+	"github.com/artificialinc/cm-429-fixer/pkg/cm"
+	acmev1 "github.com/cert-manager/cert-manager/pkg/apis/acme/v1"
+	cmapi "github.com/cert-manager/cert-manager/pkg/apis/certmanager/v1"
+	cmmeta "github.com/cert-manager/cert-manager/pkg/apis/meta/v1"
+	"github.com/go-logr/logr"
+	admissionv1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// AnnotationRateLimitedUntil is set on new objects to the time the
+	// rate limit they are expected to run into lasts until
+	AnnotationRateLimitedUntil = "cm-429-fixer.artificial.com/rate-limited-until"
+	// AnnotationRateLimitNote is set on new objects to explain why issuance
+	// is expected to wait
+	AnnotationRateLimitNote = "cm-429-fixer.artificial.com/rate-limit-note"
+)
+
+// Mode is what the webhook does with new Orders under an active limit
+type Mode string
+
+const (
+	// ModeAnnotate admits new Orders with the rate limit annotations
+	ModeAnnotate Mode = "annotate"
+	// ModeDeny rejects new Orders until the limit has passed, cert-manager
+	// creates them again with its own backoff
+	ModeDeny Mode = "deny"
+)
+
+// Checker finds the active rate limit a new Order would run into
+type Checker interface {
+	ActiveLimit(ctx context.Context, namespace string, issuer cmmeta.ObjectReference, domains []string) (cm.Limit, bool)
+}
+
+// switchable is implemented by checkers whose changes can be switched off,
+// such as the watcher with a control ConfigMap
+type switchable interface {
+	SwitchedOff(namespace string, issuer cmmeta.ObjectReference) (string, bool)
+}
+
+// ActorWebhook is the actor of the webhook's changes in the audit log
+const ActorWebhook = "webhook"
+
+// Server serves the mutating and validating webhooks
+type Server struct {
+	checker Checker
+	mode    Mode
+	log     logr.Logger
+	audit   *audit.Log
+}
+
+// Option is a function that sets some option on the server
+type Option func(*Server)
+
+// WithAudit records the objects the webhook annotates or denies in the audit log
+func WithAudit(l *audit.Log) Option {
+	return func(s *Server) {
+		s.audit = l
+	}
+}
+
+// NewServer creates a webhook server
+func NewServer(checker Checker, mode Mode, log logr.Logger, opts ...Option) *Server {
+	s := &Server{checker: checker, mode: mode, log: log}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// Handler returns the handler serving /mutate and /validate
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/mutate", s.review(s.mutate))
+	mux.Handle("/validate", s.review(s.validate))
+	return mux
+}
+
+// review decodes an AdmissionReview, lets the admit function respond to its
+// request and encodes the response
+func (s *Server) review(admit func(context.Context, *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var review admissionv1.AdmissionReview
+		if err := json.Unmarshal(body, &review); err != nil || review.Request == nil {
+			http.Error(w, "invalid AdmissionReview", http.StatusBadRequest)
+			return
+		}
+
+		resp := admit(r.Context(), review.Request)
+		resp.UID = review.Request.UID
+		review.Response = resp
+		review.Request = nil
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(&review)
+	})
+}
+
+// mutate annotates new CertificateRequests, and new Orders in annotate mode,
+// that will run into a known limit
+func (s *Server) mutate(ctx context.Context, req *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
+	meta, limit, ok := s.check(ctx, req)
+	if !ok || (req.Kind.Kind == "Order" && s.mode != ModeAnnotate) {
+		return allowed()
+	}
+
+	patch, err := json.Marshal(annotationPatch(meta.Annotations, map[string]string{
+		AnnotationRateLimitedUntil: limit.Until.UTC().Format(time.RFC3339),
+		AnnotationRateLimitNote:    note(limit),
+	}))
+	if err != nil {
+		return allowed()
+	}
+	s.record(req, meta, audit.ActionAnnotate, limit)
+	patchType := admissionv1.PatchTypeJSONPatch
+	resp := allowed()
+	resp.Patch = patch
+	resp.PatchType = &patchType
+	resp.Warnings = []string{note(limit)}
+	return resp
+}
+
+// validate rejects new Orders that will run into a known limit in deny mode
+func (s *Server) validate(ctx context.Context, req *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
+	if s.mode != ModeDeny || req.Kind.Kind != "Order" {
+		return allowed()
+	}
+	meta, limit, ok := s.check(ctx, req)
+	if !ok {
+		return allowed()
+	}
+	s.record(req, meta, audit.ActionDeny, limit)
+	return &admissionv1.AdmissionResponse{
+		Allowed: false,
+		Result: &metav1.Status{
+			Status:  metav1.StatusFailure,
+			Reason:  metav1.StatusReasonForbidden,
+			Code:    http.StatusForbidden,
+			Message: note(limit),
+		},
+	}
+}
+
+// check looks up the limit a newly created Order or CertificateRequest would
+// run into. Requests that can't be decoded are let through, the webhook must
+// never stand in the way of issuance because of its own errors.
+func (s *Server) check(ctx context.Context, req *admissionv1.AdmissionRequest) (metav1.ObjectMeta, cm.Limit, bool) {
+	if req.Operation != admissionv1.Create {
+		return metav1.ObjectMeta{}, cm.Limit{}, false
+	}
+
+	var (
+		meta    metav1.ObjectMeta
+		issuer  cmmeta.ObjectReference
+		domains []string
+	)
+	switch req.Kind.Kind {
+	case "Order":
+		var o acmev1.Order
+		if err := json.Unmarshal(req.Object.Raw, &o); err != nil {
+			s.log.Error(err, "Unable to decode Order")
+			return meta, cm.Limit{}, false
+		}
+		meta, issuer, domains = o.ObjectMeta, o.Spec.IssuerRef, o.Spec.DNSNames
+	case "CertificateRequest":
+		var cr cmapi.CertificateRequest
+		if err := json.Unmarshal(req.Object.Raw, &cr); err != nil {
+			s.log.Error(err, "Unable to decode CertificateRequest")
+			return meta, cm.Limit{}, false
+		}
+		names, err := csrDomains(cr.Spec.Request)
+		if err != nil {
+			s.log.V(1).Info("Unable to read CertificateRequest CSR", "error", err.Error())
+			return meta, cm.Limit{}, false
+		}
+		meta, issuer, domains = cr.ObjectMeta, cr.Spec.IssuerRef, names
+	default:
+		return meta, cm.Limit{}, false
+	}
+
+	if sw, ok := s.checker.(switchable); ok {
+		if reason, off := sw.SwitchedOff(req.Namespace, issuer); off {
+			s.log.V(1).Info("Switched off, letting new object through", "kind", req.Kind.Kind, "name", req.Name, "namespace", req.Namespace, "reason", reason)
+			return meta, cm.Limit{}, false
+		}
+	}
+	limit, ok := s.checker.ActiveLimit(ctx, req.Namespace, issuer, domains)
+	if ok {
+		s.log.Info("New object under an active rate limit", "kind", req.Kind.Kind, "name", req.Name, "namespace", req.Namespace,
+			"account", limit.Account, "until", limit.Until, "mode", s.mode)
+	}
+	return meta, limit, ok
+}
+
+// record records what the webhook did with a new object in the audit log.
+// New objects have no resourceVersion yet, and may only have a generateName.
+func (s *Server) record(req *admissionv1.AdmissionRequest, meta metav1.ObjectMeta, action audit.Action, limit cm.Limit) {
+	// Dry runs have no side effects, the webhooks are declared NoneOnDryRun
+	if req.DryRun != nil && *req.DryRun {
+		return
+	}
+	name := meta.Name
+	if name == "" {
+		name = meta.GenerateName
+	}
+	err := s.audit.Record(audit.Record{
+		Actor:  ActorWebhook,
+		Action: action,
+		Object: audit.Object{Kind: req.Kind.Kind, Namespace: req.Namespace, Name: name},
+		Rule:   "webhook-mode " + string(s.mode),
+		Reason: note(limit),
+	})
+	if err != nil {
+		s.log.Error(err, "Error writing audit record", "action", action, "kind", req.Kind.Kind, "name", name, "namespace", req.Namespace)
+	}
+}
+
+func allowed() *admissionv1.AdmissionResponse {
+	return &admissionv1.AdmissionResponse{Allowed: true}
+}
+
+// note explains a limit to the teams waiting on it
+func note(l cm.Limit) string {
+	return fmt.Sprintf("ACME account %s is rate limited for %s until %s, seen on Order %s: %s",
+		l.Account, strings.Join(l.Domains, ", "), l.Until.UTC().Format(time.RFC3339), l.Order, l.Reason)
+}
+
+// annotationPatch returns the JSON patch adding the annotations
+func annotationPatch(existing map[string]string, add map[string]string) []map[string]interface{} {
+	if existing == nil {
+		return []map[string]interface{}{{"op": "add", "path": "/metadata/annotations", "value": add}}
+	}
+	var patch []map[string]interface{}
+	for k, v := range add {
+		key := strings.ReplaceAll(strings.ReplaceAll(k, "~", "~0"), "/", "~1")
+		patch = append(patch, map[string]interface{}{"op": "add", "path": "/metadata/annotations/" + key, "value": v})
+	}
+	return patch
+}
+
+// csrDomains returns the DNS names and common name requested by a PEM CSR
+func csrDomains(request []byte) ([]string, error) {
+	block, _ := pem.Decode(request)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found")
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	domains := csr.DNSNames
+	if csr.Subject.CommonName != "" {
+		domains = append(domains, csr.Subject.CommonName)
+	}
+	return domains, nil
+}
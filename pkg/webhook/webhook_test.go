@@ -0,0 +1,203 @@
+package webhook_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/artificialinc/cm-429-fixer/pkg/audit"
+	"github.com/artificialinc/cm-429-fixer/pkg/cm"
+	"github.com/artificialinc/cm-429-fixer/pkg/webhook"
+	acmev1 "github.com/cert-manager/cert-manager/pkg/apis/acme/v1"
+	cmapi "github.com/cert-manager/cert-manager/pkg/apis/certmanager/v1"
+	cmmeta "github.com/cert-manager/cert-manager/pkg/apis/meta/v1"
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/assert"
+	admissionv1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// checker reports a limit for example.com
+type checker struct{}
+
+func (checker) ActiveLimit(_ context.Context, _ string, _ cmmeta.ObjectReference, domains []string) (cm.Limit, bool) {
+	for _, d := range domains {
+		if d == "example.com" {
+			return cm.Limit{
+				Account: "https://acme.example.com/acct/1",
+				Domains: []string{"example.com"},
+				Until:   time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC),
+				Reason:  "429 rateLimited",
+				Order:   "cluster/default/order1",
+			}, true
+		}
+	}
+	return cm.Limit{}, false
+}
+
+func order(domain string) runtime.Object {
+	return &acmev1.Order{
+		ObjectMeta: metav1.ObjectMeta{Name: "order2", Namespace: "default"},
+		Spec:       acmev1.OrderSpec{DNSNames: []string{domain}},
+	}
+}
+
+func certificateRequest(t *testing.T, domain string) runtime.Object {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: domain},
+		DNSNames: []string{domain},
+	}, key)
+	assert.NoError(t, err)
+	return &cmapi.CertificateRequest{
+		ObjectMeta: metav1.ObjectMeta{Name: "cr1", Namespace: "default", Annotations: map[string]string{"a": "b"}},
+		Spec:       cmapi.CertificateRequestSpec{Request: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})},
+	}
+}
+
+func admit(t *testing.T, s *webhook.Server, path, kind string, obj runtime.Object, opts ...func(*admissionv1.AdmissionRequest)) *admissionv1.AdmissionResponse {
+	raw, err := json.Marshal(obj)
+	assert.NoError(t, err)
+	req := &admissionv1.AdmissionRequest{
+		UID:       "uid1",
+		Kind:      metav1.GroupVersionKind{Kind: kind},
+		Namespace: "default",
+		Operation: admissionv1.Create,
+		Object:    runtime.RawExtension{Raw: raw},
+	}
+	for _, opt := range opts {
+		opt(req)
+	}
+	body, err := json.Marshal(&admissionv1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"},
+		Request:  req,
+	})
+	assert.NoError(t, err)
+
+	rec := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, path, bytes.NewReader(body)))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var review admissionv1.AdmissionReview
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &review))
+	if assert.NotNil(t, review.Response) {
+		assert.Equal(t, "uid1", string(review.Response.UID))
+	}
+	return review.Response
+}
+
+func patchedAnnotations(t *testing.T, resp *admissionv1.AdmissionResponse) map[string]interface{} {
+	var patch []struct {
+		Op    string      `json:"op"`
+		Path  string      `json:"path"`
+		Value interface{} `json:"value"`
+	}
+	assert.NoError(t, json.Unmarshal(resp.Patch, &patch))
+	annotations := map[string]interface{}{}
+	for _, p := range patch {
+		assert.Equal(t, "add", p.Op)
+		if p.Path == "/metadata/annotations" {
+			for k, v := range p.Value.(map[string]interface{}) {
+				annotations[k] = v
+			}
+			continue
+		}
+		annotations[p.Path] = p.Value
+	}
+	return annotations
+}
+
+func TestAnnotate(t *testing.T) {
+	t.Parallel()
+	var out bytes.Buffer
+	s := webhook.NewServer(checker{}, webhook.ModeAnnotate, logr.Discard(), webhook.WithAudit(audit.New(audit.NewWriterSink(&out))))
+
+	resp := admit(t, s, "/mutate", "Order", order("example.com"))
+	assert.True(t, resp.Allowed)
+	annotations := patchedAnnotations(t, resp)
+	assert.Equal(t, "2030-01-01T00:00:00Z", annotations[webhook.AnnotationRateLimitedUntil])
+	assert.Contains(t, annotations[webhook.AnnotationRateLimitNote], "cluster/default/order1")
+	assert.NotEmpty(t, resp.Warnings)
+
+	resp = admit(t, s, "/mutate", "Order", order("other.com"))
+	assert.True(t, resp.Allowed)
+	assert.Empty(t, resp.Patch)
+
+	resp = admit(t, s, "/validate", "Order", order("example.com"))
+	assert.True(t, resp.Allowed)
+
+	// Dry runs are annotated but not audited
+	dryRun := true
+	resp = admit(t, s, "/mutate", "Order", order("example.com"), func(req *admissionv1.AdmissionRequest) { req.DryRun = &dryRun })
+	assert.NotEmpty(t, resp.Patch)
+
+	// Only the annotated order is audited
+	var record audit.Record
+	assert.NoError(t, json.Unmarshal(out.Bytes(), &record))
+	assert.Equal(t, audit.ActionAnnotate, record.Action)
+	assert.Equal(t, webhook.ActorWebhook, record.Actor)
+	assert.Equal(t, audit.Object{Kind: "Order", Namespace: "default", Name: "order2"}, record.Object)
+	assert.Contains(t, record.Reason, "cluster/default/order1")
+}
+
+func TestDeny(t *testing.T) {
+	t.Parallel()
+	s := webhook.NewServer(checker{}, webhook.ModeDeny, logr.Discard())
+
+	resp := admit(t, s, "/validate", "Order", order("example.com"))
+	assert.False(t, resp.Allowed)
+	assert.Contains(t, resp.Result.Message, "rate limited for example.com until 2030-01-01T00:00:00Z")
+
+	resp = admit(t, s, "/validate", "Order", order("other.com"))
+	assert.True(t, resp.Allowed)
+
+	// Orders are only denied, not annotated
+	resp = admit(t, s, "/mutate", "Order", order("example.com"))
+	assert.True(t, resp.Allowed)
+	assert.Empty(t, resp.Patch)
+}
+
+func TestCertificateRequestNote(t *testing.T) {
+	t.Parallel()
+	s := webhook.NewServer(checker{}, webhook.ModeDeny, logr.Discard())
+
+	resp := admit(t, s, "/mutate", "CertificateRequest", certificateRequest(t, "example.com"))
+	assert.True(t, resp.Allowed)
+	annotations := patchedAnnotations(t, resp)
+	assert.Contains(t, annotations["/metadata/annotations/cm-429-fixer.artificial.com~1rate-limit-note"], "example.com")
+
+	resp = admit(t, s, "/validate", "CertificateRequest", certificateRequest(t, "example.com"))
+	assert.True(t, resp.Allowed)
+}
+
+// switchedOff is a checker whose changes are switched off in the default namespace
+type switchedOff struct {
+	checker
+}
+
+func (switchedOff) SwitchedOff(namespace string, _ cmmeta.ObjectReference) (string, bool) {
+	return "namespace default paused", namespace == "default"
+}
+
+func TestSwitchedOff(t *testing.T) {
+	t.Parallel()
+	for _, mode := range []webhook.Mode{webhook.ModeAnnotate, webhook.ModeDeny} {
+		s := webhook.NewServer(switchedOff{}, mode, logr.Discard())
+		resp := admit(t, s, "/mutate", "Order", order("example.com"))
+		assert.True(t, resp.Allowed)
+		assert.Empty(t, resp.Patch)
+		resp = admit(t, s, "/validate", "Order", order("example.com"))
+		assert.True(t, resp.Allowed)
+	}
+}